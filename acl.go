@@ -0,0 +1,425 @@
+package billybazilfuse
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5"
+)
+
+// Names of the extended attributes holding POSIX ACLs.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// ACLTag is the type of an entry of a POSIX ACL.
+type ACLTag uint16
+
+const (
+	// ACLUserObj holds the permissions of the owner.
+	ACLUserObj ACLTag = 0x01
+	// ACLUser holds the permissions of the user ID.
+	ACLUser ACLTag = 0x02
+	// ACLGroupObj holds the permissions of the owning group.
+	ACLGroupObj ACLTag = 0x04
+	// ACLGroup holds the permissions of the group ID.
+	ACLGroup ACLTag = 0x08
+	// ACLMask limits the permissions granted by all entries except ACLUserObj and ACLOther.
+	ACLMask ACLTag = 0x10
+	// ACLOther holds the permissions of everyone else.
+	ACLOther ACLTag = 0x20
+)
+
+// ACLEntry is an entry of a POSIX ACL. ID is only used by ACLUser and ACLGroup entries. Perm is a combination of 4 (read), 2 (write) and 1 (execute).
+type ACLEntry struct {
+	Tag  ACLTag
+	ID   uint32
+	Perm uint16
+}
+
+// ACL is a POSIX ACL, as stored in the system.posix_acl_access and system.posix_acl_default extended attributes.
+type ACL []ACLEntry
+
+const (
+	aclVersion     = 2
+	aclUndefinedID = 0xffffffff
+)
+
+// errInvalidACL is returned for extended attributes that aren't valid ACLs.
+var errInvalidACL = fuse.Errno(syscall.EINVAL)
+
+// ParseACL parses an ACL in the encoding of the extended attributes, and checks it has the entries it needs.
+func ParseACL(b []byte) (ACL, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 || binary.LittleEndian.Uint32(b) != aclVersion {
+		return nil, errInvalidACL
+	}
+	var acl ACL
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		e := ACLEntry{
+			Tag:  ACLTag(binary.LittleEndian.Uint16(b)),
+			Perm: binary.LittleEndian.Uint16(b[2:]),
+			ID:   binary.LittleEndian.Uint32(b[4:]),
+		}
+		if e.Perm&^7 != 0 {
+			return nil, errInvalidACL
+		}
+		if e.Tag != ACLUser && e.Tag != ACLGroup {
+			e.ID = 0
+		}
+		acl = append(acl, e)
+	}
+	counts := map[ACLTag]int{}
+	for _, e := range acl {
+		counts[e.Tag]++
+	}
+	if counts[ACLUserObj] != 1 || counts[ACLGroupObj] != 1 || counts[ACLOther] != 1 || counts[ACLMask] > 1 {
+		return nil, errInvalidACL
+	}
+	if counts[ACLUser]+counts[ACLGroup] > 0 && counts[ACLMask] == 0 {
+		return nil, errInvalidACL
+	}
+	if len(acl) != counts[ACLUserObj]+counts[ACLUser]+counts[ACLGroupObj]+counts[ACLGroup]+counts[ACLMask]+counts[ACLOther] {
+		return nil, errInvalidACL
+	}
+	return acl, nil
+}
+
+// Marshal encodes a in the encoding of the extended attributes.
+func (a ACL) Marshal() []byte {
+	b := make([]byte, 4, 4+8*len(a))
+	binary.LittleEndian.PutUint32(b, aclVersion)
+	for _, e := range a {
+		id := e.ID
+		if e.Tag != ACLUser && e.Tag != ACLGroup {
+			id = aclUndefinedID
+		}
+		b = binary.LittleEndian.AppendUint16(b, uint16(e.Tag))
+		b = binary.LittleEndian.AppendUint16(b, e.Perm)
+		b = binary.LittleEndian.AppendUint32(b, id)
+	}
+	return b
+}
+
+// minimal returns whether a has no entries beyond the permission bits.
+func (a ACL) minimal() bool {
+	return len(a) == 3
+}
+
+// groupClass returns the tag of the entry the group permission bits map to: the mask if there is one, or the owning group.
+func (a ACL) groupClass() ACLTag {
+	for _, e := range a {
+		if e.Tag == ACLMask {
+			return ACLMask
+		}
+	}
+	return ACLGroupObj
+}
+
+// Mode returns the permission bits equivalent to a.
+func (a ACL) Mode() os.FileMode {
+	var mode os.FileMode
+	gc := a.groupClass()
+	for _, e := range a {
+		switch e.Tag {
+		case ACLUserObj:
+			mode |= os.FileMode(e.Perm) << 6
+		case gc:
+			mode |= os.FileMode(e.Perm) << 3
+		case ACLOther:
+			mode |= os.FileMode(e.Perm)
+		}
+	}
+	return mode
+}
+
+// withMode returns a copy of a with the entries the permission bits map to changed to mode, like chmod(2) does.
+func (a ACL) withMode(mode os.FileMode) ACL {
+	ret := make(ACL, len(a))
+	gc := a.groupClass()
+	for i, e := range a {
+		switch e.Tag {
+		case ACLUserObj:
+			e.Perm = uint16(mode>>6) & 7
+		case gc:
+			e.Perm = uint16(mode>>3) & 7
+		case ACLOther:
+			e.Perm = uint16(mode) & 7
+		}
+		ret[i] = e
+	}
+	return ret
+}
+
+// aclFromMode returns the minimal ACL equivalent to the permission bits of mode.
+func aclFromMode(mode os.FileMode) ACL {
+	return ACL{
+		{Tag: ACLUserObj, Perm: uint16(mode>>6) & 7},
+		{Tag: ACLGroupObj, Perm: uint16(mode>>3) & 7},
+		{Tag: ACLOther, Perm: uint16(mode) & 7},
+	}
+}
+
+// allows returns whether a grants want (a combination of 4, 2 and 1) to the user uid in group gid, on a file owned by owner and group. It follows the access check algorithm of acl(5).
+func (a ACL) allows(uid, gid, owner, group uint32, want uint16) bool {
+	mask := uint16(7)
+	for _, e := range a {
+		if e.Tag == ACLMask {
+			mask = e.Perm
+		}
+	}
+	for _, e := range a {
+		if e.Tag == ACLUserObj && uid == owner {
+			return e.Perm&want == want
+		}
+	}
+	for _, e := range a {
+		if e.Tag == ACLUser && e.ID == uid {
+			return e.Perm&mask&want == want
+		}
+	}
+	inGroup := false
+	for _, e := range a {
+		if (e.Tag == ACLGroupObj && gid == group) || (e.Tag == ACLGroup && e.ID == gid) {
+			inGroup = true
+			if e.Perm&mask&want == want {
+				return true
+			}
+		}
+	}
+	if inGroup {
+		return false
+	}
+	for _, e := range a {
+		if e.Tag == ACLOther {
+			return e.Perm&want == want
+		}
+	}
+	return false
+}
+
+// FileACLs are the ACLs of a file or directory. Either can be nil. Only directories have a Default ACL, which new entries in them inherit.
+type FileACLs struct {
+	Access  ACL
+	Default ACL
+}
+
+// ACLStore stores POSIX ACLs for backends that can't store extended attributes. It must be safe for concurrent use.
+type ACLStore interface {
+	// Get returns the ACLs of the file at path, or ok=false if there are none.
+	Get(path string) (acls FileACLs, ok bool)
+	// Put stores the ACLs of the file at path.
+	Put(path string, acls FileACLs)
+	// Remove drops the ACLs of path and everything below it.
+	Remove(path string)
+	// Rename moves the ACLs of oldPath and everything below it to newPath.
+	Rename(oldPath, newPath string)
+}
+
+// DirACLStore is an ACLStore that keeps the ACLs in a local directory, mirroring the directory structure of the mount.
+type DirACLStore struct {
+	dir mirrorDir
+}
+
+var _ ACLStore = &DirACLStore{}
+
+// NewDirACLStore creates a DirACLStore in dir, which is created if needed.
+func NewDirACLStore(dir string) (*DirACLStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirACLStore{dir: mirrorDir(dir)}, nil
+}
+
+func (s *DirACLStore) Get(p string) (FileACLs, bool) {
+	data, ok := s.dir.get(p)
+	if !ok {
+		return FileACLs{}, false
+	}
+	var acls FileACLs
+	for _, acl := range []*ACL{&acls.Access, &acls.Default} {
+		if len(data) < 4 || uint64(len(data)-4) < uint64(binary.BigEndian.Uint32(data)) {
+			return FileACLs{}, false
+		}
+		n := binary.BigEndian.Uint32(data)
+		if n > 0 {
+			v, err := ParseACL(data[4 : 4+n])
+			if err != nil {
+				return FileACLs{}, false
+			}
+			*acl = v
+		}
+		data = data[4+n:]
+	}
+	return acls, true
+}
+
+func (s *DirACLStore) Put(p string, acls FileACLs) {
+	var data []byte
+	for _, acl := range []ACL{acls.Access, acls.Default} {
+		var b []byte
+		if acl != nil {
+			b = acl.Marshal()
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(b)))
+		data = append(data, b...)
+	}
+	s.dir.put(p, data)
+}
+
+func (s *DirACLStore) Remove(p string) {
+	s.dir.remove(p)
+}
+
+func (s *DirACLStore) Rename(oldPath, newPath string) {
+	s.dir.rename(oldPath, newPath)
+}
+
+// isACLXattr returns whether name is one of the extended attributes holding POSIX ACLs.
+func isACLXattr(name string) bool {
+	return name == aclAccessXattr || name == aclDefaultXattr
+}
+
+// storedACL returns the ACL name of p from Options.ACLStore, encoded as the extended attribute.
+func (r *FS) storedACL(p, name string) ([]byte, error) {
+	acls, _ := r.aclStore.Get(p)
+	acl := acls.Access
+	if name == aclDefaultXattr {
+		acl = acls.Default
+	}
+	if acl == nil {
+		return nil, fuse.ErrNoXattr
+	}
+	return acl.Marshal(), nil
+}
+
+// storedACLNames returns the names of the extended attributes holding the ACLs of p in Options.ACLStore.
+func (r *FS) storedACLNames(p string) []string {
+	acls, _ := r.aclStore.Get(p)
+	var names []string
+	if acls.Access != nil {
+		names = append(names, aclAccessXattr)
+	}
+	if acls.Default != nil {
+		names = append(names, aclDefaultXattr)
+	}
+	return names
+}
+
+// setStoredACL stores the ACL name of p in Options.ACLStore, or removes it if value is nil. Setting the access ACL changes the permission bits to match, like setfacl on a local filesystem.
+func (r *FS) setStoredACL(p, name string, value []byte) error {
+	var acl ACL
+	if value != nil {
+		var err error
+		if acl, err = ParseACL(value); err != nil {
+			return err
+		}
+	}
+	fi, err := r.underlying.Stat(p)
+	if err != nil {
+		return err
+	}
+	if name == aclDefaultXattr && acl != nil && !fi.IsDir() {
+		return fuse.Errno(syscall.EACCES)
+	}
+	r.aclMtx.Lock()
+	defer r.aclMtx.Unlock()
+	acls, _ := r.aclStore.Get(p)
+	if name == aclDefaultXattr {
+		acls.Default = acl
+	} else if acl != nil {
+		if ch, ok := r.underlying.(billy.Change); ok {
+			if err := ch.Chmod(p, fi.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)|acl.Mode()); err != nil {
+				return err
+			}
+		}
+		acls.Access = acl
+		if acl.minimal() {
+			// The permission bits hold all of it.
+			acls.Access = nil
+		}
+	} else {
+		acls.Access = nil
+	}
+	if acls.Access == nil && acls.Default == nil {
+		r.aclStore.Remove(p)
+		return nil
+	}
+	r.aclStore.Put(p, acls)
+	return nil
+}
+
+// chmodStoredACL updates the access ACL of p in Options.ACLStore after its permission bits were changed.
+func (r *FS) chmodStoredACL(p string, mode os.FileMode) {
+	if r.aclStore == nil {
+		return
+	}
+	r.aclMtx.Lock()
+	defer r.aclMtx.Unlock()
+	acls, ok := r.aclStore.Get(p)
+	if !ok || acls.Access == nil {
+		return
+	}
+	acls.Access = acls.Access.withMode(mode)
+	r.aclStore.Put(p, acls)
+}
+
+// inheritACLs gives the new entry p of the directory parent the parent's default ACL in Options.ACLStore, limited by the mode it was created with. New directories inherit the default ACL itself too.
+func (r *FS) inheritACLs(parent, p string, mode os.FileMode) {
+	if r.aclStore == nil {
+		return
+	}
+	pacls, ok := r.aclStore.Get(parent)
+	if !ok || pacls.Default == nil {
+		return
+	}
+	inherited := pacls.Default.withMode(pacls.Default.Mode() & mode.Perm())
+	var acls FileACLs
+	if !inherited.minimal() {
+		acls.Access = inherited
+	}
+	if mode.IsDir() {
+		acls.Default = pacls.Default
+	}
+	if ch, ok := r.underlying.(billy.Change); ok {
+		ch.Chmod(p, mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)|inherited.Mode())
+	}
+	if acls.Access == nil && acls.Default == nil {
+		return
+	}
+	r.aclMtx.Lock()
+	defer r.aclMtx.Unlock()
+	r.aclStore.Put(p, acls)
+}
+
+// dropACLs removes the ACLs of p (and everything below it) from Options.ACLStore, after it was removed.
+func (r *FS) dropACLs(p string) {
+	if r.aclStore != nil {
+		r.aclStore.Remove(p)
+	}
+}
+
+// moveACLs moves the ACLs of oldPath (and everything below it) in Options.ACLStore to newPath, after it was renamed.
+func (r *FS) moveACLs(oldPath, newPath string) {
+	if r.aclStore != nil {
+		r.aclStore.Rename(oldPath, newPath)
+	}
+}
+
+// accessACL returns the ACL the permissions of p are checked against: its access ACL if it has one, or the equivalent of its permission bits.
+func (r *FS) accessACL(p string, fi os.FileInfo) ACL {
+	if r.aclStore != nil {
+		if acls, ok := r.aclStore.Get(p); ok && acls.Access != nil {
+			return acls.Access
+		}
+	} else if r.xattrs != nil {
+		if b, err := r.xattrs.GetXattr(p, aclAccessXattr); err == nil {
+			if acl, err := ParseACL(b); err == nil {
+				return acl
+			}
+		}
+	}
+	return aclFromMode(fi.Mode())
+}
@@ -0,0 +1,120 @@
+package billybazilfuse
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestParseACL(t *testing.T) {
+	minimal := ACL{{Tag: ACLUserObj, Perm: 6}, {Tag: ACLGroupObj, Perm: 4}, {Tag: ACLOther, Perm: 4}}
+	extended := ACL{{Tag: ACLUserObj, Perm: 7}, {Tag: ACLUser, ID: 1000, Perm: 6}, {Tag: ACLGroupObj, Perm: 5}, {Tag: ACLGroup, ID: 100, Perm: 4}, {Tag: ACLMask, Perm: 6}, {Tag: ACLOther, Perm: 0}}
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		want  ACL
+	}{
+		{"minimal", minimal.Marshal(), minimal},
+		{"extended", extended.Marshal(), extended},
+		{"empty", nil, nil},
+		{"wrong version", append([]byte{1, 0, 0, 0}, minimal.Marshal()[4:]...), nil},
+		{"truncated entry", minimal.Marshal()[:20], nil},
+		{"invalid permission", ACL{{Tag: ACLUserObj, Perm: 8}, {Tag: ACLGroupObj}, {Tag: ACLOther}}.Marshal(), nil},
+		{"missing other", ACL{{Tag: ACLUserObj, Perm: 6}, {Tag: ACLGroupObj, Perm: 4}}.Marshal(), nil},
+		{"two owners", ACL{{Tag: ACLUserObj}, {Tag: ACLUserObj}, {Tag: ACLGroupObj}, {Tag: ACLOther}}.Marshal(), nil},
+		{"named user without mask", ACL{{Tag: ACLUserObj}, {Tag: ACLUser, ID: 1}, {Tag: ACLGroupObj}, {Tag: ACLOther}}.Marshal(), nil},
+		{"unknown tag", ACL{{Tag: ACLUserObj}, {Tag: 0x40}, {Tag: ACLGroupObj}, {Tag: ACLOther}}.Marshal(), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseACL(tc.input)
+			if tc.want == nil {
+				if err == nil {
+					t.Errorf("ParseACL succeeded with %v; want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseACL: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseACL = %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	const owner, group = 100, 10
+	acl := ACL{
+		{Tag: ACLUserObj, Perm: 6},
+		{Tag: ACLUser, ID: 200, Perm: 7},
+		{Tag: ACLUser, ID: 201, Perm: 0},
+		{Tag: ACLGroupObj, Perm: 4},
+		{Tag: ACLGroup, ID: 20, Perm: 6},
+		{Tag: ACLMask, Perm: 5},
+		{Tag: ACLOther, Perm: 1},
+	}
+	for _, tc := range []struct {
+		name     string
+		uid, gid uint32
+		want     uint16
+		allowed  bool
+	}{
+		{"owner reads", owner, 99, 4, true},
+		{"owner can't execute", owner, 99, 1, false},
+		{"owner ignores the mask", owner, 99, 2, true},
+		{"named user executes", 200, 99, 1, true},
+		{"named user is limited by the mask", 200, 99, 2, false},
+		{"named user without permissions", 201, group, 4, false},
+		{"owning group reads", 300, group, 4, true},
+		{"named group is limited by the mask", 300, 20, 2, false},
+		{"named group reads", 300, 20, 4, true},
+		{"group members don't fall back to other", 300, group, 1, false},
+		{"other executes", 300, 99, 1, true},
+		{"other can't read", 300, 99, 4, false},
+	} {
+		if got := acl.allows(tc.uid, tc.gid, owner, group, tc.want); got != tc.allowed {
+			t.Errorf("%s: allows(%d, %d, %o) = %v; want %v", tc.name, tc.uid, tc.gid, tc.want, got, tc.allowed)
+		}
+	}
+}
+
+func TestInheritACLs(t *testing.T) {
+	store, err := NewDirACLStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memfs.New()
+	r, err := NewWithOptions(backend, Options{ACLStore: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := ACL{{Tag: ACLUserObj, Perm: 7}, {Tag: ACLUser, ID: 200, Perm: 7}, {Tag: ACLGroupObj, Perm: 5}, {Tag: ACLMask, Perm: 7}, {Tag: ACLOther, Perm: 0}}
+	store.Put("dir", FileACLs{Default: def})
+	for _, tc := range []struct {
+		name string
+		mode os.FileMode
+		// access is the ACL the new entry should get, and withDefault whether it inherits the default ACL itself.
+		access      ACL
+		withDefault bool
+	}{
+		{"file", 0644, ACL{{Tag: ACLUserObj, Perm: 6}, {Tag: ACLUser, ID: 200, Perm: 7}, {Tag: ACLGroupObj, Perm: 5}, {Tag: ACLMask, Perm: 4}, {Tag: ACLOther, Perm: 0}}, false},
+		{"subdir", os.ModeDir | 0777, def, true},
+	} {
+		p := "dir/" + tc.name
+		r.inheritACLs("dir", p, tc.mode)
+		acls, ok := store.Get(p)
+		if !ok {
+			t.Errorf("%s didn't inherit ACLs", tc.name)
+			continue
+		}
+		if !reflect.DeepEqual(acls.Access, tc.access) {
+			t.Errorf("%s inherited access ACL %v; want %v", tc.name, acls.Access, tc.access)
+		}
+		if got := acls.Default != nil; got != tc.withDefault {
+			t.Errorf("%s inherited a default ACL: %v; want %v", tc.name, got, tc.withDefault)
+		}
+	}
+}
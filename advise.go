@@ -0,0 +1,131 @@
+package billybazilfuse
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Advice is a hint about how a file will be accessed, like the advice of posix_fadvise(2).
+type Advice int
+
+// The values match the POSIX_FADV_ constants on Linux.
+const (
+	AdviceNormal Advice = iota
+	AdviceRandom
+	AdviceSequential
+	AdviceWillNeed
+	AdviceDontNeed
+	AdviceNoReuse
+)
+
+// adviseXattr is the extended attribute that applications set on a file to give a hint, as the kernel doesn't pass posix_fadvise(2) on to FUSE filesystems.
+const adviseXattr = "user.billyfuse.fadvise"
+
+var adviceNames = map[string]Advice{
+	"normal":     AdviceNormal,
+	"random":     AdviceRandom,
+	"sequential": AdviceSequential,
+	"willneed":   AdviceWillNeed,
+	"dontneed":   AdviceDontNeed,
+	"noreuse":    AdviceNoReuse,
+}
+
+// Advise applies a hint about how the file at backend path p will be accessed, for the bytes from off up to off+length, or up to the end of the file if length is zero.
+// AdviceWillNeed reads the blocks in the range into the BlockCache in the background. AdviceDontNeed drops the cached blocks of the file, discards the data its open files prefetched and starts writing their buffered data.
+// AdviceSequential doubles the ReadAhead of the open files, AdviceRandom disables it and AdviceNormal restores it. AdviceNoReuse is ignored.
+func (r *FS) Advise(p string, off, length int64, advice Advice) error {
+	if off < 0 || length < 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	switch advice {
+	case AdviceWillNeed:
+		if r.cache == nil {
+			return nil
+		}
+		fi, err := r.underlying.Stat(p)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		// Like posix_fadvise, this doesn't wait for the data, and errors reading it are ignored.
+		go r.warmRange(context.Background(), p, fi, off, length)
+	case AdviceDontNeed:
+		if r.cache != nil {
+			r.cache.Invalidate(p)
+		}
+		for _, h := range r.handlesAt(p) {
+			h.openMtx.Lock()
+			if h.fh != nil {
+				h.fh.ReleaseMemory()
+			}
+			h.openMtx.Unlock()
+		}
+	case AdviceNormal, AdviceRandom, AdviceSequential:
+		size := r.readAhead
+		switch advice {
+		case AdviceRandom:
+			size = 0
+		case AdviceSequential:
+			size *= 2
+		}
+		for _, h := range r.handlesAt(p) {
+			h.setReadAhead(size)
+		}
+	case AdviceNoReuse:
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return nil
+}
+
+// handlesAt returns the open handles of the file at p.
+func (r *FS) handlesAt(p string) []*handle {
+	r.handlesMtx.Lock()
+	defer r.handlesMtx.Unlock()
+	var handles []*handle
+	for h := range r.handles {
+		if h.path == p {
+			handles = append(handles, h)
+		}
+	}
+	return handles
+}
+
+// setReadAhead changes how much the handle's file prefetches, also after it's reopened.
+func (h *handle) setReadAhead(size int) {
+	h.openMtx.Lock()
+	defer h.openMtx.Unlock()
+	h.readAhead = size
+	if h.fh != nil {
+		h.fh.SetReadAheadSize(size)
+	}
+}
+
+// parseAdvice parses the value of the fadvise extended attribute: the name of the advice, optionally followed by the offset and length.
+func parseAdvice(v []byte) (advice Advice, off, length int64, err error) {
+	fields := strings.Fields(string(v))
+	if len(fields) != 1 && len(fields) != 3 {
+		return 0, 0, 0, fuse.Errno(syscall.EINVAL)
+	}
+	advice, ok := adviceNames[strings.ToLower(fields[0])]
+	if !ok {
+		return 0, 0, 0, fuse.Errno(syscall.EINVAL)
+	}
+	if len(fields) == 3 {
+		off, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, 0, fuse.Errno(syscall.EINVAL)
+		}
+		length, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return 0, 0, 0, fuse.Errno(syscall.EINVAL)
+		}
+	}
+	return advice, off, length, nil
+}
@@ -0,0 +1,159 @@
+package billybazilfuse
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// alertBuckets is the number of buckets the window of an ErrorAlert is divided in. Failures drop out of the window one bucket at a time.
+const alertBuckets = 10
+
+// ErrorAlert is a threshold on the number of failed calls in a rolling window, like "10 reads failing with EIO within a minute".
+type ErrorAlert struct {
+	// Op is the type of calls counted, like "Read" (the names used by Stats). Empty counts all calls.
+	Op string
+	// Errno is the error counted, like "EIO". Empty counts all errors.
+	Errno string
+	// Threshold is the number of failures in Window at which the alert fires.
+	Threshold int
+	// Window defaults to a minute.
+	Window time.Duration
+}
+
+// String describes the alert, like "Read EIO >= 10/1m0s".
+func (a ErrorAlert) String() string {
+	op, errno := a.Op, a.Errno
+	if op == "" {
+		op = "any call"
+	}
+	if errno == "" {
+		errno = "any error"
+	}
+	return fmt.Sprintf("%s %s >= %d/%v", op, errno, a.Threshold, a.Window)
+}
+
+// errorAlerts tracks the failures counted by the ErrorAlerts.
+type errorAlerts struct {
+	callback func(a ErrorAlert, failures int, firing bool)
+
+	mtx    sync.Mutex
+	alerts []*alertState
+}
+
+type alertState struct {
+	ErrorAlert
+	bucketSize time.Duration
+	// buckets count the failures in consecutive periods of bucketSize, the last one ending at end.
+	buckets [alertBuckets]int
+	end     time.Time
+	firing  bool
+}
+
+func newErrorAlerts(alerts []ErrorAlert, callback func(a ErrorAlert, failures int, firing bool)) *errorAlerts {
+	e := &errorAlerts{callback: callback}
+	now := time.Now()
+	for _, a := range alerts {
+		if a.Window <= 0 {
+			a.Window = time.Minute
+		}
+		if a.Threshold < 1 {
+			a.Threshold = 1
+		}
+		bs := a.Window / alertBuckets
+		e.alerts = append(e.alerts, &alertState{ErrorAlert: a, bucketSize: bs, end: now.Add(bs)})
+	}
+	return e
+}
+
+// advance moves the window of s up to now, dropping the buckets that fell out of it.
+func (s *alertState) advance(now time.Time) {
+	for n := 0; !now.Before(s.end); n++ {
+		if n == alertBuckets {
+			// Everything fell out; skip ahead.
+			s.end = now.Add(s.bucketSize)
+			break
+		}
+		copy(s.buckets[:], s.buckets[1:])
+		s.buckets[alertBuckets-1] = 0
+		s.end = s.end.Add(s.bucketSize)
+	}
+}
+
+func (s *alertState) failures() int {
+	n := 0
+	for _, b := range s.buckets {
+		n += b
+	}
+	return n
+}
+
+// alertChange is an alert that started or stopped firing.
+type alertChange struct {
+	alert    ErrorAlert
+	failures int
+	firing   bool
+}
+
+// record counts the result of a call, and calls the callback for the alerts that started or stopped firing.
+func (e *errorAlerts) record(op string, err error) {
+	if e == nil {
+		return
+	}
+	errno := ""
+	if err != nil {
+		errno = errnoName(err)
+	}
+	now := time.Now()
+	var changes []alertChange
+	e.mtx.Lock()
+	for _, s := range e.alerts {
+		s.advance(now)
+		if err != nil && (s.Op == "" || s.Op == op) && (s.Errno == "" || s.Errno == errno) {
+			s.buckets[alertBuckets-1]++
+		}
+		if n := s.failures(); (n >= s.Threshold) != s.firing {
+			s.firing = !s.firing
+			changes = append(changes, alertChange{s.ErrorAlert, n, s.firing})
+		}
+	}
+	e.mtx.Unlock()
+	if e.callback != nil {
+		for _, c := range changes {
+			e.callback(c.alert, c.failures, c.firing)
+		}
+	}
+}
+
+// firing returns the alerts that are firing.
+func (e *errorAlerts) firing() []ErrorAlert {
+	if e == nil {
+		return nil
+	}
+	// Alerts stop firing when failures drop out of their window, which is only noticed when calls finish. Account for the time since.
+	e.record("", nil)
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	var ret []ErrorAlert
+	for _, s := range e.alerts {
+		if s.firing {
+			ret = append(ret, s.ErrorAlert)
+		}
+	}
+	return ret
+}
+
+// Healthy returns false while any of the ErrorAlerts is firing, or while the health probe of Options.HealthCheckInterval fails.
+func (r *FS) Healthy() bool {
+	return len(r.alerts.firing()) == 0 && !r.backendDown()
+}
+
+// errnoName returns the name of the errno the kernel gets for err, like "ENOENT".
+func errnoName(err error) string {
+	if en, ok := convertError(err).(fuse.ErrorNumber); ok {
+		return en.Errno().ErrnoName()
+	}
+	return "EIO"
+}
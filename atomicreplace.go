@@ -0,0 +1,136 @@
+package billybazilfuse
+
+import (
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+	"github.com/go-git/go-billy/v5"
+)
+
+// replacement is the temporary file a handle writes to with Options.AtomicReplace. It's renamed over the file the handle was opened at when the handle is released.
+type replacement struct {
+	tmp string
+}
+
+// shouldReplace returns whether opening a file with flags rewrites it from scratch, which AtomicReplace does in a temporary file.
+func (r *FS) shouldReplace(flags int) bool {
+	return r.atomicReplace && flags&os.O_TRUNC != 0 && flags&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY
+}
+
+// openReplacement creates a temporary file next to p to write its new contents to. It returns a nil file if p isn't an existing regular file, which is then opened normally.
+func (r *FS) openReplacement(p string) (*adapter.File, *replacement, error) {
+	fi, err := r.underlying.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, nil, nil
+	}
+	dir, base := path.Split(p)
+	var tmp string
+	var fh billy.File
+	for i := 0; i < 10; i++ {
+		tmp = path.Join(dir, "."+base+".billyfuse-"+strconv.FormatUint(rand.Uint64(), 36))
+		fh, err = r.underlying.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if ch, ok := r.underlying.(billy.Change); ok {
+		// The backend may have applied a umask.
+		ch.Chmod(tmp, fi.Mode().Perm())
+	}
+	f := r.newWritableFile(tmp, fh)
+	// Fsync on the file must sync the replacement.
+	r.writableMtx.Lock()
+	r.writableFiles[f] = p
+	r.writableMtx.Unlock()
+	r.replacingMtx.Lock()
+	r.replacing[p] = tmp
+	r.replacingMtx.Unlock()
+	return f, &replacement{tmp}, nil
+}
+
+// replaceOnTruncate is called when the file at p is truncated to zero through a handle. Without atomic O_TRUNC support the kernel opens the file without O_TRUNC and truncates it afterwards, so this switches a handle that was just opened for writing only to a replacement.
+// It returns false if there's no such handle, in which case the file should be truncated.
+func (r *FS) replaceOnTruncate(p string) (bool, error) {
+	fresh := func(h *handle) bool {
+		return h.flags.IsWriteOnly() && h.replace == nil && h.users == 0 && (h.fh == nil || !h.fh.Dirty())
+	}
+	var cand *handle
+	for _, h := range r.handlesAt(p) {
+		h.openMtx.Lock()
+		ok := fresh(h)
+		h.openMtx.Unlock()
+		if ok {
+			if cand != nil {
+				// Can't tell which one is being truncated.
+				return false, nil
+			}
+			cand = h
+		}
+	}
+	if cand == nil {
+		return false, nil
+	}
+	f, rp, err := r.openReplacement(p)
+	if err != nil || f == nil {
+		return false, err
+	}
+	cand.openMtx.Lock()
+	defer cand.openMtx.Unlock()
+	if !fresh(cand) {
+		r.abandonReplacement(p, f, rp)
+		return false, nil
+	}
+	if cand.fh != nil {
+		if err := cand.closeLocked(); err != nil && cand.closeErr == nil {
+			cand.closeErr = err
+		}
+	}
+	cand.fh, cand.replace = f, rp
+	return true, nil
+}
+
+// finishReplacement is called when a handle writing to a replacement for p is released, after its file was closed with the given error.
+// It renames the replacement over p if there was no error, and removes it otherwise.
+func (r *FS) finishReplacement(p string, rp *replacement, err error) error {
+	r.replacingMtx.Lock()
+	if r.replacing[p] == rp.tmp {
+		delete(r.replacing, p)
+	}
+	r.replacingMtx.Unlock()
+	if err == nil {
+		err = r.underlying.Rename(rp.tmp, p)
+	}
+	if err != nil {
+		r.underlying.Remove(rp.tmp)
+		return err
+	}
+	r.contentChanged(p)
+	r.dropChecksums(p)
+	return nil
+}
+
+// abandonReplacement discards a replacement that wasn't used.
+func (r *FS) abandonReplacement(p string, f *adapter.File, rp *replacement) {
+	r.forgetWritable(f)
+	f.Close()
+	r.finishReplacement(p, rp, os.ErrClosed)
+}
+
+// replacingPath returns the path of the replacement being written for p, or p if there is none, so the writer sees the size of what it wrote.
+func (r *FS) replacingPath(p string) string {
+	if !r.atomicReplace {
+		return p
+	}
+	r.replacingMtx.Lock()
+	defer r.replacingMtx.Unlock()
+	if tmp, ok := r.replacing[p]; ok {
+		return tmp
+	}
+	return p
+}
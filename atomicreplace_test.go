@@ -0,0 +1,76 @@
+package billybazilfuse
+
+import (
+	"context"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+func TestAtomicReplace(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		flags fuse.OpenFlags
+		// truncate truncates the file through Setattr after opening it, like kernels without atomic O_TRUNC support do. otherWriter opens the file for writing another time first.
+		truncate    bool
+		otherWriter bool
+		// replaced is whether the original content should stay on the backend until the handle is released.
+		replaced bool
+	}{
+		{name: "truncating open", flags: fuse.OpenWriteOnly | fuse.OpenTruncate, replaced: true},
+		{name: "truncating read-write open", flags: fuse.OpenReadWrite | fuse.OpenTruncate},
+		{name: "truncate after open", flags: fuse.OpenWriteOnly, truncate: true, replaced: true},
+		{name: "truncate after open with another writer", flags: fuse.OpenWriteOnly, truncate: true, otherWriter: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, backend := testFS(t, Options{AtomicReplace: true})
+			if err := util.WriteFile(backend, "f", []byte("content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.otherWriter {
+				defer releaseHandle(t, openHandle(t, r, "f", fuse.OpenWriteOnly))
+			}
+			h := openHandle(t, r, "f", tc.flags)
+			if tc.truncate {
+				req := &fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrHandle, Size: 0}
+				if err := r.node("f").Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+					t.Fatalf("Setattr: %v", err)
+				}
+			}
+			if err := h.Write(ctx, &fuse.WriteRequest{Data: []byte("new")}, &fuse.WriteResponse{}); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			var attr fuse.Attr
+			if err := r.node("f").Attr(ctx, &attr); err != nil {
+				t.Fatalf("Attr: %v", err)
+			}
+			if attr.Size != 3 {
+				t.Errorf("Attr while writing reported size %d; want 3", attr.Size)
+			}
+			want := "new"
+			if tc.replaced {
+				want = "content"
+			}
+			if data, err := util.ReadFile(backend, "f"); err != nil {
+				t.Fatal(err)
+			} else if string(data) != want {
+				t.Errorf("the backend has %q before the handle is released; want %q", data, want)
+			}
+			releaseHandle(t, h)
+			if data, err := util.ReadFile(backend, "f"); err != nil {
+				t.Fatal(err)
+			} else if string(data) != "new" {
+				t.Errorf("the backend has %q after the handle is released; want %q", data, "new")
+			}
+			entries, err := backend.ReadDir("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("the backend has %d files after the handle is released; want only f", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package billybazilfuse
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxBacklogWait is the longest a write is throttled. Buffered data that fails to be written stays in the backlog, so writes can't wait forever.
+const maxBacklogWait = 10 * time.Second
+
+// writeBacklog throttles writes while too much written data hasn't reached the backend yet.
+// Throttling starts when the backlog exceeds high, and stops when it's back at low.
+type writeBacklog struct {
+	high, low int64
+	// drain is called (in a new goroutine) when throttling starts, to write out buffered data.
+	drain func()
+
+	mtx        sync.Mutex
+	bytes      int64
+	throttling bool
+	// drained is closed when throttling stops.
+	drained chan struct{}
+}
+
+func (b *writeBacklog) add(delta int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.bytes += int64(delta)
+	switch {
+	case !b.throttling && b.bytes > b.high:
+		b.throttling = true
+		b.drained = make(chan struct{})
+		go b.drain()
+	case b.throttling && b.bytes <= b.low:
+		b.throttling = false
+		close(b.drained)
+	}
+}
+
+// wait returns once writes aren't throttled, or after maxBacklogWait. It fails with EINTR if ctx is cancelled, or with the error of Options.OpTimeout if its deadline passes.
+func (b *writeBacklog) wait(ctx context.Context) error {
+	b.mtx.Lock()
+	throttling, drained := b.throttling, b.drained
+	b.mtx.Unlock()
+	if !throttling {
+		return nil
+	}
+	t := time.NewTimer(maxBacklogWait)
+	defer t.Stop()
+	select {
+	case <-drained:
+	case <-t.C:
+	case <-ctx.Done():
+		return ctxErr(ctx)
+	}
+	return nil
+}
+
+// drainWriteBuffers starts writing the buffered data of all open files.
+func (r *FS) drainWriteBuffers() {
+	r.writableMtx.Lock()
+	defer r.writableMtx.Unlock()
+	for f := range r.writableFiles {
+		f.StartFlush()
+	}
+}
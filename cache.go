@@ -0,0 +1,92 @@
+package billybazilfuse
+
+import "time"
+
+// cacheBlockSize is the size of the blocks file contents are cached in.
+const cacheBlockSize = 128 * 1024
+
+// BlockKey identifies a block of a file.
+// The size and modification time of the file are part of the key, so blocks cached for an older version of the file aren't used if the file was changed outside of the mount.
+type BlockKey struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Block is the offset of the block divided by the block size (128 KiB).
+	Block int64
+}
+
+// BlockCache caches blocks of file contents. It must be safe for concurrent use.
+type BlockCache interface {
+	// Get returns the cached block, or ok=false if it isn't cached. The returned data must not be modified.
+	// Blocks are shorter than the block size only at the end of the file.
+	Get(key BlockKey) (data []byte, ok bool)
+	// Put stores a block. The cache takes ownership of data.
+	Put(key BlockKey, data []byte)
+	// Invalidate drops all cached blocks of the file at path.
+	Invalidate(path string)
+}
+
+// contentChanged is called after the content of the file at p was (possibly) changed through the mount.
+func (r *FS) contentChanged(p string) {
+	if r.cache != nil {
+		r.cache.Invalidate(p)
+	}
+	if r.shared != nil {
+		r.shared.detach(p)
+	}
+	r.statAhead.forget(p)
+	r.openAttrs.forget(p)
+}
+
+// blockRead reads from the handle in whole blocks, through the block cache if key isn't nil.
+// Blocks read from the backend are verified against sums if it isn't nil.
+// If the read lies within a single block, that block is returned rather than copied into p. The returned data must not be modified.
+func (h *handle) blockRead(key *BlockKey, sums *FileChecksums, p []byte, off int64) ([]byte, error) {
+	var k BlockKey
+	if key != nil {
+		k = *key
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		k.Block = pos / cacheBlockSize
+		var data []byte
+		ok := false
+		if key != nil {
+			data, ok = h.root.cache.Get(k)
+		}
+		if !ok {
+			data = make([]byte, cacheBlockSize)
+			m, err := h.readAt(data, k.Block*cacheBlockSize)
+			if err != nil {
+				return p[:n], err
+			}
+			data = data[:m]
+			if sums != nil {
+				if err := h.root.verifyBlock(h.path, sums, k.Block, data); err != nil {
+					return p[:n], err
+				}
+			}
+			if key != nil {
+				h.root.cache.Put(k, data)
+			}
+		}
+		start := pos - k.Block*cacheBlockSize
+		if start >= int64(len(data)) {
+			break
+		}
+		if n == 0 && (int64(len(data))-start >= int64(len(p)) || len(data) < cacheBlockSize) {
+			data = data[start:]
+			if len(data) > len(p) {
+				data = data[:len(p)]
+			}
+			return data, nil
+		}
+		n += copy(p[n:], data[start:])
+		if len(data) < cacheBlockSize {
+			// End of file.
+			break
+		}
+	}
+	return p[:n], nil
+}
@@ -0,0 +1,291 @@
+//go:build cgofuse
+// +build cgofuse
+
+// Package cgofuse exposes a github.com/winfsp/cgofuse/fuse.FileSystemInterface that passes calls to a Billy API.
+//
+// cgofuse supports macOS (macFUSE, FUSE-T), Windows (WinFsp), Linux and FreeBSD.
+// It needs cgo (except on Windows) and the FUSE headers at build time, so this package is only built with the cgofuse build tag:
+//
+//	go build -tags cgofuse
+package cgofuse
+
+import (
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+	"github.com/go-git/go-billy/v5"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// New creates a cgofuse filesystem that passes all calls through to the given filesystem.
+// Mount it with fuse.NewFileSystemHost(New(underlying)).Mount(mountpoint, nil).
+func New(underlying billy.Basic) fuse.FileSystemInterface {
+	return &filesystem{
+		underlying: underlying,
+		handles:    map[uint64]*handle{},
+	}
+}
+
+type filesystem struct {
+	fuse.FileSystemBase
+	underlying billy.Basic
+
+	mtx        sync.Mutex
+	handles    map[uint64]*handle
+	nextHandle uint64
+}
+
+type handle struct {
+	fh *adapter.File
+}
+
+var _ fuse.FileSystemInterface = &filesystem{}
+
+// billyPath converts a path from cgofuse (always starting with a slash) into a Billy path.
+func billyPath(p string) string {
+	p = path.Clean(p)
+	if p == "/" {
+		return ""
+	}
+	return p[1:]
+}
+
+var errnos = map[syscall.Errno]int{
+	syscall.EACCES:       fuse.EACCES,
+	syscall.EAGAIN:       fuse.EAGAIN,
+	syscall.EBADF:        fuse.EBADF,
+	syscall.EBUSY:        fuse.EBUSY,
+	syscall.EEXIST:       fuse.EEXIST,
+	syscall.EINTR:        fuse.EINTR,
+	syscall.EINVAL:       fuse.EINVAL,
+	syscall.EIO:          fuse.EIO,
+	syscall.EISDIR:       fuse.EISDIR,
+	syscall.ENAMETOOLONG: fuse.ENAMETOOLONG,
+	syscall.ENOENT:       fuse.ENOENT,
+	syscall.ENOSPC:       fuse.ENOSPC,
+	syscall.ENOSYS:       fuse.ENOSYS,
+	syscall.ENOTDIR:      fuse.ENOTDIR,
+	syscall.ENOTEMPTY:    fuse.ENOTEMPTY,
+	syscall.ENOTSUP:      fuse.ENOTSUP,
+	syscall.EPERM:        fuse.EPERM,
+	syscall.EROFS:        fuse.EROFS,
+	syscall.EXDEV:        fuse.EXDEV,
+}
+
+// convertError converts an error from Billy into the negative errno cgofuse expects.
+// The errno values differ between platforms, so we can't pass on the syscall.Errno directly.
+func convertError(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := errnos[adapter.Errno(err)]; ok {
+		return -e
+	}
+	return -fuse.EIO
+}
+
+// convertFlags converts open(2) flags as passed by cgofuse into the flags expected by Billy.
+func convertFlags(flags int) int {
+	var ret int
+	switch flags & fuse.O_ACCMODE {
+	case fuse.O_RDONLY:
+		ret = os.O_RDONLY
+	case fuse.O_WRONLY:
+		ret = os.O_WRONLY
+	case fuse.O_RDWR:
+		ret = os.O_RDWR
+	}
+	if flags&fuse.O_APPEND != 0 {
+		ret |= os.O_APPEND
+	}
+	if flags&fuse.O_CREAT != 0 {
+		ret |= os.O_CREATE
+	}
+	if flags&fuse.O_EXCL != 0 {
+		ret |= os.O_EXCL
+	}
+	if flags&fuse.O_TRUNC != 0 {
+		ret |= os.O_TRUNC
+	}
+	return ret
+}
+
+func fileInfoToStat(fi os.FileInfo, stat *fuse.Stat_t) {
+	mode := fi.Mode()
+	stat.Mode = uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		stat.Mode |= fuse.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		stat.Mode |= fuse.S_IFLNK
+	default:
+		stat.Mode |= fuse.S_IFREG
+	}
+	stat.Size = fi.Size()
+	stat.Mtim = fuse.NewTimespec(fi.ModTime())
+}
+
+func (f *filesystem) addHandle(fh billy.File) uint64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.nextHandle++
+	f.handles[f.nextHandle] = &handle{fh: adapter.NewFile(fh)}
+	return f.nextHandle
+}
+
+func (f *filesystem) getHandle(fh uint64) *handle {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.handles[fh]
+}
+
+func (f *filesystem) Getattr(p string, stat *fuse.Stat_t, fh uint64) int {
+	fi, err := f.underlying.Stat(billyPath(p))
+	if err != nil {
+		return convertError(err)
+	}
+	fileInfoToStat(fi, stat)
+	return 0
+}
+
+func (f *filesystem) Mkdir(p string, mode uint32) int {
+	return convertError(adapter.Mkdir(f.underlying, billyPath(p), os.FileMode(mode).Perm()))
+}
+
+// Unlink removes a file.
+func (f *filesystem) Unlink(p string) int {
+	return convertError(f.underlying.Remove(billyPath(p)))
+}
+
+// Rmdir removes a directory.
+func (f *filesystem) Rmdir(p string) int {
+	return convertError(f.underlying.Remove(billyPath(p)))
+}
+
+// Symlink creates a symbolic link.
+func (f *filesystem) Symlink(target string, newpath string) int {
+	return convertError(adapter.Symlink(f.underlying, target, billyPath(newpath)))
+}
+
+// Readlink reads the target of a symbolic link.
+func (f *filesystem) Readlink(p string) (int, string) {
+	target, err := adapter.Readlink(f.underlying, billyPath(p))
+	if err != nil {
+		return convertError(err), ""
+	}
+	return 0, target
+}
+
+// Rename renames a file.
+func (f *filesystem) Rename(oldpath string, newpath string) int {
+	return convertError(f.underlying.Rename(billyPath(oldpath), billyPath(newpath)))
+}
+
+func (f *filesystem) Chmod(p string, mode uint32) int {
+	m := os.FileMode(mode).Perm()
+	return convertError(adapter.Setattr(f.underlying, billyPath(p), adapter.SetattrRequest{Mode: &m}))
+}
+
+func (f *filesystem) Chown(p string, uid uint32, gid uint32) int {
+	var sr adapter.SetattrRequest
+	// cgofuse passes -1 for ids that shouldn't change.
+	if uid != ^uint32(0) {
+		sr.Uid = &uid
+	}
+	if gid != ^uint32(0) {
+		sr.Gid = &gid
+	}
+	return convertError(adapter.Setattr(f.underlying, billyPath(p), sr))
+}
+
+func (f *filesystem) Utimens(p string, tmsp []fuse.Timespec) int {
+	var atime, mtime time.Time
+	if tmsp == nil {
+		atime = time.Now()
+		mtime = atime
+	} else {
+		atime = tmsp[0].Time()
+		mtime = tmsp[1].Time()
+	}
+	return convertError(adapter.Setattr(f.underlying, billyPath(p), adapter.SetattrRequest{Atime: &atime, Mtime: &mtime}))
+}
+
+func (f *filesystem) Truncate(p string, size int64, fh uint64) int {
+	if h := f.getHandle(fh); h != nil {
+		return convertError(h.fh.Truncate(size))
+	}
+	s := uint64(size)
+	return convertError(adapter.Setattr(f.underlying, billyPath(p), adapter.SetattrRequest{Size: &s}))
+}
+
+func (f *filesystem) Create(p string, flags int, mode uint32) (int, uint64) {
+	fh, err := f.underlying.OpenFile(billyPath(p), convertFlags(flags)|os.O_CREATE, os.FileMode(mode).Perm())
+	if err != nil {
+		return convertError(err), ^uint64(0)
+	}
+	return 0, f.addHandle(fh)
+}
+
+func (f *filesystem) Open(p string, flags int) (int, uint64) {
+	fh, err := f.underlying.OpenFile(billyPath(p), convertFlags(flags), 0777)
+	if err != nil {
+		return convertError(err), ^uint64(0)
+	}
+	return 0, f.addHandle(fh)
+}
+
+func (f *filesystem) Read(p string, buff []byte, ofst int64, fh uint64) int {
+	h := f.getHandle(fh)
+	if h == nil {
+		return -fuse.EBADF
+	}
+	n, err := h.fh.ReadAt(buff, ofst)
+	if err != nil {
+		return convertError(err)
+	}
+	return n
+}
+
+func (f *filesystem) Write(p string, buff []byte, ofst int64, fh uint64) int {
+	h := f.getHandle(fh)
+	if h == nil {
+		return -fuse.EBADF
+	}
+	n, err := h.fh.WriteAt(buff, ofst)
+	if err != nil {
+		return convertError(err)
+	}
+	return n
+}
+
+func (f *filesystem) Release(p string, fh uint64) int {
+	f.mtx.Lock()
+	h := f.handles[fh]
+	delete(f.handles, fh)
+	f.mtx.Unlock()
+	if h == nil {
+		return -fuse.EBADF
+	}
+	return convertError(h.fh.Close())
+}
+
+func (f *filesystem) Readdir(p string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) int {
+	entries, err := adapter.ReadDir(f.underlying, billyPath(p))
+	if err != nil {
+		return convertError(err)
+	}
+	fill(".", nil, 0)
+	fill("..", nil, 0)
+	for _, e := range entries {
+		var stat fuse.Stat_t
+		fileInfoToStat(e, &stat)
+		if !fill(e.Name(), &stat, 0) {
+			break
+		}
+	}
+	return 0
+}
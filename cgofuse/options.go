@@ -0,0 +1,23 @@
+//go:build cgofuse
+// +build cgofuse
+
+package cgofuse
+
+// MountOptions are platform specific mount options. Options that don't apply to the current platform are ignored.
+type MountOptions struct {
+	// VolumeName is the name shown in Finder. macOS only.
+	VolumeName string
+	// Local marks the volume as local rather than a network volume, so Finder shows it on the desktop and in the sidebar. macOS only.
+	Local bool
+	// NoAppleDouble suppresses the creation of ._ AppleDouble files and .DS_Store files. macOS only.
+	NoAppleDouble bool
+}
+
+// Args returns the arguments to pass to fuse.FileSystemHost.Mount.
+func (o MountOptions) Args() []string {
+	var ret []string
+	for _, opt := range o.platformOptions() {
+		ret = append(ret, "-o", opt)
+	}
+	return ret
+}
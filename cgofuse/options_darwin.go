@@ -0,0 +1,20 @@
+//go:build cgofuse && darwin
+// +build cgofuse,darwin
+
+package cgofuse
+
+import "strings"
+
+func (o MountOptions) platformOptions() []string {
+	var ret []string
+	if o.VolumeName != "" {
+		ret = append(ret, "volname="+strings.ReplaceAll(o.VolumeName, ",", "\\,"))
+	}
+	if o.Local {
+		ret = append(ret, "local")
+	}
+	if o.NoAppleDouble {
+		ret = append(ret, "noappledouble")
+	}
+	return ret
+}
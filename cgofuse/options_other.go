@@ -0,0 +1,8 @@
+//go:build cgofuse && !darwin
+// +build cgofuse,!darwin
+
+package cgofuse
+
+func (o MountOptions) platformOptions() []string {
+	return nil
+}
@@ -0,0 +1,209 @@
+package billybazilfuse
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// FileChecksums are the checksums of a file that was written through the mount.
+type FileChecksums struct {
+	Size int64
+	// Blocks are the SHA-256 sums of the blocks of the file, which are 128 KiB except for the last one.
+	Blocks [][sha256.Size]byte
+}
+
+// ChecksumStore stores the checksums of files written through the mount. It must be safe for concurrent use.
+type ChecksumStore interface {
+	// Get returns the checksums of the file at path, or ok=false if there are none.
+	Get(path string) (sums FileChecksums, ok bool)
+	// Put stores the checksums of the file at path.
+	Put(path string, sums FileChecksums)
+	// Remove drops the checksums of path and everything below it.
+	Remove(path string)
+	// Rename moves the checksums of oldPath and everything below it to newPath.
+	Rename(oldPath, newPath string)
+}
+
+// checksummer computes the checksums of a file while it's being written.
+// Checksums can only be computed for files that are written sequentially from the start, which is how most files are written.
+type checksummer struct {
+	sums FileChecksums
+	// partial is the data of the last block that was written so far.
+	partial []byte
+	// valid is whether everything written so far was written sequentially from the start, through this handle.
+	valid bool
+	// dropped is whether this handle removed the stored checksums.
+	dropped bool
+}
+
+func (c *checksummer) add(data []byte) {
+	c.sums.Size += int64(len(data))
+	for len(data) > 0 {
+		n := cacheBlockSize - len(c.partial)
+		if n > len(data) {
+			n = len(data)
+		}
+		c.partial = append(c.partial, data[:n]...)
+		data = data[n:]
+		if len(c.partial) == cacheBlockSize {
+			c.sums.Blocks = append(c.sums.Blocks, sha256.Sum256(c.partial))
+			c.partial = c.partial[:0]
+		}
+	}
+}
+
+func (c *checksummer) finish() FileChecksums {
+	if len(c.partial) > 0 {
+		c.sums.Blocks = append(c.sums.Blocks, sha256.Sum256(c.partial))
+		c.partial = nil
+	}
+	return c.sums
+}
+
+// startChecksums prepares the handle for recording or verifying checksums. size is the size of the file when it was opened.
+func (h *handle) startChecksums(size int64, writable bool) {
+	r := h.root
+	if writable {
+		h.sums = &checksummer{valid: size == 0}
+		if size == 0 {
+			r.sumMtx.Lock()
+			if w := r.sumWriters[h.path]; w != nil {
+				w.valid = false
+			}
+			r.sumWriters[h.path] = h.sums
+			r.sumMtx.Unlock()
+		}
+	}
+	if sums, ok := r.checksums.Get(h.path); ok && sums.Size == size {
+		h.verify = &sums
+	}
+}
+
+// recordChecksums is called after data was written at off through the handle.
+func (h *handle) recordChecksums(off int64, data []byte) {
+	r := h.root
+	r.sumMtx.Lock()
+	defer r.sumMtx.Unlock()
+	c := h.sums
+	if c.valid && off == c.sums.Size && r.sumWriters[h.path] == c {
+		c.add(data)
+		return
+	}
+	c.valid = false
+	if !c.dropped {
+		c.dropped = true
+		r.dropChecksumsLocked(h.path)
+	}
+}
+
+// finishChecksums stores the checksums of the data written through the handle, if it was written sequentially.
+func (h *handle) finishChecksums() {
+	r := h.root
+	r.sumMtx.Lock()
+	defer r.sumMtx.Unlock()
+	c := h.sums
+	if r.sumWriters[h.path] != c {
+		return
+	}
+	delete(r.sumWriters, h.path)
+	if c.valid {
+		r.checksums.Put(h.path, c.finish())
+	}
+}
+
+// dropChecksums removes the checksums of p (and everything below it), because it was changed in a way that can't be tracked.
+func (r *FS) dropChecksums(p string) {
+	if r.checksums == nil {
+		return
+	}
+	r.sumMtx.Lock()
+	defer r.sumMtx.Unlock()
+	r.dropChecksumsLocked(p)
+}
+
+func (r *FS) dropChecksumsLocked(p string) {
+	r.stopWritersLocked(p)
+	r.checksums.Remove(p)
+}
+
+// stopWritersLocked stops recording the checksums of files being written at p or below it.
+func (r *FS) stopWritersLocked(p string) {
+	for wp, w := range r.sumWriters {
+		if wp == p || strings.HasPrefix(wp, p+"/") {
+			w.valid = false
+			delete(r.sumWriters, wp)
+		}
+	}
+}
+
+// moveChecksums moves the checksums of oldPath (and everything below it) to newPath, after it was renamed.
+func (r *FS) moveChecksums(oldPath, newPath string) {
+	if r.checksums == nil {
+		return
+	}
+	r.sumMtx.Lock()
+	defer r.sumMtx.Unlock()
+	// Handles keep using the old path, so files still being written can't be recorded anymore.
+	r.stopWritersLocked(oldPath)
+	r.stopWritersLocked(newPath)
+	r.checksums.Rename(oldPath, newPath)
+}
+
+// verifyBlock checks a block read from the backend against its checksum, and fails with EIO if it doesn't match.
+func (r *FS) verifyBlock(p string, sums *FileChecksums, block int64, data []byte) error {
+	if block < int64(len(sums.Blocks)) && sha256.Sum256(data) == sums.Blocks[block] {
+		return nil
+	}
+	if r.onChecksumMismatch != nil {
+		r.onChecksumMismatch(p, block)
+	}
+	return fuse.EIO
+}
+
+// DirChecksumStore is a ChecksumStore that keeps the checksums in a local directory, mirroring the directory structure of the mount.
+type DirChecksumStore struct {
+	dir mirrorDir
+}
+
+var _ ChecksumStore = &DirChecksumStore{}
+
+// NewDirChecksumStore creates a DirChecksumStore in dir, which is created if needed.
+func NewDirChecksumStore(dir string) (*DirChecksumStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirChecksumStore{dir: mirrorDir(dir)}, nil
+}
+
+func (s *DirChecksumStore) Get(p string) (FileChecksums, bool) {
+	data, ok := s.dir.get(p)
+	if !ok || len(data) < 8 || (len(data)-8)%sha256.Size != 0 {
+		return FileChecksums{}, false
+	}
+	sums := FileChecksums{Size: int64(binary.BigEndian.Uint64(data))}
+	for data = data[8:]; len(data) > 0; data = data[sha256.Size:] {
+		sums.Blocks = append(sums.Blocks, [sha256.Size]byte(data))
+	}
+	return sums, true
+}
+
+func (s *DirChecksumStore) Put(p string, sums FileChecksums) {
+	data := make([]byte, 8, 8+len(sums.Blocks)*sha256.Size)
+	binary.BigEndian.PutUint64(data, uint64(sums.Size))
+	for _, b := range sums.Blocks {
+		data = append(data, b[:]...)
+	}
+	s.dir.put(p, data)
+}
+
+func (s *DirChecksumStore) Remove(p string) {
+	s.dir.remove(p)
+}
+
+func (s *DirChecksumStore) Rename(oldPath, newPath string) {
+	s.dir.rename(oldPath, newPath)
+}
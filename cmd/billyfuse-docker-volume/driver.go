@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"bazil.org/fuse"
+	billybazilfuse "github.com/Jille/billy-bazilfuse"
+	"github.com/Jille/billy-bazilfuse/internal/backend"
+	"github.com/go-git/go-billy/v5"
+)
+
+// volumeSpec is how a volume was created. It is persisted so volumes survive restarts of the plugin.
+type volumeSpec struct {
+	Type   string
+	Params map[string]string
+}
+
+type volume struct {
+	spec volumeSpec
+
+	// backend is opened when the volume is first mounted, and kept open until the volume is removed, so memfs volumes keep their contents between containers.
+	backend billy.Basic
+	closer  io.Closer
+
+	// The fields below are set while the volume is mounted.
+	mountIDs map[string]bool
+	conn     *fuse.Conn
+	served   chan error
+}
+
+type driver struct {
+	stateDir string
+	osfsRoot string
+
+	mtx     sync.Mutex
+	volumes map[string]*volume
+}
+
+func newDriver(stateDir, osfsRoot string) (*driver, error) {
+	d := &driver{
+		stateDir: stateDir,
+		osfsRoot: osfsRoot,
+		volumes:  map[string]*volume{},
+	}
+	if err := os.MkdirAll(filepath.Join(stateDir, "mnt"), 0700); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(d.statePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, err
+	}
+	var specs map[string]volumeSpec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("corrupt state file %q: %w", d.statePath(), err)
+	}
+	for name, spec := range specs {
+		d.volumes[name] = &volume{spec: spec}
+		// Mounts left behind by a previous run aren't served anymore.
+		_ = fuse.Unmount(d.mountpoint(name))
+	}
+	return d, nil
+}
+
+func (d *driver) statePath() string {
+	return filepath.Join(d.stateDir, "volumes.json")
+}
+
+func (d *driver) mountpoint(name string) string {
+	return filepath.Join(d.stateDir, "mnt", name)
+}
+
+// saveLocked writes the specs of all volumes to the state file. d.mtx must be held.
+func (d *driver) saveLocked() error {
+	specs := map[string]volumeSpec{}
+	for name, v := range d.volumes {
+		specs[name] = v.spec
+	}
+	b, err := json.MarshalIndent(specs, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := d.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.statePath())
+}
+
+// specFor turns the options given to `docker volume create` into a volumeSpec. The option type picks the backend, the others are its parameters.
+func (d *driver) specFor(name string, opts map[string]string) (volumeSpec, error) {
+	spec := volumeSpec{Type: opts["type"], Params: map[string]string{}}
+	for k, v := range opts {
+		if k != "type" {
+			spec.Params[k] = v
+		}
+	}
+	if spec.Type == "" {
+		spec.Type = "memfs"
+	}
+	if spec.Type == "osfs" {
+		// osfs volumes are subdirectories of -osfs_root, so users of the Docker API can't expose arbitrary host directories.
+		if d.osfsRoot == "" {
+			return spec, errors.New("osfs volumes are disabled; start the plugin with -osfs_root")
+		}
+		sub := spec.Params["subdir"]
+		delete(spec.Params, "subdir")
+		if _, ok := spec.Params["path"]; ok {
+			return spec, errors.New("osfs volumes take subdir rather than path")
+		}
+		if sub == "" {
+			sub = name
+		}
+		if !filepath.IsLocal(sub) {
+			return spec, fmt.Errorf("subdir %q is outside of the osfs root", sub)
+		}
+		spec.Params["path"] = filepath.Join(d.osfsRoot, sub)
+		if err := d.checkOsfsPath(spec.Params["path"]); err != nil {
+			return spec, err
+		}
+	}
+	return spec, nil
+}
+
+// checkOsfsPath checks that p is still within -osfs_root after resolving symlinks, as a symlink in the root could otherwise point anywhere on the host.
+// Only the part of p that exists is resolved; the rest is created as directories by create.
+func (d *driver) checkOsfsPath(p string) error {
+	root, err := filepath.EvalSymlinks(d.osfsRoot)
+	if err != nil {
+		return err
+	}
+	existing, rest := p, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = filepath.Join(resolved, rest)
+			break
+		}
+		parent := filepath.Dir(existing)
+		if !os.IsNotExist(err) || parent == existing {
+			return err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	if rel, err := filepath.Rel(root, existing); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("%q is outside of the osfs root", p)
+	}
+	return nil
+}
+
+func (d *driver) create(name string, opts map[string]string) error {
+	if name == "" || !filepath.IsLocal(name) || filepath.Base(name) != name {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	spec, err := d.specFor(name, opts)
+	if err != nil {
+		return err
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.volumes[name]; ok {
+		return fmt.Errorf("volume %q already exists", name)
+	}
+	if spec.Type == "osfs" {
+		if err := os.MkdirAll(spec.Params["path"], 0755); err != nil {
+			return err
+		}
+	}
+	v := &volume{spec: spec}
+	// Open the backend right away to report bad parameters at creation time.
+	if err := v.open(); err != nil {
+		return err
+	}
+	d.volumes[name] = v
+	if err := d.saveLocked(); err != nil {
+		delete(d.volumes, name)
+		v.closer.Close()
+		return err
+	}
+	return nil
+}
+
+func (v *volume) open() error {
+	if v.backend != nil {
+		return nil
+	}
+	b, c, err := backend.Open(v.spec.Type, v.spec.Params)
+	if err != nil {
+		return err
+	}
+	v.backend, v.closer = b, c
+	return nil
+}
+
+func (d *driver) remove(name string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	v, ok := d.volumes[name]
+	if !ok {
+		return fmt.Errorf("no such volume %q", name)
+	}
+	if len(v.mountIDs) > 0 {
+		return fmt.Errorf("volume %q is in use", name)
+	}
+	delete(d.volumes, name)
+	if err := d.saveLocked(); err != nil {
+		d.volumes[name] = v
+		return err
+	}
+	if v.closer != nil {
+		v.closer.Close()
+	}
+	os.Remove(d.mountpoint(name))
+	return nil
+}
+
+func (d *driver) mount(name, id string) (string, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	v, ok := d.volumes[name]
+	if !ok {
+		return "", fmt.Errorf("no such volume %q", name)
+	}
+	mp := d.mountpoint(name)
+	if v.conn != nil {
+		v.mountIDs[id] = true
+		return mp, nil
+	}
+	if v.spec.Type == "osfs" {
+		// The directory could have been replaced by a symlink since the volume was created.
+		if err := d.checkOsfsPath(v.spec.Params["path"]); err != nil {
+			return "", err
+		}
+	}
+	if err := v.open(); err != nil {
+		return "", err
+	}
+	bfs, err := billybazilfuse.NewWithOptions(v.backend, billybazilfuse.Options{})
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(mp, 0755); err != nil {
+		return "", err
+	}
+	opts := append([]fuse.MountOption{fuse.FSName(name), fuse.Subtype("billyfuse"), fuse.AllowOther()}, bfs.MountOptions()...)
+	c, err := fuse.Mount(mp, opts...)
+	if err != nil {
+		return "", fmt.Errorf("failed to mount %q: %w", mp, err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		err := bfs.Serve(c)
+		bfs.Close()
+		served <- err
+	}()
+	v.conn = c
+	v.served = served
+	v.mountIDs = map[string]bool{id: true}
+	return mp, nil
+}
+
+func (d *driver) unmount(name, id string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	v, ok := d.volumes[name]
+	if !ok {
+		return fmt.Errorf("no such volume %q", name)
+	}
+	if !v.mountIDs[id] {
+		return fmt.Errorf("volume %q is not mounted by %q", name, id)
+	}
+	delete(v.mountIDs, id)
+	if len(v.mountIDs) > 0 {
+		return nil
+	}
+	mp := d.mountpoint(name)
+	if err := fuse.Unmount(mp); err != nil {
+		v.mountIDs[id] = true
+		return fmt.Errorf("failed to unmount %q: %w", mp, err)
+	}
+	if err := <-v.served; err != nil {
+		log.Printf("Serving volume %q failed: %v", name, err)
+	}
+	v.conn.Close()
+	v.conn = nil
+	v.served = nil
+	return nil
+}
+
+// path returns the mountpoint of a volume, or "" if it isn't mounted.
+func (d *driver) path(name string) (string, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	v, ok := d.volumes[name]
+	if !ok {
+		return "", fmt.Errorf("no such volume %q", name)
+	}
+	if v.conn == nil {
+		return "", nil
+	}
+	return d.mountpoint(name), nil
+}
+
+func (d *driver) list() []string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	names := make([]string, 0, len(d.volumes))
+	for name := range d.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shutdown unmounts all volumes and closes their backends.
+func (d *driver) shutdown() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for name, v := range d.volumes {
+		if v.conn != nil {
+			if err := fuse.Unmount(d.mountpoint(name)); err != nil {
+				log.Printf("Failed to unmount volume %q: %v", name, err)
+			} else {
+				<-v.served
+			}
+			v.conn.Close()
+			v.conn = nil
+		}
+		if v.closer != nil {
+			v.closer.Close()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Binary billyfuse-docker-volume is a Docker volume plugin that serves Billy filesystems (memfs, osfs or SFTP) through this adapter.
+//
+// Volumes are created with the backend type and its parameters as options:
+//
+//	docker volume create -d billyfuse -o type=sftp -o host=example.com -o user=me -o key=/etc/billyfuse/id_ed25519 -o path=/srv/data data
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+var (
+	name     = flag.String("name", "billyfuse", "Name of the volume driver, as passed to docker volume create -d")
+	stateDir = flag.String("state_dir", "/var/lib/billyfuse-docker-volume", "Directory for the volume definitions and mountpoints")
+	osfsRoot = flag.String("osfs_root", "", "Directory under which osfs volumes are created (osfs volumes are disabled if empty)")
+	socket   = flag.String("socket", "", "Path of the plugin socket (defaults to /run/docker/plugins/<name>.sock)")
+)
+
+const contentType = "application/vnd.docker.plugins.v1.2+json"
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *socket == "" {
+		*socket = filepath.Join("/run/docker/plugins", *name+".sock")
+	}
+	d, err := newDriver(*stateDir, *osfsRoot)
+	if err != nil {
+		log.Fatalf("Failed to load state: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*socket), 0755); err != nil {
+		log.Fatalf("Failed to create socket directory: %v", err)
+	}
+	os.Remove(*socket)
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Fatalf("Failed to listen on %q: %v", *socket, err)
+	}
+	srv := &http.Server{Handler: d.handler()}
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		srv.Close()
+	}()
+	log.Printf("Serving volume driver %q on %s", *name, *socket)
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Printf("Serve failed: %v", err)
+	}
+	d.shutdown()
+	os.Remove(*socket)
+}
+
+type volumeRequest struct {
+	Name string
+	ID   string
+	Opts map[string]string
+}
+
+type volumeInfo struct {
+	Name       string
+	Mountpoint string `json:",omitempty"`
+}
+
+type volumeResponse struct {
+	Err        string
+	Mountpoint string        `json:",omitempty"`
+	Volume     *volumeInfo   `json:",omitempty"`
+	Volumes    []*volumeInfo `json:",omitempty"`
+}
+
+func (d *driver) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, map[string][]string{"Implements": {"VolumeDriver"}})
+	})
+	mux.HandleFunc("/VolumeDriver.Capabilities", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, map[string]map[string]string{"Capabilities": {"Scope": "local"}})
+	})
+	handle := func(method string, fn func(req volumeRequest) (volumeResponse, error)) {
+		mux.HandleFunc("/VolumeDriver."+method, func(w http.ResponseWriter, r *http.Request) {
+			var req volumeRequest
+			// Docker sends an empty body for List.
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				reply(w, volumeResponse{Err: fmt.Sprintf("invalid request: %v", err)})
+				return
+			}
+			resp, err := fn(req)
+			if err != nil {
+				log.Printf("%s %q: %v", method, req.Name, err)
+				resp = volumeResponse{Err: err.Error()}
+			}
+			reply(w, resp)
+		})
+	}
+	handle("Create", func(req volumeRequest) (volumeResponse, error) {
+		return volumeResponse{}, d.create(req.Name, req.Opts)
+	})
+	handle("Remove", func(req volumeRequest) (volumeResponse, error) {
+		return volumeResponse{}, d.remove(req.Name)
+	})
+	handle("Mount", func(req volumeRequest) (volumeResponse, error) {
+		mp, err := d.mount(req.Name, req.ID)
+		return volumeResponse{Mountpoint: mp}, err
+	})
+	handle("Unmount", func(req volumeRequest) (volumeResponse, error) {
+		return volumeResponse{}, d.unmount(req.Name, req.ID)
+	})
+	handle("Path", func(req volumeRequest) (volumeResponse, error) {
+		mp, err := d.path(req.Name)
+		return volumeResponse{Mountpoint: mp}, err
+	})
+	handle("Get", func(req volumeRequest) (volumeResponse, error) {
+		mp, err := d.path(req.Name)
+		return volumeResponse{Volume: &volumeInfo{Name: req.Name, Mountpoint: mp}}, err
+	})
+	handle("List", func(req volumeRequest) (volumeResponse, error) {
+		resp := volumeResponse{Volumes: []*volumeInfo{}}
+		for _, n := range d.list() {
+			mp, _ := d.path(n)
+			resp.Volumes = append(resp.Volumes, &volumeInfo{Name: n, Mountpoint: mp})
+		}
+		return resp, nil
+	})
+	return mux
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+// Binary billyfuse-stress mounts an in-memory Billy filesystem and hammers it with concurrent readers, writers, renames and deletes, periodically verifying file contents.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	billybazilfuse "github.com/Jille/billy-bazilfuse"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+var (
+	duration    = flag.Duration("duration", time.Minute, "How long to run the stress test")
+	workers     = flag.Int("workers", 16, "Number of concurrent workers")
+	slots       = flag.Int("files", 64, "Number of distinct file names to operate on")
+	maxSize     = flag.Int("max_size", 256*1024, "Maximum size of the files written")
+	blockSize   = flag.Int("block_size", 4096, "Block size used for concurrent writes to a single file handle")
+	verifyEvery = flag.Duration("verify_interval", 5*time.Second, "How often to verify all files")
+	seed        = flag.Int64("seed", 0, "Random seed (0 picks one based on the time)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <mountpoint>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("Using seed %d", *seed)
+	mountpoint := flag.Arg(0)
+
+	c, err := fuse.Mount(mountpoint, fuse.FSName("billyfuse-stress"), fuse.Subtype("billyfuse"))
+	if err != nil {
+		log.Fatalf("Failed to mount %q: %v", mountpoint, err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- fs.Serve(c, billybazilfuse.New(memfs.New(), nil))
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	s := newStresser(mountpoint)
+	failed := s.run(*duration, sigs)
+
+	if err := fuse.Unmount(mountpoint); err != nil {
+		log.Printf("Failed to unmount %q: %v", mountpoint, err)
+	}
+	if err := <-serveErr; err != nil {
+		log.Printf("Serve failed: %v", err)
+		failed = true
+	}
+	c.Close()
+	s.printStats()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// slot is a file name with the expected hash of its content.
+type slot struct {
+	mtx    sync.Mutex
+	name   string
+	exists bool
+	hash   [sha256.Size]byte
+}
+
+type stresser struct {
+	dir   string
+	slots []*slot
+
+	ops      [numOps]int64
+	failures int64
+}
+
+type op int
+
+const (
+	opWrite op = iota
+	opRead
+	opConcurrentWrite
+	opRename
+	opDelete
+	numOps
+)
+
+var opNames = [numOps]string{"write", "read", "concurrent-write", "rename", "delete"}
+
+func newStresser(dir string) *stresser {
+	s := &stresser{
+		dir:   dir,
+		slots: make([]*slot, *slots),
+	}
+	for i := range s.slots {
+		s.slots[i] = &slot{name: filepath.Join(dir, fmt.Sprintf("f%d", i))}
+	}
+	return s
+}
+
+// run runs the workers and verifier until the duration passes or a signal comes in. It returns whether any failures were detected.
+func (s *stresser) run(d time.Duration, sigs <-chan os.Signal) bool {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.worker(rand.New(rand.NewSource(*seed+int64(i))), stop)
+		}(i)
+	}
+	t := time.NewTicker(*verifyEvery)
+	deadline := time.After(d)
+loop:
+	for {
+		select {
+		case <-t.C:
+			s.verifyAll()
+		case <-deadline:
+			break loop
+		case sig := <-sigs:
+			log.Printf("Received %s, stopping", sig)
+			break loop
+		}
+	}
+	t.Stop()
+	close(stop)
+	wg.Wait()
+	s.verifyAll()
+	return atomic.LoadInt64(&s.failures) > 0
+}
+
+func (s *stresser) worker(rnd *rand.Rand, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		o := op(rnd.Intn(int(numOps)))
+		atomic.AddInt64(&s.ops[o], 1)
+		sl := s.slots[rnd.Intn(len(s.slots))]
+		var err error
+		switch o {
+		case opWrite:
+			err = s.write(rnd, sl)
+		case opRead:
+			err = s.verify(sl)
+		case opConcurrentWrite:
+			err = s.concurrentWrite(rnd, sl)
+		case opRename:
+			err = s.rename(sl, s.slots[rnd.Intn(len(s.slots))])
+		case opDelete:
+			err = s.delete(sl)
+		}
+		if err != nil {
+			s.fail("%s: %v", opNames[o], err)
+		}
+	}
+}
+
+func (s *stresser) fail(format string, args ...interface{}) {
+	atomic.AddInt64(&s.failures, 1)
+	log.Printf("FAILURE: "+format, args...)
+}
+
+func randomData(rnd *rand.Rand) []byte {
+	b := make([]byte, rnd.Intn(*maxSize+1))
+	rnd.Read(b)
+	return b
+}
+
+func (s *stresser) write(rnd *rand.Rand, sl *slot) error {
+	data := randomData(rnd)
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	if err := ioutil.WriteFile(sl.name, data, 0644); err != nil {
+		return err
+	}
+	sl.exists = true
+	sl.hash = sha256.Sum256(data)
+	return nil
+}
+
+// concurrentWrite writes a file through a single handle from many goroutines at once, which exercises concurrent Write calls on the same FUSE handle.
+func (s *stresser) concurrentWrite(rnd *rand.Rand, sl *slot) error {
+	data := randomData(rnd)
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	fh, err := os.OpenFile(sl.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// Whatever happens below, the content is no longer what we had recorded.
+	sl.exists = false
+	var wg sync.WaitGroup
+	errs := make(chan error, len(data) / *blockSize + 1)
+	for off := 0; off < len(data); off += *blockSize {
+		end := off + *blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		wg.Add(1)
+		go func(off, end int) {
+			defer wg.Done()
+			if _, err := fh.WriteAt(data[off:end], int64(off)); err != nil {
+				errs <- err
+			}
+		}(off, end)
+	}
+	wg.Wait()
+	close(errs)
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	sl.exists = true
+	sl.hash = sha256.Sum256(data)
+	return s.verifyLocked(sl)
+}
+
+func (s *stresser) verify(sl *slot) error {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	return s.verifyLocked(sl)
+}
+
+func (s *stresser) verifyLocked(sl *slot) error {
+	data, err := ioutil.ReadFile(sl.name)
+	if err != nil {
+		if os.IsNotExist(err) && !sl.exists {
+			return nil
+		}
+		return err
+	}
+	if !sl.exists {
+		return fmt.Errorf("%s exists but shouldn't", sl.name)
+	}
+	if h := sha256.Sum256(data); !bytes.Equal(h[:], sl.hash[:]) {
+		return fmt.Errorf("%s has the wrong content (%d bytes, hash %x, expected %x)", sl.name, len(data), h, sl.hash)
+	}
+	return nil
+}
+
+func (s *stresser) rename(from, to *slot) error {
+	if from == to {
+		return nil
+	}
+	// Lock in a consistent order to avoid deadlocks.
+	first, second := from, to
+	if first.name > second.name {
+		first, second = second, first
+	}
+	first.mtx.Lock()
+	defer first.mtx.Unlock()
+	second.mtx.Lock()
+	defer second.mtx.Unlock()
+	err := os.Rename(from.name, to.name)
+	if err != nil {
+		if os.IsNotExist(err) && !from.exists {
+			return nil
+		}
+		return err
+	}
+	if !from.exists {
+		return fmt.Errorf("renamed %s, but it shouldn't exist", from.name)
+	}
+	to.exists = true
+	to.hash = from.hash
+	from.exists = false
+	return nil
+}
+
+func (s *stresser) delete(sl *slot) error {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	err := os.Remove(sl.name)
+	if err != nil {
+		if os.IsNotExist(err) && !sl.exists {
+			return nil
+		}
+		return err
+	}
+	if !sl.exists {
+		return errors.New("deleted a file that shouldn't exist")
+	}
+	sl.exists = false
+	return nil
+}
+
+func (s *stresser) verifyAll() {
+	for _, sl := range s.slots {
+		if err := s.verify(sl); err != nil {
+			s.fail("verify: %v", err)
+		}
+	}
+	log.Printf("Verified %d files; %d failures so far", len(s.slots), atomic.LoadInt64(&s.failures))
+}
+
+func (s *stresser) printStats() {
+	for o := op(0); o < numOps; o++ {
+		log.Printf("%-16s %d", opNames[o], atomic.LoadInt64(&s.ops[o]))
+	}
+	log.Printf("%-16s %d", "failures", atomic.LoadInt64(&s.failures))
+}
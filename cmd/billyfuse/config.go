@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/BurntSushi/toml"
+	billybazilfuse "github.com/Jille/billy-bazilfuse"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the file passed with -config, describing any number of mounts.
+type config struct {
+	Mounts []mountConfig `yaml:"mounts" toml:"mounts"`
+}
+
+// mountConfig describes one mount. Most fields mirror the flags; the others can only be set in config files.
+// The fields cleared by withoutReloadable are applied to running mounts on SIGHUP, the others need a restart.
+type mountConfig struct {
+	Name                string            `yaml:"name" toml:"name"`
+	Backend             string            `yaml:"backend" toml:"backend"`
+	Params              map[string]string `yaml:"params" toml:"params"`
+	Mountpoint          string            `yaml:"mountpoint" toml:"mountpoint"`
+	CacheMemory         int64             `yaml:"cache_memory" toml:"cache_memory"`
+	CacheDir            string            `yaml:"cache_dir" toml:"cache_dir"`
+	CacheDisk           int64             `yaml:"cache_disk" toml:"cache_disk"`
+	CacheTTL            duration          `yaml:"cache_ttl" toml:"cache_ttl"`
+	ReadAhead           int               `yaml:"read_ahead" toml:"read_ahead"`
+	MaxReadahead        uint32            `yaml:"max_readahead" toml:"max_readahead"`
+	MaxBackground       uint16            `yaml:"max_background" toml:"max_background"`
+	CongestionThreshold uint16            `yaml:"congestion_threshold" toml:"congestion_threshold"`
+	WriteBuffer         int               `yaml:"write_buffer" toml:"write_buffer"`
+	WriteJournal        string            `yaml:"write_journal" toml:"write_journal"`
+	OpLog               string            `yaml:"op_log" toml:"op_log"`
+	OpLogSample         int               `yaml:"op_log_sample" toml:"op_log_sample"`
+	OpTimeout           duration          `yaml:"op_timeout" toml:"op_timeout"`
+	StatAhead           int               `yaml:"stat_ahead" toml:"stat_ahead"`
+	LogEIO              bool              `yaml:"log_eio" toml:"log_eio"`
+	CheckReady          bool              `yaml:"check_ready" toml:"check_ready"`
+	Watch               bool              `yaml:"watch" toml:"watch"`
+	Warm                []string          `yaml:"warm" toml:"warm"`
+	WarmContent         bool              `yaml:"warm_content" toml:"warm_content"`
+
+	CacheBypass                []string       `yaml:"cache_bypass" toml:"cache_bypass"`
+	KeepCache                  []string       `yaml:"keep_cache" toml:"keep_cache"`
+	DirectIO                   []string       `yaml:"direct_io" toml:"direct_io"`
+	NoCache                    []string       `yaml:"no_cache" toml:"no_cache"`
+	PollInterval               duration       `yaml:"poll_interval" toml:"poll_interval"`
+	PollBudget                 int            `yaml:"poll_budget" toml:"poll_budget"`
+	MaxConcurrentCalls         int            `yaml:"max_concurrent_calls" toml:"max_concurrent_calls"`
+	MaxConcurrentMetadataCalls int            `yaml:"max_concurrent_metadata_calls" toml:"max_concurrent_metadata_calls"`
+	MaxConcurrentDataCalls     int            `yaml:"max_concurrent_data_calls" toml:"max_concurrent_data_calls"`
+	ControlDir                 string         `yaml:"control_dir" toml:"control_dir"`
+	MemoryBudget               int64          `yaml:"memory_budget" toml:"memory_budget"`
+	WriteBacklogHigh           int64          `yaml:"write_backlog_high" toml:"write_backlog_high"`
+	WriteBacklogLow            int64          `yaml:"write_backlog_low" toml:"write_backlog_low"`
+	MaxBackendRead             int            `yaml:"max_backend_read" toml:"max_backend_read"`
+	MaxBackendWrite            int            `yaml:"max_backend_write" toml:"max_backend_write"`
+	WriteSpillDir              string         `yaml:"write_spill_dir" toml:"write_spill_dir"`
+	WriteSpillSize             int            `yaml:"write_spill_size" toml:"write_spill_size"`
+	HotPaths                   int            `yaml:"hot_paths" toml:"hot_paths"`
+	OpLogMaxSize               int64          `yaml:"op_log_max_size" toml:"op_log_max_size"`
+	OpLogBackups               int            `yaml:"op_log_backups" toml:"op_log_backups"`
+	OpLogSampleOps             map[string]int `yaml:"op_log_sample_ops" toml:"op_log_sample_ops"`
+	OpLogSlow                  duration       `yaml:"op_log_slow" toml:"op_log_slow"`
+	ErrorAlerts                []errorAlert   `yaml:"error_alerts" toml:"error_alerts"`
+	HealthCheckInterval        duration       `yaml:"health_check_interval" toml:"health_check_interval"`
+	HealthCheckPath            string         `yaml:"health_check_path" toml:"health_check_path"`
+	TimeoutEIO                 bool           `yaml:"timeout_eio" toml:"timeout_eio"`
+	StatAheadTrigger           int            `yaml:"stat_ahead_trigger" toml:"stat_ahead_trigger"`
+	StatAheadMaxFailures       int            `yaml:"stat_ahead_max_failures" toml:"stat_ahead_max_failures"`
+	StatAheadSiblings          int            `yaml:"stat_ahead_siblings" toml:"stat_ahead_siblings"`
+	OpenAttrs                  bool           `yaml:"open_attrs" toml:"open_attrs"`
+	FallbackErrno              errno          `yaml:"fallback_errno" toml:"fallback_errno"`
+	LongOpenHandle             duration       `yaml:"long_open_handle" toml:"long_open_handle"`
+	SerializeWrites            bool           `yaml:"serialize_writes" toml:"serialize_writes"`
+	Coherence                  coherence      `yaml:"coherence" toml:"coherence"`
+	DeviceNodes                bool           `yaml:"device_nodes" toml:"device_nodes"`
+	Profile                    profile        `yaml:"profile" toml:"profile"`
+	SecurityXattrs             securityXattrs `yaml:"security_xattrs" toml:"security_xattrs"`
+	CheckPermissions           bool           `yaml:"check_permissions" toml:"check_permissions"`
+	ACLDir                     string         `yaml:"acl_dir" toml:"acl_dir"`
+	CapabilityXattr            capabilities   `yaml:"capability_xattr" toml:"capability_xattr"`
+}
+
+// withoutReloadable returns a copy of mc without the fields that can be changed while it's mounted. Warming and checking readiness only happen at startup, so changing them is ignored too.
+func (mc mountConfig) withoutReloadable() mountConfig {
+	mc.CacheTTL = 0
+	mc.CacheBypass = nil
+	mc.KeepCache = nil
+	mc.DirectIO = nil
+	mc.NoCache = nil
+	mc.PollBudget = 0
+	mc.MaxConcurrentCalls = 0
+	mc.MaxConcurrentMetadataCalls = 0
+	mc.MaxConcurrentDataCalls = 0
+	mc.Warm = nil
+	mc.WarmContent = false
+	mc.CheckReady = false
+	return mc
+}
+
+func (mc mountConfig) options() billybazilfuse.Options {
+	o := billybazilfuse.Options{
+		ReadAhead:                  mc.ReadAhead,
+		WriteBufferSize:            mc.WriteBuffer,
+		WriteJournal:               mc.WriteJournal,
+		MaxReadahead:               mc.MaxReadahead,
+		MaxBackground:              mc.MaxBackground,
+		CongestionThreshold:        mc.CongestionThreshold,
+		WatchLocal:                 mc.Watch,
+		KeepCachePaths:             mc.KeepCache,
+		DirectIOPaths:              mc.DirectIO,
+		NoCachePaths:               mc.NoCache,
+		PollInterval:               time.Duration(mc.PollInterval),
+		PollBudget:                 mc.PollBudget,
+		MaxConcurrentCalls:         mc.MaxConcurrentCalls,
+		MaxConcurrentMetadataCalls: mc.MaxConcurrentMetadataCalls,
+		MaxConcurrentDataCalls:     mc.MaxConcurrentDataCalls,
+		ControlDir:                 mc.ControlDir,
+		MemoryBudget:               mc.MemoryBudget,
+		WriteBacklogHigh:           mc.WriteBacklogHigh,
+		WriteBacklogLow:            mc.WriteBacklogLow,
+		MaxBackendRead:             mc.MaxBackendRead,
+		MaxBackendWrite:            mc.MaxBackendWrite,
+		WriteSpillDir:              mc.WriteSpillDir,
+		WriteSpillSize:             mc.WriteSpillSize,
+		HotPaths:                   mc.HotPaths,
+		OpLogFile:                  mc.OpLog,
+		OpLogMaxSize:               mc.OpLogMaxSize,
+		OpLogBackups:               mc.OpLogBackups,
+		OpLogSampling: billybazilfuse.OpLogSampling{
+			Rate:   mc.OpLogSample,
+			Rates:  mc.OpLogSampleOps,
+			Errors: true,
+			Slow:   time.Duration(mc.OpLogSlow),
+		},
+		ErrorAlerts:         mc.errorAlerts(),
+		HealthCheckInterval: time.Duration(mc.HealthCheckInterval),
+		HealthCheckPath:     mc.HealthCheckPath,
+		OpTimeout:           time.Duration(mc.OpTimeout),
+		TimeoutEIO:          mc.TimeoutEIO,
+		StatAhead: billybazilfuse.StatAhead{
+			Parallelism:    mc.StatAhead,
+			Trigger:        mc.StatAheadTrigger,
+			MaxFailures:    mc.StatAheadMaxFailures,
+			SiblingTrigger: mc.StatAheadSiblings,
+		},
+		OpenAttrs:        mc.OpenAttrs,
+		FallbackErrno:    fuse.Errno(mc.FallbackErrno),
+		LongOpenHandle:   time.Duration(mc.LongOpenHandle),
+		SerializeWrites:  mc.SerializeWrites,
+		Coherence:        mc.Coherence,
+		DeviceNodes:      mc.DeviceNodes,
+		SecurityXattrs:   mc.SecurityXattrs,
+		CheckPermissions: mc.CheckPermissions,
+		CapabilityXattr:  mc.CapabilityXattr,
+	}
+	return o.WithProfile(mc.Profile.opts)
+}
+
+// errorAlert is a billybazilfuse.ErrorAlert in a config file. When it starts or stops firing, that's logged.
+type errorAlert struct {
+	Op        string   `yaml:"op" toml:"op"`
+	Errno     string   `yaml:"errno" toml:"errno"`
+	Threshold int      `yaml:"threshold" toml:"threshold"`
+	Window    duration `yaml:"window" toml:"window"`
+}
+
+func (mc mountConfig) errorAlerts() []billybazilfuse.ErrorAlert {
+	var ret []billybazilfuse.ErrorAlert
+	for _, a := range mc.ErrorAlerts {
+		ret = append(ret, billybazilfuse.ErrorAlert{Op: a.Op, Errno: a.Errno, Threshold: a.Threshold, Window: time.Duration(a.Window)})
+	}
+	return ret
+}
+
+func (mc mountConfig) cacheConfig() billybazilfuse.CacheConfig {
+	return billybazilfuse.CacheConfig{
+		MemoryBudget: mc.CacheMemory,
+		DiskDir:      mc.CacheDir,
+		DiskBudget:   mc.CacheDisk,
+		TTL:          time.Duration(mc.CacheTTL),
+		Bypass:       mc.CacheBypass,
+	}
+}
+
+// duration is a time.Duration written like "5m" in config files.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// errno is a fuse.Errno written like "EREMOTEIO" in config files.
+type errno fuse.Errno
+
+func (e *errno) UnmarshalText(b []byte) error {
+	v, err := billybazilfuse.ParseErrno(string(b))
+	if err != nil {
+		return err
+	}
+	*e = errno(v)
+	return nil
+}
+
+// profile is a security profile written like "hardened" in config files.
+type profile struct {
+	opts billybazilfuse.Options
+}
+
+func (p *profile) UnmarshalText(b []byte) error {
+	v, err := billybazilfuse.ParseProfile(string(b))
+	if err != nil {
+		return err
+	}
+	p.opts = v
+	return nil
+}
+
+// coherence is a billybazilfuse.Coherence, written like "invalidate" in config files.
+type coherence = billybazilfuse.Coherence
+
+// securityXattrs is a billybazilfuse.SecurityXattrPolicy, written like "stub" in config files.
+type securityXattrs = billybazilfuse.SecurityXattrPolicy
+
+// capabilities is a billybazilfuse.CapabilityXattrPolicy, written like "deny" in config files.
+type capabilities = billybazilfuse.CapabilityXattrPolicy
+
+// loadConfig reads a YAML or TOML config file, depending on its extension.
+func loadConfig(fn string) (*config, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	switch filepath.Ext(fn) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(&cfg)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), &cfg)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown key %q", md.Undecoded()[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("%s: config files should end in .yaml, .yml or .toml", fn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	if len(cfg.Mounts) == 0 {
+		return nil, fmt.Errorf("%s: no mounts configured", fn)
+	}
+	seen := map[string]bool{}
+	for i := range cfg.Mounts {
+		m := &cfg.Mounts[i]
+		if m.Mountpoint == "" {
+			return nil, fmt.Errorf("%s: mount %d has no mountpoint", fn, i+1)
+		}
+		if m.Name == "" {
+			m.Name = m.Mountpoint
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("%s: duplicate mount %q", fn, m.Name)
+		}
+		seen[m.Name] = true
+		if m.CacheDisk == 0 {
+			m.CacheDisk = 1 << 30
+		}
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,193 @@
+// Binary billyfuse mounts a local directory through Billy and this adapter, with the adapter's caching options available as flags.
+// With -config, it serves any number of mounts of any backend described in a config file instead.
+// "billyfuse top <control directory>" shows what a running mount is doing.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+var (
+	cacheMemory   = flag.Int64("cache_memory", 0, "Bytes of file contents to cache in memory")
+	cacheDir      = flag.String("cache_dir", "", "Directory to cache file contents in across restarts")
+	cacheDisk     = flag.Int64("cache_disk", 1<<30, "Bytes of file contents to cache in -cache_dir")
+	cacheTTL      = flag.Duration("cache_ttl", 0, "How long cached file contents are used (0 means until the file changes)")
+	readAhead     = flag.Int("read_ahead", 0, "Bytes to prefetch when files are read sequentially")
+	maxReadahead  = flag.Uint("max_readahead", 0, "Maximum bytes the kernel reads ahead (0 for the kernel default)")
+	maxBackground = flag.Uint("max_background", 0, "Maximum background requests the kernel sends at once (0 for the kernel default)")
+	congestion    = flag.Uint("congestion_threshold", 0, "Background requests beyond which the kernel considers the mount congested (0 for the kernel default)")
+	writeBuffer   = flag.Int("write_buffer", 0, "Bytes of adjacent writes to coalesce per open file")
+	writeJournal  = flag.String("write_journal", "", "Local file to record buffered writes in, so they're replayed after a crash")
+	opLog         = flag.String("op_log", "", "File to log every operation to as JSON lines, rotated at 100 MiB")
+	opLogSample   = flag.Int("op_log_sample", 0, "Log only 1 in this many operations of each type to -op_log, plus all failed ones")
+	opTimeout     = flag.Duration("op_timeout", 0, "Fail operations that wait longer than this for the backend with ETIMEDOUT (0 means no limit)")
+	statAhead     = flag.Int("stat_ahead", 0, "Number of concurrent Stats to fetch the attributes of a directory's entries with when they're stat'ed one by one after listing it, like ls -l does (0 disables)")
+	logEIO        = flag.Bool("log_eio", false, "Log the backend error behind every operation that fails with EIO")
+	checkReady    = flag.Bool("check_ready", false, "Fail if the directory can't be read, rather than mounting it")
+	watch         = flag.Bool("watch", false, "Watch the directory for changes made outside of the mount")
+	warm          = flag.String("warm", "", "Comma separated path patterns to list and stat after mounting, to warm the backend's caches")
+	warmContent   = flag.Bool("warm_content", false, "Also read the contents of the -warm paths into the cache (needs -cache_memory or -cache_dir)")
+	configFile    = flag.String("config", "", "YAML or TOML file describing the mounts to serve, instead of the arguments")
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		runTop(os.Args[2:])
+		return
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <directory> <mountpoint>\n       %s -config <file>\n       %s top [flags] <control directory>\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var mounts []mountConfig
+	if *configFile != "" {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		mounts = cfg.Mounts
+	} else {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		mc := mountConfig{
+			Name:                flag.Arg(1),
+			Backend:             "osfs",
+			Params:              map[string]string{"path": flag.Arg(0)},
+			Mountpoint:          flag.Arg(1),
+			CacheMemory:         *cacheMemory,
+			CacheDir:            *cacheDir,
+			CacheDisk:           *cacheDisk,
+			CacheTTL:            duration(*cacheTTL),
+			ReadAhead:           *readAhead,
+			MaxReadahead:        uint32(*maxReadahead),
+			MaxBackground:       uint16(*maxBackground),
+			CongestionThreshold: uint16(*congestion),
+			WriteBuffer:         *writeBuffer,
+			WriteJournal:        *writeJournal,
+			OpLog:               *opLog,
+			OpLogSample:         *opLogSample,
+			OpTimeout:           duration(*opTimeout),
+			StatAhead:           *statAhead,
+			LogEIO:              *logEIO,
+			CheckReady:          *checkReady,
+			Watch:               *watch,
+			WarmContent:         *warmContent,
+		}
+		if *warm != "" {
+			mc.Warm = strings.Split(*warm, ",")
+		}
+		mounts = []mountConfig{mc}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	exited := make(chan *mount, len(mounts))
+	var running []*mount
+	failed := false
+	for _, mc := range mounts {
+		m, err := start(ctx, mc, exited)
+		if err != nil {
+			log.Printf("[%s] Failed to mount %q: %v", mc.Name, mc.Mountpoint, err)
+			failed = true
+			continue
+		}
+		log.Printf("[%s] Serving %s backend at %q", mc.Name, mc.Backend, mc.Mountpoint)
+		running = append(running, m)
+	}
+
+	stopping := false
+	for live := len(running); live > 0; {
+		select {
+		case <-sigs:
+			if stopping {
+				continue
+			}
+			stopping = true
+			cancel()
+			// Unmount in reverse order, so mounts nested in earlier ones are gone first.
+			for i := len(running) - 1; i >= 0; i-- {
+				m := running[i]
+				select {
+				case <-m.done:
+					continue
+				default:
+				}
+				m.unmount()
+				<-m.done
+			}
+		case <-hups:
+			if *configFile == "" {
+				log.Printf("Ignoring SIGHUP, as there is no config file to reload")
+				continue
+			}
+			reload(running)
+		case m := <-exited:
+			live--
+			m.release()
+			switch {
+			case m.err != nil:
+				log.Printf("[%s] Serve failed: %v", m.cfg.Name, m.err)
+				failed = true
+			case !stopping:
+				log.Printf("[%s] Unmounted", m.cfg.Name)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// reload reads the config file again, and applies the settings that can be changed to the running mounts.
+func reload(running []*mount) {
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Printf("Failed to reload config: %v", err)
+		return
+	}
+	byName := map[string]mountConfig{}
+	for _, mc := range cfg.Mounts {
+		byName[mc.Name] = mc
+	}
+	isRunning := map[string]bool{}
+	for _, m := range running {
+		isRunning[m.cfg.Name] = true
+	}
+	for _, mc := range cfg.Mounts {
+		if !isRunning[mc.Name] {
+			log.Printf("[%s] Not running; restart to mount it", mc.Name)
+		}
+	}
+	for _, m := range running {
+		select {
+		case <-m.done:
+			continue
+		default:
+		}
+		mc, ok := byName[m.cfg.Name]
+		if !ok {
+			log.Printf("[%s] Removed from the config; restart to unmount it", m.cfg.Name)
+			continue
+		}
+		m.reload(mc)
+	}
+}
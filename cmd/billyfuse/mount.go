@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	billybazilfuse "github.com/Jille/billy-bazilfuse"
+	"github.com/Jille/billy-bazilfuse/internal/backend"
+)
+
+// readyTimeout is how long check_ready waits for the backend to respond.
+const readyTimeout = 30 * time.Second
+
+// mount is a running mount.
+type mount struct {
+	cfg    mountConfig
+	bfs    *billybazilfuse.FS
+	cache  *billybazilfuse.TieredCache
+	closer io.Closer
+	conn   *fuse.Conn
+	// stopStats stops dumping stats on SIGUSR1.
+	stopStats func()
+
+	// done is closed when serving finished, with the error in err.
+	done chan struct{}
+	err  error
+}
+
+// start creates the backend and filesystem of a mount, mounts it and starts serving it. When serving finishes, the mount is sent to exited.
+func start(ctx context.Context, cfg mountConfig, exited chan<- *mount) (*mount, error) {
+	if cfg.WarmContent && cfg.CacheMemory <= 0 && cfg.CacheDir == "" {
+		return nil, errors.New("warm_content needs cache_memory or cache_dir")
+	}
+	b, closer, err := backend.Open(cfg.Backend, cfg.Params)
+	if err != nil {
+		return nil, err
+	}
+	m := &mount{cfg: cfg, closer: closer, done: make(chan struct{})}
+	opts := cfg.options()
+	opts.OnErrorAlert = func(a billybazilfuse.ErrorAlert, failures int, firing bool) {
+		if firing {
+			log.Printf("[%s] Alert firing: %s (%d failures)", cfg.Name, a, failures)
+		} else {
+			log.Printf("[%s] Alert resolved: %s", cfg.Name, a)
+		}
+	}
+	opts.OnUnknownError = func(op string, err error, count int64) {
+		log.Printf("[%s] Unrecognized error from %s (%d times so far): %T: %v", cfg.Name, op, count, err, err)
+	}
+	opts.OnLongOpenHandle = func(h billybazilfuse.OpenHandle) {
+		log.Printf("[%s] /%s has been open since %s (pid %d, %v)", cfg.Name, h.Path, h.Opened.Format(time.RFC3339), h.Pid, h.Flags)
+	}
+	if cfg.LogEIO {
+		opts.OnError = func(ctx context.Context, req fuse.Request, err error, errno fuse.Errno) {
+			if errno != fuse.EIO {
+				return
+			}
+			ci, _ := billybazilfuse.CallInfoFromContext(ctx)
+			log.Printf("[%s] EIO on /%s: %v", cfg.Name, ci.Path, err)
+		}
+	}
+	if cfg.CacheMemory > 0 || cfg.CacheDir != "" {
+		m.cache, err = billybazilfuse.NewTieredCache(cfg.cacheConfig())
+		if err != nil {
+			closer.Close()
+			return nil, err
+		}
+		opts.BlockCache = m.cache
+	}
+	if cfg.ACLDir != "" {
+		s, err := billybazilfuse.NewDirACLStore(cfg.ACLDir)
+		if err != nil {
+			closer.Close()
+			return nil, err
+		}
+		opts.ACLStore = s
+	}
+	m.bfs, err = billybazilfuse.NewWithOptions(b, opts)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	if cfg.CheckReady {
+		rctx, cancel := context.WithTimeout(ctx, readyTimeout)
+		err := m.bfs.CheckReady(rctx)
+		cancel()
+		if err != nil {
+			m.bfs.Close()
+			closer.Close()
+			return nil, err
+		}
+	}
+	fsName := cfg.Params["path"]
+	if fsName == "" {
+		fsName = cfg.Backend
+	}
+	m.conn, err = fuse.Mount(cfg.Mountpoint, append([]fuse.MountOption{fuse.FSName(fsName), fuse.Subtype("billyfuse")}, m.bfs.MountOptions()...)...)
+	if err != nil {
+		m.bfs.Close()
+		closer.Close()
+		return nil, err
+	}
+	m.stopStats = m.bfs.DumpStatsOnSignal(syscall.SIGUSR1, func(format string, args ...interface{}) {
+		log.Printf("[%s] "+format, append([]interface{}{cfg.Name}, args...)...)
+	})
+	go func() {
+		m.err = m.bfs.Serve(m.conn)
+		close(m.done)
+		exited <- m
+	}()
+	if len(cfg.Warm) > 0 {
+		go func() {
+			start := time.Now()
+			if err := m.bfs.Warm(ctx, cfg.Warm, cfg.WarmContent); err != nil && ctx.Err() == nil {
+				log.Printf("[%s] Warming failed: %v", cfg.Name, err)
+				return
+			}
+			log.Printf("[%s] Warming finished in %v", cfg.Name, time.Since(start))
+		}()
+	}
+	return m, nil
+}
+
+// reload applies the settings of cfg that can be changed while mounted, and logs if others differ from the ones the mount was started with.
+func (m *mount) reload(cfg mountConfig) {
+	if !reflect.DeepEqual(cfg.withoutReloadable(), m.cfg.withoutReloadable()) {
+		log.Printf("[%s] Some changes need a restart and were not applied", m.cfg.Name)
+	}
+	if err := m.bfs.Reload(cfg.options()); err != nil {
+		log.Printf("[%s] Failed to reload: %v", m.cfg.Name, err)
+		return
+	}
+	if m.cache != nil {
+		if err := m.cache.Reload(cfg.cacheConfig()); err != nil {
+			log.Printf("[%s] Failed to reload the cache: %v", m.cfg.Name, err)
+			return
+		}
+	}
+	log.Printf("[%s] Reloaded", m.cfg.Name)
+}
+
+// unmount asks the kernel to unmount the mount. Serving finishes once it's unmounted.
+func (m *mount) unmount() {
+	if err := fuse.Unmount(m.cfg.Mountpoint); err != nil {
+		log.Printf("[%s] Failed to unmount %q: %v", m.cfg.Name, m.cfg.Mountpoint, err)
+	}
+}
+
+// release waits for serving to finish and releases the connection and backend.
+func (m *mount) release() {
+	<-m.done
+	m.stopStats()
+	m.conn.Close()
+	m.bfs.Close()
+	m.closer.Close()
+}
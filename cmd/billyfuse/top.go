@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	billybazilfuse "github.com/Jille/billy-bazilfuse"
+)
+
+// runTop implements "billyfuse top": it shows what a running mount is doing by reading the stats file in its control directory, like iotop.
+func runTop(args []string) {
+	fl := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fl.Duration("interval", time.Second, "How often to refresh")
+	iterations := fl.Int("n", 0, "Number of refreshes before exiting (0 means until interrupted)")
+	fl.Usage = func() {
+		fmt.Fprintf(fl.Output(), "Usage: %s top [flags] <control directory>\n", os.Args[0])
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() != 1 || *interval <= 0 {
+		fl.Usage()
+		os.Exit(2)
+	}
+	fn := filepath.Join(fl.Arg(0), "stats")
+
+	prev, err := readStats(fn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read stats: %v\n", err)
+		os.Exit(1)
+	}
+	prevTime := time.Now()
+	for i := 0; *iterations == 0 || i < *iterations; i++ {
+		time.Sleep(*interval)
+		st, err := readStats(fn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read stats: %v\n", err)
+			os.Exit(1)
+		}
+		now := time.Now()
+		// Clear the screen and move the cursor to the top left.
+		fmt.Print("\033[H\033[2J" + renderTop(fl.Arg(0), prev, st, now.Sub(prevTime)))
+		prev, prevTime = st, now
+	}
+}
+
+func readStats(fn string) (billybazilfuse.Stats, error) {
+	var st billybazilfuse.Stats
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return st, err
+	}
+	return st, json.Unmarshal(b, &st)
+}
+
+// topRow is the activity of one type of call between two snapshots.
+type topRow struct {
+	op       string
+	inFlight int
+	calls    int64
+	latency  time.Duration
+}
+
+// renderTop formats the difference between two snapshots taken elapsed apart.
+func renderTop(dir string, prev, cur billybazilfuse.Stats, elapsed time.Duration) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s  %s  open handles: %d\n", dir, time.Now().Format("15:04:05"), cur.OpenHandles)
+	if cs := cur.Cache; cs != nil {
+		fmt.Fprintf(&sb, "cache: %d memory hits, %d disk hits, %d misses, %d bytes in memory, %d bytes on disk\n", cs.MemoryHits, cs.DiskHits, cs.Misses, cs.MemoryUsage, cs.DiskUsage)
+	}
+	if bh := cur.Backend; bh != nil && !bh.Checked.IsZero() {
+		if bh.Up {
+			fmt.Fprintf(&sb, "backend: up, last check took %v\n", bh.Latency.Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(&sb, "backend: DOWN since %s: %s\n", bh.Since.Format("15:04:05"), bh.Error)
+		}
+	}
+	for _, a := range cur.FiringAlerts {
+		fmt.Fprintf(&sb, "ALERT: %s\n", a)
+	}
+	sb.WriteString("\n")
+
+	var rows []topRow
+	for op := range unionKeys(cur.InFlight, cur.Ops) {
+		c, p := cur.Ops[op], prev.Ops[op]
+		row := topRow{op: op, inFlight: cur.InFlight[op], calls: c.Calls - p.Calls}
+		if row.calls > 0 {
+			row.latency = (c.Time - p.Time) / time.Duration(row.calls)
+		}
+		if row.inFlight == 0 && row.calls == 0 {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].inFlight != rows[j].inFlight {
+			return rows[i].inFlight > rows[j].inFlight
+		}
+		if rows[i].calls != rows[j].calls {
+			return rows[i].calls > rows[j].calls
+		}
+		return rows[i].op < rows[j].op
+	})
+	fmt.Fprintf(&sb, "%-16s %9s %10s %12s\n", "OP", "IN FLIGHT", "CALLS/S", "AVG LATENCY")
+	for _, r := range rows {
+		fmt.Fprintf(&sb, "%-16s %9d %10.1f %12v\n", r.op, r.inFlight, float64(r.calls)/elapsed.Seconds(), r.latency.Round(time.Microsecond))
+	}
+
+	if len(cur.SlowCalls) > 0 {
+		sb.WriteString("\nSLOW CALLS\n")
+		for _, c := range cur.SlowCalls {
+			state := ""
+			if c.InFlight {
+				state = " (running)"
+			}
+			fmt.Fprintf(&sb, "%-16s pid %-8d %v%s\n", c.Op, c.Pid, c.Duration.Round(time.Millisecond), state)
+		}
+	}
+	if len(cur.HotPathsByOps) > 0 {
+		sb.WriteString("\nHOT PATHS BY OPS\n")
+		for _, hp := range cur.HotPathsByOps {
+			fmt.Fprintf(&sb, "%12d /%s\n", hp.Count, hp.Path)
+		}
+	}
+	if len(cur.HotPathsByBytes) > 0 {
+		sb.WriteString("\nHOT PATHS BY BYTES\n")
+		for _, hp := range cur.HotPathsByBytes {
+			fmt.Fprintf(&sb, "%12d /%s\n", hp.Count, hp.Path)
+		}
+	}
+	return sb.String()
+}
+
+func unionKeys(inFlight map[string]int, ops map[string]billybazilfuse.OpStats) map[string]struct{} {
+	ret := map[string]struct{}{}
+	for op := range inFlight {
+		ret[op] = struct{}{}
+	}
+	for op := range ops {
+		ret[op] = struct{}{}
+	}
+	return ret
+}
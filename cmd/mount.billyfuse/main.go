@@ -0,0 +1,354 @@
+// Binary mount.billyfuse is a mount(8) helper, so Billy filesystems can be mounted from fstab and systemd mount units:
+//
+//	sftp:me@example.com:/srv/data  /mnt/data  billyfuse  key=/root/.ssh/id_ed25519,_netdev  0 0
+//
+// The device is <type>:<argument>. The argument is the directory for osfs, [user@]host:path for sftp, and ignored for memfs.
+// Options are backend parameters (overriding those from the device), caching options and the usual mount options.
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	billybazilfuse "github.com/Jille/billy-bazilfuse"
+	"github.com/Jille/billy-bazilfuse/internal/backend"
+)
+
+// daemonEnv is set in the environment of the background process that serves the mount.
+const daemonEnv = "BILLYFUSE_MOUNT_DAEMON"
+
+// readyTimeout is how long the option check_ready waits for the backend to respond.
+const readyTimeout = 30 * time.Second
+
+// ignoredOptions are handled by mount(8) itself, or only mean something to fstab and systemd.
+var ignoredOptions = map[string]bool{
+	"defaults": true, "rw": true, "auto": true, "noauto": true, "user": true, "nouser": true, "users": true, "owner": true, "group": true,
+	"_netdev": true, "nofail": true, "dev": true, "nodev": true, "suid": true, "nosuid": true, "exec": true, "noexec": true,
+	"atime": true, "noatime": true, "relatime": true, "norelatime": true, "strictatime": true, "lazytime": true, "nolazytime": true,
+}
+
+var backendParams = map[string]bool{"host": true, "user": true, "password": true, "key": true, "known_hosts": true, "path": true}
+
+type mountConfig struct {
+	device     string
+	mountpoint string
+	typ        string
+	params     map[string]string
+	opts       billybazilfuse.Options
+	cache      billybazilfuse.CacheConfig
+	mountOpts  []fuse.MountOption
+	checkReady bool
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mount.billyfuse: ")
+	cfg, fake, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount.billyfuse: %v\nUsage: mount.billyfuse <type>:<argument> <mountpoint> [-fnsv] [-o options]\n", err)
+		os.Exit(1)
+	}
+	if fake {
+		return
+	}
+	if os.Getenv(daemonEnv) != "" {
+		serve(cfg)
+		return
+	}
+	os.Exit(spawn())
+}
+
+// parseArgs parses the arguments mount(8) passes to helpers: the device, the mountpoint and then flags.
+func parseArgs(args []string) (*mountConfig, bool, error) {
+	var positional []string
+	var options []string
+	fake, sloppy := false, false
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			positional = append(positional, a)
+			continue
+		}
+		switch a {
+		case "-o":
+			if i+1 == len(args) {
+				return nil, false, fmt.Errorf("-o needs an argument")
+			}
+			i++
+			options = append(options, strings.Split(args[i], ",")...)
+		case "-t", "-N":
+			// The type is implied, and mount namespaces are entered by mount(8).
+			i++
+		default:
+			for _, c := range a[1:] {
+				switch c {
+				case 'f':
+					fake = true
+				case 's':
+					sloppy = true
+				case 'n', 'v':
+				default:
+					return nil, false, fmt.Errorf("unknown flag -%c", c)
+				}
+			}
+		}
+	}
+	if len(positional) != 2 {
+		return nil, false, fmt.Errorf("need a device and a mountpoint")
+	}
+	cfg := &mountConfig{
+		device:     positional[0],
+		mountpoint: positional[1],
+		params:     map[string]string{},
+	}
+	if err := cfg.parseDevice(); err != nil {
+		return nil, false, err
+	}
+	for _, o := range options {
+		if err := cfg.parseOption(o); err != nil {
+			if sloppy {
+				continue
+			}
+			return nil, false, err
+		}
+	}
+	if cfg.cache.DiskDir != "" && cfg.cache.DiskBudget == 0 {
+		cfg.cache.DiskBudget = 1 << 30
+	}
+	return cfg, fake, nil
+}
+
+func (cfg *mountConfig) parseDevice() error {
+	typ, arg, _ := strings.Cut(cfg.device, ":")
+	cfg.typ = typ
+	switch typ {
+	case "memfs":
+	case "osfs":
+		cfg.params["path"] = arg
+	case "sftp":
+		hostPart, p, ok := strings.Cut(arg, ":")
+		if !ok {
+			return fmt.Errorf("sftp device should look like sftp:[user@]host:path, not %q", cfg.device)
+		}
+		if user, host, ok := strings.Cut(hostPart, "@"); ok {
+			cfg.params["user"] = user
+			hostPart = host
+		}
+		cfg.params["host"] = hostPart
+		cfg.params["path"] = p
+	default:
+		return fmt.Errorf("unknown backend type %q (supported: %s)", typ, strings.Join(backend.Types, ", "))
+	}
+	return nil
+}
+
+func (cfg *mountConfig) parseOption(o string) error {
+	k, v, hasValue := strings.Cut(o, "=")
+	if backendParams[k] && hasValue {
+		cfg.params[k] = v
+		return nil
+	}
+	if ignoredOptions[k] || strings.HasPrefix(k, "x-") || k == "comment" || k == "" {
+		return nil
+	}
+	switch k {
+	case "ro":
+		cfg.opts.ReadOnly = true
+		return nil
+	case "allow_other":
+		cfg.mountOpts = append(cfg.mountOpts, fuse.AllowOther())
+		return nil
+	case "default_permissions":
+		cfg.mountOpts = append(cfg.mountOpts, fuse.DefaultPermissions())
+		return nil
+	case "check_ready":
+		cfg.checkReady = true
+		return nil
+	case "timeout_eio":
+		cfg.opts.TimeoutEIO = true
+		return nil
+	case "open_attrs":
+		cfg.opts.OpenAttrs = true
+		return nil
+	case "serialize_writes":
+		cfg.opts.SerializeWrites = true
+		return nil
+	case "device_nodes":
+		cfg.opts.DeviceNodes = true
+		return nil
+	case "check_permissions":
+		cfg.opts.CheckPermissions = true
+		return nil
+	}
+	if !hasValue {
+		return fmt.Errorf("unknown option %q", k)
+	}
+	var err error
+	switch k {
+	case "read_ahead":
+		cfg.opts.ReadAhead, err = strconv.Atoi(v)
+	case "write_buffer":
+		cfg.opts.WriteBufferSize, err = strconv.Atoi(v)
+	case "write_journal":
+		cfg.opts.WriteJournal = v
+	case "op_log":
+		cfg.opts.OpLogFile = v
+	case "op_log_sample":
+		cfg.opts.OpLogSampling.Rate, err = strconv.Atoi(v)
+		cfg.opts.OpLogSampling.Errors = true
+	case "stat_ahead":
+		cfg.opts.StatAhead.Parallelism, err = strconv.Atoi(v)
+	case "stat_ahead_siblings":
+		cfg.opts.StatAhead.SiblingTrigger, err = strconv.Atoi(v)
+	case "coherence":
+		err = cfg.opts.Coherence.UnmarshalText([]byte(v))
+	case "acl_dir":
+		var s *billybazilfuse.DirACLStore
+		s, err = billybazilfuse.NewDirACLStore(v)
+		cfg.opts.ACLStore = s
+	case "security_xattrs":
+		err = cfg.opts.SecurityXattrs.UnmarshalText([]byte(v))
+	case "capability_xattr":
+		err = cfg.opts.CapabilityXattr.UnmarshalText([]byte(v))
+	case "profile":
+		var p billybazilfuse.Options
+		p, err = billybazilfuse.ParseProfile(v)
+		cfg.opts = cfg.opts.WithProfile(p)
+	case "fallback_errno":
+		cfg.opts.FallbackErrno, err = billybazilfuse.ParseErrno(v)
+	case "op_timeout":
+		cfg.opts.OpTimeout, err = time.ParseDuration(v)
+	case "max_readahead":
+		var n uint64
+		n, err = strconv.ParseUint(v, 10, 32)
+		cfg.opts.MaxReadahead = uint32(n)
+	case "max_background":
+		var n uint64
+		n, err = strconv.ParseUint(v, 10, 16)
+		cfg.opts.MaxBackground = uint16(n)
+	case "congestion_threshold":
+		var n uint64
+		n, err = strconv.ParseUint(v, 10, 16)
+		cfg.opts.CongestionThreshold = uint16(n)
+	case "cache_memory":
+		cfg.cache.MemoryBudget, err = strconv.ParseInt(v, 10, 64)
+	case "cache_dir":
+		cfg.cache.DiskDir = v
+	case "cache_disk":
+		cfg.cache.DiskBudget, err = strconv.ParseInt(v, 10, 64)
+	default:
+		return fmt.Errorf("unknown option %q", k)
+	}
+	if err != nil {
+		return fmt.Errorf("option %s: %v", k, err)
+	}
+	return nil
+}
+
+// spawn starts the background process that serves the mount, and waits until it reports whether mounting succeeded. It returns the exit code.
+func spawn() int {
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	w.Close()
+	status, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Print(err)
+		return 1
+	}
+	if status != "ok\n" {
+		if status == "" {
+			status = "serving process exited\n"
+		}
+		fmt.Fprint(os.Stderr, "mount.billyfuse: ", status)
+		return 1
+	}
+	cmd.Process.Release()
+	return 0
+}
+
+// serve mounts the filesystem and serves it until it is unmounted. It reports whether mounting succeeded on file descriptor 3.
+func serve(cfg *mountConfig) {
+	status := os.NewFile(3, "status")
+	if l, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "mount.billyfuse"); err == nil {
+		log.SetOutput(l)
+		log.SetPrefix("")
+	}
+	fail := func(format string, args ...interface{}) {
+		fmt.Fprintf(status, format+"\n", args...)
+		os.Exit(1)
+	}
+	if cfg.cache.MemoryBudget > 0 || cfg.cache.DiskDir != "" {
+		cache, err := billybazilfuse.NewTieredCache(cfg.cache)
+		if err != nil {
+			fail("failed to create cache: %v", err)
+		}
+		cfg.opts.BlockCache = cache
+	}
+	b, closer, err := backend.Open(cfg.typ, cfg.params)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer closer.Close()
+	bfs, err := billybazilfuse.NewWithOptions(b, cfg.opts)
+	if err != nil {
+		fail("failed to create filesystem: %v", err)
+	}
+	defer bfs.Close()
+	if cfg.checkReady {
+		ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+		err := bfs.CheckReady(ctx)
+		cancel()
+		if err != nil {
+			fail("%v", err)
+		}
+	}
+	opts := append([]fuse.MountOption{fuse.FSName(cfg.device), fuse.Subtype("billyfuse")}, cfg.mountOpts...)
+	c, err := fuse.Mount(cfg.mountpoint, append(opts, bfs.MountOptions()...)...)
+	if err != nil {
+		fail("failed to mount %q: %v", cfg.mountpoint, err)
+	}
+	defer c.Close()
+	fmt.Fprintln(status, "ok")
+	status.Close()
+	defer bfs.DumpStatsOnSignal(syscall.SIGUSR1, log.Printf)()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		if err := fuse.Unmount(cfg.mountpoint); err != nil {
+			log.Printf("Failed to unmount %q: %v", cfg.mountpoint, err)
+		}
+	}()
+	if err := bfs.Serve(c); err != nil {
+		log.Printf("Serving %q failed: %v", cfg.mountpoint, err)
+	}
+}
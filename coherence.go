@@ -0,0 +1,62 @@
+package billybazilfuse
+
+import (
+	"fmt"
+
+	"bazil.org/fuse"
+)
+
+// Coherence picks how the kernel's page cache is used for file contents. That decides whether mmap works, and how soon processes see changes made to the backend outside of the mount.
+// Workloads that mmap files (like sqlite and linkers) need CloseToOpen or Invalidate.
+type Coherence int
+
+const (
+	// CloseToOpen caches the contents of a file in the page cache while it's open and drops them when it's opened again, like NFS does, except for KeepCachePaths and DirectIOPaths. mmap works, but a process that keeps a file open (or mapped) doesn't see changes made outside of the mount.
+	CloseToOpen Coherence = iota
+	// DirectIO opens all files (except KeepCachePaths) with direct I/O, so every read and write goes to the backend and is always coherent with changes made outside of the mount. mmap isn't supported on such files, and fails.
+	DirectIO
+	// Invalidate keeps the page cache across opens (except for DirectIOPaths and NoCachePaths), and drops the cached contents of a file when a change to it is noticed, through a Watcher, WatchLocal or PollInterval. mmap works, and open and mapped files see changes once they're noticed.
+	// NewWithOptions fails if none of those is available.
+	Invalidate
+)
+
+// String returns the name of c, like "close_to_open".
+func (c Coherence) String() string {
+	switch c {
+	case CloseToOpen:
+		return "close_to_open"
+	case DirectIO:
+		return "direct_io"
+	case Invalidate:
+		return "invalidate"
+	}
+	return fmt.Sprintf("Coherence(%d)", int(c))
+}
+
+// UnmarshalText parses the name of a Coherence, as returned by String.
+func (c *Coherence) UnmarshalText(b []byte) error {
+	for _, v := range []Coherence{CloseToOpen, DirectIO, Invalidate} {
+		if string(b) == v.String() {
+			*c = v
+			return nil
+		}
+	}
+	return fmt.Errorf("billy-bazilfuse: unknown coherence %q", b)
+}
+
+// coherenceFlags returns the flags of the response to opening a file that doesn't match any of the path patterns of Options.
+func (r *FS) coherenceFlags() fuse.OpenResponseFlags {
+	switch r.coherence {
+	case DirectIO:
+		return fuse.OpenDirectIO
+	case Invalidate:
+		return fuse.OpenKeepCache
+	}
+	return 0
+}
+
+// noticesChanges returns whether the filesystem learns about changes made outside of the mount, as Invalidate needs.
+func (r *FS) noticesChanges() bool {
+	_, ok := r.underlying.(Watcher)
+	return ok || r.localDir != "" || r.poller != nil
+}
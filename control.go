@@ -0,0 +1,278 @@
+package billybazilfuse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// controlXattrPrefix is the prefix of the extended attributes of the control file holding settings.
+const controlXattrPrefix = "user.billyfuse."
+
+// controlSetting is a setting that can be changed through the control file.
+type controlSetting struct {
+	get func(o *Options) string
+	set func(o *Options, v string) error
+}
+
+func intSetting(field func(o *Options) *int) controlSetting {
+	return controlSetting{
+		get: func(o *Options) string {
+			return strconv.Itoa(*field(o))
+		},
+		set: func(o *Options, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fuse.Errno(syscall.EINVAL)
+			}
+			*field(o) = n
+			return nil
+		},
+	}
+}
+
+// patternsSetting is a comma separated list of patterns.
+func patternsSetting(field func(o *Options) *[]string) controlSetting {
+	return controlSetting{
+		get: func(o *Options) string {
+			return strings.Join(*field(o), ",")
+		},
+		set: func(o *Options, v string) error {
+			var patterns []string
+			if v != "" {
+				patterns = strings.Split(v, ",")
+			}
+			if validatePatterns(patterns) != nil {
+				return fuse.Errno(syscall.EINVAL)
+			}
+			*field(o) = patterns
+			return nil
+		},
+	}
+}
+
+var controlSettings = map[string]controlSetting{
+	"max_concurrent_calls":          intSetting(func(o *Options) *int { return &o.MaxConcurrentCalls }),
+	"max_concurrent_metadata_calls": intSetting(func(o *Options) *int { return &o.MaxConcurrentMetadataCalls }),
+	"max_concurrent_data_calls":     intSetting(func(o *Options) *int { return &o.MaxConcurrentDataCalls }),
+	"poll_budget":                   intSetting(func(o *Options) *int { return &o.PollBudget }),
+	"keep_cache_paths":              patternsSetting(func(o *Options) *[]string { return &o.KeepCachePaths }),
+	"direct_io_paths":               patternsSetting(func(o *Options) *[]string { return &o.DirectIOPaths }),
+	"no_cache_paths":                patternsSetting(func(o *Options) *[]string { return &o.NoCachePaths }),
+}
+
+// controlDir is the virtual directory named by Options.ControlDir.
+// Calls on it and its file don't go through the CallHook or the concurrency limits, so the limits can be fixed while the backend is saturated.
+type controlDir struct {
+	root *FS
+}
+
+var _ fs.Node = &controlDir{}
+var _ fs.NodeStringLookuper = &controlDir{}
+var _ fs.HandleReadDirAller = &controlDir{}
+
+func (d *controlDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0555
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	return nil
+}
+
+func (d *controlDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	switch name {
+	case "ctl":
+		return &controlFile{d.root}, nil
+	case "stats":
+		return &statusFile{d.root.statsJSON}, nil
+	case "health":
+		return &statusFile{d.root.healthText}, nil
+	case "hot":
+		if d.root.hot != nil {
+			return &statusFile{d.root.hotPathsText}, nil
+		}
+	case "handles":
+		return &statusFile{d.root.handlesText}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *controlDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	ret := []fuse.Dirent{{Name: "ctl", Type: fuse.DT_File}, {Name: "stats", Type: fuse.DT_File}, {Name: "health", Type: fuse.DT_File}, {Name: "handles", Type: fuse.DT_File}}
+	if d.root.hot != nil {
+		ret = append(ret, fuse.Dirent{Name: "hot", Type: fuse.DT_File})
+	}
+	return ret, nil
+}
+
+// controlFile is the file ctl in the control directory. Its extended attributes are the settings, and its content lists them.
+type controlFile struct {
+	root *FS
+}
+
+var _ fs.Node = &controlFile{}
+var _ fs.NodeOpener = &controlFile{}
+var _ fs.HandleReadAller = &controlFile{}
+var _ fs.NodeGetxattrer = &controlFile{}
+var _ fs.NodeListxattrer = &controlFile{}
+var _ fs.NodeSetxattrer = &controlFile{}
+var _ fs.NodeRemovexattrer = &controlFile{}
+
+func (f *controlFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = 0644
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	return nil
+}
+
+func (f *controlFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	// The file claims to be empty, so the kernel has to be told to read it anyway.
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+func (f *controlFile) ReadAll(ctx context.Context) ([]byte, error) {
+	f.root.settingsMtx.Lock()
+	defer f.root.settingsMtx.Unlock()
+	names := make([]string, 0, len(controlSettings))
+	for name := range controlSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s=%s\n", name, controlSettings[name].get(&f.root.settings))
+	}
+	return []byte(sb.String()), nil
+}
+
+func (f *controlFile) setting(name string) (controlSetting, bool) {
+	if !strings.HasPrefix(name, controlXattrPrefix) {
+		return controlSetting{}, false
+	}
+	s, ok := controlSettings[strings.TrimPrefix(name, controlXattrPrefix)]
+	return s, ok
+}
+
+func (f *controlFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	s, ok := f.setting(req.Name)
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	f.root.settingsMtx.Lock()
+	defer f.root.settingsMtx.Unlock()
+	resp.Xattr = []byte(s.get(&f.root.settings))
+	return nil
+}
+
+func (f *controlFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	names := make([]string, 0, len(controlSettings))
+	for name := range controlSettings {
+		names = append(names, controlXattrPrefix+name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	return nil
+}
+
+func (f *controlFile) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if req.Uid != 0 && req.Uid != uint32(os.Getuid()) {
+		return fuse.EPERM
+	}
+	s, ok := f.setting(req.Name)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	f.root.settingsMtx.Lock()
+	defer f.root.settingsMtx.Unlock()
+	opts := f.root.settings
+	if err := s.set(&opts, string(req.Xattr)); err != nil {
+		return err
+	}
+	return convertError(f.root.reloadLocked(opts))
+}
+
+func (f *controlFile) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if _, ok := f.setting(req.Name); ok {
+		return fuse.EPERM
+	}
+	return fuse.ErrNoXattr
+}
+
+// statusFile is a read-only file in the control directory whose content is generated when it's read.
+type statusFile struct {
+	content func() ([]byte, error)
+}
+
+var _ fs.Node = &statusFile{}
+var _ fs.NodeOpener = &statusFile{}
+var _ fs.HandleReadAller = &statusFile{}
+
+func (f *statusFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = 0444
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	return nil
+}
+
+func (f *statusFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	// The file claims to be empty, so the kernel has to be told to read it anyway.
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+func (f *statusFile) ReadAll(ctx context.Context) ([]byte, error) {
+	return f.content()
+}
+
+// statsJSON is the content of the file stats in the control directory: the Stats encoded as JSON.
+func (r *FS) statsJSON() ([]byte, error) {
+	b, err := json.Marshal(r.Stats())
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// healthText is the content of the file health in the control directory: "ok", or "unhealthy" followed by the reasons, one per line.
+func (r *FS) healthText() ([]byte, error) {
+	var reasons []string
+	if r.backendDown() {
+		bh := r.health.get()
+		reasons = append(reasons, fmt.Sprintf("backend down since %s: %s", bh.Since.Format(time.RFC3339), bh.Error))
+	}
+	for _, a := range r.alerts.firing() {
+		reasons = append(reasons, fmt.Sprintf("alert firing: %s", a))
+	}
+	if len(reasons) == 0 {
+		return []byte("ok\n"), nil
+	}
+	return []byte("unhealthy\n" + strings.Join(reasons, "\n") + "\n"), nil
+}
+
+// hotPathsText is the content of the file hot in the control directory. It lists the paths with the most operations and then those with the most bytes, one per line with the count in front.
+func (r *FS) hotPathsText() ([]byte, error) {
+	ops, bytes := r.hot.top()
+	var sb strings.Builder
+	for _, hp := range ops {
+		fmt.Fprintf(&sb, "ops %d /%s\n", hp.Count, hp.Path)
+	}
+	for _, hp := range bytes {
+		fmt.Fprintf(&sb, "bytes %d /%s\n", hp.Count, hp.Path)
+	}
+	return []byte(sb.String()), nil
+}
@@ -0,0 +1,20 @@
+package billybazilfuse
+
+import "github.com/go-git/go-billy/v5"
+
+// Copier can be implemented by backends that can copy data between files without it passing through this process, like a server-side copy of a remote store.
+// It serves copy_file_range(2), which cp and Go's io.Copy use when copying between files. Backends without it (or returning ENOTSUP or ENOSYS) get the data read and written instead.
+// bazil.org/fuse doesn't support copy_file_range, so with this package's FS the kernel reads and writes the data itself; the gofuse frontend uses Copier.
+type Copier interface {
+	// CopyRange copies up to n bytes from src at srcOff to dst at dstOff, and returns the number of bytes copied. src and dst were opened on the backend implementing Copier.
+	// It returns less than n only if src ends first.
+	CopyRange(dst billy.File, dstOff int64, src billy.File, srcOff int64, n int64) (int64, error)
+}
+
+// Cloner can be implemented by backends that can clone data cheaply, by letting files share storage (like snapshot-capable stores and reflinks).
+// The kernel handles the FICLONE and FICLONERANGE ioctls itself and doesn't pass them on to FUSE filesystems, so clones are made for copy_file_range(2), which cp --reflink=auto falls back to. Cloner is tried before Copier.
+type Cloner interface {
+	// CloneRange makes up to n bytes of dst at dstOff share the storage of src at srcOff, and returns the number of bytes cloned. src and dst were opened on the backend implementing Cloner.
+	// It returns less than n only if src ends first. Backends return ENOTSUP for ranges they can't clone (like unaligned ones), in which case the data is copied instead.
+	CloneRange(dst billy.File, dstOff int64, src billy.File, srcOff int64, n int64) (int64, error)
+}
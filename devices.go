@@ -0,0 +1,36 @@
+package billybazilfuse
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// isDevice returns whether mode is a character or block device.
+func isDevice(mode os.FileMode) bool {
+	return mode&os.ModeDevice != 0
+}
+
+// deviceNumber returns the device number of the device node fi describes, as the kernel expects it in attributes.
+func deviceNumber(fi os.FileInfo) (uint32, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return encodeDevice(uint64(st.Rdev)), true
+}
+
+// mknodDevice creates the device node p in the local directory the backend is stored in, with the device number rdev from the kernel.
+func (r *FS) mknodDevice(p string, mode os.FileMode, rdev uint32) error {
+	m := uint32(mode.Perm())
+	if mode&os.ModeCharDevice != 0 {
+		m |= syscall.S_IFCHR
+	} else {
+		m |= syscall.S_IFBLK
+	}
+	fn := filepath.Join(r.deviceDir, filepath.FromSlash(p))
+	if err := mknod(fn, m, decodeDevice(rdev)); err != nil {
+		return &os.PathError{Op: "mknod", Path: p, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package billybazilfuse
+
+import "golang.org/x/sys/unix"
+
+// encodeDevice converts a device number from stat(2) to the encoding FUSE uses. FreeBSD passes them unchanged.
+func encodeDevice(dev uint64) uint32 {
+	return uint32(dev)
+}
+
+// decodeDevice converts a device number from FUSE to the encoding mknod(2) uses.
+func decodeDevice(rdev uint32) uint64 {
+	return uint64(rdev)
+}
+
+func mknod(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, dev)
+}
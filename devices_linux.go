@@ -0,0 +1,18 @@
+package billybazilfuse
+
+import "golang.org/x/sys/unix"
+
+// encodeDevice converts a device number from stat(2) to the encoding FUSE uses.
+func encodeDevice(dev uint64) uint32 {
+	major, minor := unix.Major(dev), unix.Minor(dev)
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
+
+// decodeDevice converts a device number from FUSE to the encoding mknod(2) uses.
+func decodeDevice(rdev uint32) uint64 {
+	return unix.Mkdev((rdev&0xfff00)>>8, rdev&0xff|(rdev>>12)&0xfff00)
+}
+
+func mknod(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, int(dev))
+}
@@ -0,0 +1,47 @@
+package billybazilfuse
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// dirMtimes remembers when directories were last changed through the mount, for backends that don't update the modification time of directories.
+type dirMtimes struct {
+	mtx     sync.Mutex
+	changed map[string]time.Time
+}
+
+func newDirMtimes() *dirMtimes {
+	return &dirMtimes{changed: map[string]time.Time{}}
+}
+
+func (dm *dirMtimes) touch(dir string) {
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	dm.changed[dir] = time.Now()
+}
+
+// forgetTree forgets p and everything below it, after it was renamed.
+func (dm *dirMtimes) forgetTree(p string) {
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	for d := range dm.changed {
+		if d == p || strings.HasPrefix(d, p+"/") {
+			delete(dm.changed, d)
+		}
+	}
+}
+
+// apply reports the time dir was last changed through the mount, if that's later than what the backend reports.
+func (dm *dirMtimes) apply(dir string, attr *fuse.Attr) {
+	dm.mtx.Lock()
+	t, ok := dm.changed[dir]
+	dm.mtx.Unlock()
+	if ok && t.After(attr.Mtime) {
+		attr.Mtime = t
+		attr.Ctime = t
+	}
+}
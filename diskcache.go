@@ -0,0 +1,314 @@
+package billybazilfuse
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DiskCache is a BlockCache that stores blocks in a local directory, so they survive restarts of the process.
+//
+// Blocks are stored by the hash of their contents in blocks/, and keys/ maps the hash of every BlockKey to the hash of its contents.
+// Blocks are verified against their hash when they're read. The least recently used blocks are removed when the budget is exceeded.
+// Invalidate only knows about blocks cached by this process; blocks from earlier runs are only used if the file still has the same size and modification time.
+type DiskCache struct {
+	dir    string
+	budget int64
+	ttl    atomic.Int64 // a time.Duration
+
+	mtx    sync.Mutex
+	used   int64
+	lru    *list.List // of *diskCacheBlock, most recently used first
+	blocks map[string]*list.Element
+	// keys and byPath index the keys written by this process, so Invalidate can find them. Keys are dropped with the block they point to.
+	keys   map[string]diskCacheKey        // key hash -> key
+	byPath map[string]map[string]struct{} // path -> key hashes
+}
+
+type diskCacheBlock struct {
+	hash string
+	size int64
+	// keys are the hashes of the keys written by this process that point to this block.
+	keys map[string]struct{}
+}
+
+type diskCacheKey struct {
+	path  string
+	block string
+}
+
+var _ BlockCache = &DiskCache{}
+
+// NewDiskCache creates a DiskCache in dir, which is created if needed, holding at most budget bytes of blocks.
+func NewDiskCache(dir string, budget int64) (*DiskCache, error) {
+	for _, d := range []string{"blocks", "keys"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+	c := &DiskCache{
+		dir:    dir,
+		budget: budget,
+		lru:    list.New(),
+		blocks: map[string]*list.Element{},
+		keys:   map[string]diskCacheKey{},
+		byPath: map[string]map[string]struct{}{},
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "blocks"))
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		diskCacheBlock
+		mtime time.Time
+	}
+	var blocks []existing
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			// Left behind by a crash during Put.
+			os.Remove(filepath.Join(dir, "blocks", e.Name()))
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		blocks = append(blocks, existing{diskCacheBlock{hash: e.Name(), size: fi.Size()}, fi.ModTime()})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].mtime.After(blocks[j].mtime)
+	})
+	for _, b := range blocks {
+		b := b.diskCacheBlock
+		c.blocks[b.hash] = c.lru.PushBack(&b)
+		c.used += b.size
+	}
+	c.mtx.Lock()
+	c.evictLocked()
+	c.mtx.Unlock()
+	c.removeDanglingKeys()
+	return c, nil
+}
+
+// removeDanglingKeys removes key files that refer to blocks that no longer exist.
+func (c *DiskCache) removeDanglingKeys() {
+	entries, err := os.ReadDir(filepath.Join(c.dir, "keys"))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		hash, err := os.ReadFile(c.keyFile(e.Name()))
+		if err == nil && !strings.HasPrefix(e.Name(), ".tmp-") {
+			if _, ok := c.blocks[string(hash)]; ok {
+				continue
+			}
+		}
+		os.Remove(c.keyFile(e.Name()))
+	}
+}
+
+func hashKey(key BlockKey) string {
+	h := sha256.New()
+	h.Write([]byte(key.Path))
+	var buf [25]byte
+	binary.BigEndian.PutUint64(buf[1:], uint64(key.Size))
+	binary.BigEndian.PutUint64(buf[9:], uint64(key.ModTime.UnixNano()))
+	binary.BigEndian.PutUint64(buf[17:], uint64(key.Block))
+	h.Write(buf[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *DiskCache) keyFile(kh string) string {
+	return filepath.Join(c.dir, "keys", kh)
+}
+
+func (c *DiskCache) blockFile(hash string) string {
+	return filepath.Join(c.dir, "blocks", hash)
+}
+
+func (c *DiskCache) Get(key BlockKey) ([]byte, bool) {
+	kh := hashKey(key)
+	if ttl := time.Duration(c.ttl.Load()); ttl > 0 {
+		fi, err := os.Stat(c.keyFile(kh))
+		if err != nil {
+			return nil, false
+		}
+		if time.Since(fi.ModTime()) > ttl {
+			c.removeKey(kh)
+			return nil, false
+		}
+	}
+	hash, err := os.ReadFile(c.keyFile(kh))
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.blockFile(string(hash)))
+	if err != nil {
+		c.removeKey(kh)
+		return nil, false
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != string(hash) {
+		c.removeBlock(string(hash))
+		c.removeKey(kh)
+		return nil, false
+	}
+	c.mtx.Lock()
+	if e, ok := c.blocks[string(hash)]; ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mtx.Unlock()
+	// Remember recent use across restarts.
+	now := time.Now()
+	os.Chtimes(c.blockFile(string(hash)), now, now)
+	return data, true
+}
+
+func (c *DiskCache) Put(key BlockKey, data []byte) {
+	if int64(len(data)) > c.budget {
+		return
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	c.mtx.Lock()
+	_, exists := c.blocks[hash]
+	c.mtx.Unlock()
+	if !exists {
+		if err := writeFileAtomic(c.blockFile(hash), data); err != nil {
+			return
+		}
+		c.mtx.Lock()
+		if _, ok := c.blocks[hash]; !ok {
+			c.blocks[hash] = c.lru.PushFront(&diskCacheBlock{hash: hash, size: int64(len(data))})
+			c.used += int64(len(data))
+		}
+		c.mtx.Unlock()
+	}
+	kh := hashKey(key)
+	if err := writeFileAtomic(c.keyFile(kh), []byte(hash)); err != nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.blocks[hash]
+	if !ok {
+		// Evicted in the meantime.
+		os.Remove(c.keyFile(kh))
+		return
+	}
+	c.forgetKeyLocked(kh)
+	b := e.Value.(*diskCacheBlock)
+	if b.keys == nil {
+		b.keys = map[string]struct{}{}
+	}
+	b.keys[kh] = struct{}{}
+	c.keys[kh] = diskCacheKey{key.Path, hash}
+	if c.byPath[key.Path] == nil {
+		c.byPath[key.Path] = map[string]struct{}{}
+	}
+	c.byPath[key.Path][kh] = struct{}{}
+	c.evictLocked()
+}
+
+func (c *DiskCache) Invalidate(path string) {
+	c.mtx.Lock()
+	var khs []string
+	for kh := range c.byPath[path] {
+		khs = append(khs, kh)
+		c.forgetKeyLocked(kh)
+	}
+	c.mtx.Unlock()
+	for _, kh := range khs {
+		os.Remove(c.keyFile(kh))
+	}
+}
+
+// removeKey removes the key file kh.
+func (c *DiskCache) removeKey(kh string) {
+	c.mtx.Lock()
+	c.forgetKeyLocked(kh)
+	c.mtx.Unlock()
+	os.Remove(c.keyFile(kh))
+}
+
+// forgetKeyLocked removes kh from the index of keys written by this process.
+func (c *DiskCache) forgetKeyLocked(kh string) {
+	k, ok := c.keys[kh]
+	if !ok {
+		return
+	}
+	delete(c.keys, kh)
+	if m := c.byPath[k.path]; m != nil {
+		delete(m, kh)
+		if len(m) == 0 {
+			delete(c.byPath, k.path)
+		}
+	}
+	if e, ok := c.blocks[k.block]; ok {
+		delete(e.Value.(*diskCacheBlock).keys, kh)
+	}
+}
+
+// dropBlockLocked removes b, which is no longer in the LRU, and the keys written by this process that point to it.
+func (c *DiskCache) dropBlockLocked(b *diskCacheBlock) {
+	delete(c.blocks, b.hash)
+	c.used -= b.size
+	for kh := range b.keys {
+		c.forgetKeyLocked(kh)
+		os.Remove(c.keyFile(kh))
+	}
+	os.Remove(c.blockFile(b.hash))
+}
+
+// usage returns the number of bytes cached.
+func (c *DiskCache) usage() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.used
+}
+
+func (c *DiskCache) evictLocked() {
+	for c.used > c.budget {
+		// Key files from earlier runs pointing to this block are cleaned up when they're next used.
+		c.dropBlockLocked(c.lru.Remove(c.lru.Back()).(*diskCacheBlock))
+	}
+}
+
+func (c *DiskCache) removeBlock(hash string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.blocks[hash]; ok {
+		c.dropBlockLocked(c.lru.Remove(e).(*diskCacheBlock))
+		return
+	}
+	os.Remove(c.blockFile(hash))
+}
+
+// writeFileAtomic writes a file through a temporary file, so readers never see a partially written file.
+func writeFileAtomic(fn string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fn), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fn); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package billybazilfuse
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// NameEncoding translates between the (UTF-8) names the kernel sees and the names on the backend.
+type NameEncoding interface {
+	// Encode converts a name from the kernel into the name on the backend.
+	Encode(name string) (string, error)
+	// Decode converts a name from the backend into the name presented to the kernel.
+	Decode(name string) string
+}
+
+// CharmapNameEncoding returns a NameEncoding for backends that store names in a single byte character set like ISO 8859-1.
+//
+// Bytes that aren't defined in the character set are presented as %XX (and a literal % that looks like such an escape as %25).
+// Names containing characters that can't be represented in the character set are rejected with EILSEQ.
+func CharmapNameEncoding(cm *charmap.Charmap) NameEncoding {
+	return charmapEncoding{cm}
+}
+
+type charmapEncoding struct {
+	cm *charmap.Charmap
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// isEscape returns whether s starts with %XX.
+func isEscape(s string) bool {
+	if len(s) < 3 || s[0] != '%' {
+		return false
+	}
+	_, ok1 := unhex(s[1])
+	_, ok2 := unhex(s[2])
+	return ok1 && ok2
+}
+
+func (e charmapEncoding) Encode(name string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(name); {
+		if isEscape(name[i:]) {
+			hi, _ := unhex(name[i+1])
+			lo, _ := unhex(name[i+2])
+			sb.WriteByte(hi<<4 | lo)
+			i += 3
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(name[i:])
+		b, ok := e.cm.EncodeRune(r)
+		if !ok || (r == utf8.RuneError && size == 1) {
+			return "", syscall.EILSEQ
+		}
+		sb.WriteByte(b)
+		i += size
+	}
+	return sb.String(), nil
+}
+
+func (e charmapEncoding) Decode(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		r := e.cm.DecodeByte(name[i])
+		switch r {
+		case '%':
+			if isEscape(name[i:]) {
+				sb.WriteString("%25")
+			} else {
+				sb.WriteByte('%')
+			}
+		case utf8.RuneError:
+			fmt.Fprintf(&sb, "%%%02X", name[i])
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// encodePath encodes every component of a slash separated path.
+func encodePath(enc NameEncoding, p string) (string, error) {
+	parts := strings.Split(p, "/")
+	for i, c := range parts {
+		if c == "" || c == "." || c == ".." {
+			continue
+		}
+		ec, err := enc.Encode(c)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = ec
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// decodePath decodes every component of a slash separated path.
+func decodePath(enc NameEncoding, p string) string {
+	parts := strings.Split(p, "/")
+	for i, c := range parts {
+		if c == "" || c == "." || c == ".." {
+			continue
+		}
+		parts[i] = enc.Decode(c)
+	}
+	return strings.Join(parts, "/")
+}
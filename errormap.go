@@ -0,0 +1,44 @@
+package billybazilfuse
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// ErrorMapper picks the errno the kernel gets for an error from Billy, like EAGAIN for a backend's rate limiting errors. It returns false to keep the built-in mapping.
+type ErrorMapper func(err error) (errno fuse.Errno, ok bool)
+
+// mapError applies the ErrorMapper and the FallbackErrno to an error converted by convertError. It's called before the error is returned to bazil, which only then asks for its errno.
+func (r *FS) mapError(err error) {
+	ce, ok := err.(*convertedError)
+	if !ok {
+		return
+	}
+	if r.errorMapper != nil {
+		if errno, ok := r.errorMapper(ce.err); ok {
+			ce.errno = errno
+			ce.unknown = false
+			return
+		}
+	}
+	if ce.unknown && r.fallbackErrno != 0 {
+		ce.errno = r.fallbackErrno
+	}
+}
+
+// ParseErrno parses the name of an errno, like "EREMOTEIO", or its number on this platform.
+func ParseErrno(s string) (fuse.Errno, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return fuse.Errno(n), nil
+	}
+	for e := syscall.Errno(1); e < 4096; e++ {
+		if unix.ErrnoName(e) == s {
+			return fuse.Errno(e), nil
+		}
+	}
+	return 0, fmt.Errorf("billy-bazilfuse: unknown errno %q", s)
+}
@@ -1,8 +1,19 @@
 module github.com/Jille/billy-bazilfuse
 
-go 1.16
+go 1.21
 
 require (
 	bazil.org/fuse v0.0.0-20200524192727-fb710f7dfd05
+	github.com/BurntSushi/toml v1.6.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/go-git/go-billy/v5 v5.3.1
+	github.com/hanwen/go-fuse/v2 v2.11.0
+	github.com/pkg/sftp v1.13.6
+	github.com/winfsp/cgofuse v1.6.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/text v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/kr/fs v0.1.0 // indirect
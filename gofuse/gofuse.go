@@ -0,0 +1,243 @@
+// Package gofuse exposes a github.com/hanwen/go-fuse/v2/fs node tree that passes calls to a Billy API.
+//
+// It is an alternative to the bazil.org/fuse frontend in the parent package for users that want go-fuse's raw bridge (splice, readdirplus).
+package gofuse
+
+import (
+	"context"
+	"math"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+	"github.com/go-git/go-billy/v5"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// New creates the root of a go-fuse node tree that passes all calls through to the given filesystem.
+// Pass it to fs.Mount or fs.NewNodeFS.
+func New(underlying billy.Basic) fs.InodeEmbedder {
+	return &node{root: &root{underlying: underlying}}
+}
+
+type root struct {
+	underlying billy.Basic
+}
+
+type node struct {
+	fs.Inode
+	root *root
+}
+
+var _ fs.NodeCopyFileRanger = &node{}
+var _ fs.NodeCreater = &node{}
+var _ fs.NodeGetattrer = &node{}
+var _ fs.NodeLookuper = &node{}
+var _ fs.NodeMkdirer = &node{}
+var _ fs.NodeOpener = &node{}
+var _ fs.NodeReaddirer = &node{}
+var _ fs.NodeReadlinker = &node{}
+var _ fs.NodeRenamer = &node{}
+var _ fs.NodeRmdirer = &node{}
+var _ fs.NodeSetattrer = &node{}
+var _ fs.NodeSymlinker = &node{}
+var _ fs.NodeUnlinker = &node{}
+
+// path returns the path of this node within the Billy filesystem.
+func (n *node) path() string {
+	return n.Path(nil)
+}
+
+func fileInfoToAttr(fi os.FileInfo, out *fuse.Attr) {
+	out.Mode = adapter.UnixMode(fi.Mode())
+	out.Size = uint64(fi.Size())
+	mtime := fi.ModTime()
+	out.SetTimes(nil, &mtime, nil)
+}
+
+// newChild stats fn and creates an inode for it.
+func (n *node) newChild(ctx context.Context, fn string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fi, err := n.root.underlying.Stat(fn)
+	if err != nil {
+		return nil, adapter.Errno(err)
+	}
+	fileInfoToAttr(fi, &out.Attr)
+	return n.NewInode(ctx, &node{root: n.root}, fs.StableAttr{Mode: out.Attr.Mode & syscall.S_IFMT}), 0
+}
+
+func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fi, err := n.root.underlying.Stat(n.path())
+	if err != nil {
+		return adapter.Errno(err)
+	}
+	fileInfoToAttr(fi, &out.Attr)
+	return 0
+}
+
+func (n *node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	var sr adapter.SetattrRequest
+	if m, ok := in.GetMode(); ok {
+		mode := os.FileMode(m).Perm()
+		sr.Mode = &mode
+	}
+	if uid, ok := in.GetUID(); ok {
+		sr.Uid = &uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		sr.Gid = &gid
+	}
+	if atime, ok := in.GetATime(); ok {
+		sr.Atime = &atime
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		sr.Mtime = &mtime
+	}
+	if size, ok := in.GetSize(); ok {
+		sr.Size = &size
+	}
+	if err := adapter.Setattr(n.root.underlying, n.path(), sr); err != nil {
+		return adapter.Errno(err)
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return n.newChild(ctx, path.Join(n.path(), name), out)
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, err := adapter.ReadDir(n.root.underlying, n.path())
+	if err != nil {
+		return nil, adapter.Errno(err)
+	}
+	ret := make([]fuse.DirEntry, len(entries))
+	for i, e := range entries {
+		ret[i] = fuse.DirEntry{
+			Name: e.Name(),
+			Mode: adapter.UnixMode(e.Mode()),
+		}
+	}
+	return fs.NewListDirStream(ret), 0
+}
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fn := path.Join(n.path(), name)
+	if err := adapter.Mkdir(n.root.underlying, fn, os.FileMode(mode).Perm()); err != nil {
+		return nil, adapter.Errno(err)
+	}
+	return n.newChild(ctx, fn, out)
+}
+
+// Unlink removes a file.
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return adapter.Errno(n.root.underlying.Remove(path.Join(n.path(), name)))
+}
+
+// Rmdir removes a directory.
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return adapter.Errno(n.root.underlying.Remove(path.Join(n.path(), name)))
+}
+
+// Symlink creates a symbolic link.
+func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fn := path.Join(n.path(), name)
+	if err := adapter.Symlink(n.root.underlying, target, fn); err != nil {
+		return nil, adapter.Errno(err)
+	}
+	return n.newChild(ctx, fn, out)
+}
+
+// Readlink reads the target of a symbolic link.
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := adapter.Readlink(n.root.underlying, n.path())
+	if err != nil {
+		return nil, adapter.Errno(err)
+	}
+	return []byte(target), 0
+}
+
+// Rename renames a file.
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		// RENAME_EXCHANGE and RENAME_NOREPLACE can't be expressed in Billy.
+		return syscall.EINVAL
+	}
+	newPath := path.Join(newParent.EmbeddedInode().Path(nil), newName)
+	return adapter.Errno(n.root.underlying.Rename(path.Join(n.path(), name), newPath))
+}
+
+// CopyFileRange copies data between open files, by the backend if it implements billybazilfuse.Cloner or billybazilfuse.Copier.
+func (n *node) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut uint64, length uint64, flags uint64) (uint32, syscall.Errno) {
+	if flags != 0 {
+		return 0, syscall.EINVAL
+	}
+	src, ok := fhIn.(*handle)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	dst, ok := fhOut.(*handle)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	// The number of bytes copied is returned as a uint32.
+	if length > math.MaxUint32 {
+		length = math.MaxUint32
+	}
+	copied, err := adapter.CopyRange(n.root.underlying, dst.fh, int64(offOut), src.fh, int64(offIn), int64(length))
+	if err != nil && copied == 0 {
+		return 0, adapter.Errno(err)
+	}
+	return uint32(copied), 0
+}
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	fn := path.Join(n.path(), name)
+	fh, err := n.root.underlying.OpenFile(fn, int(flags), os.FileMode(mode).Perm())
+	if err != nil {
+		return nil, nil, 0, adapter.Errno(err)
+	}
+	child, errno := n.newChild(ctx, fn, out)
+	if errno != 0 {
+		fh.Close()
+		return nil, nil, 0, errno
+	}
+	return child, &handle{fh: adapter.NewFile(fh)}, 0, 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	fh, err := n.root.underlying.OpenFile(n.path(), int(flags), 0777)
+	if err != nil {
+		return nil, 0, adapter.Errno(err)
+	}
+	return &handle{fh: adapter.NewFile(fh)}, 0, 0
+}
+
+type handle struct {
+	fh *adapter.File
+}
+
+var _ fs.FileReader = &handle{}
+var _ fs.FileReleaser = &handle{}
+var _ fs.FileWriter = &handle{}
+
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.fh.ReadAt(dest, off)
+	if err != nil {
+		return nil, adapter.Errno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *handle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	n, err := h.fh.WriteAt(data, off)
+	if err != nil {
+		return 0, adapter.Errno(err)
+	}
+	return uint32(n), 0
+}
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	return adapter.Errno(h.fh.Close())
+}
@@ -0,0 +1,101 @@
+package billybazilfuse
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// OpenHandle describes a file opened through the mount that wasn't closed yet.
+type OpenHandle struct {
+	// Path is the path of the file on the backend.
+	Path  string
+	Flags fuse.OpenFlags
+	// Opened is when the file was opened, and Pid the process that opened it (or 0 if unknown). The file may since have been passed on to other processes.
+	Opened time.Time
+	Pid    uint32
+}
+
+// Handles returns the files opened through the mount that weren't closed yet, oldest first.
+func (r *FS) Handles() []OpenHandle {
+	r.handlesMtx.Lock()
+	ret := make([]OpenHandle, 0, len(r.handles))
+	for h := range r.handles {
+		ret = append(ret, h.info())
+	}
+	r.handlesMtx.Unlock()
+	sortHandles(ret)
+	return ret
+}
+
+// longOpenHandles returns the handles open for longer than Options.LongOpenHandle, oldest first.
+func (r *FS) longOpenHandles() []OpenHandle {
+	if r.longOpenHandle <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-r.longOpenHandle)
+	var ret []OpenHandle
+	r.handlesMtx.Lock()
+	for h := range r.handles {
+		if h.opened.Before(cutoff) {
+			ret = append(ret, h.info())
+		}
+	}
+	r.handlesMtx.Unlock()
+	sortHandles(ret)
+	return ret
+}
+
+func (h *handle) info() OpenHandle {
+	return OpenHandle{Path: h.path, Flags: h.flags, Opened: h.opened, Pid: h.pid}
+}
+
+func sortHandles(handles []OpenHandle) {
+	sort.Slice(handles, func(i, j int) bool {
+		return handles[i].Opened.Before(handles[j].Opened)
+	})
+}
+
+// warnLongOpen calls Options.OnLongOpenHandle once for every handle that's open for longer than Options.LongOpenHandle, until ctx is cancelled.
+func (r *FS) warnLongOpen(ctx context.Context) {
+	interval := r.longOpenHandle / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cutoff := time.Now().Add(-r.longOpenHandle)
+		var warn []OpenHandle
+		r.handlesMtx.Lock()
+		for h := range r.handles {
+			if !h.warned && h.opened.Before(cutoff) {
+				h.warned = true
+				warn = append(warn, h.info())
+			}
+		}
+		r.handlesMtx.Unlock()
+		sortHandles(warn)
+		for _, oh := range warn {
+			r.onLongOpenHandle(oh)
+		}
+	}
+}
+
+// handlesText returns the content of the file handles in the control directory: a line per open file, oldest first.
+func (r *FS) handlesText() ([]byte, error) {
+	var sb strings.Builder
+	for _, oh := range r.Handles() {
+		fmt.Fprintf(&sb, "%s pid %d %v /%s\n", oh.Opened.Format(time.RFC3339), oh.Pid, oh.Flags, oh.Path)
+	}
+	return []byte(sb.String()), nil
+}
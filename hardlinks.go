@@ -0,0 +1,312 @@
+package billybazilfuse
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+)
+
+// hardlinkMarker is the header of the files that stand in for emulated hardlinks. The backend path of the file holding the content follows it.
+const hardlinkMarker = "!<billy-bazilfuse hardlink>\n"
+
+// maxHardlinkTarget is the maximum length of the path stored in a hardlink marker file.
+const maxHardlinkTarget = 4096
+
+// linkTable keeps track of emulated hardlinks.
+// The content of a linked file lives under one of its names (the storage path). Its other names (aliases) are marker files pointing to it.
+// When the storage path is removed, the content is renamed over one of the aliases, so it lives on for as long as any name refers to it.
+type linkTable struct {
+	mtx     sync.Mutex
+	storage map[string]string   // alias -> storage path
+	aliases map[string][]string // storage path -> aliases
+}
+
+func newLinkTable() *linkTable {
+	return &linkTable{
+		storage: map[string]string{},
+		aliases: map[string][]string{},
+	}
+}
+
+func (lt *linkTable) add(alias, storage string) {
+	if lt.storage[alias] == storage {
+		return
+	}
+	lt.removeAlias(alias)
+	lt.storage[alias] = storage
+	lt.aliases[storage] = append(lt.aliases[storage], alias)
+	sort.Strings(lt.aliases[storage])
+}
+
+func (lt *linkTable) removeAlias(alias string) {
+	storage, ok := lt.storage[alias]
+	if !ok {
+		return
+	}
+	delete(lt.storage, alias)
+	var rest []string
+	for _, a := range lt.aliases[storage] {
+		if a != alias {
+			rest = append(rest, a)
+		}
+	}
+	if len(rest) == 0 {
+		delete(lt.aliases, storage)
+	} else {
+		lt.aliases[storage] = rest
+	}
+}
+
+func (lt *linkTable) sameFile(a, b string) bool {
+	if s, ok := lt.storage[a]; ok {
+		a = s
+	}
+	if s, ok := lt.storage[b]; ok {
+		b = s
+	}
+	return a == b
+}
+
+// hardlinkStorage returns the path holding the content of p, which is p itself unless p is an emulated hardlink.
+func (r *FS) hardlinkStorage(p string) (string, error) {
+	if r.links == nil {
+		return p, nil
+	}
+	r.links.mtx.Lock()
+	defer r.links.mtx.Unlock()
+	return r.hardlinkStorageLocked(p)
+}
+
+// knownHardlinkStorage is like hardlinkStorage, but only consults the link table and never the backend.
+func (r *FS) knownHardlinkStorage(p string) string {
+	if r.links == nil {
+		return p
+	}
+	r.links.mtx.Lock()
+	defer r.links.mtx.Unlock()
+	if s, ok := r.links.storage[p]; ok {
+		return s
+	}
+	return p
+}
+
+// hardlinkStorageLocked returns the storage path of p, adding marker files found on the backend to the link table.
+// A marker pointing to a file that no longer exists is presented as the marker file itself.
+func (r *FS) hardlinkStorageLocked(p string) (string, error) {
+	if s, ok := r.links.storage[p]; ok {
+		return s, nil
+	}
+	if _, ok := r.links.aliases[p]; ok {
+		return p, nil
+	}
+	fi, err := r.underlying.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return "", err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() <= int64(len(hardlinkMarker)) || fi.Size() > int64(len(hardlinkMarker)+maxHardlinkTarget) {
+		return p, nil
+	}
+	storage, ok, err := readMarkerFile(r.underlying, p, fi, hardlinkMarker)
+	if err != nil || !ok {
+		return p, err
+	}
+	if _, err := r.underlying.Stat(storage); err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return "", err
+	}
+	r.links.add(p, storage)
+	return storage, nil
+}
+
+// scanHardlinks walks the backend to fill the link table with the marker files below dir, so the aliases of a file are known before it's removed.
+func (r *FS) scanHardlinks(dir string) error {
+	entries, err := adapter.ReadDir(r.underlying, dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		if e.IsDir() {
+			if err := r.scanHardlinks(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := r.hardlinkStorageLocked(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkCount returns the number of names of p known to the link table.
+func (r *FS) linkCount(p string) uint32 {
+	r.links.mtx.Lock()
+	defer r.links.mtx.Unlock()
+	return uint32(1 + len(r.links.aliases[p]))
+}
+
+// writeHardlinkMarker writes a marker file at p pointing to storage.
+func (r *FS) writeHardlinkMarker(p, storage string, flag int) error {
+	fh, err := r.underlying.OpenFile(p, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write([]byte(hardlinkMarker + storage)); err != nil {
+		fh.Close()
+		r.underlying.Remove(p)
+		return err
+	}
+	return fh.Close()
+}
+
+// link creates an emulated hardlink at p to the file stored at storage.
+func (r *FS) link(storage, p string) error {
+	r.links.mtx.Lock()
+	defer r.links.mtx.Unlock()
+	if err := r.writeHardlinkMarker(p, storage, os.O_EXCL); err != nil {
+		return err
+	}
+	r.links.add(p, storage)
+	return nil
+}
+
+// remove removes p from the backend. If p holds the content of emulated hardlinks, the content is moved to one of them first.
+func (r *FS) remove(p string) error {
+	if r.links == nil {
+		return r.underlying.Remove(p)
+	}
+	r.links.mtx.Lock()
+	defer r.links.mtx.Unlock()
+	if _, err := r.hardlinkStorageLocked(p); err != nil {
+		return err
+	}
+	if _, ok := r.links.storage[p]; ok {
+		if err := r.underlying.Remove(p); err != nil {
+			return err
+		}
+		r.links.removeAlias(p)
+		return nil
+	}
+	if len(r.links.aliases[p]) > 0 {
+		return r.promoteLocked(p)
+	}
+	return r.underlying.Remove(p)
+}
+
+// promoteLocked moves the content at storage over its first alias, and points the other aliases at that alias.
+// Afterwards storage no longer exists.
+func (r *FS) promoteLocked(storage string) error {
+	aliases := r.links.aliases[storage]
+	heir, rest := aliases[0], aliases[1:]
+	if err := r.underlying.Remove(heir); err != nil {
+		return err
+	}
+	if err := r.underlying.Rename(storage, heir); err != nil {
+		// Try to put the marker back so the alias doesn't disappear.
+		r.writeHardlinkMarker(heir, storage, os.O_EXCL)
+		return err
+	}
+	// The node the kernel has for the file, which all its names share, now has its content at heir.
+	r.moveNodes(storage, heir)
+	delete(r.links.aliases, storage)
+	delete(r.links.storage, heir)
+	for _, a := range rest {
+		r.links.add(a, heir)
+	}
+	if r.inodes != nil {
+		if err := r.inodes.Remove(heir); err != nil {
+			return err
+		}
+		if err := r.inodes.Rename(storage, heir); err != nil {
+			return err
+		}
+	}
+	for _, a := range rest {
+		if err := r.writeHardlinkMarker(a, heir, os.O_TRUNC); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rename renames oldPath to newPath on the backend, keeping emulated hardlinks and the nodes the kernel knows of pointing to the right place.
+func (r *FS) rename(oldPath, newPath string) error {
+	if r.links == nil {
+		if err := r.underlying.Rename(oldPath, newPath); err != nil {
+			return err
+		}
+		r.moveNodes(oldPath, newPath)
+		return nil
+	}
+	r.links.mtx.Lock()
+	defer r.links.mtx.Unlock()
+	if _, err := r.hardlinkStorageLocked(oldPath); err != nil {
+		return err
+	}
+	if _, err := r.hardlinkStorageLocked(newPath); err != nil {
+		return err
+	}
+	if oldPath != newPath && r.links.sameFile(oldPath, newPath) {
+		// Renaming a file over another name of the same file does nothing.
+		return nil
+	}
+	if len(r.links.aliases[newPath]) > 0 {
+		// newPath is about to be replaced, but its content lives on in its aliases.
+		if err := r.promoteLocked(newPath); err != nil {
+			return err
+		}
+	}
+	if err := r.underlying.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	r.moveNodes(oldPath, newPath)
+	r.links.removeAlias(newPath)
+	return r.moveLocked(oldPath, newPath)
+}
+
+// moveLocked updates the link table after oldPath (and everything below it) was renamed to newPath, and rewrites the marker files that pointed into it.
+func (r *FS) moveLocked(oldPath, newPath string) error {
+	move := func(p string) (string, bool) {
+		if p == oldPath {
+			return newPath, true
+		}
+		if strings.HasPrefix(p, oldPath+"/") {
+			return newPath + p[len(oldPath):], true
+		}
+		return p, false
+	}
+	storage := map[string]string{}
+	var rewrite []string
+	for alias, s := range r.links.storage {
+		alias, _ = move(alias)
+		s, moved := move(s)
+		storage[alias] = s
+		if moved {
+			rewrite = append(rewrite, alias)
+		}
+	}
+	r.links.storage = map[string]string{}
+	r.links.aliases = map[string][]string{}
+	for alias, s := range storage {
+		r.links.add(alias, s)
+	}
+	for _, a := range rewrite {
+		if err := r.writeHardlinkMarker(a, storage[a], os.O_TRUNC); err != nil {
+			return err
+		}
+	}
+	return nil
+}
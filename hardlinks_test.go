@@ -0,0 +1,105 @@
+package billybazilfuse
+
+import (
+	"context"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+func TestHardlinks(t *testing.T) {
+	ctx := context.Background()
+	remove := func(name string) func(r *FS) error {
+		return func(r *FS) error {
+			return r.node("").Remove(ctx, &fuse.RemoveRequest{Name: name})
+		}
+	}
+	rename := func(from, to string) func(r *FS) error {
+		return func(r *FS) error {
+			root := r.node("")
+			return root.Rename(ctx, &fuse.RenameRequest{OldName: from, NewName: to}, root)
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		links []string
+		op    func(r *FS) error
+		// remount does op on a new FS, which only knows the links from the backend.
+		remount bool
+		// names are the names that should have the content afterwards, and gone the ones that shouldn't exist.
+		names []string
+		gone  []string
+	}{
+		{name: "remove link", links: []string{"b"}, op: remove("b"), names: []string{"a"}, gone: []string{"b"}},
+		{name: "remove original", links: []string{"b"}, op: remove("a"), names: []string{"b"}, gone: []string{"a"}},
+		{name: "remove original of two links", links: []string{"b", "c"}, op: remove("a"), names: []string{"b", "c"}, gone: []string{"a"}},
+		{name: "remove original after remount", links: []string{"b"}, op: remove("a"), remount: true, names: []string{"b"}, gone: []string{"a"}},
+		{name: "rename original", links: []string{"b"}, op: rename("a", "c"), names: []string{"b", "c"}, gone: []string{"a"}},
+		{name: "rename link", links: []string{"b"}, op: rename("b", "c"), names: []string{"a", "c"}, gone: []string{"b"}},
+		{name: "rename over other name", links: []string{"b"}, op: rename("b", "a"), names: []string{"a", "b"}},
+		{name: "rename other file over original", links: []string{"b"}, op: func(r *FS) error {
+			if err := util.WriteFile(r.underlying, "other", []byte("other"), 0644); err != nil {
+				return err
+			}
+			return rename("other", "a")(r)
+		}, names: []string{"b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, backend := testFS(t, Options{EmulateHardlinks: true})
+			if err := util.WriteFile(backend, "a", []byte("content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			root := r.node("")
+			a := lookup(t, root, "a")
+			for _, name := range tc.links {
+				n, err := root.Link(ctx, &fuse.LinkRequest{NewName: name}, a)
+				if err != nil {
+					t.Fatalf("Link(%q): %v", name, err)
+				}
+				if n != a {
+					t.Errorf("Link(%q) returned another node than the original", name)
+				}
+			}
+			if tc.remount {
+				var err error
+				r, err = NewWithOptions(backend, Options{EmulateHardlinks: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				a = lookup(t, r.node(""), "a")
+			}
+			if err := tc.op(r); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			for _, name := range tc.names {
+				n := lookup(t, r.node(""), name)
+				if n != a {
+					t.Errorf("Lookup(%q) returned another node than the original", name)
+				}
+				var attr fuse.Attr
+				if err := n.Attr(ctx, &attr); err != nil {
+					t.Errorf("Attr(%q): %v", name, err)
+				} else if attr.Nlink != uint32(len(tc.names)) {
+					t.Errorf("Attr(%q) reported %d links; want %d", name, attr.Nlink, len(tc.names))
+				}
+				h, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+				if err != nil {
+					t.Errorf("Open(%q): %v", name, err)
+					continue
+				}
+				resp := &fuse.ReadResponse{Data: make([]byte, 0, 64)}
+				if err := h.(*handle).Read(ctx, &fuse.ReadRequest{Size: 64}, resp); err != nil {
+					t.Errorf("Read(%q): %v", name, err)
+				} else if string(resp.Data) != "content" {
+					t.Errorf("Read(%q) = %q; want %q", name, resp.Data, "content")
+				}
+			}
+			for _, name := range tc.gone {
+				if _, err := backend.Stat(name); err == nil {
+					t.Errorf("%q still exists after %s", name, tc.name)
+				}
+			}
+		})
+	}
+}
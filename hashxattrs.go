@@ -0,0 +1,85 @@
+package billybazilfuse
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashXattrPrefix is the prefix of the virtual extended attributes holding content hashes.
+const hashXattrPrefix = "user.billyfuse."
+
+// maxCachedHashes is the number of computed hashes kept.
+const maxCachedHashes = 10000
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// hashCache remembers computed content hashes, keyed on the size and modification time of the file so changed files are hashed again.
+type hashCache struct {
+	mtx    sync.Mutex
+	hashes map[contentHashKey]string
+}
+
+type contentHashKey struct {
+	path      string
+	size      int64
+	modTime   time.Time
+	algorithm string
+}
+
+// contentHash returns the hex encoded hash of the file at p, or ok=false if name isn't a hash attribute.
+func (r *FS) contentHash(p, name string) (sum string, ok bool, err error) {
+	algorithm, found := strings.CutPrefix(name, hashXattrPrefix)
+	newHash, ok := hashAlgorithms[algorithm]
+	if !found || !ok {
+		return "", false, nil
+	}
+	fi, err := r.underlying.Stat(p)
+	if err != nil {
+		return "", false, err
+	}
+	if fi, err = r.withEmulatedTypes(p, fi); err != nil {
+		return "", false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", false, nil
+	}
+	key := contentHashKey{p, fi.Size(), fi.ModTime(), algorithm}
+	hc := r.hashes
+	hc.mtx.Lock()
+	sum, ok = hc.hashes[key]
+	hc.mtx.Unlock()
+	if ok {
+		return sum, true, nil
+	}
+	fh, err := r.underlying.Open(p)
+	if err != nil {
+		return "", false, err
+	}
+	defer fh.Close()
+	h := newHash()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", false, err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	if len(hc.hashes) >= maxCachedHashes {
+		for k := range hc.hashes {
+			delete(hc.hashes, k)
+			break
+		}
+	}
+	hc.hashes[key] = sum
+	return sum, true, nil
+}
@@ -0,0 +1,159 @@
+package billybazilfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// BackendHealth is the result of the health probe of Options.HealthCheckInterval.
+type BackendHealth struct {
+	Up bool
+	// Error is why the last probe failed.
+	Error string `json:",omitempty"`
+	// Checked is when the last probe finished, or zero if none finished yet. Since is when Up last changed.
+	Checked time.Time
+	Since   time.Time
+	// Latency is how long the last probe took.
+	Latency time.Duration
+}
+
+// healthProbe periodically checks whether the backend responds, by calling Stat on a path.
+type healthProbe struct {
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+
+	mtx     sync.Mutex
+	status  BackendHealth
+	running bool
+}
+
+var errHealthTimeout = errors.New("health probe timed out")
+
+// checkHealth probes the backend every interval until ctx is cancelled.
+func (r *FS) checkHealth(ctx context.Context) {
+	t := time.NewTicker(r.health.interval)
+	defer t.Stop()
+	for {
+		r.probeHealth()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probeHealth calls Stat on the probed path, and records the result. A probe that takes longer than the timeout is recorded as failed, and no new probe is started until it returns.
+func (r *FS) probeHealth() BackendHealth {
+	h := r.health
+	h.mtx.Lock()
+	if h.running {
+		h.mtx.Unlock()
+		h.record(time.Now(), h.timeout, errHealthTimeout)
+		return h.get()
+	}
+	h.running = true
+	h.mtx.Unlock()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		_, err := r.underlying.Stat(h.path)
+		h.mtx.Lock()
+		h.running = false
+		h.mtx.Unlock()
+		result <- err
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(h.timeout):
+		err = errHealthTimeout
+	}
+	h.record(time.Now(), time.Since(start), err)
+	return h.get()
+}
+
+func (h *healthProbe) record(now time.Time, latency time.Duration, err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	up := err == nil
+	if up != h.status.Up || h.status.Checked.IsZero() {
+		h.status.Since = now
+	}
+	h.status.Up = up
+	h.status.Error = ""
+	if err != nil {
+		h.status.Error = err.Error()
+	}
+	h.status.Checked = now
+	h.status.Latency = latency
+}
+
+func (h *healthProbe) get() BackendHealth {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.status
+}
+
+// BackendHealth returns the result of the last health probe, or false if health checking isn't enabled.
+func (r *FS) BackendHealth() (BackendHealth, bool) {
+	if r.health == nil {
+		return BackendHealth{}, false
+	}
+	return r.health.get(), true
+}
+
+// backendDown returns whether the last health probe failed.
+func (r *FS) backendDown() bool {
+	if r.health == nil {
+		return false
+	}
+	st := r.health.get()
+	return !st.Up && !st.Checked.IsZero()
+}
+
+// CheckReady returns an error if the backend doesn't respond, by calling Stat on the root (which must be a directory) and on Options.HealthCheckPath, or if ctx expires first.
+// Call it before mounting to fail with a clear error, rather than presenting a mount that fails on first touch.
+func (r *FS) CheckReady(ctx context.Context) error {
+	paths := []string{""}
+	if r.health != nil && r.health.path != "" {
+		paths = append(paths, r.health.path)
+	}
+	for _, p := range paths {
+		fi, err := statContext(ctx, r.underlying, p)
+		if err == nil && p == "" && !fi.IsDir() {
+			err = errors.New("not a directory")
+		}
+		if err != nil {
+			return fmt.Errorf("billy-bazilfuse: backend isn't ready: stat %q: %w", "/"+p, err)
+		}
+	}
+	return nil
+}
+
+// statContext calls Stat on fs, giving up when ctx expires. The call can't be cancelled, so it keeps running in the background then.
+func statContext(ctx context.Context, fs billy.Basic, p string) (os.FileInfo, error) {
+	type result struct {
+		fi  os.FileInfo
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		fi, err := fs.Stat(p)
+		ch <- result{fi, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.fi, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,106 @@
+package billybazilfuse
+
+import (
+	"context"
+
+	"bazil.org/fuse"
+)
+
+// ResponseHook is called after a call from FUSE succeeded, before its response is returned to the kernel, and can modify the response, like scrubbing attributes or hiding directory entries.
+// resp is the response bazil passes (like *fuse.OpenResponse or *fuse.ReadResponse), *fuse.Attr for the attributes of a node, *[]fuse.Dirent for directory listings (which get one entry at a time for directories larger than Options.ReadDirChunkThreshold) and *string for the target of a symlink.
+// req is nil for attributes and ReadDirAll listings, which bazil asks for without a request (attributes are also asked for to complete the responses of Lookup, Create and the like).
+// The Data of a *fuse.ReadResponse may be shared with the cache, so it must be replaced rather than modified in place. Returning an error fails the call with it.
+type ResponseHook func(ctx context.Context, req fuse.Request, resp interface{}) error
+
+// respondAfter is deferred by calls to pass their response to the ResponseHook if they succeed. err points to the result of the call.
+func (r *FS) respondAfter(ctx context.Context, req fuse.Request, resp interface{}, err *error) {
+	if *err != nil || r.responseHook == nil {
+		return
+	}
+	*err = convertError(r.responseHook(ctx, req, resp))
+}
+
+// ErrorHook is called when a call from FUSE fails, with the error from Billy (or from the filesystem itself) and the errno the kernel gets for it, so the cause of an opaque EIO can be logged.
+// req is nil for the calls bazil makes without a request, like Attr. It's called before the error is returned, so it shouldn't block.
+type ErrorHook func(ctx context.Context, req fuse.Request, err error, errno fuse.Errno)
+
+// OnRequest returns a CallHook that calls fn for requests of type *T, like *fuse.OpenRequest, and lets all others through:
+//
+//	billybazilfuse.OnRequest(func(ctx context.Context, req *fuse.OpenRequest) error { ... })
+//
+// Combine hooks for several types with ChainCallHooks.
+func OnRequest[T any, PT interface {
+	*T
+	fuse.Request
+}](fn func(ctx context.Context, req *T) error) CallHook {
+	return func(ctx context.Context, req fuse.Request) error {
+		if r, ok := req.(PT); ok {
+			return fn(ctx, r)
+		}
+		return nil
+	}
+}
+
+// OnResponse returns a ResponseHook that calls fn for responses of type *T, like *fuse.Attr or *[]fuse.Dirent, and leaves all others alone.
+// Combine hooks for several types with ChainResponseHooks.
+func OnResponse[T any](fn func(ctx context.Context, req fuse.Request, resp *T) error) ResponseHook {
+	return func(ctx context.Context, req fuse.Request, resp interface{}) error {
+		if r, ok := resp.(*T); ok {
+			return fn(ctx, req, r)
+		}
+		return nil
+	}
+}
+
+// ChainCallHooks returns a CallHook that calls the hooks in order, stopping at the first that returns an error.
+func ChainCallHooks(hooks ...CallHook) CallHook {
+	return func(ctx context.Context, req fuse.Request) error {
+		for _, h := range hooks {
+			if err := h(ctx, req); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ChainResponseHooks returns a ResponseHook that calls the hooks in order, stopping at the first that returns an error.
+func ChainResponseHooks(hooks ...ResponseHook) ResponseHook {
+	return func(ctx context.Context, req fuse.Request, resp interface{}) error {
+		for _, h := range hooks {
+			if err := h(ctx, req, resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// CallInfo describes the call from FUSE a hook is called for. Get it with CallInfoFromContext.
+type CallInfo struct {
+	// Path is the path on the backend of the node the call is on, "" for the root. For calls on entries of a directory (like Lookup, Create and Rename), it's the path of the directory.
+	Path string
+	// Handle is set for calls on an open file or directory (like Read, Write and Release). Flags are the flags a file was opened with, without O_CREAT, O_EXCL and O_TRUNC.
+	Handle bool
+	Flags  fuse.OpenFlags
+}
+
+type callInfoKey struct{}
+
+// CallInfoFromContext returns the CallInfo of the call ctx was passed to a CallHook or ResponseHook for.
+func CallInfoFromContext(ctx context.Context) (CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(CallInfo)
+	return info, ok
+}
+
+// withCallInfo returns ctx with info, if there are hooks to get it.
+func (r *FS) withCallInfo(ctx context.Context, info CallInfo) context.Context {
+	if !r.hooked {
+		return ctx
+	}
+	return context.WithValue(ctx, callInfoKey{}, info)
+}
+
+func (h *handle) callInfo() CallInfo {
+	return CallInfo{Path: h.path, Handle: true, Flags: h.flags}
+}
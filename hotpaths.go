@@ -0,0 +1,144 @@
+package billybazilfuse
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hotPathsDecay is how often the counts of the hot paths are halved, so the leaderboards follow recent activity.
+const hotPathsDecay = time.Minute
+
+// HotPath is a path on a leaderboard of Stats, with its number of operations or bytes read and written.
+// Counts are approximate: paths that just entered the leaderboard may be overestimated. They're halved every minute.
+type HotPath struct {
+	Path  string
+	Count int64
+}
+
+// hotPaths keeps the most accessed paths by operations and by bytes.
+type hotPaths struct {
+	n int
+
+	mtx       sync.Mutex
+	ops       *leaderboard
+	bytes     *leaderboard
+	lastDecay time.Time
+}
+
+// newHotPaths creates leaderboards of the n most accessed paths. More paths are tracked to make the counts more accurate.
+func newHotPaths(n int) *hotPaths {
+	capacity := 4 * n
+	if capacity < 64 {
+		capacity = 64
+	}
+	return &hotPaths{n: n, ops: newLeaderboard(capacity), bytes: newLeaderboard(capacity), lastDecay: time.Now()}
+}
+
+// add records an operation on p that read or wrote the given number of bytes.
+func (h *hotPaths) add(p string, bytes int) {
+	if h == nil {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if time.Since(h.lastDecay) >= hotPathsDecay {
+		h.ops.halve()
+		h.bytes.halve()
+		h.lastDecay = time.Now()
+	}
+	h.ops.add(p, 1)
+	if bytes > 0 {
+		h.bytes.add(p, int64(bytes))
+	}
+}
+
+// top returns the leaderboards by operations and by bytes.
+func (h *hotPaths) top() (ops, bytes []HotPath) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.ops.top(h.n), h.bytes.top(h.n)
+}
+
+// leaderboard estimates the paths with the highest counts with a bounded number of entries, using the Space-Saving algorithm: a new path replaces the one with the lowest count, and inherits that count.
+type leaderboard struct {
+	capacity int
+	entries  leaderboardHeap // a min-heap by count
+	byPath   map[string]*leaderboardEntry
+}
+
+type leaderboardEntry struct {
+	path  string
+	count int64
+	index int
+}
+
+func newLeaderboard(capacity int) *leaderboard {
+	return &leaderboard{capacity: capacity, byPath: map[string]*leaderboardEntry{}}
+}
+
+func (l *leaderboard) add(p string, n int64) {
+	if e, ok := l.byPath[p]; ok {
+		e.count += n
+		heap.Fix(&l.entries, e.index)
+		return
+	}
+	if len(l.entries) < l.capacity {
+		e := &leaderboardEntry{path: p, count: n}
+		heap.Push(&l.entries, e)
+		l.byPath[p] = e
+		return
+	}
+	e := l.entries[0]
+	delete(l.byPath, e.path)
+	e.path = p
+	e.count += n
+	l.byPath[p] = e
+	heap.Fix(&l.entries, 0)
+}
+
+func (l *leaderboard) halve() {
+	for _, e := range l.entries {
+		e.count /= 2
+	}
+}
+
+func (l *leaderboard) top(n int) []HotPath {
+	ret := make([]HotPath, 0, len(l.entries))
+	for _, e := range l.entries {
+		if e.count > 0 {
+			ret = append(ret, HotPath{e.path, e.count})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Count > ret[j].Count
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+type leaderboardHeap []*leaderboardEntry
+
+func (h leaderboardHeap) Len() int           { return len(h) }
+func (h leaderboardHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h leaderboardHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *leaderboardHeap) Push(x interface{}) {
+	e := x.(*leaderboardEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *leaderboardHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
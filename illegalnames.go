@@ -0,0 +1,150 @@
+package billybazilfuse
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// IllegalNames selects which names are considered problematic for the backend or for other consumers of its data.
+type IllegalNames struct {
+	// TrailingDotsAndSpaces matches names ending in a dot or a space, which Windows silently strips.
+	TrailingDotsAndSpaces bool
+	// ReservedDeviceNames matches the Windows device names (CON, PRN, AUX, NUL, COM1-9 and LPT1-9), also when followed by an extension.
+	ReservedDeviceNames bool
+	// ControlCharacters matches names containing ASCII control characters.
+	ControlCharacters bool
+	// WindowsReservedCharacters matches names containing any of <>:"\|?*.
+	WindowsReservedCharacters bool
+
+	// Escape stores such names on the backend with the offending characters replaced by U+F000 plus their ASCII value, rather than refusing to create them with EINVAL.
+	// Names on the backend containing characters in that range are presented with those characters unescaped.
+	// With a NameEncoding, which might not be able to represent those characters, the offending bytes of the encoded name are replaced by %XX instead, and names on the backend containing such escapes are presented unescaped.
+	Escape bool
+}
+
+func (in IllegalNames) any() bool {
+	return in.TrailingDotsAndSpaces || in.ReservedDeviceNames || in.ControlCharacters || in.WindowsReservedCharacters
+}
+
+const escapeBase = 0xF000
+
+var reservedDeviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func isReservedDeviceName(name string) bool {
+	base := name
+	if i := strings.IndexByte(base, '.'); i != -1 {
+		base = base[:i]
+	}
+	return reservedDeviceNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// escapeIndices returns whether each byte of name needs escaping. It returns nil if nothing needs to be escaped.
+func (in IllegalNames) escapeIndices(name string) []bool {
+	var ret []bool
+	mark := func(i int) {
+		if ret == nil {
+			ret = make([]bool, len(name))
+		}
+		ret[i] = true
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if in.ControlCharacters && (c < 0x20 || c == 0x7f) {
+			mark(i)
+		}
+		if in.WindowsReservedCharacters && strings.IndexByte(`<>:"\|?*`, c) != -1 {
+			mark(i)
+		}
+	}
+	if in.TrailingDotsAndSpaces && name != "." && name != ".." {
+		for i := len(name) - 1; i >= 0 && (name[i] == '.' || name[i] == ' '); i-- {
+			mark(i)
+		}
+	}
+	if in.ReservedDeviceNames && isReservedDeviceName(name) {
+		mark(0)
+	}
+	return ret
+}
+
+// check returns EINVAL if name is illegal and won't be escaped.
+func (in IllegalNames) check(name string) error {
+	if !in.Escape && in.escapeIndices(name) != nil {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// illegalNameEncoding escapes illegal names before passing them on to the next NameEncoding (if any).
+type illegalNameEncoding struct {
+	rules IllegalNames
+	next  NameEncoding
+}
+
+func (e illegalNameEncoding) Encode(name string) (string, error) {
+	if e.next != nil {
+		// The illegal characters are all ASCII, which the next encoding leaves alone, so we can escape its result.
+		name, err := e.next.Encode(name)
+		if err != nil {
+			return "", err
+		}
+		return e.escape(name, func(sb *strings.Builder, c byte) {
+			fmt.Fprintf(sb, "%%%02X", c)
+		}), nil
+	}
+	return e.escape(name, func(sb *strings.Builder, c byte) {
+		sb.WriteRune(escapeBase + rune(c))
+	}), nil
+}
+
+// escape returns name with the bytes that need escaping written by esc.
+func (e illegalNameEncoding) escape(name string, esc func(sb *strings.Builder, c byte)) string {
+	idx := e.rules.escapeIndices(name)
+	if idx == nil {
+		return name
+	}
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if idx[i] {
+			esc(&sb, name[i])
+		} else {
+			sb.WriteByte(name[i])
+		}
+	}
+	return sb.String()
+}
+
+// unescapable returns whether an escape of c is presented as c. Bytes that would change the meaning of the name (a NUL, a slash or the % of an escape) stay escaped.
+func unescapable(c rune) bool {
+	return 0 < c && c < 0x80 && c != '/' && c != '%'
+}
+
+func (e illegalNameEncoding) Decode(name string) string {
+	if e.next != nil {
+		var sb strings.Builder
+		for i := 0; i < len(name); i++ {
+			if isEscape(name[i:]) {
+				hi, _ := unhex(name[i+1])
+				lo, _ := unhex(name[i+2])
+				if c := hi<<4 | lo; unescapable(rune(c)) {
+					sb.WriteByte(c)
+					i += 2
+					continue
+				}
+			}
+			sb.WriteByte(name[i])
+		}
+		return e.next.Decode(sb.String())
+	}
+	return strings.Map(func(r rune) rune {
+		if unescapable(r - escapeBase) {
+			return r - escapeBase
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,63 @@
+package billybazilfuse
+
+import (
+	"context"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestIllegalNameEncoding(t *testing.T) {
+	rules := IllegalNames{TrailingDotsAndSpaces: true, ReservedDeviceNames: true, ControlCharacters: true, WindowsReservedCharacters: true, Escape: true}
+	latin1 := CharmapNameEncoding(charmap.ISO8859_1)
+	for _, tc := range []struct {
+		name    string
+		next    NameEncoding
+		backend string
+	}{
+		{"plain", nil, "plain"},
+		{"a:b", nil, "ab"},
+		{"dots..", nil, "dots"},
+		{"con.txt", nil, "on.txt"},
+		{"café", latin1, "caf\xe9"},
+		{"a:b", latin1, "a%3Ab"},
+		{"café?", latin1, "caf\xe9%3F"},
+		{"tab\t", latin1, "tab%09"},
+		{"NUL", latin1, "%4EUL"},
+		{"trailing. ", latin1, "trailing%2E%20"},
+		{"100%", latin1, "100%"},
+	} {
+		e := illegalNameEncoding{rules, tc.next}
+		got, err := e.Encode(tc.name)
+		if err != nil {
+			t.Errorf("Encode(%q): %v", tc.name, err)
+			continue
+		}
+		if got != tc.backend {
+			t.Errorf("Encode(%q) = %q; want %q", tc.name, got, tc.backend)
+		}
+		if dec := e.Decode(got); dec != tc.name {
+			t.Errorf("Decode(%q) = %q; want %q", got, dec, tc.name)
+		}
+	}
+}
+
+func TestIllegalNamesWithCharmap(t *testing.T) {
+	ctx := context.Background()
+	r, backend := testFS(t, Options{
+		NameEncoding: CharmapNameEncoding(charmap.ISO8859_1),
+		IllegalNames: IllegalNames{WindowsReservedCharacters: true, Escape: true},
+	})
+	root := r.node("")
+	if _, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "é:1", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := backend.Stat("\xe9%3A1"); err != nil {
+		t.Errorf("the file isn't on the backend under its escaped name: %v", err)
+	}
+	var attr fuse.Attr
+	if err := lookup(t, root, "é:1").Attr(ctx, &attr); err != nil {
+		t.Errorf("Attr: %v", err)
+	}
+}
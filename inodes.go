@@ -0,0 +1,283 @@
+package billybazilfuse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rootInode is the inode number the kernel always uses for the root of a FUSE mount.
+const rootInode = 1
+
+// inodeMap hands out inode numbers that stay the same for a path as long as it exists.
+// Numbers are never handed out twice, as bazil doesn't let us send a generation number to tell the kernel apart reused ones.
+// If backed by a file, the mapping is journaled to it so it survives remounts.
+//
+// The journal consists of lines "s <inode> <quoted path>" to set and "d <inode>" to delete a mapping.
+// It is compacted every time it is loaded, starting with a line "n <inode>" with the next number to hand out, so numbers of deleted paths aren't handed out again after a remount.
+type inodeMap struct {
+	mtx     sync.Mutex
+	byPath  map[string]uint64
+	byInode map[uint64]string
+	// children indexes the mapped paths by their directory, so Remove and Rename only visit the paths they affect.
+	// A directory without a number of its own is listed in its parent as long as something below it has one.
+	children map[string]map[string]struct{}
+	next     uint64
+	journal  *os.File
+}
+
+func newInodeMap(fn string) (*inodeMap, error) {
+	m := &inodeMap{
+		byPath:   map[string]uint64{"": rootInode},
+		byInode:  map[uint64]string{rootInode: ""},
+		children: map[string]map[string]struct{}{},
+		next:     rootInode + 1,
+	}
+	if fn == "" {
+		return m, nil
+	}
+	if err := m.load(fn); err != nil {
+		return nil, err
+	}
+	if err := m.compact(fn); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *inodeMap) load(fn string) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	for lineno := 1; ; lineno++ {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// A partial last line means we crashed while writing it.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.replay(strings.TrimSuffix(line, "\n")); err != nil {
+			return fmt.Errorf("%s:%d: %v", fn, lineno, err)
+		}
+	}
+}
+
+func (m *inodeMap) replay(line string) error {
+	sp := strings.SplitN(line, " ", 3)
+	if len(sp) < 2 {
+		return fmt.Errorf("corrupt inode map entry %q", line)
+	}
+	ino, err := strconv.ParseUint(sp[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("corrupt inode map entry %q", line)
+	}
+	switch {
+	case sp[0] == "n" && len(sp) == 2:
+		if ino > m.next {
+			m.next = ino
+		}
+		return nil
+	case sp[0] == "s" && len(sp) == 3:
+		p, err := strconv.Unquote(sp[2])
+		if err != nil {
+			return fmt.Errorf("corrupt inode map entry %q", line)
+		}
+		m.set(p, ino)
+	case sp[0] == "d" && len(sp) == 2:
+		if p, ok := m.byInode[ino]; ok {
+			m.forget(p)
+		}
+	default:
+		return fmt.Errorf("corrupt inode map entry %q", line)
+	}
+	if ino >= m.next {
+		m.next = ino + 1
+	}
+	return nil
+}
+
+// compact rewrites the journal to contain only the current mappings, and opens it for appending.
+func (m *inodeMap) compact(fn string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "n %d\n", m.next)
+	for p, ino := range m.byPath {
+		if ino != rootInode {
+			fmt.Fprintf(w, "s %d %s\n", ino, strconv.Quote(p))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fn); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	m.journal = tmp
+	return nil
+}
+
+func (m *inodeMap) set(p string, ino uint64) {
+	if old, ok := m.byInode[ino]; ok {
+		delete(m.byPath, old)
+		m.unindex(old)
+	}
+	if old, ok := m.byPath[p]; ok {
+		delete(m.byInode, old)
+	}
+	m.byPath[p] = ino
+	m.byInode[ino] = p
+	m.index(p)
+}
+
+// forget deletes the mapping of p.
+func (m *inodeMap) forget(p string) {
+	delete(m.byInode, m.byPath[p])
+	delete(m.byPath, p)
+	m.unindex(p)
+}
+
+// index adds p, and its directories, to the children of their parents.
+func (m *inodeMap) index(p string) {
+	for p != "" {
+		dir := parentDir(p)
+		c, ok := m.children[dir]
+		if !ok {
+			c = map[string]struct{}{}
+			m.children[dir] = c
+		}
+		if _, ok := c[p]; ok {
+			return
+		}
+		c[p] = struct{}{}
+		p = dir
+	}
+}
+
+// unindex removes p from the children of its parent if neither it nor anything below it has a number anymore, and does the same for its directories.
+func (m *inodeMap) unindex(p string) {
+	for p != "" {
+		if _, ok := m.byPath[p]; ok || len(m.children[p]) > 0 {
+			return
+		}
+		dir := parentDir(p)
+		delete(m.children[dir], p)
+		if len(m.children[dir]) == 0 {
+			delete(m.children, dir)
+		}
+		p = dir
+	}
+}
+
+// subtree returns the mapped paths at and below p.
+func (m *inodeMap) subtree(p string) []string {
+	var ret []string
+	if _, ok := m.byPath[p]; ok {
+		ret = append(ret, p)
+	}
+	for c := range m.children[p] {
+		ret = append(ret, m.subtree(c)...)
+	}
+	return ret
+}
+
+func (m *inodeMap) write(format string, args ...interface{}) error {
+	if m.journal == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(m.journal, format, args...)
+	return err
+}
+
+// Get returns the inode number for the given path, allocating one if needed.
+func (m *inodeMap) Get(p string) (uint64, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if ino, ok := m.byPath[p]; ok {
+		return ino, nil
+	}
+	ino := m.next
+	if err := m.write("s %d %s\n", ino, strconv.Quote(p)); err != nil {
+		return 0, err
+	}
+	m.next++
+	m.set(p, ino)
+	return ino, nil
+}
+
+// Path returns the path that currently has the given inode number.
+func (m *inodeMap) Path(ino uint64) (string, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	p, ok := m.byInode[ino]
+	return p, ok
+}
+
+// Remove forgets the inode number of a path (and anything below it).
+func (m *inodeMap) Remove(p string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, q := range m.subtree(p) {
+		if err := m.write("d %d\n", m.byPath[q]); err != nil {
+			return err
+		}
+		m.forget(q)
+	}
+	return nil
+}
+
+// Rename moves the inode numbers of a path (and anything below it) to their new location.
+// Whatever was at the new location is forgotten.
+func (m *inodeMap) Rename(from, to string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if ino, ok := m.byPath[to]; ok && to != from {
+		if err := m.write("d %d\n", ino); err != nil {
+			return err
+		}
+		m.forget(to)
+	}
+	moved := map[string]uint64{}
+	for _, q := range m.subtree(from) {
+		moved[to+q[len(from):]] = m.byPath[q]
+	}
+	for np, ino := range moved {
+		if err := m.write("s %d %s\n", ino, strconv.Quote(np)); err != nil {
+			return err
+		}
+		m.set(np, ino)
+	}
+	return nil
+}
+
+// Close closes the journal.
+func (m *inodeMap) Close() error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.Close()
+}
@@ -0,0 +1,114 @@
+package billybazilfuse
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInodeMap(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// get are the paths numbered first, in order, so a gets 2, the next 3 and so on.
+		get []string
+		op  func(m *inodeMap) error
+		// want are the paths that should still have a number afterwards, and the number they should have.
+		want map[string]uint64
+	}{
+		{
+			name: "remove file",
+			get:  []string{"a", "b"},
+			op:   func(m *inodeMap) error { return m.Remove("a") },
+			want: map[string]uint64{"b": 3},
+		},
+		{
+			name: "remove directory",
+			get:  []string{"a", "a/b", "a/b/c", "ab"},
+			op:   func(m *inodeMap) error { return m.Remove("a") },
+			want: map[string]uint64{"ab": 5},
+		},
+		{
+			name: "remove below a directory without a number",
+			get:  []string{"a/b/c", "a/d"},
+			op:   func(m *inodeMap) error { return m.Remove("a") },
+			want: map[string]uint64{},
+		},
+		{
+			name: "rename directory",
+			get:  []string{"a", "a/b", "a/b/c", "ab"},
+			op:   func(m *inodeMap) error { return m.Rename("a", "x/y") },
+			want: map[string]uint64{"x/y": 2, "x/y/b": 3, "x/y/b/c": 4, "ab": 5},
+		},
+		{
+			name: "rename over other file",
+			get:  []string{"a", "b"},
+			op:   func(m *inodeMap) error { return m.Rename("a", "b") },
+			want: map[string]uint64{"b": 2},
+		},
+		{
+			name: "rename onto itself",
+			get:  []string{"a", "a/b"},
+			op:   func(m *inodeMap) error { return m.Rename("a", "a") },
+			want: map[string]uint64{"a": 2, "a/b": 3},
+		},
+		{
+			name: "rename, then remove the new location",
+			get:  []string{"a", "a/b"},
+			op: func(m *inodeMap) error {
+				if err := m.Rename("a", "c"); err != nil {
+					return err
+				}
+				return m.Remove("c")
+			},
+			want: map[string]uint64{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "inodes")
+			m, err := newInodeMap(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tc.get {
+				if _, err := m.Get(p); err != nil {
+					t.Fatalf("Get(%q): %v", p, err)
+				}
+			}
+			if err := tc.op(m); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			m.Close()
+			want := map[string]uint64{"": rootInode}
+			for p, ino := range tc.want {
+				want[p] = ino
+			}
+			if !reflect.DeepEqual(m.byPath, want) {
+				t.Errorf("mapping = %v; want %v", m.byPath, want)
+			}
+			for dir, c := range m.children {
+				for p := range c {
+					if len(m.subtree(p)) == 0 {
+						t.Errorf("%q is still indexed in %q without anything numbered below it", p, dir)
+					}
+				}
+			}
+
+			// After a remount, the same paths have the same numbers, and no number is handed out again.
+			m, err = newInodeMap(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if !reflect.DeepEqual(m.byPath, want) {
+				t.Errorf("mapping after remount = %v; want %v", m.byPath, want)
+			}
+			ino, err := m.Get("new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next := uint64(rootInode + 1 + len(tc.get)); ino != next {
+				t.Errorf("Get of a new path after remount = %d; want %d", ino, next)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Package adapter contains the Billy-facing logic that is shared between the different FUSE frontends.
+package adapter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Errno converts an error returned by Billy into an errno that can be returned to the kernel.
+func Errno(err error) syscall.Errno {
+	errno, _ := KnownErrno(err)
+	return errno
+}
+
+// KnownErrno is Errno, but also returns false if err wasn't recognized and is converted to EIO for lack of a better errno.
+func KnownErrno(err error) (syscall.Errno, bool) {
+	if err == nil {
+		return 0, true
+	}
+	// Errors from the OS, like an *fs.PathError for EACCES from osfs, keep their errno.
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno, true
+	}
+	if os.IsExist(err) {
+		return syscall.EEXIST, true
+	}
+	if os.IsNotExist(err) {
+		return syscall.ENOENT, true
+	}
+	if os.IsPermission(err) {
+		return syscall.EPERM, true
+	}
+	// Read-only billy implementations (like go-git's packfile and siva filesystems) fail writes with ErrReadOnly.
+	if errors.Is(err, billy.ErrReadOnly) {
+		return syscall.EROFS, true
+	}
+	// A path escaping a chroot (like a symlink or rename out of a go-git worktree) crosses into another filesystem as far as the kernel is concerned.
+	if errors.Is(err, billy.ErrCrossedBoundary) {
+		return syscall.EXDEV, true
+	}
+	if errors.Is(err, os.ErrInvalid) || errors.Is(err, os.ErrClosed) {
+		return syscall.EINVAL, true
+	}
+	if errors.Is(err, billy.ErrNotSupported) {
+		return syscall.ENOTSUP, true
+	}
+	if errors.Is(err, context.Canceled) {
+		return syscall.EINTR, true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return syscall.ETIMEDOUT, true
+	}
+	return syscall.EIO, false
+}
+
+// UnixMode converts an os.FileMode into the mode bits used by the kernel (including the S_IFMT bits).
+func UnixMode(mode os.FileMode) uint32 {
+	ret := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		ret |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		ret |= syscall.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		ret |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		ret |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		ret |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		ret |= syscall.S_IFBLK
+	default:
+		ret |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		ret |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		ret |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		ret |= syscall.S_ISVTX
+	}
+	return ret
+}
+
+// Mkdir creates a directory, or returns ENOSYS if the filesystem doesn't support directories.
+func Mkdir(fs billy.Basic, fn string, mode os.FileMode) error {
+	if dfs, ok := fs.(billy.Dir); ok {
+		return dfs.MkdirAll(fn, mode)
+	}
+	return syscall.ENOSYS
+}
+
+// ReadDir lists a directory, or returns ENOSYS if the filesystem doesn't support directories.
+func ReadDir(fs billy.Basic, fn string) ([]os.FileInfo, error) {
+	if dfs, ok := fs.(billy.Dir); ok {
+		return dfs.ReadDir(fn)
+	}
+	return nil, syscall.ENOSYS
+}
+
+// Symlink creates a symbolic link, or returns ENOSYS if the filesystem doesn't support symlinks.
+func Symlink(fs billy.Basic, target, fn string) error {
+	if sfs, ok := fs.(billy.Symlink); ok {
+		return sfs.Symlink(target, fn)
+	}
+	return syscall.ENOSYS
+}
+
+// Readlink reads the target of a symbolic link, or returns ENOSYS if the filesystem doesn't support symlinks.
+func Readlink(fs billy.Basic, fn string) (string, error) {
+	if sfs, ok := fs.(billy.Symlink); ok {
+		return sfs.Readlink(fn)
+	}
+	return "", syscall.ENOSYS
+}
+
+// SetattrRequest describes which attributes to change. Nil fields are left untouched.
+type SetattrRequest struct {
+	Mode  *os.FileMode
+	Uid   *uint32
+	Gid   *uint32
+	Atime *time.Time
+	Mtime *time.Time
+	Size  *uint64
+}
+
+// Setattr changes the attributes of a file.
+func Setattr(fs billy.Basic, fn string, req SetattrRequest) error {
+	if req.Mode != nil || req.Uid != nil || req.Gid != nil || req.Atime != nil || req.Mtime != nil {
+		cfs, ok := fs.(billy.Change)
+		if !ok {
+			return syscall.ENOTSUP
+		}
+		if req.Mode != nil {
+			if err := cfs.Chmod(fn, *req.Mode); err != nil {
+				return err
+			}
+		}
+		if req.Uid != nil || req.Gid != nil {
+			uid := -1
+			if req.Uid != nil {
+				uid = int(*req.Uid)
+			}
+			gid := -1
+			if req.Gid != nil {
+				gid = int(*req.Gid)
+			}
+			if err := cfs.Lchown(fn, uid, gid); err != nil {
+				return err
+			}
+		}
+		// TODO: Handle atime-only changes correctly.
+		if req.Mtime != nil {
+			var atime time.Time
+			if req.Atime != nil {
+				atime = *req.Atime
+			}
+			if err := cfs.Chtimes(fn, atime, *req.Mtime); err != nil {
+				return err
+			}
+		}
+	}
+	if req.Size != nil {
+		fh, err := fs.OpenFile(fn, os.O_WRONLY, 0777)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		if err := fh.Truncate(int64(*req.Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package adapter
+
+import "github.com/go-git/go-billy/v5"
+
+// copyBufferSize is the size of the buffer used to copy data when the backend can't copy it itself.
+const copyBufferSize = 128 * 1024
+
+// copier and cloner have the same methods as billybazilfuse.Copier and billybazilfuse.Cloner, which are documented there.
+type copier interface {
+	CopyRange(dst billy.File, dstOff int64, src billy.File, srcOff int64, n int64) (int64, error)
+}
+
+type cloner interface {
+	CloneRange(dst billy.File, dstOff int64, src billy.File, srcOff int64, n int64) (int64, error)
+}
+
+// CopyRange copies up to n bytes from src at srcOff to dst at dstOff, and returns the number of bytes copied, which is less than n only if src ends first.
+// If fs implements CloneRange or CopyRange (tried in that order), the backend copies the data itself. Otherwise, or if that isn't supported, the data is read and written here.
+func CopyRange(fs billy.Basic, dst *File, dstOff int64, src *File, srcOff int64, n int64) (int64, error) {
+	// The backend must see the data written through both files so far.
+	if err := src.Flush(); err != nil {
+		return 0, err
+	}
+	if err := dst.Flush(); err != nil {
+		return 0, err
+	}
+	if c, ok := fs.(cloner); ok && dst.ow == nil {
+		if copied, ok, err := dst.offload(func() (int64, error) { return c.CloneRange(dst.fh, dstOff, src.fh, srcOff, n) }); ok {
+			return copied, err
+		}
+	}
+	if c, ok := fs.(copier); ok && dst.ow == nil {
+		if copied, ok, err := dst.offload(func() (int64, error) { return c.CopyRange(dst.fh, dstOff, src.fh, srcOff, n) }); ok {
+			return copied, err
+		}
+	}
+	buf := make([]byte, copyBufferSize)
+	var copied int64
+	for copied < n {
+		chunk := buf
+		if rest := n - copied; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		m, err := src.ReadAt(chunk, srcOff+copied)
+		if err != nil {
+			return copied, err
+		}
+		if m == 0 {
+			break
+		}
+		w, err := dst.WriteAt(chunk[:m], dstOff+copied)
+		copied += int64(w)
+		if err != nil {
+			return copied, err
+		}
+		if m < len(chunk) {
+			break
+		}
+	}
+	return copied, nil
+}
+
+// offload runs a copy into f that is done by the backend, and returns whether the backend supported it.
+func (f *File) offload(copy func() (int64, error)) (int64, bool, error) {
+	f.dirty.Store(true)
+	if f.ra != nil {
+		f.ra.invalidate()
+	}
+	copied, err := copy()
+	return copied, !isUnsupported(err), err
+}
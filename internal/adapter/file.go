@@ -0,0 +1,276 @@
+package adapter
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// File serializes positional I/O on an open billy.File.
+//
+// FUSE sends reads and writes for one handle concurrently. If the file doesn't implement io.WriterAt, writes are emulated with Seek+Write.
+// Many backends implement ReadAt by seeking as well, so in that case reads take the same lock, to prevent them from moving the offset between a write's Seek and Write.
+// If ReadAt turns out not to be supported (as with some streaming backends), reads fall back to Seek+Read under the lock for the rest of the handle's lifetime.
+type File struct {
+	fh       billy.File
+	writerAt io.WriterAt
+
+	mtx          sync.Mutex
+	seekForReads atomic.Bool
+	// pathMtx is held as well for writes emulated with Seek+Write, if set. It's shared with the other files open at the same path.
+	pathMtx sync.Locker
+	// dirty is whether the file was written to since it was opened or last synced.
+	dirty atomic.Bool
+
+	wb *writeBuffer
+	ra *readAhead
+	ow *orderedWrites
+
+	mem     Memory
+	backlog func(delta int)
+	journal Journal
+	// maxRead and maxWrite are the largest read and write passed to the backend at once, or zero for unlimited.
+	maxRead  int
+	maxWrite int
+}
+
+// NewFile wraps fh. fh must not be used directly anymore.
+func NewFile(fh billy.File) *File {
+	f := &File{fh: fh}
+	f.writerAt, _ = fh.(io.WriterAt)
+	return f
+}
+
+// ReadAt reads from the file at the given offset. Hitting EOF is not considered an error.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	data, err := f.ReadAtView(p, off)
+	if len(data) > 0 && &data[0] != &p[0] {
+		copy(p, data)
+	}
+	return len(data), err
+}
+
+// ReadAtView is like ReadAt, but returns the data rather than the number of bytes read. If the file already holds the data (like when it was prefetched), that is returned without copying it into p.
+// The returned data must not be modified.
+func (f *File) ReadAtView(p []byte, off int64) ([]byte, error) {
+	if f.wb != nil {
+		if err := f.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	if f.ra != nil {
+		return f.readAheadView(p, off)
+	}
+	n, err := f.readDirect(p, off)
+	return p[:n], err
+}
+
+// SetMaxRead makes the file split reads into reads of at most n bytes from the backend, for backends that limit the size of a read.
+// Reads that return less than asked for without an error are continued, rather than treated as hitting the end of the file.
+// It must be called before the file is used.
+func (f *File) SetMaxRead(n int) {
+	f.maxRead = n
+}
+
+// readDirect reads from the backend.
+func (f *File) readDirect(p []byte, off int64) (int, error) {
+	if f.maxRead <= 0 {
+		return f.readChunk(p, off)
+	}
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > f.maxRead {
+			chunk = chunk[:f.maxRead]
+		}
+		m, err := f.readChunk(chunk, off+int64(n))
+		n += m
+		if err != nil || m == 0 {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readChunk does a single read from the backend.
+func (f *File) readChunk(p []byte, off int64) (int, error) {
+	if !f.seekForReads.Load() {
+		n, err := f.readAt(p, off)
+		if !isUnsupported(err) {
+			return n, err
+		}
+		f.seekForReads.Store(true)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, err := f.fh.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.fh, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if f.writerAt == nil {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+	}
+	n, err := f.fh.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// isUnsupported returns whether err indicates that the call isn't implemented.
+func isUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch Errno(err) {
+	case syscall.ENOSYS, syscall.ENOTSUP:
+		return true
+	}
+	return false
+}
+
+// WriteAt writes to the file at the given offset.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.dirty.Store(true)
+	if f.ra != nil {
+		f.ra.invalidate()
+	}
+	if f.ow != nil {
+		return f.orderedWriteAt(p, off)
+	}
+	return f.unorderedWriteAt(p, off)
+}
+
+func (f *File) unorderedWriteAt(p []byte, off int64) (int, error) {
+	if f.wb != nil {
+		return f.bufferedWriteAt(p, off)
+	}
+	return f.writeAt(p, off)
+}
+
+// SetMaxWrite makes the file split writes into writes of at most n bytes to the backend, for backends that limit the size of a write.
+// If one of them fails, the number of bytes written before it is returned with the error.
+// It must be called before the file is used.
+func (f *File) SetMaxWrite(n int) {
+	f.maxWrite = n
+}
+
+// writeAt writes to the backend.
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if f.maxWrite <= 0 || len(p) <= f.maxWrite {
+		return f.writeChunk(p, off)
+	}
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > f.maxWrite {
+			chunk = chunk[:f.maxWrite]
+		}
+		m, err := f.writeChunk(chunk, off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m < len(chunk) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// SeekingWriterAt is implemented by files that implement io.WriterAt, but might emulate it with Seek+Write, like wrappers around other files.
+type SeekingWriterAt interface {
+	SeeksForWrites() bool
+}
+
+func seeksForWrites(w io.WriterAt) bool {
+	s, ok := w.(SeekingWriterAt)
+	return ok && s.SeeksForWrites()
+}
+
+// SetPathLock makes writes emulated with Seek+Write hold l as well, so they can't interleave with writes through other files open at the same path.
+// It must be called before the file is used.
+func (f *File) SetPathLock(l sync.Locker) {
+	f.pathMtx = l
+}
+
+// writeChunk does a single write to the backend.
+func (f *File) writeChunk(p []byte, off int64) (int, error) {
+	if f.pathMtx != nil && (f.writerAt == nil || seeksForWrites(f.writerAt)) {
+		f.pathMtx.Lock()
+		defer f.pathMtx.Unlock()
+	}
+	if f.writerAt != nil {
+		return f.writerAt.WriteAt(p, off)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, err := f.fh.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return f.fh.Write(p)
+}
+
+// Truncate changes the size of the file.
+func (f *File) Truncate(size int64) error {
+	f.dirty.Store(true)
+	if f.ra != nil {
+		f.ra.invalidate()
+	}
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	return f.fh.Truncate(size)
+}
+
+// Dirty returns whether the file was written to since it was opened or last synced.
+func (f *File) Dirty() bool {
+	return f.dirty.Load()
+}
+
+// Sync writes out buffered data and, if the backend file supports it (like *os.File), flushes it to stable storage.
+// It does nothing if the file wasn't written to since it was last synced.
+func (f *File) Sync() error {
+	if !f.dirty.CompareAndSwap(true, false) {
+		return nil
+	}
+	err := f.flush()
+	if err == nil {
+		if s, ok := f.fh.(interface{ Sync() error }); ok {
+			err = s.Sync()
+		}
+	}
+	if err != nil {
+		f.dirty.Store(true)
+	}
+	return err
+}
+
+// Close flushes buffered writes and closes the file.
+func (f *File) Close() error {
+	if f.ra != nil {
+		f.ra.wait()
+		f.ra.invalidate()
+	}
+	err := f.Flush()
+	if f.wb != nil {
+		f.wb.mtx.Lock()
+		f.releaseBufferLocked()
+		f.wb.mtx.Unlock()
+	}
+	if cerr := f.fh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
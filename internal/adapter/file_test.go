@@ -0,0 +1,118 @@
+package adapter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// seekingFile is a billy.File without io.WriterAt whose ReadAt seeks, like many backends. It does no locking of its own, so the race detector catches any concurrent use that File lets through.
+type seekingFile struct {
+	data []byte
+	pos  int64
+	// noReadAt makes ReadAt fail with ENOSYS, like streaming backends.
+	noReadAt bool
+}
+
+func (s *seekingFile) Name() string { return "seeking" }
+
+func (s *seekingFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, fmt.Errorf("unsupported whence %d", whence)
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+func (s *seekingFile) Read(p []byte) (int, error) {
+	if s.pos >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[s.pos:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *seekingFile) ReadAt(p []byte, off int64) (int, error) {
+	if s.noReadAt {
+		return 0, &os.PathError{Op: "readat", Path: s.Name(), Err: syscall.ENOSYS}
+	}
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *seekingFile) Write(p []byte) (int, error) {
+	if end := s.pos + int64(len(p)); end > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, end-int64(len(s.data)))...)
+	}
+	n := copy(s.data[s.pos:], p)
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *seekingFile) Close() error              { return nil }
+func (s *seekingFile) Lock() error               { return nil }
+func (s *seekingFile) Unlock() error             { return nil }
+func (s *seekingFile) Truncate(size int64) error { s.data = s.data[:size]; return nil }
+
+const (
+	testBlockSize = 512
+	testBlocks    = 64
+)
+
+// testConcurrentIO writes every block of the file with its own byte while reading blocks concurrently, and checks that no read sees a block that's half written or read from the wrong offset.
+func testConcurrentIO(t *testing.T, fh *seekingFile) {
+	fh.data = make([]byte, testBlockSize*testBlocks)
+	f := NewFile(fh)
+	var wg sync.WaitGroup
+	for i := 0; i < testBlocks; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			block := bytes.Repeat([]byte{byte(i + 1)}, testBlockSize)
+			if n, err := f.WriteAt(block, int64(i*testBlockSize)); err != nil || n != len(block) {
+				t.Errorf("WriteAt(block %d) = %d, %v", i, n, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, testBlockSize)
+			n, err := f.ReadAt(buf, int64(i*testBlockSize))
+			if err != nil || n != len(buf) {
+				t.Errorf("ReadAt(block %d) = %d, %v", i, n, err)
+				return
+			}
+			if buf[0] != 0 && buf[0] != byte(i+1) {
+				t.Errorf("ReadAt(block %d) returned data of block %d", i, buf[0]-1)
+			}
+			if !bytes.Equal(buf, bytes.Repeat(buf[:1], testBlockSize)) {
+				t.Errorf("ReadAt(block %d) returned a mix of blocks", i)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < testBlocks; i++ {
+		if !bytes.Equal(fh.data[i*testBlockSize:(i+1)*testBlockSize], bytes.Repeat([]byte{byte(i + 1)}, testBlockSize)) {
+			t.Errorf("block %d wasn't written at its offset", i)
+		}
+	}
+}
+
+func TestFileConcurrentSeekingReadAt(t *testing.T) {
+	testConcurrentIO(t, &seekingFile{})
+}
+
+func TestFileConcurrentWithoutReadAt(t *testing.T) {
+	testConcurrentIO(t, &seekingFile{noReadAt: true})
+}
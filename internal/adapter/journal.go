@@ -0,0 +1,29 @@
+package adapter
+
+// Journal records writes before they're buffered, so they can be replayed if the process dies before they reach the backend.
+type Journal interface {
+	// Write records that data was written at off. If it fails, the write fails.
+	Write(off int64, data []byte) error
+	// Settled records that none of the writes recorded so far are pending anymore: they reached the backend, or writing them failed and the error was reported.
+	Settled()
+}
+
+// SetJournal makes the file record the writes it buffers to j.
+// It must be called before the file is used.
+func (f *File) SetJournal(j Journal) {
+	f.journal = j
+}
+
+// journalWrite records a write that is about to be buffered.
+func (f *File) journalWrite(p []byte, off int64) error {
+	if f.journal == nil {
+		return nil
+	}
+	return f.journal.Write(off, p)
+}
+
+func (f *File) journalSettled() {
+	if f.journal != nil {
+		f.journal.Settled()
+	}
+}
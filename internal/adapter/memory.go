@@ -0,0 +1,29 @@
+package adapter
+
+// Memory accounts for the memory held by the buffers of files, so it can be bounded across all of them.
+type Memory interface {
+	// Add is called with the number of bytes allocated (positive) or released (negative).
+	Add(delta int64)
+	// Over returns whether the budget is exceeded, in which case optional buffers (like prefetched data) aren't allocated.
+	Over() bool
+}
+
+// SetMemory makes the file account the memory of its write buffer and prefetched data to m.
+// It must be called before the file is used.
+func (f *File) SetMemory(m Memory) {
+	f.mem = m
+}
+
+func (f *File) account(delta int) {
+	if f.mem != nil && delta != 0 {
+		f.mem.Add(int64(delta))
+	}
+}
+
+// ReleaseMemory discards prefetched data, and starts writing buffered data in the background. Errors writing the data are returned by the next Flush.
+func (f *File) ReleaseMemory() {
+	if f.ra != nil {
+		f.ra.invalidate()
+	}
+	f.StartFlush()
+}
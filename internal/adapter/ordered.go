@@ -0,0 +1,64 @@
+package adapter
+
+import (
+	"sync"
+	"time"
+)
+
+// orderedWrites passes writes to the backend one at a time, in order of their offset when they're sequential.
+// The kernel may have multiple writes for a file in flight, and they're handled concurrently, so they can reach the backend in a different order than the kernel sent them.
+// Writes that would leave a gap after the previous write are held back until the gap is filled, or until timeout passes (for writers that really do skip ahead).
+type orderedWrites struct {
+	timeout time.Duration
+
+	mtx  sync.Mutex
+	busy bool
+	// next is the offset after the furthest write so far, or -1 if unknown.
+	next int64
+	// changed is closed (and replaced) whenever a write finishes.
+	changed chan struct{}
+}
+
+// EnableOrderedWrites makes writes reach the backend one at a time and in order, for backends where out-of-order writes are destructive (like append-only stores).
+// size is the current size of the file, or -1 if unknown. A write beyond the end of the data written so far waits up to timeout for the writes before it.
+// It must be called before the file is used.
+func (f *File) EnableOrderedWrites(size int64, timeout time.Duration) {
+	f.ow = &orderedWrites{timeout: timeout, next: size, changed: make(chan struct{})}
+}
+
+func (f *File) orderedWriteAt(p []byte, off int64) (int, error) {
+	ow := f.ow
+	var expired <-chan time.Time
+	gaveUp := false
+	ow.mtx.Lock()
+	for ow.busy || (!gaveUp && ow.next >= 0 && off > ow.next) {
+		if expired == nil && !ow.busy {
+			t := time.NewTimer(ow.timeout)
+			defer t.Stop()
+			expired = t.C
+		}
+		ch := ow.changed
+		ow.mtx.Unlock()
+		select {
+		case <-ch:
+		case <-expired:
+			// Stop waiting for the gap to be filled, but still wait our turn.
+			gaveUp = true
+		}
+		ow.mtx.Lock()
+	}
+	ow.busy = true
+	ow.mtx.Unlock()
+
+	n, err := f.unorderedWriteAt(p, off)
+
+	ow.mtx.Lock()
+	defer ow.mtx.Unlock()
+	ow.busy = false
+	if end := off + int64(n); end > ow.next {
+		ow.next = end
+	}
+	close(ow.changed)
+	ow.changed = make(chan struct{})
+	return n, err
+}
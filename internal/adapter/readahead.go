@@ -0,0 +1,189 @@
+package adapter
+
+import (
+	"context"
+	"sync"
+)
+
+// readAhead prefetches the data following sequential reads, so streaming a file isn't bound by one backend round trip per kernel read.
+type readAhead struct {
+	size    int
+	gate    func(ctx context.Context) (func(), error)
+	account func(delta int)
+	// ctx is cancelled when the file is closed, so prefetches still waiting for the gate are abandoned.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mtx sync.Mutex
+	// next is where the next read would start if reads are sequential.
+	next int64
+	// gen is increased whenever the file is modified, so prefetches that were in flight at the time are discarded.
+	gen uint64
+	// data is the prefetched data, starting at off. eof is whether it runs up to the end of the file.
+	off      int64
+	data     []byte
+	eof      bool
+	fetching *prefetch
+}
+
+type prefetch struct {
+	off  int64
+	size int
+	// started is closed once the gate let the prefetch through.
+	started chan struct{}
+	done    chan struct{}
+}
+
+// EnableReadAhead makes the file prefetch size bytes in the background when it's read sequentially.
+// Writes through the file discard prefetched data, but changes made through other files aren't noticed until the prefetched data has been read.
+// If gate isn't nil, it is called before every prefetch and may block until ctx is cancelled; the function it returns is called when the prefetch is done.
+// Reads never wait for a prefetch that's still waiting for the gate, but read directly instead.
+// It must be called before the file is used.
+func (f *File) EnableReadAhead(size int, gate func(ctx context.Context) (func(), error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.ra = &readAhead{size: size, gate: gate, account: f.account, ctx: ctx, cancel: cancel}
+}
+
+// SetReadAheadSize changes how much the file prefetches, or stops it from prefetching if size is zero. It does nothing if read-ahead wasn't enabled.
+func (f *File) SetReadAheadSize(size int) {
+	if f.ra == nil {
+		return
+	}
+	f.ra.mtx.Lock()
+	defer f.ra.mtx.Unlock()
+	f.ra.size = size
+}
+
+// readAheadView reads len(p) bytes at off, returning prefetched data without copying it if possible, and otherwise reading into p.
+func (f *File) readAheadView(p []byte, off int64) ([]byte, error) {
+	ra := f.ra
+	ra.mtx.Lock()
+	for {
+		if data, ok := ra.viewLocked(len(p), off); ok {
+			ra.next = off + int64(len(data))
+			if end := ra.off + int64(len(ra.data)); !ra.eof && end-ra.next < int64(ra.size/2) {
+				f.prefetchLocked(end)
+			}
+			ra.mtx.Unlock()
+			return data, nil
+		}
+		pf := ra.fetching
+		if pf == nil || off < pf.off || off >= pf.off+int64(pf.size) || !pf.running() {
+			break
+		}
+		// The data we need is on its way.
+		ra.mtx.Unlock()
+		<-pf.done
+		ra.mtx.Lock()
+	}
+	sequential := off == ra.next
+	ra.mtx.Unlock()
+
+	n, err := f.readDirect(p, off)
+	if err != nil {
+		return p[:n], err
+	}
+	ra.mtx.Lock()
+	ra.next = off + int64(n)
+	if sequential && n == len(p) {
+		f.prefetchLocked(ra.next)
+	}
+	ra.mtx.Unlock()
+	return p[:n], nil
+}
+
+// viewLocked returns the prefetched data at off, if it covers size bytes (or up to the end of the file).
+// Prefetched data is never modified once it's stored, so the returned slice stays valid.
+func (ra *readAhead) viewLocked(size int, off int64) ([]byte, bool) {
+	if off < ra.off || off >= ra.off+int64(len(ra.data)) {
+		return nil, false
+	}
+	data := ra.data[off-ra.off:]
+	if len(data) > size {
+		return data[:size], true
+	}
+	return data, len(data) == size || ra.eof
+}
+
+// prefetchLocked starts reading size bytes from off in the background, unless a prefetch is already running.
+func (f *File) prefetchLocked(off int64) {
+	ra := f.ra
+	if ra.fetching != nil || ra.size <= 0 || (f.mem != nil && f.mem.Over()) {
+		return
+	}
+	pf := &prefetch{off: off, size: ra.size, started: make(chan struct{}), done: make(chan struct{})}
+	ra.fetching = pf
+	gen := ra.gen
+	go func() {
+		if ra.gate != nil {
+			done, err := ra.gate(ra.ctx)
+			if err != nil {
+				ra.mtx.Lock()
+				ra.fetching = nil
+				close(pf.done)
+				ra.mtx.Unlock()
+				return
+			}
+			defer done()
+		}
+		close(pf.started)
+		buf := make([]byte, pf.size)
+		ra.account(len(buf))
+		n, err := f.readDirect(buf, off)
+		ra.mtx.Lock()
+		defer ra.mtx.Unlock()
+		defer close(pf.done)
+		ra.fetching = nil
+		if err != nil || ra.gen != gen {
+			ra.account(-len(buf))
+			return
+		}
+		held := cap(ra.data)
+		defer func() {
+			ra.account(cap(ra.data) - held - len(buf))
+		}()
+		if off == ra.off+int64(len(ra.data)) && ra.next >= ra.off && ra.next <= off {
+			// Keep the prefetched data that hasn't been read yet.
+			keep := ra.data[ra.next-ra.off:]
+			data := make([]byte, 0, len(keep)+n)
+			data = append(data, keep...)
+			ra.data = append(data, buf[:n]...)
+			ra.off = ra.next
+		} else {
+			ra.off = off
+			ra.data = buf[:n]
+		}
+		ra.eof = n < pf.size
+	}()
+}
+
+// running returns whether the prefetch got past the gate and is reading.
+func (pf *prefetch) running() bool {
+	select {
+	case <-pf.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// invalidate discards prefetched data.
+func (ra *readAhead) invalidate() {
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	ra.gen++
+	ra.account(-cap(ra.data))
+	ra.data = nil
+	ra.eof = false
+}
+
+// wait abandons a prefetch that's still waiting for the gate, and waits for a running one to finish. No prefetches are started afterwards.
+func (ra *readAhead) wait() {
+	ra.cancel()
+	ra.mtx.Lock()
+	pf := ra.fetching
+	ra.mtx.Unlock()
+	if pf != nil {
+		<-pf.done
+	}
+}
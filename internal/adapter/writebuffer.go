@@ -0,0 +1,281 @@
+package adapter
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// writeBuffer collects adjacent small writes, so they can be passed to the backend as one larger write.
+type writeBuffer struct {
+	size   int
+	maxAge time.Duration
+	// spillDir is where buffers are kept instead of in memory when the memory budget is exceeded, up to spillSize bytes. It's empty if they aren't.
+	spillDir  string
+	spillSize int
+
+	mtx  sync.Mutex
+	off  int64
+	data []byte
+	// spill holds the buffered data instead of data if it was spilled to disk. The data that wasn't written yet starts at spillStart and ends at spillEnd.
+	spill      *os.File
+	spillStart int64
+	spillEnd   int64
+	timer      *time.Timer
+	// err is the error of a flush that happened in the background. It's returned by the next call to Flush.
+	err error
+}
+
+// EnableWriteBuffer makes the file buffer up to size bytes of adjacent writes before passing them on to the backend.
+// Buffered data is written when a non-adjacent write comes in, when the file is read from, truncated, flushed or closed, and at the latest after maxAge.
+// It must be called before the file is used.
+func (f *File) EnableWriteBuffer(size int, maxAge time.Duration) {
+	f.wb = &writeBuffer{size: size, maxAge: maxAge}
+}
+
+// EnableSpill makes the file buffer writes in an unlinked file in dir instead of in memory when the Memory passed to SetMemory is over its budget, buffering up to size bytes there.
+// It must be called before the file is used.
+func (f *File) EnableSpill(dir string, size int) {
+	f.wb.spillDir = dir
+	f.wb.spillSize = size
+}
+
+// buffered returns the number of bytes in the buffer.
+func (wb *writeBuffer) buffered() int {
+	if wb.spill != nil {
+		return int(wb.spillEnd - wb.spillStart)
+	}
+	return len(wb.data)
+}
+
+// limit returns the number of bytes the buffer can hold.
+func (wb *writeBuffer) limit() int {
+	if wb.spill != nil {
+		return wb.spillSize
+	}
+	return wb.size
+}
+
+// appendLocked adds p to the buffer. wb.mtx must be held.
+func (wb *writeBuffer) appendLocked(p []byte) error {
+	if wb.spill == nil {
+		wb.data = append(wb.data, p...)
+		return nil
+	}
+	if _, err := wb.spill.WriteAt(p, wb.spillEnd); err != nil {
+		return err
+	}
+	wb.spillEnd += int64(len(p))
+	return nil
+}
+
+func (f *File) bufferedWriteAt(p []byte, off int64) (int, error) {
+	wb := f.wb
+	wb.mtx.Lock()
+	defer wb.mtx.Unlock()
+	if n := wb.buffered(); n > 0 && off == wb.off+int64(n) && n+len(p) <= wb.limit() {
+		if err := f.journalWrite(p, off); err != nil {
+			return 0, err
+		}
+		if err := wb.appendLocked(p); err != nil {
+			return 0, err
+		}
+		f.addBacklog(len(p))
+		return len(p), nil
+	}
+	if err := f.flushLocked(); err != nil {
+		return 0, err
+	}
+	if len(p) >= wb.size {
+		return f.writeAt(p, off)
+	}
+	if err := f.journalWrite(p, off); err != nil {
+		return 0, err
+	}
+	if wb.data == nil && wb.spill == nil {
+		if wb.spillDir != "" && f.mem != nil && f.mem.Over() {
+			f.startSpillLocked()
+		}
+		if wb.spill == nil {
+			wb.data = make([]byte, 0, wb.size)
+			f.account(wb.size)
+		}
+	}
+	wb.off = off
+	if err := wb.appendLocked(p); err != nil {
+		return 0, err
+	}
+	f.addBacklog(len(p))
+	if wb.maxAge > 0 {
+		wb.timer = time.AfterFunc(wb.maxAge, f.flushInBackground)
+	}
+	return len(p), nil
+}
+
+// BufferedEnd returns the offset just past the data that was written to the file but is still buffered, or 0 if nothing is buffered.
+func (f *File) BufferedEnd() int64 {
+	if f.wb == nil {
+		return 0
+	}
+	f.wb.mtx.Lock()
+	defer f.wb.mtx.Unlock()
+	n := f.wb.buffered()
+	if n == 0 {
+		return 0
+	}
+	return f.wb.off + int64(n)
+}
+
+// SetBacklog makes the file call backlog with the change in the number of bytes that were written to it but not yet to the backend.
+// It must be called before the file is used.
+func (f *File) SetBacklog(backlog func(delta int)) {
+	f.backlog = backlog
+}
+
+func (f *File) addBacklog(delta int) {
+	if f.backlog != nil && delta != 0 {
+		f.backlog(delta)
+	}
+}
+
+// StartFlush starts writing buffered data in the background. Errors doing so are returned by the next Flush.
+func (f *File) StartFlush() {
+	if f.wb != nil {
+		go f.flushInBackground()
+	}
+}
+
+func (f *File) flushInBackground() {
+	f.wb.mtx.Lock()
+	defer f.wb.mtx.Unlock()
+	if err := f.flushLocked(); err != nil && f.wb.err == nil {
+		f.wb.err = err
+	}
+}
+
+// flushLocked writes out the buffered data. wb.mtx must be held.
+func (f *File) flushLocked() error {
+	wb := f.wb
+	if wb.timer != nil {
+		wb.timer.Stop()
+		wb.timer = nil
+	}
+	if wb.spill != nil {
+		return f.flushSpillLocked()
+	}
+	data := wb.data
+	for len(data) > 0 {
+		n, err := f.writeAt(data, wb.off)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		wb.off += int64(n)
+		data = data[n:]
+		f.addBacklog(-n)
+		if err != nil {
+			// Keep what wasn't written, so a retry can write it.
+			wb.data = append(wb.data[:0], data...)
+			return err
+		}
+	}
+	if len(wb.data) > 0 {
+		f.journalSettled()
+	}
+	wb.data = wb.data[:0]
+	if f.mem != nil {
+		// Don't hold on to memory that's accounted for.
+		f.releaseBufferLocked()
+	}
+	return nil
+}
+
+// releaseBufferLocked frees the buffer, discarding any data in it. wb.mtx must be held.
+func (f *File) releaseBufferLocked() {
+	if f.wb.spill != nil {
+		f.releaseSpillLocked()
+		return
+	}
+	if f.wb.data != nil {
+		if len(f.wb.data) > 0 {
+			// The data is discarded.
+			f.journalSettled()
+		}
+		f.addBacklog(-len(f.wb.data))
+		f.account(-f.wb.size)
+		f.wb.data = nil
+	}
+}
+
+// Flush writes out buffered data, and returns any error that happened while doing so in the background. It does nothing for files that weren't written to.
+func (f *File) Flush() error {
+	if !f.dirty.Load() {
+		return nil
+	}
+	return f.flush()
+}
+
+func (f *File) flush() error {
+	if f.wb == nil {
+		return nil
+	}
+	f.wb.mtx.Lock()
+	defer f.wb.mtx.Unlock()
+	err := f.flushLocked()
+	if f.wb.err != nil {
+		err, f.wb.err = f.wb.err, nil
+	}
+	return err
+}
+
+// startSpillLocked makes the buffer hold data in a file in spillDir rather than in memory. If that file can't be created, the buffer stays in memory. wb.mtx must be held.
+func (f *File) startSpillLocked() {
+	wb := f.wb
+	sf, err := os.CreateTemp(wb.spillDir, "spill-")
+	if err != nil {
+		return
+	}
+	// Nobody else needs to see it, and this way it's cleaned up whatever happens to the process.
+	os.Remove(sf.Name())
+	wb.spill = sf
+	wb.spillStart, wb.spillEnd = 0, 0
+}
+
+// flushSpillLocked writes out the data buffered in the spill file, and then drops the file. wb.mtx must be held.
+func (f *File) flushSpillLocked() error {
+	wb := f.wb
+	buf := make([]byte, wb.size)
+	for wb.spillStart < wb.spillEnd {
+		chunk := buf
+		if rest := wb.spillEnd - wb.spillStart; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		if _, err := wb.spill.ReadAt(chunk, wb.spillStart); err != nil {
+			return err
+		}
+		n, err := f.writeAt(chunk, wb.off)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		wb.off += int64(n)
+		wb.spillStart += int64(n)
+		f.addBacklog(-n)
+		if err != nil {
+			return err
+		}
+	}
+	f.journalSettled()
+	f.releaseSpillLocked()
+	return nil
+}
+
+// releaseSpillLocked closes the spill file, discarding any data in it. wb.mtx must be held.
+func (f *File) releaseSpillLocked() {
+	wb := f.wb
+	if n := wb.spillEnd - wb.spillStart; n > 0 {
+		f.journalSettled()
+		f.addBacklog(-int(n))
+	}
+	wb.spill.Close()
+	wb.spill = nil
+}
@@ -0,0 +1,218 @@
+// Package backend creates Billy filesystems from a type and string parameters, for the command line tools.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	billybazilfuse "github.com/Jille/billy-bazilfuse"
+	"github.com/Jille/billy-bazilfuse/internal/sftpfs"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Types are the supported backend types.
+var Types = []string{"memfs", "osfs", "sftp"}
+
+// Open creates a backend of the given type. The returned Closer releases its resources (like network connections) and is never nil.
+//
+// The parameters per type are:
+//   - memfs: none.
+//   - osfs: path, the local directory.
+//   - sftp: host (with an optional port), user, password or key (a private key file), known_hosts (defaults to ~/.ssh/known_hosts) and path, the directory on the server.
+func Open(typ string, params map[string]string) (billy.Basic, io.Closer, error) {
+	var allowed []string
+	switch typ {
+	case "memfs":
+	case "osfs":
+		allowed = []string{"path"}
+	case "sftp":
+		allowed = []string{"host", "user", "password", "key", "known_hosts", "path"}
+	default:
+		return nil, nil, fmt.Errorf("unknown backend type %q (supported: %s)", typ, strings.Join(Types, ", "))
+	}
+	if err := checkParams(params, allowed); err != nil {
+		return nil, nil, fmt.Errorf("backend %s: %w", typ, err)
+	}
+	switch typ {
+	case "memfs":
+		return memfs.New(), nopCloser{}, nil
+	case "osfs":
+		if params["path"] == "" {
+			return nil, nil, fmt.Errorf("backend osfs: missing parameter path")
+		}
+		return osfs.New(params["path"]), nopCloser{}, nil
+	default:
+		return openSFTP(params)
+	}
+}
+
+func checkParams(params map[string]string, allowed []string) error {
+	var unknown []string
+	for k := range params {
+		found := false
+		for _, a := range allowed {
+			if k == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameters %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func openSFTP(params map[string]string) (billy.Basic, io.Closer, error) {
+	host := params["host"]
+	if host == "" {
+		return nil, nil, fmt.Errorf("backend sftp: missing parameter host")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	cfg := &ssh.ClientConfig{
+		User: params["user"],
+	}
+	if cfg.User == "" {
+		return nil, nil, fmt.Errorf("backend sftp: missing parameter user")
+	}
+	if p := params["password"]; p != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(p))
+	}
+	if k := params["key"]; k != "" {
+		pem, err := os.ReadFile(k)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backend sftp: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backend sftp: failed to parse key %q: %w", k, err)
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if len(cfg.Auth) == 0 {
+		return nil, nil, fmt.Errorf("backend sftp: need a password or key")
+	}
+	kh := params["known_hosts"]
+	if kh == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("backend sftp: no known_hosts given: %w", err)
+		}
+		kh = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(kh)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backend sftp: %w", err)
+	}
+	cfg.HostKeyCallback = hostKeys
+
+	root := params["path"]
+	if root == "" {
+		root = "."
+	}
+	sc := &sftpConn{host: host, cfg: cfg, root: root}
+	fs, err := sc.dial(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("backend sftp: %w", err)
+	}
+	return &sftpBackend{fs, sc}, sc, nil
+}
+
+// sftpBackend is an SFTP filesystem that can reconnect when the connection drops.
+type sftpBackend struct {
+	*sftpfs.FS
+	conn *sftpConn
+}
+
+var _ billybazilfuse.Reconnector = &sftpBackend{}
+
+func (b *sftpBackend) IsConnectionError(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection)
+}
+
+func (b *sftpBackend) Reconnect(ctx context.Context) (billybazilfuse.Reconnector, error) {
+	fs, err := b.conn.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpBackend{fs, b.conn}, nil
+}
+
+// sftpConn connects to an SFTP server, and closes the previous connection when it connects again.
+type sftpConn struct {
+	host string
+	cfg  *ssh.ClientConfig
+	root string
+
+	mtx    sync.Mutex
+	closer closers
+}
+
+func (c *sftpConn) dial(ctx context.Context) (*sftpfs.FS, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.host)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(nc, c.host, c.cfg)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.mtx.Lock()
+	old := c.closer
+	c.closer = closers{client, conn}
+	c.mtx.Unlock()
+	old.Close()
+	return sftpfs.New(client, c.root), nil
+}
+
+// Close closes the current connection.
+func (c *sftpConn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.closer.Close()
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var ret error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -0,0 +1,122 @@
+// Package sftpfs is a minimal Billy filesystem on top of an SFTP client, for the command line tools.
+package sftpfs
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/sftp"
+)
+
+// FS exposes the directory root on an SFTP server as a Billy filesystem.
+// Permissions of new files and directories are left to the server.
+type FS struct {
+	client *sftp.Client
+	root   string
+}
+
+var _ billy.Basic = &FS{}
+var _ billy.Dir = &FS{}
+var _ billy.Symlink = &FS{}
+var _ billy.Change = &FS{}
+
+// New creates an FS for the directory root on the server client is connected to.
+func New(client *sftp.Client, root string) *FS {
+	return &FS{client: client, root: root}
+}
+
+func (fs *FS) abs(fn string) string {
+	return path.Join(fs.root, fn)
+}
+
+func (fs *FS) Create(fn string) (billy.File, error) {
+	return fs.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *FS) Open(fn string) (billy.File, error) {
+	return fs.OpenFile(fn, os.O_RDONLY, 0)
+}
+
+func (fs *FS) OpenFile(fn string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.client.OpenFile(fs.abs(fn), flag)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, name: fn}, nil
+}
+
+func (fs *FS) Stat(fn string) (os.FileInfo, error) {
+	return fs.client.Stat(fs.abs(fn))
+}
+
+func (fs *FS) Lstat(fn string) (os.FileInfo, error) {
+	return fs.client.Lstat(fs.abs(fn))
+}
+
+// Rename renames a file, replacing newpath if it exists. Servers without the posix-rename extension refuse to replace files.
+func (fs *FS) Rename(oldpath, newpath string) error {
+	if err := fs.client.PosixRename(fs.abs(oldpath), fs.abs(newpath)); err == nil {
+		return nil
+	}
+	return fs.client.Rename(fs.abs(oldpath), fs.abs(newpath))
+}
+
+func (fs *FS) Remove(fn string) error {
+	return fs.client.Remove(fs.abs(fn))
+}
+
+func (fs *FS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (fs *FS) ReadDir(fn string) ([]os.FileInfo, error) {
+	return fs.client.ReadDir(fs.abs(fn))
+}
+
+func (fs *FS) MkdirAll(fn string, perm os.FileMode) error {
+	return fs.client.MkdirAll(fs.abs(fn))
+}
+
+func (fs *FS) Symlink(target, link string) error {
+	return fs.client.Symlink(target, fs.abs(link))
+}
+
+func (fs *FS) Readlink(link string) (string, error) {
+	return fs.client.ReadLink(fs.abs(link))
+}
+
+func (fs *FS) Chmod(name string, mode os.FileMode) error {
+	return fs.client.Chmod(fs.abs(name), mode)
+}
+
+func (fs *FS) Lchown(name string, uid, gid int) error {
+	// SFTP has no lchown; changing the owner of a link changes its target.
+	return fs.client.Chown(fs.abs(name), uid, gid)
+}
+
+func (fs *FS) Chown(name string, uid, gid int) error {
+	return fs.client.Chown(fs.abs(name), uid, gid)
+}
+
+func (fs *FS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.client.Chtimes(fs.abs(name), atime, mtime)
+}
+
+type file struct {
+	*sftp.File
+	name string
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) Lock() error {
+	return nil
+}
+
+func (f *file) Unlock() error {
+	return nil
+}
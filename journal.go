@@ -0,0 +1,210 @@
+package billybazilfuse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+	"github.com/go-git/go-billy/v5"
+	"golang.org/x/sys/unix"
+)
+
+// Records in the write journal consist of a header, a payload and the CRC-32 of both.
+// The header holds the kind, the id of the file, the offset and the length of the payload.
+const journalHeaderSize = 1 + 8 + 8 + 4
+
+const (
+	// journalPath declares the path of a file. The payload is the path.
+	journalPath = 'P'
+	// journalWrite records a buffered write at the offset. The payload is the data.
+	journalWrite = 'W'
+	// journalSettled records that none of the writes to the file before it are pending.
+	journalSettled = 'S'
+)
+
+// writeJournal records writes that are buffered with Options.WriteBufferSize in a local file, so they can be replayed on the backend if the process dies before writing them out.
+// The file is emptied whenever no writes are pending.
+type writeJournal struct {
+	mtx    sync.Mutex
+	f      *os.File
+	nextID uint64
+	// pending is the number of files with pending writes.
+	pending int
+	// gen is increased whenever the journal is emptied, after which files must record their path again.
+	gen uint64
+}
+
+// openWriteJournal replays the writes that were pending in the journal at fn on fs, and then opens it to record new writes.
+// The journal is locked for as long as it's open, as record ids are per filesystem and emptying it would drop the pending writes of another one.
+func openWriteJournal(fn string, fs billy.Basic) (*writeJournal, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, fmt.Errorf("billy-bazilfuse: write journal %s is in use by another filesystem", fn)
+		}
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := replayJournal(data, fs); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("billy-bazilfuse: replaying write journal %s: %w", fn, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &writeJournal{f: f, gen: 1}, nil
+}
+
+// replayJournal writes the pending writes recorded in data to fs. A torn record at the end (from a crash while it was appended) is ignored.
+func replayJournal(data []byte, fs billy.Basic) error {
+	type journaledFile struct {
+		path   string
+		writes [][]byte // records
+	}
+	files := map[uint64]*journaledFile{}
+	var order []uint64
+	for len(data) >= journalHeaderSize+4 {
+		size := journalHeaderSize + int(binary.LittleEndian.Uint32(data[17:21]))
+		if len(data) < size+4 || crc32.ChecksumIEEE(data[:size]) != binary.LittleEndian.Uint32(data[size:]) {
+			break
+		}
+		rec := data[:size]
+		data = data[size+4:]
+		id := binary.LittleEndian.Uint64(rec[1:9])
+		switch rec[0] {
+		case journalPath:
+			files[id] = &journaledFile{path: string(rec[journalHeaderSize:])}
+			order = append(order, id)
+		case journalWrite:
+			if jf := files[id]; jf != nil {
+				jf.writes = append(jf.writes, rec)
+			}
+		case journalSettled:
+			if jf := files[id]; jf != nil {
+				jf.writes = nil
+			}
+		}
+	}
+	for _, id := range order {
+		jf := files[id]
+		if len(jf.writes) == 0 {
+			continue
+		}
+		fh, err := fs.OpenFile(jf.path, os.O_WRONLY, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The file was removed.
+				continue
+			}
+			return err
+		}
+		f := adapter.NewFile(fh)
+		for _, rec := range jf.writes {
+			off := int64(binary.LittleEndian.Uint64(rec[9:17]))
+			if _, err := f.WriteAt(rec[journalHeaderSize:], off); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendLocked writes a record to the journal. j.mtx must be held.
+func (j *writeJournal) appendLocked(kind byte, id uint64, off int64, payload []byte) error {
+	rec := make([]byte, journalHeaderSize+len(payload)+4)
+	rec[0] = kind
+	binary.LittleEndian.PutUint64(rec[1:9], id)
+	binary.LittleEndian.PutUint64(rec[9:17], uint64(off))
+	binary.LittleEndian.PutUint32(rec[17:21], uint32(len(payload)))
+	copy(rec[journalHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(rec[len(rec)-4:], crc32.ChecksumIEEE(rec[:len(rec)-4]))
+	// A single write, so a crash can only tear the last record.
+	_, err := j.f.Write(rec)
+	return err
+}
+
+// forFile returns the journal for a file opened at p.
+func (j *writeJournal) forFile(p string) adapter.Journal {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.nextID++
+	return &journaledFile{j: j, id: j.nextID, path: p}
+}
+
+// Close closes the journal. It must only be called when no writes are pending.
+func (j *writeJournal) Close() error {
+	return j.f.Close()
+}
+
+// journaledFile is the journal of one open file.
+type journaledFile struct {
+	j    *writeJournal
+	id   uint64
+	path string
+	// pending is whether writes were recorded since the file was last settled, and declared the generation of the journal its path was last recorded in. They're protected by j.mtx.
+	pending  bool
+	declared uint64
+}
+
+var _ adapter.Journal = &journaledFile{}
+
+func (jf *journaledFile) Write(off int64, data []byte) error {
+	j := jf.j
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if jf.declared != j.gen {
+		if err := j.appendLocked(journalPath, jf.id, 0, []byte(jf.path)); err != nil {
+			return err
+		}
+		jf.declared = j.gen
+	}
+	if err := j.appendLocked(journalWrite, jf.id, off, data); err != nil {
+		return err
+	}
+	if !jf.pending {
+		jf.pending = true
+		j.pending++
+	}
+	return nil
+}
+
+func (jf *journaledFile) Settled() {
+	j := jf.j
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if !jf.pending {
+		return
+	}
+	jf.pending = false
+	j.pending--
+	if j.pending == 0 {
+		// Nothing needs to be replayed anymore.
+		if err := j.f.Truncate(0); err == nil {
+			j.gen++
+			return
+		}
+	}
+	// If this fails, so does recording the next write.
+	j.appendLocked(journalSettled, jf.id, 0, nil)
+}
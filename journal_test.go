@@ -0,0 +1,144 @@
+package billybazilfuse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+func recordWrite(t *testing.T, jf adapter.Journal, off int64, data string) {
+	t.Helper()
+	if err := jf.Write(off, []byte(data)); err != nil {
+		t.Fatalf("journal Write: %v", err)
+	}
+}
+
+func TestWriteJournalReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// record records writes to the journal, which are then lost in a crash.
+		record func(t *testing.T, j *writeJournal)
+		// tear cuts this many bytes off the end of the journal, like a crash while appending the last record does.
+		tear int64
+		want map[string]string
+	}{
+		{
+			name: "pending writes",
+			record: func(t *testing.T, j *writeJournal) {
+				jf := j.forFile("f")
+				recordWrite(t, jf, 0, "AB")
+				recordWrite(t, jf, 4, "CD")
+			},
+			want: map[string]string{"f": "ABntCDt", "g": "content"},
+		},
+		{
+			name: "settled writes",
+			record: func(t *testing.T, j *writeJournal) {
+				jf := j.forFile("f")
+				recordWrite(t, jf, 0, "AB")
+				jf.Settled()
+			},
+			want: map[string]string{"f": "content", "g": "content"},
+		},
+		{
+			name: "one of two files settled",
+			record: func(t *testing.T, j *writeJournal) {
+				f, g := j.forFile("f"), j.forFile("g")
+				recordWrite(t, f, 0, "AB")
+				recordWrite(t, g, 0, "CD")
+				f.Settled()
+			},
+			want: map[string]string{"f": "content", "g": "CDntent"},
+		},
+		{
+			name: "written again after the journal was emptied",
+			record: func(t *testing.T, j *writeJournal) {
+				jf := j.forFile("f")
+				recordWrite(t, jf, 0, "AB")
+				jf.Settled()
+				recordWrite(t, jf, 2, "CD")
+			},
+			want: map[string]string{"f": "coCDent", "g": "content"},
+		},
+		{
+			name: "torn last record",
+			record: func(t *testing.T, j *writeJournal) {
+				jf := j.forFile("f")
+				recordWrite(t, jf, 0, "AB")
+				recordWrite(t, jf, 4, "CD")
+			},
+			tear: 3,
+			want: map[string]string{"f": "ABntent", "g": "content"},
+		},
+		{
+			name: "removed file",
+			record: func(t *testing.T, j *writeJournal) {
+				recordWrite(t, j.forFile("gone"), 0, "AB")
+				recordWrite(t, j.forFile("f"), 0, "CD")
+			},
+			want: map[string]string{"f": "CDntent", "g": "content"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "journal")
+			backend := memfs.New()
+			for _, p := range []string{"f", "g"} {
+				if err := util.WriteFile(backend, p, []byte("content"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			j, err := openWriteJournal(fn, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.record(t, j)
+			j.Close()
+			if tc.tear > 0 {
+				fi, err := os.Stat(fn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(fn, fi.Size()-tc.tear); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			j, err = openWriteJournal(fn, backend)
+			if err != nil {
+				t.Fatalf("replaying the journal: %v", err)
+			}
+			defer j.Close()
+			for p, want := range tc.want {
+				data, err := util.ReadFile(backend, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != want {
+					t.Errorf("%s has %q after replaying the journal; want %q", p, data, want)
+				}
+			}
+			if fi, err := os.Stat(fn); err != nil {
+				t.Fatal(err)
+			} else if fi.Size() != 0 {
+				t.Errorf("the journal has %d bytes after replaying it; want it emptied", fi.Size())
+			}
+		})
+	}
+}
+
+func TestWriteJournalIsLocked(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "journal")
+	j, err := openWriteJournal(fn, memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if j2, err := openWriteJournal(fn, memfs.New()); err == nil {
+		j2.Close()
+		t.Errorf("a journal in use by another filesystem was opened")
+	}
+}
@@ -4,15 +4,18 @@ package billybazilfuse
 import (
 	"context"
 	"errors"
-	"io"
+	"fmt"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
 	"github.com/go-git/go-billy/v5"
 )
 
@@ -22,34 +25,560 @@ type CallHook func(ctx context.Context, req fuse.Request) error
 // New creates a fuse/fs.FS that passes all calls through to the given filesystem.
 // callHook is called before every call from FUSE, and can be nil.
 func New(underlying billy.Basic, callHook CallHook) fs.FS {
+	f, err := NewWithOptions(underlying, Options{CallHook: callHook})
+	if err != nil {
+		// Only optional features can fail to initialize.
+		panic(err)
+	}
+	return f
+}
+
+// NewWithOptions creates a fuse/fs.FS that passes all calls through to the given filesystem.
+func NewWithOptions(underlying billy.Basic, opts Options) (*FS, error) {
+	if _, ok := underlying.(billy.Dir); !ok && opts.RequireDir {
+		return nil, &MissingFeaturesError{[]string{"billy.Dir"}}
+	}
+	for _, patterns := range [][]string{opts.KeepCachePaths, opts.DirectIOPaths} {
+		if err := validatePatterns(patterns); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CheckPermissions && opts.DefaultPermissions {
+		return nil, errors.New("billy-bazilfuse: CheckPermissions and DefaultPermissions can't be combined, as the kernel would ignore ACLs")
+	}
+	if opts.StripSetuid && opts.AllowSetuid {
+		return nil, errors.New("billy-bazilfuse: StripSetuid and AllowSetuid can't be combined")
+	}
+	readOnly := opts.ReadOnly || lacksWrite(underlying)
+	xattrs := xattrerFor(underlying)
+	if rc, ok := underlying.(Reconnector); ok {
+		underlying = newReconnectingFS(rc, opts.ReconnectTimeout)
+	}
+	callHook := opts.CallHook
 	if callHook == nil {
 		callHook = func(ctx context.Context, req fuse.Request) error {
 			return nil
 		}
 	}
-	return &root{
-		underlying: underlying,
-		callHook:   callHook,
+	f := &FS{
+		nodes:           map[string]*node{},
+		writableFiles:   map[*adapter.File]string{},
+		handles:         map[*handle]struct{}{},
+		calls:           newCallTracker(),
+		underlying:      underlying,
+		callHook:        callHook,
+		responseHook:    opts.ResponseHook,
+		hooked:          opts.CallHook != nil || opts.ResponseHook != nil || opts.OnError != nil,
+		onError:         opts.OnError,
+		unknownErrors:   newUnknownErrors(opts.OnUnknownError),
+		errorMapper:     opts.ErrorMapper,
+		fallbackErrno:   opts.FallbackErrno,
+		nameEncoding:    opts.NameEncoding,
+		illegalNames:    opts.IllegalNames,
+		resolveSymlinks: opts.ResolveSymlinks,
+		disableSymlinks: opts.DisableSymlinks,
+		disableChown:    opts.DisableChown,
+		disableXattrs:   opts.DisableXattrs,
+		denyXattrWrites: opts.DenyXattrWrites,
+		xattrs:          xattrs,
+		securityXattrs:  opts.SecurityXattrs,
+		capabilityXattr: opts.CapabilityXattr,
+		stripSetuid:     opts.StripSetuid,
+		allowSetuid:     opts.AllowSetuid,
+		squashRoot:      opts.SquashRoot,
+		defaultPerms:    opts.DefaultPermissions,
+		checkPerms:      opts.CheckPermissions,
+		aclStore:        opts.ACLStore,
+		readOnly:        readOnly,
+		openFlagPolicy:  opts.OpenFlagPolicy,
+	}
+	f.openPolicy.Store(&openPolicy{opts.KeepCachePaths, opts.DirectIOPaths, opts.NoCachePaths})
+	f.settings = opts
+	f.controlDir = opts.ControlDir
+	if _, ok := underlying.(billy.Symlink); !ok && opts.EmulateSymlinks {
+		f.emulateSymlinks = true
+	}
+	if opts.WriteBufferSize > 0 {
+		f.writeBufferSize = opts.WriteBufferSize
+		f.writeBufferAge = opts.WriteBufferAge
+		if f.writeBufferAge == 0 {
+			f.writeBufferAge = time.Second
+		}
+		if opts.WriteSpillDir != "" {
+			f.writeSpillDir = opts.WriteSpillDir
+			f.writeSpillSize = opts.WriteSpillSize
+			if f.writeSpillSize <= 0 {
+				f.writeSpillSize = 64 << 20
+			}
+		}
+		if opts.WriteJournal != "" {
+			j, err := openWriteJournal(opts.WriteJournal, underlying)
+			if err != nil {
+				return nil, err
+			}
+			f.journal = j
+		}
+	}
+	f.readAhead = opts.ReadAhead
+	if f.readAhead > 0 && f.readAhead < int(opts.MaxReadahead) {
+		f.readAhead = int(opts.MaxReadahead)
+	}
+	f.maxReadahead = opts.MaxReadahead
+	f.maxBackground = opts.MaxBackground
+	f.congestionThreshold = opts.CongestionThreshold
+	if opts.HotPaths > 0 {
+		f.hot = newHotPaths(opts.HotPaths)
+	}
+	if opts.AtomicReplace {
+		f.atomicReplace = true
+		f.replacing = map[string]string{}
+	}
+	f.cache = opts.BlockCache
+	if opts.MemoryBudget > 0 {
+		f.memory = newMemoryBudget(opts.MemoryBudget, opts.BlockCache)
+	}
+	f.maxBackendRead = opts.MaxBackendRead
+	f.maxBackendWrite = opts.MaxBackendWrite
+	if opts.WriteBacklogHigh > 0 {
+		f.backlog = &writeBacklog{high: opts.WriteBacklogHigh, low: opts.WriteBacklogLow, drain: f.drainWriteBuffers}
+		if f.backlog.low <= 0 || f.backlog.low > f.backlog.high {
+			f.backlog.low = f.backlog.high / 2
+		}
+	}
+	if opts.WatchLocal {
+		f.localDir = localDirectory(underlying)
+		if f.localDir == "" {
+			return nil, errors.New("billy-bazilfuse: WatchLocal needs a backend created with osfs.New or implementing LocalDirectory")
+		}
+	}
+	f.limiter = newLimiter(opts.MaxConcurrentCalls, opts.MaxConcurrentMetadataCalls, opts.MaxConcurrentDataCalls)
+	f.lazyOpen = opts.LazyOpen
+	f.orderedWrites = opts.OrderedWrites
+	if opts.SerializeWrites {
+		f.writeLocks = newWriteLocks()
+	}
+	f.unknownDirentTypes = opts.UnknownDirentTypes
+	f.direntOrder = opts.DirentOrder
+	f.readDirChunkThreshold = opts.ReadDirChunkThreshold
+	if opts.TrackDirMtimes {
+		f.dirMtimes = newDirMtimes()
+	}
+	if opts.HashXattrs {
+		f.hashes = &hashCache{hashes: map[contentHashKey]string{}}
+	}
+	if opts.Checksums != nil {
+		f.checksums = opts.Checksums
+		f.onChecksumMismatch = opts.OnChecksumMismatch
+		f.sumWriters = map[string]*checksummer{}
+	}
+	if opts.IdleHandleTimeout > 0 {
+		f.idleTimeout = opts.IdleHandleTimeout
+	}
+	f.longOpenHandle = opts.LongOpenHandle
+	f.onLongOpenHandle = opts.OnLongOpenHandle
+	if opts.ShareReadHandles {
+		f.shared = newSharedFiles()
+	}
+	if opts.PollInterval > 0 {
+		f.poller = newPoller(opts.PollInterval, opts.PollBudget, opts.PollPaths)
+	}
+	f.coherence = opts.Coherence
+	f.emulateSpecial = opts.EmulateSpecialFiles
+	if opts.DeviceNodes {
+		f.deviceDir = localDirectory(underlying)
+		if f.deviceDir == "" {
+			return nil, errors.New("billy-bazilfuse: DeviceNodes needs a backend created with osfs.New or implementing LocalDirectory")
+		}
+	}
+	if f.coherence == Invalidate && !f.noticesChanges() {
+		return nil, errors.New("billy-bazilfuse: Coherence Invalidate needs a backend implementing Watcher, WatchLocal or PollInterval")
+	}
+	if opts.EmulateHardlinks {
+		f.links = newLinkTable()
+		if err := f.scanHardlinks(""); err != nil {
+			return nil, fmt.Errorf("billy-bazilfuse: scanning for hardlinks: %w", err)
+		}
+	}
+	if opts.IllegalNames.Escape && opts.IllegalNames.any() {
+		f.nameEncoding = illegalNameEncoding{opts.IllegalNames, opts.NameEncoding}
+	}
+	if opts.StableInodes || opts.InodeMapFile != "" {
+		im, err := newInodeMap(opts.InodeMapFile)
+		if err != nil {
+			return nil, err
+		}
+		f.inodes = im
+	}
+	if opts.CaseInsensitive || opts.Normalization != NoNormalization {
+		f.names = newNameIndex(opts.CaseInsensitive, opts.Normalization)
+	}
+	if opts.OpLogFile != "" {
+		maxSize := opts.OpLogMaxSize
+		if maxSize == 0 {
+			maxSize = 100 << 20
+		}
+		rf, err := NewRotatingFile(opts.OpLogFile, maxSize, opts.OpLogBackups)
+		if err != nil {
+			return nil, err
+		}
+		f.opLog = newOpLog(rf, opts.OpLogSampling)
+		f.opLog.file = rf
+	} else if opts.OpLog != nil {
+		f.opLog = newOpLog(opts.OpLog, opts.OpLogSampling)
+	}
+	if len(opts.ErrorAlerts) > 0 {
+		f.alerts = newErrorAlerts(opts.ErrorAlerts, opts.OnErrorAlert)
+	}
+	if opts.HealthCheckInterval > 0 {
+		f.health = &healthProbe{path: opts.HealthCheckPath, interval: opts.HealthCheckInterval, timeout: opts.HealthCheckTimeout}
+		if f.health.timeout <= 0 {
+			f.health.timeout = 10 * time.Second
+		}
+	}
+	if opts.StatAhead.Parallelism > 0 {
+		f.statAhead = newStatAhead(opts.StatAhead)
+	}
+	if opts.OpenAttrs {
+		f.openAttrs = newOpenAttrs()
 	}
+	f.opTimeout = opts.OpTimeout
+	f.timeoutErr = errTimedOut
+	if opts.TimeoutEIO {
+		f.timeoutErr = fuse.EIO
+	}
+	return f, nil
 }
 
-type root struct {
-	underlying billy.Basic
-	callHook   CallHook
+// FS is a fuse/fs.FS that passes all calls through to a Billy filesystem.
+type FS struct {
+	underlying      billy.Basic
+	callHook        CallHook
+	responseHook    ResponseHook
+	hooked          bool
+	onError         ErrorHook
+	unknownErrors   *unknownErrors
+	errorMapper     ErrorMapper
+	fallbackErrno   fuse.Errno
+	inodes          *inodeMap
+	names           *nameIndex
+	nameEncoding    NameEncoding
+	illegalNames    IllegalNames
+	resolveSymlinks bool
+	emulateSymlinks bool
+	links           *linkTable
+	disableSymlinks bool
+	disableChown    bool
+	disableXattrs   bool
+	denyXattrWrites bool
+	xattrs          Xattrer
+	securityXattrs  SecurityXattrPolicy
+	capabilityXattr CapabilityXattrPolicy
+	stripSetuid     bool
+	allowSetuid     bool
+	squashRoot      bool
+	defaultPerms    bool
+	checkPerms      bool
+	aclStore        ACLStore
+	aclMtx          sync.Mutex
+	readOnly        bool
+	openFlagPolicy  OpenFlagPolicy
+	writeLocks      *writeLocks
+	coherence       Coherence
+	emulateSpecial  bool
+	deviceDir       string
+	writeBufferSize int
+	writeBufferAge  time.Duration
+	readAhead       int
+	maxReadahead    uint32
+	openPolicy      atomic.Pointer[openPolicy]
+	cache           BlockCache
+	memory          *memoryBudget
+	backlog         *writeBacklog
+	maxBackendRead  int
+	maxBackendWrite int
+	journal         *writeJournal
+	writeSpillDir   string
+	writeSpillSize  int
+
+	maxBackground       uint16
+	congestionThreshold uint16
+
+	atomicReplace bool
+	// replacing maps paths to the replacements being written for them with AtomicReplace.
+	replacingMtx sync.Mutex
+	replacing    map[string]string
+
+	// settings are the Options last passed to NewWithOptions or Reload. Only the fields Reload applies are kept up to date.
+	settingsMtx sync.Mutex
+	settings    Options
+	controlDir  string
+
+	// writableFiles are the open files that can be written to, and the paths they were opened at.
+	writableMtx   sync.Mutex
+	writableFiles map[*adapter.File]string
+
+	poller   *poller
+	limiter  *limiter
+	localDir string
+	shared   *sharedFiles
+	lazyOpen bool
+
+	orderedWrites bool
+
+	checksums          ChecksumStore
+	onChecksumMismatch func(path string, block int64)
+	sumMtx             sync.Mutex
+	sumWriters         map[string]*checksummer
+
+	hashes *hashCache
+
+	unknownDirentTypes    bool
+	direntOrder           DirentOrder
+	readDirChunkThreshold int
+	dirMtimes             *dirMtimes
+	// owner is the only uid served, if this is a view of a MultiUserFS.
+	owner *uint32
+
+	idleTimeout time.Duration
+	handlesMtx  sync.Mutex
+	handles     map[*handle]struct{}
+	calls       *callTracker
+	hot         *hotPaths
+	opLog       *opLog
+	alerts      *errorAlerts
+	health      *healthProbe
+	statAhead   *statAhead
+	openAttrs   *openAttrs
+	opTimeout   time.Duration
+	timeoutErr  fuse.Errno
+
+	// longOpenHandle and onLongOpenHandle are Options.LongOpenHandle and OnLongOpenHandle.
+	longOpenHandle   time.Duration
+	onLongOpenHandle func(OpenHandle)
+
+	nodesMtx sync.Mutex
+	nodes    map[string]*node
+	server   *fs.Server
+}
+
+var _ fs.FS = &FS{}
+var _ fs.FSInodeGenerator = &FS{}
+
+func (r *FS) Root() (fs.Node, error) {
+	return r.node(""), nil
+}
+
+// Serve serves the filesystem on c until it's unmounted, like fs.Serve.
+// Unlike fs.Serve, this lets the filesystem invalidate the kernel's caches when it learns about changes made outside of the mount, like from a Watcher.
+func (r *FS) Serve(c *fuse.Conn) error {
+	srv := fs.New(c, nil)
+	r.setServer(srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if w, ok := r.underlying.(Watcher); ok {
+		events, err := w.Watch(ctx)
+		if err != nil {
+			return err
+		}
+		go r.consumeEvents(events)
+	}
+	if r.poller != nil {
+		go r.poll(ctx)
+	}
+	if r.idleTimeout > 0 {
+		go r.reapIdle(ctx)
+	}
+	if r.longOpenHandle > 0 && r.onLongOpenHandle != nil {
+		go r.warnLongOpen(ctx)
+	}
+	if r.health != nil {
+		go r.checkHealth(ctx)
+	}
+	if r.localDir != "" {
+		if err := r.watchLocal(ctx, r.localDir); err != nil {
+			return err
+		}
+	}
+	return srv.Serve(r)
 }
 
-func (r *root) Root() (fs.Node, error) {
-	return &node{r, ""}, nil
+func (r *FS) setServer(srv *fs.Server) {
+	r.nodesMtx.Lock()
+	defer r.nodesMtx.Unlock()
+	r.server = srv
+}
+
+// Close releases resources held by the filesystem. Call it after the filesystem has been unmounted.
+func (r *FS) Close() error {
+	var err error
+	if r.inodes != nil {
+		err = r.inodes.Close()
+	}
+	if r.journal != nil {
+		if jerr := r.journal.Close(); err == nil {
+			err = jerr
+		}
+	}
+	if r.opLog != nil && r.opLog.file != nil {
+		if lerr := r.opLog.file.Close(); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+// MountOptions returns the options that must be passed to fuse.Mount for the configured Options.
+func (r *FS) MountOptions() []fuse.MountOption {
+	var ret []fuse.MountOption
+	if r.readOnly {
+		ret = append(ret, fuse.ReadOnly())
+	}
+	if r.deviceDir != "" {
+		ret = append(ret, fuse.AllowDev())
+	}
+	if r.allowSetuid {
+		ret = append(ret, fuse.AllowSUID())
+	}
+	if r.defaultPerms {
+		ret = append(ret, fuse.DefaultPermissions())
+	}
+	if r.maxReadahead > 0 {
+		ret = append(ret, fuse.MaxReadahead(r.maxReadahead))
+	}
+	if r.maxBackground > 0 {
+		ret = append(ret, fuse.MaxBackground(r.maxBackground))
+	}
+	if r.congestionThreshold > 0 {
+		ret = append(ret, fuse.CongestionThreshold(r.congestionThreshold))
+	}
+	return ret
+}
+
+// GenerateInode is called by bazil for entries that don't have an inode number yet.
+func (r *FS) GenerateInode(parentInode uint64, name string) uint64 {
+	if r.inodes != nil {
+		if parent, ok := r.inodes.Path(parentInode); ok {
+			if ino, err := r.inodes.Get(path.Join(parent, name)); err == nil {
+				return ino
+			}
+		}
+	}
+	return fs.GenerateDynamicInode(parentInode, name)
+}
+
+// encodeName converts a name from the kernel into a name on the backend.
+func (r *FS) encodeName(name string) (string, error) {
+	if r.nameEncoding == nil {
+		return name, nil
+	}
+	return r.nameEncoding.Encode(name)
+}
+
+// dirChanged is called after entries in dir were added, removed or renamed through the mount.
+func (r *FS) dirChanged(dir string) {
+	if r.names != nil {
+		r.names.invalidate(dir)
+	}
+	if r.dirMtimes != nil {
+		r.dirMtimes.touch(dir)
+	}
+	r.statAhead.forgetDir(dir)
+}
+
+// treeChanged is called after p (and everything below it) was renamed through the mount.
+func (r *FS) treeChanged(p string) {
+	if r.names != nil {
+		r.names.invalidateTree(p)
+	}
+	if r.dirMtimes != nil {
+		r.dirMtimes.forgetTree(p)
+	}
+	r.statAhead.forgetTree(p)
 }
 
 type node struct {
-	root *root
-	path string
+	root *FS
+	// p is the path of the node on the backend. It changes when the file is renamed while the kernel knows about it.
+	p atomic.Pointer[string]
+}
+
+// path returns the current path of the node on the backend.
+func (n *node) path() string {
+	return *n.p.Load()
+}
+
+// node returns the node for the backend path p. The same node is returned for as long as the kernel knows about it, so it can be invalidated later.
+func (r *FS) node(p string) *node {
+	r.nodesMtx.Lock()
+	defer r.nodesMtx.Unlock()
+	if n, ok := r.nodes[p]; ok {
+		return n
+	}
+	n := &node{root: r}
+	n.p.Store(&p)
+	r.nodes[p] = n
+	return n
+}
+
+// moveNodes updates the nodes the kernel knows of at oldPath and below it after they were renamed to newPath.
+// Nodes that were at newPath are forgotten, so their paths aren't given to the nodes of other files.
+func (r *FS) moveNodes(oldPath, newPath string) {
+	r.nodesMtx.Lock()
+	defer r.nodesMtx.Unlock()
+	moved := map[string]*node{}
+	for p, n := range r.nodes {
+		if p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+			moved[newPath+p[len(oldPath):]] = n
+			delete(r.nodes, p)
+		}
+	}
+	r.forgetNodesLocked(newPath)
+	for p, n := range moved {
+		p := p
+		n.p.Store(&p)
+		r.nodes[p] = n
+	}
+}
+
+// forgetNodes forgets the nodes at p and below it after p was removed, so the nodes aren't reused for a new file created at the same path.
+func (r *FS) forgetNodes(p string) {
+	r.nodesMtx.Lock()
+	defer r.nodesMtx.Unlock()
+	r.forgetNodesLocked(p)
+}
+
+func (r *FS) forgetNodesLocked(p string) {
+	for q := range r.nodes {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			delete(r.nodes, q)
+		}
+	}
+}
+
+// lookupNode returns the node for p if the kernel knows about it.
+func (r *FS) lookupNode(p string) (*node, bool) {
+	r.nodesMtx.Lock()
+	defer r.nodesMtx.Unlock()
+	n, ok := r.nodes[p]
+	return n, ok
+}
+
+// Forget is called when the kernel no longer knows about this node.
+func (n *node) Forget() {
+	n.root.nodesMtx.Lock()
+	defer n.root.nodesMtx.Unlock()
+	if n.root.nodes[n.path()] == n {
+		delete(n.root.nodes, n.path())
+	}
 }
 
 var _ fs.Node = &node{}
 var _ fs.NodeCreater = &node{}
+var _ fs.NodeForgetter = &node{}
+var _ fs.NodeFsyncer = &node{}
+var _ fs.NodeLinker = &node{}
 var _ fs.NodeMkdirer = &node{}
+var _ fs.NodeMknoder = &node{}
 var _ fs.NodeOpener = &node{}
 var _ fs.NodeReadlinker = &node{}
 var _ fs.NodeRemover = &node{}
@@ -57,12 +586,81 @@ var _ fs.NodeRenamer = &node{}
 var _ fs.NodeRequestLookuper = &node{}
 var _ fs.NodeSymlinker = &node{}
 
-func (n *node) Attr(ctx context.Context, attr *fuse.Attr) error {
-	fi, err := n.root.underlying.Stat(n.path)
+// childPath returns the path on the backend of the entry name in this directory.
+// The name of the control directory is reserved in the root directory.
+func (n *node) childPath(name string) (string, error) {
+	if n.path() == "" && name == n.root.controlDir && name != "" {
+		return "", fuse.EPERM
+	}
+	name, err := n.root.encodeName(name)
+	if err != nil {
+		return "", err
+	}
+	if n.root.names != nil {
+		return n.root.names.resolve(n.root.underlying, n.path(), name)
+	}
+	return path.Join(n.path(), name), nil
+}
+
+func (n *node) Attr(ctx context.Context, attr *fuse.Attr) (err error) {
+	ctx, done, err := n.root.beginOp(ctx, "Attr", n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, nil, attr, &err)
+	n.root.hot.add(n.path(), 0)
+	var fi os.FileInfo
+	if rp := n.root.replacingPath(n.path()); rp != n.path() {
+		fi, err = n.root.underlying.Stat(rp)
+	} else {
+		fi, err = n.root.statEntry(n.path())
+	}
+	if err != nil {
+		return convertError(err)
+	}
+	if n.root.poller != nil {
+		n.root.poller.seen(n.path(), fi)
+	}
+	fi, err = n.root.withEmulatedTypes(n.path(), fi)
 	if err != nil {
 		return convertError(err)
 	}
 	fileInfoToAttr(fi, attr)
+	if n.root.stripSetuid {
+		attr.Mode &^= setuidBits
+	}
+	if n.root.checkPerms {
+		attr.Uid, attr.Gid = fileOwner(fi)
+	}
+	if n.root.deviceDir != "" && isDevice(fi.Mode()) {
+		if rdev, ok := deviceNumber(fi); ok {
+			attr.Rdev = rdev
+		}
+	}
+	if fi.Mode().IsRegular() {
+		// Other handles and processes must see the size written through any handle, even if it's still buffered.
+		if end := n.root.bufferedEnd(n.path()); end > int64(attr.Size) {
+			attr.Size = uint64(end)
+			attr.Mtime = time.Now()
+		}
+	}
+	if n.root.uncacheable(n.path()) {
+		attr.Valid = 0
+	}
+	if n.root.dirMtimes != nil && fi.IsDir() {
+		n.root.dirMtimes.apply(n.path(), attr)
+	}
+	if n.root.inodes != nil {
+		ino, err := n.root.inodes.Get(n.path())
+		if err != nil {
+			return convertError(err)
+		}
+		attr.Inode = ino
+	}
+	if n.root.links != nil {
+		attr.Nlink = n.root.linkCount(n.path())
+	}
 	return nil
 }
 
@@ -72,244 +670,964 @@ func fileInfoToAttr(fi os.FileInfo, out *fuse.Attr) {
 	out.Mtime = fi.ModTime()
 }
 
-func (n *node) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
-	if err := n.root.callHook(ctx, req); err != nil {
+func (n *node) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
 		return nil, convertError(err)
 	}
-	return &node{n.root, path.Join(n.path, req.Name)}, nil
-}
-
-func (n *node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-	if err := n.root.callHook(ctx, req); err != nil {
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, req, resp, &err)
+	if n.path() == "" && req.Name == n.root.controlDir && req.Name != "" {
+		return &controlDir{n.root}, nil
+	}
+	fn, err := n.childPath(req.Name)
+	if err != nil {
 		return nil, convertError(err)
 	}
-	if dfs, ok := n.root.underlying.(billy.Dir); ok {
-		fn := path.Join(n.path, req.Name)
-		if err := dfs.MkdirAll(fn, os.FileMode(req.Mode)); err != nil {
+	if n.root.resolveSymlinks {
+		fn, err = n.root.resolvePath(n.path(), path.Base(fn))
+		if err != nil {
 			return nil, convertError(err)
 		}
-		return &node{n.root, fn}, nil
 	}
-	return nil, fuse.ENOSYS
+	fn, err = n.root.hardlinkStorage(fn)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if n.root.uncacheable(fn) {
+		resp.EntryValid = 0
+	}
+	n.root.hot.add(fn, 0)
+	return n.root.node(fn), nil
+}
+
+func (n *node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	defer func() { done(err) }()
+	if err := n.root.illegalNames.check(req.Name); err != nil {
+		return nil, convertError(err)
+	}
+	fn, err := n.childPath(req.Name)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if err := adapter.Mkdir(n.root.underlying, fn, req.Mode); err != nil {
+		return nil, convertError(err)
+	}
+	n.root.inheritACLs(n.path(), fn, req.Mode)
+	n.root.dirChanged(n.path())
+	return n.root.node(fn), nil
 }
 
 // Unlink removes a file.
-func (n *node) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if err := n.root.callHook(ctx, req); err != nil {
+func (n *node) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	fn, err := n.childPath(req.Name)
+	if err != nil {
+		return convertError(err)
+	}
+	if err := n.root.remove(fn); err != nil {
 		return convertError(err)
 	}
-	return convertError(n.root.underlying.Remove(path.Join(n.path, req.Name)))
+	n.root.forgetNodes(fn)
+	n.root.dirChanged(n.path())
+	n.root.contentChanged(fn)
+	n.root.dropChecksums(fn)
+	n.root.dropACLs(fn)
+	if n.root.inodes != nil {
+		return convertError(n.root.inodes.Remove(fn))
+	}
+	return nil
+}
+
+// Link creates a hardlink. Only supported with Options.EmulateHardlinks.
+func (n *node) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (_ fs.Node, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	defer func() { done(err) }()
+	if n.root.links == nil {
+		return nil, fuse.EPERM
+	}
+	if err := n.root.illegalNames.check(req.NewName); err != nil {
+		return nil, convertError(err)
+	}
+	on, err := n.root.asNode(old)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	fi, err := n.root.underlying.Stat(on.path())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if fi.IsDir() {
+		return nil, fuse.EPERM
+	}
+	fn, err := n.childPath(req.NewName)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if err := n.root.link(on.path(), fn); err != nil {
+		return nil, convertError(err)
+	}
+	n.root.dirChanged(n.path())
+	return n.root.node(on.path()), nil
 }
 
 // Symlink creates a symbolic link.
-func (n *node) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
-	if err := n.root.callHook(ctx, req); err != nil {
+func (n *node) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (_ fs.Node, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	defer func() { done(err) }()
+	if n.root.disableSymlinks {
+		return nil, fuse.EPERM
+	}
+	if err := n.root.illegalNames.check(req.NewName); err != nil {
 		return nil, convertError(err)
 	}
-	if sfs, ok := n.root.underlying.(billy.Symlink); ok {
-		fn := path.Join(n.path, req.NewName)
-		if err := sfs.Symlink(req.Target, fn); err != nil {
+	fn, err := n.childPath(req.NewName)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	target := req.Target
+	if n.root.nameEncoding != nil {
+		target, err = encodePath(n.root.nameEncoding, target)
+		if err != nil {
 			return nil, convertError(err)
 		}
-		return &node{n.root, fn}, nil
 	}
-	return nil, fuse.ENOSYS
+	if err := n.root.symlink(target, fn); err != nil {
+		return nil, convertError(err)
+	}
+	n.root.dirChanged(n.path())
+	return n.root.node(fn), nil
 }
 
 // Readlink reads the target of a symbolic link.
-func (n *node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
-	if err := n.root.callHook(ctx, req); err != nil {
+func (n *node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (target string, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
 		return "", convertError(err)
 	}
-	if sfs, ok := n.root.underlying.(billy.Symlink); ok {
-		fn, err := sfs.Readlink(n.path)
-		if err != nil {
-			return "", convertError(err)
-		}
-		return fn, nil
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, req, &target, &err)
+	n.root.hot.add(n.path(), 0)
+	fn, err := n.root.readlink(n.path())
+	if err != nil {
+		return "", convertError(err)
 	}
-	return "", fuse.ENOSYS
+	if n.root.nameEncoding != nil {
+		fn = decodePath(n.root.nameEncoding, fn)
+	}
+	return fn, nil
 }
 
 // Rename renames a file.
-func (n *node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
-	if err := n.root.callHook(ctx, req); err != nil {
+func (n *node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	if err := n.root.illegalNames.check(req.NewName); err != nil {
+		return convertError(err)
+	}
+	nd, err := n.root.asNode(newDir)
+	if err != nil {
+		return convertError(err)
+	}
+	if err := n.root.checkRenameTarget(req, nd.path()); err != nil {
+		return convertError(err)
+	}
+	oldPath, err := n.childPath(req.OldName)
+	if err != nil {
+		return convertError(err)
+	}
+	newPath, err := nd.childPath(req.NewName)
+	if err != nil {
 		return convertError(err)
 	}
-	return convertError(n.root.underlying.Rename(path.Join(n.path, req.OldName), path.Join(newDir.(*node).path, req.NewName)))
+	if newPath == oldPath && req.OldName != req.NewName && n.root.names != nil {
+		// Renaming a file to a name that only differs in case.
+		name, err := n.root.encodeName(req.NewName)
+		if err != nil {
+			return convertError(err)
+		}
+		newPath = path.Join(nd.path(), n.root.names.normalization.normalize(name))
+	}
+	if n.root.journal != nil {
+		// The journal replays writes at the path the file was opened at.
+		if err := n.root.flushBelow(oldPath); err != nil {
+			return convertError(err)
+		}
+	}
+	if err := n.root.rename(oldPath, newPath); err != nil {
+		return convertError(err)
+	}
+	n.root.dirChanged(n.path())
+	n.root.dirChanged(nd.path())
+	n.root.treeChanged(oldPath)
+	n.root.contentChanged(oldPath)
+	n.root.contentChanged(newPath)
+	n.root.moveChecksums(oldPath, newPath)
+	n.root.moveACLs(oldPath, newPath)
+	if n.root.inodes != nil {
+		return convertError(n.root.inodes.Rename(oldPath, newPath))
+	}
+	return nil
 }
 
-func (n *node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	if err := n.root.callHook(ctx, req); err != nil {
+// Fsync writes out buffered data. Billy has no way to ask the backend to persist data.
+// The request doesn't say which handle it's for, so the buffers of all open files are written.
+func (n *node) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
 		return convertError(err)
 	}
+	defer func() { done(err) }()
+	return convertError(n.root.syncPath(n.path()))
+}
+
+// setattrRequest converts the changes requested by the kernel into a request for the backend. Times the kernel asks to set to the current time, like touch(1) on FreeBSD does, are set to now.
+func (r *FS) setattrRequest(req *fuse.SetattrRequest, now time.Time) adapter.SetattrRequest {
 	if req.Valid.AtimeNow() {
 		req.Valid |= fuse.SetattrAtime
-		req.Atime = time.Now()
+		req.Atime = now
 	}
 	if req.Valid.MtimeNow() {
 		req.Valid |= fuse.SetattrMtime
-		req.Atime = time.Now()
+		req.Mtime = now
 	}
-	if req.Valid.Mode() || req.Valid.Uid() || req.Valid.Gid() || req.Valid.Atime() || req.Valid.Mtime() {
-		cfs, ok := n.root.underlying.(billy.Change)
-		if !ok {
-			return fuse.ENOTSUP
-		}
-		if req.Valid.Mode() {
-			if err := cfs.Chmod(n.path, req.Mode); err != nil {
-				return convertError(err)
-			}
-		}
-		if req.Valid.Uid() || req.Valid.Gid() {
-			uid := int(req.Uid)
-			if !req.Valid.Uid() {
-				uid = -1
-			}
-			gid := int(req.Gid)
-			if !req.Valid.Gid() {
-				gid = -1
-			}
-			if err := cfs.Lchown(n.path, uid, gid); err != nil {
-				return convertError(err)
-			}
-		}
-		if req.Valid.Atime() || req.Valid.Mtime() {
-			// TODO: Handle correctly.
-			if req.Valid.Mtime() {
-				if err := cfs.Chtimes(n.path, req.Atime, req.Mtime); err != nil {
-					return convertError(err)
-				}
-			}
+	var sr adapter.SetattrRequest
+	if req.Valid.Mode() {
+		if r.stripSetuid {
+			req.Mode &^= setuidBits
 		}
+		sr.Mode = &req.Mode
 	}
-	if req.Valid.Size() {
-		fh, err := n.root.underlying.OpenFile(n.path, os.O_WRONLY, 0777)
-		if err != nil {
+	if req.Valid.Uid() {
+		sr.Uid = &req.Uid
+	}
+	if req.Valid.Gid() {
+		sr.Gid = &req.Gid
+	}
+	if req.Valid.Atime() {
+		sr.Atime = &req.Atime
+	}
+	if req.Valid.Mtime() {
+		sr.Mtime = &req.Mtime
+	}
+	return sr
+}
+
+func (n *node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, req, resp, &err)
+	n.root.hot.add(n.path(), 0)
+	if (req.Valid.Uid() || req.Valid.Gid()) && n.root.disableChown {
+		return fuse.EPERM
+	}
+	sr := n.root.setattrRequest(req, time.Now())
+	if req.Valid.Size() && req.Size == 0 && req.Valid.Handle() && n.root.atomicReplace && sr.Mode == nil && sr.Uid == nil && sr.Gid == nil {
+		if ok, err := n.root.replaceOnTruncate(n.path()); err != nil {
 			return convertError(err)
+		} else if ok {
+			return nil
 		}
-		defer fh.Close()
-		if err := fh.Truncate(int64(req.Size)); err != nil {
+	}
+	if req.Valid.Size() {
+		sr.Size = &req.Size
+		// Buffered writes to the file must not land after the truncation. Other files are left alone.
+		if err := n.root.flushPath(n.path()); err != nil {
 			return convertError(err)
 		}
 	}
+	if err := adapter.Setattr(n.root.underlying, n.path(), sr); err != nil {
+		return convertError(err)
+	}
+	n.root.statAhead.forget(n.path())
+	n.root.openAttrs.forget(n.path())
+	if sr.Mode != nil {
+		n.root.chmodStoredACL(n.path(), *sr.Mode)
+	}
+	if sr.Size != nil {
+		n.root.contentChanged(n.path())
+		n.root.dropChecksums(n.path())
+	}
 	// TODO: if req.Valid.Handle()
 	// TODO: if req.Valid.LockOwner()
 	return nil
 }
 
-func (n *node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	if err := n.root.callHook(ctx, req); err != nil {
+func (n *node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, req, resp, &err)
+	if err := n.root.illegalNames.check(req.Name); err != nil {
+		return nil, nil, convertError(err)
+	}
+	fn, err := n.childPath(req.Name)
+	if err != nil {
 		return nil, nil, convertError(err)
 	}
-	fn := path.Join(n.path, req.Name)
+	fn, err = n.root.hardlinkStorage(fn)
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+	defer n.root.applyOpenFlagPolicy(fn, req.Flags, &resp.OpenResponse, &err)
 	fh, err := n.root.underlying.OpenFile(fn, int(req.Flags), req.Mode)
 	if err != nil {
 		return nil, nil, convertError(err)
 	}
-	return &node{n.root, fn}, &handle{root: n.root, fh: fh}, nil
+	n.root.inheritACLs(n.path(), fn, req.Mode)
+	n.root.dirChanged(n.path())
+	n.root.contentChanged(fn)
+	resp.Flags |= n.root.openFlags(fn)
+	if n.root.uncacheable(fn) {
+		resp.EntryValid = 0
+	}
+	n.root.hot.add(fn, 0)
+	return n.root.node(fn), n.root.handleFor(fn, n.root.newWritableFile(fn, fh), nil, req.Flags, req.Pid), nil
 }
 
-func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if err := n.root.callHook(ctx, req); err != nil {
+// Mknod creates a file. Only regular files are supported, FIFOs and sockets with Options.EmulateSpecialFiles and devices with Options.DeviceNodes.
+// FreeBSD's FUSE implementation before 12.1 creates files with Mknod followed by Open rather than Create.
+func (n *node) Mknod(ctx context.Context, req *fuse.MknodRequest) (_ fs.Node, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	defer func() { done(err) }()
+	if err := n.root.illegalNames.check(req.Name); err != nil {
+		return nil, convertError(err)
+	}
+	special := n.root.emulateSpecial && req.Mode&(os.ModeNamedPipe|os.ModeSocket) != 0
+	device := n.root.deviceDir != "" && isDevice(req.Mode)
+	if !req.Mode.IsRegular() && !special && !device {
+		return nil, fuse.EPERM
+	}
+	fn, err := n.childPath(req.Name)
+	if err != nil {
 		return nil, convertError(err)
 	}
+	if device {
+		if err := n.root.mknodDevice(fn, req.Mode, req.Rdev); err != nil {
+			return nil, convertError(err)
+		}
+		n.root.dirChanged(n.path())
+		return n.root.node(fn), nil
+	}
+	if special {
+		if err := n.root.mknodSpecial(fn, req.Mode); err != nil {
+			return nil, convertError(err)
+		}
+		n.root.dirChanged(n.path())
+		return n.root.node(fn), nil
+	}
+	fh, err := n.root.underlying.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, req.Mode)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	n.root.dirChanged(n.path())
+	if err := fh.Close(); err != nil {
+		return nil, convertError(err)
+	}
+	return n.root.node(fn), nil
+}
+
+func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, req, resp, &err)
+	n.root.hot.add(n.path(), 0)
 	if req.Dir {
-		return &dirHandle{root: n.root, path: n.path}, nil
+		if n.root.readDirChunkThreshold > 0 {
+			return &chunkedDirHandle{dir: dirHandle{root: n.root, path: n.path()}}, nil
+		}
+		return &dirHandle{root: n.root, path: n.path()}, nil
+	}
+	resp.Flags |= n.root.openFlags(n.path())
+	defer n.root.applyOpenFlagPolicy(n.path(), req.Flags, resp, &err)
+	if n.root.shouldReplace(int(req.Flags)) {
+		f, rp, err := n.root.openReplacement(n.path())
+		if err != nil {
+			return nil, convertError(err)
+		}
+		if f != nil {
+			h := n.root.handleFor(n.path(), f, nil, req.Flags, req.Pid)
+			h.replace = rp
+			return h, nil
+		}
+	}
+	if req.Flags&fuse.OpenTruncate == 0 {
+		// Processes usually fstat files right after opening them.
+		n.root.openAttrs.prefetch(n.root, n.path())
 	}
-	fh, err := n.root.underlying.OpenFile(n.path, int(req.Flags), 0777)
+	if n.root.lazyOpen && req.Flags&fuse.OpenTruncate == 0 {
+		return n.root.handleFor(n.path(), nil, nil, req.Flags, req.Pid), nil
+	}
+	f, sf, err := n.root.openFile(n.path(), req.Flags)
 	if err != nil {
 		return nil, convertError(err)
 	}
-	return &handle{root: n.root, fh: fh}, nil
+	if req.Flags&fuse.OpenTruncate != 0 {
+		n.root.contentChanged(n.path())
+	}
+	return n.root.handleFor(n.path(), f, sf, req.Flags, req.Pid), nil
+}
+
+// openFile opens the file at p on the backend. The returned sharedFile is set if the file is shared with other handles.
+func (r *FS) openFile(p string, flags fuse.OpenFlags) (*adapter.File, *sharedFile, error) {
+	if r.shared != nil && flags.IsReadOnly() && flags&fuse.OpenTruncate == 0 {
+		sf, err := r.shared.acquire(p, func() (*adapter.File, error) {
+			fh, err := r.underlying.OpenFile(p, int(flags), 0777)
+			if err != nil {
+				return nil, err
+			}
+			return r.newFile(fh), nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return sf.fh, sf, nil
+	}
+	fh, err := r.underlying.OpenFile(p, int(flags), 0777)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.newWritableFile(p, fh), nil, nil
+}
+
+// openFlags returns the flags for the response to opening the file at p.
+func (r *FS) openFlags(p string) fuse.OpenResponseFlags {
+	policy := r.openPolicy.Load()
+	if matchAny(policy.directIOPaths, p) || matchAny(policy.noCachePaths, p) {
+		return fuse.OpenDirectIO
+	}
+	if matchAny(policy.keepCachePaths, p) {
+		return fuse.OpenKeepCache
+	}
+	return r.coherenceFlags()
+}
+
+// uncacheable returns whether p matches Options.NoCachePaths.
+func (r *FS) uncacheable(p string) bool {
+	return matchAny(r.openPolicy.Load().noCachePaths, p)
+}
+
+// orderedWriteTimeout is how long a write waits for the writes before it with Options.OrderedWrites.
+const orderedWriteTimeout = time.Second
+
+// newWritableFile wraps a file opened on the backend at p, enabling read-ahead and write buffering if configured.
+func (r *FS) newWritableFile(p string, fh billy.File) *adapter.File {
+	f := r.newFile(fh)
+	if r.writeBufferSize > 0 {
+		f.EnableWriteBuffer(r.writeBufferSize, r.writeBufferAge)
+		if r.backlog != nil {
+			f.SetBacklog(r.backlog.add)
+		}
+		if r.journal != nil {
+			f.SetJournal(r.journal.forFile(p))
+		}
+		if r.writeSpillDir != "" {
+			f.EnableSpill(r.writeSpillDir, r.writeSpillSize)
+		}
+	}
+	if r.orderedWrites {
+		size := int64(-1)
+		if fi, err := r.underlying.Stat(p); err == nil {
+			size = fi.Size()
+		}
+		f.EnableOrderedWrites(size, orderedWriteTimeout)
+	}
+	r.writeLocks.attach(p, f)
+	r.writableMtx.Lock()
+	r.writableFiles[f] = p
+	r.writableMtx.Unlock()
+	return f
+}
+
+// forgetWritable stops tracking a writable file, before it's closed.
+func (r *FS) forgetWritable(f *adapter.File) {
+	r.writableMtx.Lock()
+	delete(r.writableFiles, f)
+	r.writableMtx.Unlock()
+	r.writeLocks.detach(f)
+}
+
+// newFile wraps a file opened on the backend, enabling read-ahead if configured.
+func (r *FS) newFile(fh billy.File) *adapter.File {
+	f := adapter.NewFile(fh)
+	if r.memory != nil {
+		f.SetMemory(r.memory)
+	}
+	if r.maxBackendRead > 0 {
+		f.SetMaxRead(r.maxBackendRead)
+	}
+	if r.maxBackendWrite > 0 {
+		f.SetMaxWrite(r.maxBackendWrite)
+	}
+	if r.readAhead > 0 {
+		f.EnableReadAhead(r.readAhead, r.background)
+	}
+	return f
+}
+
+// handleFor creates a handle for f, which was opened at p with the given flags by process pid. f is nil if the file is opened lazily.
+func (r *FS) handleFor(p string, f *adapter.File, sf *sharedFile, flags fuse.OpenFlags, pid uint32) *handle {
+	now := time.Now()
+	h := &handle{
+		root:   r,
+		path:   p,
+		fh:     f,
+		shared: sf,
+		// Opening the file again must not create or truncate it.
+		flags:     flags &^ (fuse.OpenCreate | fuse.OpenExclusive | fuse.OpenTruncate),
+		lastUsed:  now,
+		readAhead: r.readAhead,
+		opened:    now,
+		pid:       pid,
+	}
+	uncacheable := r.uncacheable(p)
+	if uncacheable {
+		h.readAhead = 0
+		if f != nil {
+			f.SetReadAheadSize(0)
+		}
+	}
+	r.trackHandle(h)
+	if r.cache != nil || r.checksums != nil {
+		if fi, err := r.underlying.Stat(p); err == nil {
+			if r.cache != nil && !uncacheable {
+				h.cacheKey = &BlockKey{Path: p, Size: fi.Size(), ModTime: fi.ModTime()}
+			}
+			if r.checksums != nil {
+				h.startChecksums(fi.Size(), !flags.IsReadOnly())
+			}
+		}
+	}
+	return h
+}
+
+// dirtyFiles returns the open files that were written to since they were last synced. If filter isn't nil, only files opened at paths it accepts are returned.
+func (r *FS) dirtyFiles(filter func(p string) bool) []*adapter.File {
+	r.writableMtx.Lock()
+	defer r.writableMtx.Unlock()
+	var files []*adapter.File
+	for f, fp := range r.writableFiles {
+		if f.Dirty() && (filter == nil || filter(fp)) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// bufferedEnd returns the offset just past the buffered writes to the files opened at p, or 0 if there are none. The backend doesn't include those in the size of the file yet.
+func (r *FS) bufferedEnd(p string) int64 {
+	if r.writeBufferSize <= 0 {
+		return 0
+	}
+	r.writableMtx.Lock()
+	defer r.writableMtx.Unlock()
+	var end int64
+	for f, fp := range r.writableFiles {
+		if fp == p {
+			if e := f.BufferedEnd(); e > end {
+				end = e
+			}
+		}
+	}
+	return end
+}
+
+// flushPath writes out the buffered data of the files opened at p.
+func (r *FS) flushPath(p string) error {
+	var ret error
+	for _, f := range r.dirtyFiles(func(fp string) bool { return fp == p }) {
+		if err := f.Flush(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// flushBelow writes out the buffered data of the files opened at p or below it.
+func (r *FS) flushBelow(p string) error {
+	var ret error
+	for _, f := range r.dirtyFiles(func(fp string) bool { return fp == p || strings.HasPrefix(fp, p+"/") }) {
+		if err := f.Flush(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// syncPath syncs the files opened at p that were written to.
+func (r *FS) syncPath(p string) error {
+	var ret error
+	for _, f := range r.dirtyFiles(func(fp string) bool { return fp == p }) {
+		if err := f.Sync(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
 }
 
 type handle struct {
-	root      *root
-	fh        billy.File
-	writeLock sync.Mutex
+	root *FS
+	path string
+
+	openMtx sync.Mutex
+	// fh is nil while the backend file isn't open, because it's opened lazily or was closed for being idle. It's (re)opened with flags.
+	fh *adapter.File
+	// shared is set if fh is shared with other handles.
+	shared *sharedFile
+	flags  fuse.OpenFlags
+	// users is the number of operations using fh, and lastUsed when the last one finished.
+	users    int
+	lastUsed time.Time
+	// closeErr is the error from closing fh when it was idle, which is reported by the next Flush or Release.
+	closeErr error
+
+	cacheMtx sync.Mutex
+	// cacheKey identifies the version of the file that was opened, or is nil if reads bypass the cache.
+	cacheKey *BlockKey
+	// verify are the checksums to verify reads against, or nil if there are none.
+	verify *FileChecksums
+
+	// sums records the checksums of the data written through the handle. It's nil for read-only handles, and protected by FS.sumMtx.
+	sums *checksummer
+
+	// readAhead is how much the file prefetches, which hints given through Advise change. It's protected by openMtx.
+	readAhead int
+	// replace is set if fh is a replacement for the file at path, with Options.AtomicReplace. It's protected by openMtx.
+	replace *replacement
+
+	// opened is when the handle was opened, by process pid. warned is set once Options.OnLongOpenHandle was called for it, and is protected by FS.handlesMtx.
+	opened time.Time
+	pid    uint32
+	warned bool
 }
 
+var _ fs.HandleFlusher = &handle{}
 var _ fs.HandleReader = &handle{}
 var _ fs.HandleReleaser = &handle{}
 var _ fs.HandleWriter = &handle{}
 
-func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	if err := h.root.callHook(ctx, req); err != nil {
+// file returns the backend file, opening it if it isn't open. If open is false, it returns nil instead of opening the file.
+// Every call that returns a file must be followed by a call to put.
+func (h *handle) file(open bool) (*adapter.File, error) {
+	h.openMtx.Lock()
+	defer h.openMtx.Unlock()
+	if h.fh == nil {
+		if !open {
+			return nil, nil
+		}
+		f, sf, err := h.root.openFile(h.path, h.flags)
+		if err != nil {
+			return nil, err
+		}
+		h.fh, h.shared = f, sf
+		if h.readAhead != h.root.readAhead {
+			f.SetReadAheadSize(h.readAhead)
+		}
+	}
+	h.users++
+	return h.fh, nil
+}
+
+// put marks the end of an operation using the file returned by file.
+func (h *handle) put() {
+	h.openMtx.Lock()
+	defer h.openMtx.Unlock()
+	h.users--
+	h.lastUsed = time.Now()
+}
+
+// closeLocked closes the backend file.
+func (h *handle) closeLocked() error {
+	f, sf := h.fh, h.shared
+	h.fh, h.shared = nil, nil
+	if sf != nil {
+		return h.root.shared.release(sf)
+	}
+	h.root.forgetWritable(f)
+	return f.Close()
+}
+
+// readAt reads from the backend file.
+func (h *handle) readAt(p []byte, off int64) (int, error) {
+	f, err := h.file(true)
+	if err != nil {
+		return 0, err
+	}
+	defer h.put()
+	return f.ReadAt(p, off)
+}
+
+// readView is like readAt, but may return data the file already holds instead of copying it into p. The returned data must not be modified.
+func (h *handle) readView(p []byte, off int64) ([]byte, error) {
+	f, err := h.file(true)
+	if err != nil {
+		return nil, err
+	}
+	defer h.put()
+	return f.ReadAtView(p, off)
+}
+
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	ctx, done, err := h.root.beginCall(ctx, req, h.callInfo())
+	if err != nil {
 		return convertError(err)
 	}
-	resp.Data = make([]byte, req.Size)
-	n, err := h.fh.ReadAt(resp.Data, req.Offset)
-	if err == io.EOF {
-		err = nil
+	defer func() { done(err) }()
+	defer h.root.respondAfter(ctx, req, resp, &err)
+	// bazil preallocates a response buffer of req.Size (which the kernel limits to the maximum read size), and copies it into the reply after we return.
+	// Reading into it avoids allocating another buffer for every read. Data that's already in memory (cached blocks and prefetched data) is returned as is, as bazil doesn't modify it, which saves copying it twice.
+	// bazil has no vectorized responses, so reads spanning several blocks are still gathered into the buffer.
+	buf := resp.Data[:cap(resp.Data)]
+	if len(buf) < req.Size {
+		buf = make([]byte, req.Size)
 	}
-	resp.Data = resp.Data[:n]
+	buf = buf[:req.Size]
+	h.cacheMtx.Lock()
+	key, verify := h.cacheKey, h.verify
+	h.cacheMtx.Unlock()
+	if key != nil || verify != nil {
+		resp.Data, err = h.blockRead(key, verify, buf, req.Offset)
+	} else {
+		resp.Data, err = h.readView(buf, req.Offset)
+	}
+	h.root.hot.add(h.path, len(resp.Data))
 	return convertError(err)
 }
 
-func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	if err := h.root.callHook(ctx, req); err != nil {
+func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	ctx, done, err := h.root.beginCall(ctx, req, h.callInfo())
+	if err != nil {
 		return convertError(err)
 	}
-	if wa, ok := h.fh.(io.WriterAt); ok {
-		n, err := wa.WriteAt(req.Data, req.Offset)
-		if err != nil {
-			return convertError(err)
-		}
-		resp.Size = n
-		return nil
+	defer func() { done(err) }()
+	defer h.root.respondAfter(ctx, req, resp, &err)
+	if h.root.cache != nil || h.root.checksums != nil {
+		// The version of the file this handle opened is gone.
+		h.cacheMtx.Lock()
+		h.cacheKey = nil
+		h.verify = nil
+		h.cacheMtx.Unlock()
 	}
-	h.writeLock.Lock()
-	defer h.writeLock.Unlock()
-	if _, err := h.fh.Seek(req.Offset, io.SeekStart); err != nil {
+	f, err := h.file(true)
+	if err != nil {
 		return convertError(err)
 	}
-	n, err := h.fh.Write(req.Data)
-	if err != nil {
+	defer h.put()
+	n, err := f.WriteAt(req.Data, req.Offset)
+	h.root.contentChanged(h.path)
+	h.root.hot.add(h.path, n)
+	if h.sums != nil {
+		h.recordChecksums(req.Offset, req.Data[:n])
+	}
+	if err != nil && n == 0 {
 		return convertError(err)
 	}
+	// Like write(2), a write that failed partway reports what was written. Writing the rest will return the error.
 	resp.Size = n
 	return nil
 }
 
-func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	if err := h.root.callHook(ctx, req); err != nil {
+func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	ctx, done, err := h.root.beginCall(ctx, req, h.callInfo())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	h.root.untrackHandle(h)
+	if h.sums != nil {
+		h.finishChecksums()
+	}
+	h.openMtx.Lock()
+	defer h.openMtx.Unlock()
+	err = h.closeErr
+	if h.fh != nil {
+		if h.replace != nil && err == nil {
+			// The new contents must be on stable storage before they replace the old ones.
+			err = h.fh.Sync()
+		}
+		if cerr := h.closeLocked(); err == nil {
+			err = cerr
+		}
+	}
+	if h.replace != nil {
+		err = h.root.finishReplacement(h.path, h.replace, err)
+	}
+	return convertError(err)
+}
+
+// Flush is called when a file descriptor is closed, and writes out buffered data.
+func (h *handle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	ctx, done, err := h.root.beginCall(ctx, req, h.callInfo())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	f, _ := h.file(false)
+	if f == nil {
+		h.openMtx.Lock()
+		defer h.openMtx.Unlock()
+		err, h.closeErr = h.closeErr, nil
 		return convertError(err)
 	}
-	return convertError(h.fh.Close())
+	defer h.put()
+	return convertError(f.Flush())
 }
 
 type dirHandle struct {
-	root *root
+	root *FS
 	path string
 }
 
 var _ fs.HandleReadDirAller = &dirHandle{}
 
-func (h *dirHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	if dfs, ok := h.root.underlying.(billy.Dir); ok {
-		entries, err := dfs.ReadDir(h.path)
+func (h *dirHandle) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	ctx, done, err := h.root.beginOp(ctx, "ReadDirAll", h.path)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	defer func() { done(err) }()
+	defer h.root.respondAfter(ctx, nil, &dirents, &err)
+	h.root.hot.add(h.path, 0)
+	l, err := h.list()
+	if err != nil {
+		return nil, convertError(err)
+	}
+	ret := make([]fuse.Dirent, len(l.entries))
+	for i, e := range l.entries {
+		ret[i], err = h.dirent(e, l.names[i])
 		if err != nil {
 			return nil, convertError(err)
 		}
-		ret := make([]fuse.Dirent, len(entries))
+	}
+	return ret, nil
+}
+
+// listing is the contents of a directory, in the order they're presented.
+type listing struct {
+	entries []os.FileInfo
+	// names are the names of the entries as presented to the kernel.
+	names []string
+	less  func(a, b string) bool
+}
+
+func (l *listing) Len() int           { return len(l.entries) }
+func (l *listing) Less(i, j int) bool { return l.less(l.names[i], l.names[j]) }
+func (l *listing) Swap(i, j int) {
+	l.entries[i], l.entries[j] = l.entries[j], l.entries[i]
+	l.names[i], l.names[j] = l.names[j], l.names[i]
+}
+
+// list lists the directory from the backend.
+func (h *dirHandle) list() (*listing, error) {
+	entries, err := h.root.readDirForListing(h.path)
+	if err != nil {
+		return nil, err
+	}
+	if (h.root.emulateSymlinks || h.root.emulateSpecial) && !h.root.unknownDirentTypes {
 		for i, e := range entries {
-			t := fuse.DT_File
-			if e.IsDir() {
-				t = fuse.DT_Dir
-			} else if e.Mode()&os.ModeSymlink > 0 {
-				t = fuse.DT_Link
+			entries[i], err = h.root.withEmulatedTypes(path.Join(h.path, e.Name()), e)
+			if err != nil {
+				return nil, err
 			}
-			ret[i] = fuse.Dirent{
-				Name: e.Name(),
-				Type: t,
+		}
+	}
+	var names []string
+	if h.root.names != nil {
+		entries, names = h.root.names.presentEntries(entries)
+	}
+	if names == nil {
+		names = make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Name()
+		}
+	}
+	if h.root.nameEncoding != nil {
+		for i, n := range names {
+			names[i] = h.root.nameEncoding.Decode(n)
+		}
+	}
+	if h.path == "" && h.root.controlDir != "" {
+		// Entries on the backend are shadowed by the control directory, which isn't listed itself.
+		for i, n := range names {
+			if n == h.root.controlDir {
+				entries = append(entries[:i:i], entries[i+1:]...)
+				names = append(names[:i:i], names[i+1:]...)
+				break
 			}
 		}
-		return ret, nil
 	}
-	return nil, fuse.ENOSYS
+	l := &listing{entries: entries, names: names, less: h.root.direntOrder.less()}
+	if l.less != nil {
+		sort.Sort(l)
+	}
+	return l, nil
 }
 
+// dirent converts an entry of the directory, presented to the kernel as name.
+func (h *dirHandle) dirent(e os.FileInfo, name string) (fuse.Dirent, error) {
+	t := fuse.DT_File
+	if h.root.unknownDirentTypes {
+		t = fuse.DT_Unknown
+	} else if e.IsDir() {
+		t = fuse.DT_Dir
+	} else if e.Mode()&os.ModeSymlink > 0 {
+		t = fuse.DT_Link
+		if h.root.resolveSymlinks {
+			// Lookup will present whatever the link points to.
+			t = fuse.DT_Unknown
+		}
+	} else if e.Mode()&os.ModeNamedPipe > 0 {
+		t = fuse.DT_FIFO
+	} else if e.Mode()&os.ModeSocket > 0 {
+		t = fuse.DT_Socket
+	} else if e.Mode()&os.ModeCharDevice > 0 {
+		t = fuse.DT_Char
+	} else if e.Mode()&os.ModeDevice > 0 {
+		t = fuse.DT_Block
+	}
+	ret := fuse.Dirent{
+		Name: name,
+		Type: t,
+	}
+	if h.root.inodes != nil {
+		ino, err := h.root.inodes.Get(h.root.knownHardlinkStorage(path.Join(h.path, e.Name())))
+		if err != nil {
+			return fuse.Dirent{}, err
+		}
+		ret.Inode = ino
+	}
+	return ret, nil
+}
+
+// convertError converts an error from Billy into the errno returned to the kernel. The original error is kept for Options.OnError.
 func convertError(err error) error {
 	if err == nil {
 		return nil
@@ -317,20 +1635,36 @@ func convertError(err error) error {
 	if _, ok := err.(fuse.ErrorNumber); ok {
 		return err
 	}
-	if os.IsExist(err) {
-		return fuse.EEXIST
-	}
-	if os.IsNotExist(err) {
-		return fuse.ENOENT
-	}
-	if os.IsPermission(err) {
-		return fuse.EPERM
+	// Backends and hooks can annotate an errno with fmt.Errorf("...: %w", err) without losing it.
+	var en fuse.ErrorNumber
+	if errors.As(err, &en) {
+		return &convertedError{err, en.Errno(), false}
 	}
-	if errors.Is(err, os.ErrInvalid) || errors.Is(err, os.ErrClosed) || errors.Is(err, billy.ErrCrossedBoundary) {
-		return fuse.Errno(syscall.EINVAL)
+	errno, known := adapter.KnownErrno(err)
+	return &convertedError{err, fuse.Errno(errno), !known}
+}
+
+// convertedError is an error from Billy with the errno it was converted to.
+type convertedError struct {
+	err   error
+	errno fuse.Errno
+	// unknown is set if err wasn't recognized, and errno is the fallback.
+	unknown bool
+}
+
+func (e *convertedError) Error() string     { return e.errno.Error() }
+func (e *convertedError) Errno() fuse.Errno { return e.errno }
+func (e *convertedError) Unwrap() error     { return e.err }
+
+var _ fuse.ErrorNumber = &convertedError{}
+
+// originalError returns the error err was converted from, and the errno the kernel gets for it.
+func originalError(err error) (error, fuse.Errno) {
+	if ce, ok := err.(*convertedError); ok {
+		return ce.err, ce.errno
 	}
-	if errors.Is(err, billy.ErrNotSupported) {
-		return fuse.ENOTSUP
+	if en, ok := err.(fuse.ErrorNumber); ok {
+		return err, en.Errno()
 	}
-	return fuse.EIO
+	return err, fuse.Errno(adapter.Errno(err))
 }
@@ -0,0 +1,253 @@
+package billybazilfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+func TestAttrIncludesBufferedWrites(t *testing.T) {
+	ctx := context.Background()
+	backend := memfs.New()
+	if err := util.WriteFile(backend, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewWithOptions(backend, Options{WriteBufferSize: 1 << 20, WriteBufferAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file is open through another handle as well, like when a shell has it open while a program appends to it.
+	open := func() *handle {
+		t.Helper()
+		h, err := r.node("f").Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return h.(*handle)
+	}
+	writer := open()
+	open()
+	data := []byte("hello, world")
+	if err := writer.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if fi, err := backend.Stat("f"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 5 {
+		t.Fatalf("the write wasn't buffered: backend has size %d", fi.Size())
+	}
+
+	var attr fuse.Attr
+	if err := r.node("f").Attr(ctx, &attr); err != nil {
+		t.Fatalf("Attr: %v", err)
+	}
+	if attr.Size != uint64(len(data)) {
+		t.Errorf("Attr through another node reported size %d; want %d", attr.Size, len(data))
+	}
+}
+
+func TestSetattrRequestTimesNow(t *testing.T) {
+	r := &FS{}
+	now := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		valid        fuse.SetattrValid
+		atime, mtime bool
+	}{
+		{fuse.SetattrAtimeNow, true, false},
+		{fuse.SetattrMtimeNow, false, true},
+		{fuse.SetattrAtimeNow | fuse.SetattrMtimeNow, true, true},
+	} {
+		sr := r.setattrRequest(&fuse.SetattrRequest{Valid: tc.valid}, now)
+		if (sr.Atime != nil) != tc.atime || (sr.Atime != nil && !sr.Atime.Equal(now)) {
+			t.Errorf("setattrRequest(%v) set atime to %v", tc.valid, sr.Atime)
+		}
+		if (sr.Mtime != nil) != tc.mtime || (sr.Mtime != nil && !sr.Mtime.Equal(now)) {
+			t.Errorf("setattrRequest(%v) set mtime to %v", tc.valid, sr.Mtime)
+		}
+	}
+}
+
+func TestSetattrRequestStripsSetuid(t *testing.T) {
+	r := &FS{stripSetuid: true}
+	sr := r.setattrRequest(&fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: os.ModeSetuid | os.ModeSetgid | 0755}, time.Now())
+	if sr.Mode == nil || *sr.Mode != 0755 {
+		t.Errorf("setattrRequest with StripSetuid set mode to %v; want -rwxr-xr-x", sr.Mode)
+	}
+}
+
+func TestConvertError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want fuse.Errno
+	}{
+		{os.ErrNotExist, fuse.ENOENT},
+		{&os.PathError{Op: "open", Path: "f", Err: syscall.EACCES}, fuse.Errno(syscall.EACCES)},
+		{billy.ErrReadOnly, fuse.Errno(syscall.EROFS)},
+		{billy.ErrNotSupported, fuse.ENOTSUP},
+		{context.Canceled, fuse.EINTR},
+		{context.DeadlineExceeded, fuse.Errno(syscall.ETIMEDOUT)},
+		// Missing attributes are ENODATA on Linux and ENOATTR on FreeBSD, and must survive being wrapped.
+		{fmt.Errorf("getxattr: %w", fuse.ErrNoXattr), fuse.ErrNoXattr.Errno()},
+		{errors.New("something else"), fuse.EIO},
+	} {
+		err := convertError(tc.err)
+		en, ok := err.(fuse.ErrorNumber)
+		if !ok {
+			t.Errorf("convertError(%v) = %v, which has no errno", tc.err, err)
+			continue
+		}
+		if en.Errno() != tc.want {
+			t.Errorf("convertError(%v) = %v; want %v", tc.err, en.Errno(), tc.want)
+		}
+	}
+}
+
+// testFS creates a FS on an empty memfs, with the given options.
+func testFS(t *testing.T, opts Options) (*FS, billy.Filesystem) {
+	t.Helper()
+	backend := memfs.New()
+	r, err := NewWithOptions(backend, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, backend
+}
+
+func lookup(t *testing.T, dir *node, name string) *node {
+	t.Helper()
+	n, err := dir.Lookup(context.Background(), &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatalf("Lookup(%q): %v", name, err)
+	}
+	return n.(*node)
+}
+
+func TestNodesFollowRenames(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		// replace recreates a at the old path after it was renamed to b.
+		replace func(root *node) (*node, error)
+	}{
+		{"mkdir", func(root *node) (*node, error) {
+			n, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "a", Mode: os.ModeDir | 0755})
+			if err != nil {
+				return nil, err
+			}
+			return n.(*node), nil
+		}},
+		{"create", func(root *node) (*node, error) {
+			n, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "a", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{})
+			if err != nil {
+				return nil, err
+			}
+			return n.(*node), nil
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, backend := testFS(t, Options{})
+			if err := backend.MkdirAll("a/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			root := r.node("")
+			a := lookup(t, root, "a")
+			sub := lookup(t, a, "sub")
+			if err := root.Rename(ctx, &fuse.RenameRequest{OldName: "a", NewName: "b"}, root); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+			if a.path() != "b" || sub.path() != "b/sub" {
+				t.Errorf("after renaming a to b, the nodes are at %q and %q; want b and b/sub", a.path(), sub.path())
+			}
+			var attr fuse.Attr
+			if err := a.Attr(ctx, &attr); err != nil {
+				t.Errorf("Attr of the renamed node: %v", err)
+			}
+			n, err := tc.replace(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == a {
+				t.Errorf("the new a got the node of b")
+			}
+			if got := lookup(t, root, "b"); got != a {
+				t.Errorf("Lookup(b) returned a different node than the one renamed to b")
+			}
+		})
+	}
+}
+
+func TestNodesAreForgottenOnRemove(t *testing.T) {
+	ctx := context.Background()
+	r, backend := testFS(t, Options{})
+	if err := util.WriteFile(backend, "f", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := r.node("")
+	old := lookup(t, root, "f")
+	if _, err := old.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{}); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "f"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	n, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "f", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if n == old {
+		t.Errorf("the new f got the node of the removed one")
+	}
+}
+
+func TestLazyOpen(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		flags fuse.OpenFlags
+		use   func(t *testing.T, h *handle)
+		// opens is the number of files that should have been opened on the backend.
+		opens int
+	}{
+		{name: "open and close", flags: fuse.OpenReadOnly, use: func(t *testing.T, h *handle) {}, opens: 0},
+		{name: "flush", flags: fuse.OpenReadWrite, use: func(t *testing.T, h *handle) {
+			if err := h.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+				t.Errorf("Flush: %v", err)
+			}
+		}, opens: 0},
+		{name: "read", flags: fuse.OpenReadOnly, use: func(t *testing.T, h *handle) {
+			if got := readHandle(t, h); got != "content" {
+				t.Errorf("Read = %q; want %q", got, "content")
+			}
+			readHandle(t, h)
+		}, opens: 1},
+		{name: "write", flags: fuse.OpenWriteOnly, use: func(t *testing.T, h *handle) {
+			if err := h.Write(ctx, &fuse.WriteRequest{Data: []byte("C")}, &fuse.WriteResponse{}); err != nil {
+				t.Errorf("Write: %v", err)
+			}
+		}, opens: 1},
+		{name: "truncate", flags: fuse.OpenWriteOnly | fuse.OpenTruncate, use: func(t *testing.T, h *handle) {}, opens: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, backend := countingTestFS(t, Options{LazyOpen: true})
+			h := openHandle(t, r, "f", tc.flags)
+			tc.use(t, h)
+			releaseHandle(t, h)
+			opens, open := backend.counts()
+			if opens != tc.opens {
+				t.Errorf("%d files were opened on the backend; want %d", opens, tc.opens)
+			}
+			if open != 0 {
+				t.Errorf("%d files are still open on the backend after Release", open)
+			}
+		})
+	}
+}
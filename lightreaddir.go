@@ -0,0 +1,48 @@
+package billybazilfuse
+
+import (
+	iofs "io/fs"
+	"os"
+	"time"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+)
+
+// LightReadDir can be implemented by backends that pay for a Stat per entry to produce the os.FileInfos returned by ReadDir, but can list the names and types of the entries cheaply.
+// Directory listings use it instead of ReadDir. The Info method of the returned entries isn't called.
+type LightReadDir interface {
+	ReadDirLight(path string) ([]iofs.DirEntry, error)
+}
+
+// readDirForListing lists a directory for ReadDirAll, which only needs the names and types of the entries.
+func (r *FS) readDirForListing(p string) ([]os.FileInfo, error) {
+	lrd, ok := r.underlying.(LightReadDir)
+	if !ok || ((r.emulateSymlinks || r.emulateSpecial) && !r.unknownDirentTypes) {
+		// Emulated symlinks are recognized by their size.
+		entries, err := adapter.ReadDir(r.underlying, p)
+		if err == nil {
+			r.statAhead.listed(p, entries, true)
+		}
+		return entries, err
+	}
+	entries, err := lrd.ReadDirLight(p)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]os.FileInfo, len(entries))
+	for i, e := range entries {
+		ret[i] = direntInfo{e}
+	}
+	r.statAhead.listed(p, ret, false)
+	return ret, nil
+}
+
+// direntInfo presents a DirEntry as an os.FileInfo with only a name and type.
+type direntInfo struct {
+	iofs.DirEntry
+}
+
+func (di direntInfo) Size() int64        { return 0 }
+func (di direntInfo) Mode() os.FileMode  { return di.Type() }
+func (di direntInfo) ModTime() time.Time { return time.Time{} }
+func (di direntInfo) Sys() interface{}   { return nil }
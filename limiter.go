@@ -0,0 +1,201 @@
+package billybazilfuse
+
+import (
+	"context"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// opClass groups calls for concurrency limiting.
+type opClass int
+
+const (
+	// metadataOp is everything but reading and writing file contents.
+	metadataOp opClass = iota
+	// dataOp is reading and writing file contents.
+	dataOp
+	// backgroundOp is work nobody is waiting for, like prefetching.
+	backgroundOp
+	numOpClasses
+)
+
+func classify(req fuse.Request) opClass {
+	switch req.(type) {
+	case *fuse.ReadRequest, *fuse.WriteRequest:
+		return dataOp
+	}
+	return metadataOp
+}
+
+// limiter bounds the number of calls into the backend, in total and per opClass. The limits can be changed at any time.
+type limiter struct {
+	global  *scheduler
+	classes [numOpClasses]*scheduler
+}
+
+func newLimiter(total, metadata, data int) *limiter {
+	l := &limiter{global: newScheduler(total)}
+	l.classes[metadataOp] = newScheduler(metadata)
+	l.classes[dataOp] = newScheduler(data)
+	// Background work has slots of its own, as calls holding global slots may be waiting for it.
+	l.classes[backgroundOp] = newScheduler(total)
+	return l
+}
+
+func (l *limiter) setLimits(total, metadata, data int) {
+	l.global.setLimit(total)
+	l.classes[backgroundOp].setLimit(total)
+	l.classes[metadataOp].setLimit(metadata)
+	l.classes[dataOp].setLimit(data)
+}
+
+// acquire waits for a slot for a call of the given class on behalf of caller (a pid, or 0 if unknown). The returned function must be called when the call is done.
+// It fails with EINTR if ctx is cancelled (because the kernel interrupted the request) while waiting, or with the error of Options.OpTimeout if its deadline passes.
+// Background work doesn't take global slots: calls can wait for prefetches, so prefetches waiting for slots held by those calls would never run.
+func (l *limiter) acquire(ctx context.Context, class opClass, caller uint32) (func(), error) {
+	sem := l.classes[class]
+	if err := sem.acquire(ctx, class, caller); err != nil {
+		return nil, err
+	}
+	if class == backgroundOp {
+		return sem.release, nil
+	}
+	if err := l.global.acquire(ctx, class, caller); err != nil {
+		sem.release()
+		return nil, err
+	}
+	return func() {
+		l.global.release()
+		sem.release()
+	}, nil
+}
+
+// begin is called at the start of every call from FUSE on the node at p. It calls the CallHook, and waits for the concurrency limiter.
+// It returns ctx with the deadline of Options.OpTimeout and the CallInfo, which the call should use from then on. The returned function must be called with the result of the call when it's done.
+func (r *FS) begin(ctx context.Context, req fuse.Request, p string) (context.Context, func(error), error) {
+	return r.beginCall(ctx, req, CallInfo{Path: p})
+}
+
+// beginCall is begin with the CallInfo for the hooks, for calls on handles.
+func (r *FS) beginCall(ctx context.Context, req fuse.Request, info CallInfo) (context.Context, func(error), error) {
+	op := opName(req)
+	p := info.Path
+	ctx, cancel := r.withTimeout(ctx)
+	ctx = r.withCallInfo(ctx, info)
+	finished := r.finisher(ctx, op, p, req)
+	finished = cancelAfter(finished, cancel)
+	if err := r.checkOwner(req); err != nil {
+		finished(err)
+		return ctx, nil, err
+	}
+	if err := r.checkWritable(req); err != nil {
+		finished(err)
+		return ctx, nil, err
+	}
+	if err := r.checkSquashedRoot(req); err != nil {
+		finished(err)
+		return ctx, nil, err
+	}
+	if err := r.checkPermissions(req, info); err != nil {
+		finished(err)
+		return ctx, nil, err
+	}
+	if err := r.callHook(ctx, req); err != nil {
+		if ctx.Err() != nil {
+			err = ctxErr(ctx)
+		}
+		finished(err)
+		return ctx, nil, err
+	}
+	if err := r.throttle(ctx, req); err != nil {
+		finished(err)
+		return ctx, nil, err
+	}
+	done, err := r.enterFinished(ctx, classify(req), req.Hdr().Pid, op, finished)
+	return ctx, done, err
+}
+
+// throttle delays writes while the write backlog is too large, and reads while the MemoryBudget is exceeded. It's done before taking a slot from the concurrency limiter, so throttled calls don't hold up others.
+func (r *FS) throttle(ctx context.Context, req fuse.Request) error {
+	switch req := req.(type) {
+	case *fuse.WriteRequest:
+		if r.backlog != nil {
+			return r.backlog.wait(ctx)
+		}
+	case *fuse.ReadRequest:
+		if !req.Dir {
+			return r.waitForMemory(ctx)
+		}
+	}
+	return nil
+}
+
+// beginOp is begin for calls bazil doesn't pass the request of, like Attr.
+func (r *FS) beginOp(ctx context.Context, op string, p string) (context.Context, func(error), error) {
+	ctx, cancel := r.withTimeout(ctx)
+	ctx = r.withCallInfo(ctx, CallInfo{Path: p})
+	done, err := r.enterFinished(ctx, metadataOp, 0, op, cancelAfter(r.finisher(ctx, op, p, nil), cancel))
+	return ctx, done, err
+}
+
+// cancelAfter returns a function that calls finished and then cancel.
+func cancelAfter(finished func(error), cancel context.CancelFunc) func(error) {
+	return func(err error) {
+		finished(err)
+		cancel()
+	}
+}
+
+// finisher returns the function that applies the ErrorMapper to the error of a call, records the result in the OpLog, the ErrorAlerts and the counters of unrecognized errors, and passes errors to OnError.
+func (r *FS) finisher(ctx context.Context, op string, p string, req fuse.Request) func(error) {
+	var start time.Time
+	if r.opLog != nil {
+		start = time.Now()
+	}
+	return func(err error) {
+		r.mapError(err)
+		r.opLog.record(op, p, req, start, err)
+		r.alerts.record(op, err)
+		if err == nil {
+			return
+		}
+		if ce, ok := err.(*convertedError); ok && ce.unknown {
+			r.unknownErrors.record(op, ce.err)
+		}
+		if r.onError != nil {
+			orig, errno := originalError(err)
+			r.onError(ctx, req, orig, errno)
+		}
+	}
+}
+
+func (r *FS) enterFinished(ctx context.Context, class opClass, caller uint32, op string, finished func(error)) (func(error), error) {
+	done, err := r.enter(ctx, class, caller, op)
+	if err != nil {
+		finished(err)
+		return nil, err
+	}
+	return func(err error) {
+		done()
+		finished(err)
+	}, nil
+}
+
+func (r *FS) enter(ctx context.Context, class opClass, caller uint32, op string) (func(), error) {
+	c := r.calls.start(op, caller)
+	done, err := r.limiter.acquire(ctx, class, caller)
+	if err != nil {
+		r.calls.finish(c)
+		return nil, err
+	}
+	return func() {
+		done()
+		r.calls.finish(c)
+	}, nil
+}
+
+// background waits for a slot for background work, like prefetching. The returned function must be called when the work is done.
+func (r *FS) background(ctx context.Context) (func(), error) {
+	return r.limiter.acquire(ctx, backgroundOp, 0)
+}
@@ -0,0 +1,93 @@
+package billybazilfuse
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+// LocalDirectory can be implemented by backends that store their files in a local directory, so Options.WatchLocal can watch it.
+type LocalDirectory interface {
+	// LocalDirectory returns the local directory holding the root of the backend.
+	LocalDirectory() string
+}
+
+// localDirectory returns the local directory underlying is stored in, or "" if it isn't known.
+// Besides LocalDirectory, this recognizes backends created with osfs.New.
+func localDirectory(underlying billy.Basic) string {
+	if ld, ok := underlying.(LocalDirectory); ok {
+		return ld.LocalDirectory()
+	}
+	// osfs.New wraps the OS in a chroot and a polyfill.
+	root := ""
+	for b := underlying; ; {
+		if ch, ok := b.(billy.Chroot); ok && root == "" {
+			root = ch.Root()
+		}
+		if _, ok := b.(*osfs.OS); ok {
+			return root
+		}
+		u, ok := b.(interface{ Underlying() billy.Basic })
+		if !ok {
+			break
+		}
+		b = u.Underlying()
+	}
+	return ""
+}
+
+// watchLocal watches dir and everything below it for changes until ctx is cancelled, and reports them as external changes.
+// The initial watches are set up before it returns.
+func (r *FS) watchLocal(ctx context.Context, dir string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return err
+	}
+	addTree(w, dir)
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Has(fsnotify.Create) {
+					// New directories need to be watched too. Adding them is racy, so anything created in them before that is missed.
+					addTree(w, ev.Name)
+				}
+				rel, err := filepath.Rel(dir, ev.Name)
+				if err != nil {
+					continue
+				}
+				r.externalChange(filepath.ToSlash(rel))
+			case <-w.Errors:
+				// Errors (like queue overflows) mean we might have missed events, which we can't do anything about.
+			}
+		}
+	}()
+	return nil
+}
+
+// addTree adds watches for all directories below (and including) root. Failures (like hitting the inotify watch limit) are ignored, so that part of the tree isn't watched.
+func addTree(w *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			w.Add(p)
+		}
+		return nil
+	})
+}
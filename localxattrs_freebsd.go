@@ -0,0 +1,6 @@
+package billybazilfuse
+
+// newLocalXattrs returns nil, as FreeBSD's extended attributes don't map cleanly onto Linux's namespaces.
+func newLocalXattrs(dir string) Xattrer {
+	return nil
+}
@@ -0,0 +1,72 @@
+package billybazilfuse
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// localXattrs stores extended attributes on the files in a local directory.
+type localXattrs struct {
+	dir string
+}
+
+func newLocalXattrs(dir string) Xattrer {
+	return localXattrs{dir}
+}
+
+func (l localXattrs) local(p string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(p))
+}
+
+func (l localXattrs) GetXattr(p, name string) ([]byte, error) {
+	fn := l.local(p)
+	for {
+		n, err := unix.Lgetxattr(fn, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		n, err = unix.Lgetxattr(fn, name, buf)
+		if err == unix.ERANGE {
+			// It grew in between.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func (l localXattrs) ListXattrs(p string) ([]string, error) {
+	fn := l.local(p)
+	for {
+		n, err := unix.Llistxattr(fn, nil)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		n, err = unix.Llistxattr(fn, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(bytes.TrimSuffix(buf[:n], []byte{0}), []byte{0}) {
+			names = append(names, string(name))
+		}
+		return names, nil
+	}
+}
+
+func (l localXattrs) SetXattr(p, name string, value []byte, flags uint32) error {
+	return unix.Lsetxattr(l.local(p), name, value, int(flags))
+}
+
+func (l localXattrs) RemoveXattr(p, name string) error {
+	return unix.Lremovexattr(l.local(p), name)
+}
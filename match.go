@@ -0,0 +1,31 @@
+package billybazilfuse
+
+import (
+	"path"
+	"strings"
+)
+
+// matchAny returns whether the backend path p matches any of the path.Match patterns.
+// Patterns without a slash are matched against the base name of p.
+func matchAny(patterns []string, p string) bool {
+	for _, pat := range patterns {
+		name := p
+		if !strings.Contains(pat, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePatterns returns an error if any of the patterns is malformed.
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
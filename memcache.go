@@ -0,0 +1,114 @@
+package billybazilfuse
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryCache is a BlockCache that keeps the least recently used blocks in memory, up to a budget.
+type MemoryCache struct {
+	budget int64
+	ttl    atomic.Int64 // a time.Duration
+
+	mtx    sync.Mutex
+	used   int64
+	lru    *list.List // of *memoryCacheEntry, most recently used first
+	blocks map[BlockKey]*list.Element
+	byPath map[string]map[*list.Element]struct{}
+}
+
+type memoryCacheEntry struct {
+	key   BlockKey
+	data  []byte
+	added time.Time
+}
+
+var _ BlockCache = &MemoryCache{}
+
+// NewMemoryCache creates a MemoryCache that holds at most budget bytes of file contents.
+func NewMemoryCache(budget int64) *MemoryCache {
+	return &MemoryCache{
+		budget: budget,
+		lru:    list.New(),
+		blocks: map[BlockKey]*list.Element{},
+		byPath: map[string]map[*list.Element]struct{}{},
+	}
+}
+
+func (c *MemoryCache) Get(key BlockKey) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.blocks[key]
+	if !ok {
+		return nil, false
+	}
+	ce := e.Value.(*memoryCacheEntry)
+	if ttl := time.Duration(c.ttl.Load()); ttl > 0 && time.Since(ce.added) > ttl {
+		c.removeLocked(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return ce.data, true
+}
+
+func (c *MemoryCache) Put(key BlockKey, data []byte) {
+	if int64(len(data)) > c.budget {
+		return
+	}
+	if cap(data) > len(data) {
+		// The last block of a file is usually read into a buffer of a whole block. Keeping that would hold on to far more memory than we count.
+		data = append(make([]byte, 0, len(data)), data...)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.blocks[key]; ok {
+		c.removeLocked(e)
+	}
+	e := c.lru.PushFront(&memoryCacheEntry{key, data, time.Now()})
+	c.blocks[key] = e
+	if c.byPath[key.Path] == nil {
+		c.byPath[key.Path] = map[*list.Element]struct{}{}
+	}
+	c.byPath[key.Path][e] = struct{}{}
+	c.used += int64(len(data))
+	for c.used > c.budget {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *MemoryCache) Invalidate(path string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for e := range c.byPath[path] {
+		c.removeLocked(e)
+	}
+}
+
+// usage returns the number of bytes cached.
+func (c *MemoryCache) usage() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.used
+}
+
+func (c *MemoryCache) shed(n int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for target := c.used - n; c.used > target && c.lru.Len() > 0; {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *MemoryCache) removeLocked(e *list.Element) {
+	ce := c.lru.Remove(e).(*memoryCacheEntry)
+	delete(c.blocks, ce.key)
+	if m := c.byPath[ce.key.Path]; m != nil {
+		delete(m, e)
+		if len(m) == 0 {
+			delete(c.byPath, ce.key.Path)
+		}
+	}
+	c.used -= int64(len(ce.data))
+}
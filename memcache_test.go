@@ -0,0 +1,23 @@
+package billybazilfuse
+
+import "testing"
+
+func TestMemoryCacheCountsShortBlocks(t *testing.T) {
+	const budget = 1 << 20
+	c := NewMemoryCache(budget)
+	// Many small files, each read into a buffer of a whole block.
+	for i := int64(0); i < 100; i++ {
+		buf := make([]byte, cacheBlockSize)
+		c.Put(BlockKey{Path: "f", Block: i}, buf[:10])
+	}
+	var held int
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		held += cap(e.Value.(*memoryCacheEntry).data)
+	}
+	if held > budget {
+		t.Errorf("the cache holds on to %d bytes, over its budget of %d", held, budget)
+	}
+	if c.lru.Len() != 100 {
+		t.Errorf("the cache kept %d of the blocks; want all 100", c.lru.Len())
+	}
+}
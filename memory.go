@@ -0,0 +1,122 @@
+package billybazilfuse
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+)
+
+// maxMemoryWait is the longest a read waits for memory to be released when the budget is exceeded.
+// Memory held by buffered writes that fail to be written isn't released, so reads can't wait forever.
+const maxMemoryWait = 5 * time.Second
+
+// memoryCacher is implemented by the caches that hold blocks in memory.
+type memoryCacher interface {
+	usage() int64
+	// shed drops the least recently used blocks until n bytes were freed or the cache is empty.
+	shed(n int64)
+}
+
+// memoryBudget bounds the memory used by the buffers of open files and the memory tier of the cache.
+type memoryBudget struct {
+	limit int64
+	cache memoryCacher // nil if the cache doesn't hold blocks in memory
+
+	mtx  sync.Mutex
+	used int64
+	// released is closed (and replaced) whenever memory is released.
+	released chan struct{}
+}
+
+var _ adapter.Memory = &memoryBudget{}
+
+func newMemoryBudget(limit int64, cache BlockCache) *memoryBudget {
+	m := &memoryBudget{limit: limit, released: make(chan struct{})}
+	m.cache, _ = cache.(memoryCacher)
+	return m
+}
+
+func (m *memoryBudget) Add(delta int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.used += delta
+	if delta < 0 {
+		close(m.released)
+		m.released = make(chan struct{})
+	}
+}
+
+// Over returns whether the buffers and the cache use more than the budget.
+func (m *memoryBudget) Over() bool {
+	return m.excess() > 0
+}
+
+func (m *memoryBudget) excess() int64 {
+	m.mtx.Lock()
+	n := m.used - m.limit
+	m.mtx.Unlock()
+	if m.cache != nil {
+		n += m.cache.usage()
+	}
+	return n
+}
+
+// wait returns once the budget isn't exceeded, shedding cached blocks and releasing the buffers of open files to get there.
+// It gives up waiting after maxMemoryWait, and fails with EINTR if ctx is cancelled, or with the error of Options.OpTimeout if its deadline passes.
+func (m *memoryBudget) wait(ctx context.Context, release func()) error {
+	n := m.excess()
+	if n <= 0 {
+		return nil
+	}
+	if m.cache != nil {
+		m.cache.shed(n)
+		if !m.Over() {
+			return nil
+		}
+	}
+	release()
+	deadline := time.NewTimer(maxMemoryWait)
+	defer deadline.Stop()
+	for {
+		m.mtx.Lock()
+		released := m.released
+		m.mtx.Unlock()
+		if !m.Over() {
+			return nil
+		}
+		select {
+		case <-released:
+		case <-deadline.C:
+			return nil
+		case <-ctx.Done():
+			return ctxErr(ctx)
+		}
+	}
+}
+
+// releaseMemory discards the prefetched data of all open files, and starts writing their buffered data.
+func (r *FS) releaseMemory() {
+	r.handlesMtx.Lock()
+	handles := make([]*handle, 0, len(r.handles))
+	for h := range r.handles {
+		handles = append(handles, h)
+	}
+	r.handlesMtx.Unlock()
+	for _, h := range handles {
+		h.openMtx.Lock()
+		if h.fh != nil {
+			h.fh.ReleaseMemory()
+		}
+		h.openMtx.Unlock()
+	}
+}
+
+// waitForMemory delays a read while the MemoryBudget is exceeded.
+func (r *FS) waitForMemory(ctx context.Context) error {
+	if r.memory == nil {
+		return nil
+	}
+	return r.memory.wait(ctx, r.releaseMemory)
+}
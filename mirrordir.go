@@ -0,0 +1,66 @@
+package billybazilfuse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mirrorDir is a local directory holding a file of data per path of the mount, mirroring its directory structure. It's used by the stores that keep data about files outside of the backend.
+type mirrorDir string
+
+// names returns the local paths for the data of p as a file and as a directory.
+// Names are prefixed so a file and a directory with the same name can't clash.
+func (m mirrorDir) names(p string) (file, dir string) {
+	parts := strings.Split(p, "/")
+	for i := range parts[:len(parts)-1] {
+		parts[i] = "d." + parts[i]
+	}
+	base := parts[len(parts)-1]
+	parts[len(parts)-1] = "f." + base
+	file = filepath.Join(string(m), filepath.Join(parts...))
+	parts[len(parts)-1] = "d." + base
+	dir = filepath.Join(string(m), filepath.Join(parts...))
+	return file, dir
+}
+
+// get returns the data of p, or ok=false if there is none.
+func (m mirrorDir) get(p string) ([]byte, bool) {
+	fn, _ := m.names(p)
+	data, err := os.ReadFile(fn)
+	return data, err == nil
+}
+
+// put stores the data of p.
+func (m mirrorDir) put(p string, data []byte) {
+	fn, _ := m.names(p)
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return
+	}
+	writeFileAtomic(fn, data)
+}
+
+// remove drops the data of p and everything below it.
+func (m mirrorDir) remove(p string) {
+	fn, dn := m.names(p)
+	os.Remove(fn)
+	os.RemoveAll(dn)
+}
+
+// rename moves the data of oldPath and everything below it to newPath.
+func (m mirrorDir) rename(oldPath, newPath string) {
+	m.remove(newPath)
+	oldFile, oldDir := m.names(oldPath)
+	newFile, newDir := m.names(newPath)
+	for _, r := range [][2]string{{oldFile, newFile}, {oldDir, newDir}} {
+		if err := os.Rename(r[0], r[1]); err != nil && errors.Is(err, os.ErrNotExist) {
+			if _, serr := os.Stat(r[0]); serr == nil {
+				// The parent directory doesn't exist yet.
+				if os.MkdirAll(filepath.Dir(r[1]), 0700) == nil {
+					os.Rename(r[0], r[1])
+				}
+			}
+		}
+	}
+}
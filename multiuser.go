@@ -0,0 +1,307 @@
+package billybazilfuse
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+)
+
+// MultiUserFS is a fuse/fs.FS that gives every user their own view, so one mount (with fuse.AllowOther) can serve isolated home-directory-like trees to many users.
+//
+// The root directory of the mount shows the view of the calling user. Each view is a separate FS with the same Options, and only serves requests from its own uid.
+// The local files of WriteJournal, InodeMapFile and OpLogFile get the uid as a suffix, like journal.1000, so every view has its own.
+// Lookups in the root directory aren't cached by the kernel, so users that look up the same name each get their own node.
+type MultiUserFS struct {
+	view func(uid uint32) (billy.Basic, error)
+	opts Options
+
+	mtx    sync.Mutex
+	views  map[uint32]*FS
+	server *fs.Server
+}
+
+var _ fs.FS = &MultiUserFS{}
+
+// NewMultiUser creates a MultiUserFS. view is called the first time a uid uses the mount, and returns the backend for that user, like UserSubtrees does.
+func NewMultiUser(view func(uid uint32) (billy.Basic, error), opts Options) *MultiUserFS {
+	return &MultiUserFS{
+		view:  view,
+		opts:  opts,
+		views: map[uint32]*FS{},
+	}
+}
+
+// UserSubtrees returns a view function for NewMultiUser that gives each user the directory /<uid> of underlying, which is created if needed.
+func UserSubtrees(underlying billy.Filesystem) func(uid uint32) (billy.Basic, error) {
+	return func(uid uint32) (billy.Basic, error) {
+		dir := strconv.FormatUint(uint64(uid), 10)
+		if err := underlying.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return chroot.New(underlying, dir), nil
+	}
+}
+
+func (m *MultiUserFS) Root() (fs.Node, error) {
+	return &userRoot{m}, nil
+}
+
+// Serve serves the filesystem on c until it's unmounted, like fs.Serve. It lets the views invalidate the kernel's caches, but doesn't start the background work of FS.Serve.
+func (m *MultiUserFS) Serve(c *fuse.Conn) error {
+	srv := fs.New(c, nil)
+	m.mtx.Lock()
+	m.server = srv
+	for _, v := range m.views {
+		v.setServer(srv)
+	}
+	m.mtx.Unlock()
+	return srv.Serve(m)
+}
+
+// Close closes all views.
+func (m *MultiUserFS) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var ret error
+	for _, v := range m.views {
+		if err := v.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// root returns the root node of the view of the user making req.
+func (m *MultiUserFS) root(req fuse.Request) (*node, error) {
+	uid := req.Hdr().Uid
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	v, ok := m.views[uid]
+	if !ok {
+		underlying, err := m.view(uid)
+		if err != nil {
+			return nil, err
+		}
+		v, err = NewWithOptions(underlying, m.viewOptions(uid))
+		if err != nil {
+			return nil, err
+		}
+		v.owner = &uid
+		if m.server != nil {
+			v.setServer(m.server)
+		}
+		m.views[uid] = v
+	}
+	return v.node(""), nil
+}
+
+// viewOptions returns the Options for the view of uid. Files that a FS keeps to itself are suffixed with the uid.
+func (m *MultiUserFS) viewOptions(uid uint32) Options {
+	opts := m.opts
+	suffix := "." + strconv.FormatUint(uint64(uid), 10)
+	if opts.WriteJournal != "" {
+		opts.WriteJournal += suffix
+	}
+	if opts.InodeMapFile != "" {
+		opts.InodeMapFile += suffix
+	}
+	if opts.OpLogFile != "" {
+		opts.OpLogFile += suffix
+	}
+	return opts
+}
+
+// checkOwner refuses requests from users other than the owner of a view.
+func (r *FS) checkOwner(req fuse.Request) error {
+	if r.owner != nil && req.Hdr().Uid != *r.owner {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
+
+// asNode returns the node of this FS for a node passed by bazil, which can be the root of a MultiUserFS.
+// Nodes of other views, and virtual nodes like the control directory, are refused with EXDEV.
+func (r *FS) asNode(n fs.Node) (*node, error) {
+	if _, ok := n.(*userRoot); ok {
+		return r.node(""), nil
+	}
+	nd, ok := n.(*node)
+	if !ok || nd.root != r {
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+	return nd, nil
+}
+
+// userRoot is the root directory of a MultiUserFS. It passes all calls to the root of the calling user's view.
+type userRoot struct {
+	m *MultiUserFS
+}
+
+var _ fs.Node = &userRoot{}
+var _ fs.NodeCreater = &userRoot{}
+var _ fs.NodeFsyncer = &userRoot{}
+var _ fs.NodeGetattrer = &userRoot{}
+var _ fs.NodeGetxattrer = &userRoot{}
+var _ fs.NodeLinker = &userRoot{}
+var _ fs.NodeListxattrer = &userRoot{}
+var _ fs.NodeMkdirer = &userRoot{}
+var _ fs.NodeMknoder = &userRoot{}
+var _ fs.NodeOpener = &userRoot{}
+var _ fs.NodeRemovexattrer = &userRoot{}
+var _ fs.NodeRemover = &userRoot{}
+var _ fs.NodeRenamer = &userRoot{}
+var _ fs.NodeRequestLookuper = &userRoot{}
+var _ fs.NodeSetattrer = &userRoot{}
+var _ fs.NodeSetxattrer = &userRoot{}
+var _ fs.NodeSymlinker = &userRoot{}
+
+// Attr is only used when bazil doesn't know the calling user. Getattr returns the user's view.
+func (u *userRoot) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0755
+	return nil
+}
+
+func (u *userRoot) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	if err := n.Attr(ctx, &resp.Attr); err != nil {
+		return err
+	}
+	// Other users must get their own attributes.
+	resp.Attr.Valid = 0
+	return nil
+}
+
+func (u *userRoot) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	n, err := u.m.root(req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	ret, err := n.Lookup(ctx, req, resp)
+	// Other users looking up the same name must get their own node.
+	resp.EntryValid = 0
+	return ret, err
+}
+
+func (u *userRoot) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	n, err := u.m.root(req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return n.Open(ctx, req, resp)
+}
+
+func (u *userRoot) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	n, err := u.m.root(req)
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+	nn, h, err := n.Create(ctx, req, resp)
+	resp.EntryValid = 0
+	return nn, h, err
+}
+
+func (u *userRoot) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	n, err := u.m.root(req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return n.Mkdir(ctx, req)
+}
+
+func (u *userRoot) Mknod(ctx context.Context, req *fuse.MknodRequest) (fs.Node, error) {
+	n, err := u.m.root(req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return n.Mknod(ctx, req)
+}
+
+func (u *userRoot) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	n, err := u.m.root(req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return n.Symlink(ctx, req)
+}
+
+func (u *userRoot) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	n, err := u.m.root(req)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return n.Link(ctx, req, old)
+}
+
+func (u *userRoot) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Remove(ctx, req)
+}
+
+func (u *userRoot) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Rename(ctx, req, newDir)
+}
+
+func (u *userRoot) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Setattr(ctx, req, resp)
+}
+
+func (u *userRoot) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Fsync(ctx, req)
+}
+
+func (u *userRoot) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Getxattr(ctx, req, resp)
+}
+
+func (u *userRoot) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Listxattr(ctx, req, resp)
+}
+
+func (u *userRoot) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Setxattr(ctx, req)
+}
+
+func (u *userRoot) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	n, err := u.m.root(req)
+	if err != nil {
+		return convertError(err)
+	}
+	return n.Removexattr(ctx, req)
+}
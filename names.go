@@ -0,0 +1,162 @@
+package billybazilfuse
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+	"github.com/go-git/go-billy/v5"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization is a Unicode normalization form for file names.
+type Normalization int
+
+const (
+	// NoNormalization passes names through unmodified.
+	NoNormalization Normalization = iota
+	// NFC is the composed form, as generally used by Linux and Windows.
+	NFC
+	// NFD is the decomposed form, as used by macOS.
+	NFD
+)
+
+func (n Normalization) normalize(name string) string {
+	switch n {
+	case NFC:
+		return norm.NFC.String(name)
+	case NFD:
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// foldName returns a key that is equal for all names that are equal under Unicode case folding (like strings.EqualFold).
+func foldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		return min
+	}, name)
+}
+
+// nameIndex remembers per directory which names on the backend are considered equivalent, either because they only differ in case or in Unicode normalization.
+// Directories are indexed on first use and dropped from the index when they're modified through the mount.
+type nameIndex struct {
+	caseInsensitive bool
+	normalization   Normalization
+
+	mtx  sync.Mutex
+	dirs map[string]map[string][]string
+}
+
+func newNameIndex(caseInsensitive bool, normalization Normalization) *nameIndex {
+	return &nameIndex{
+		caseInsensitive: caseInsensitive,
+		normalization:   normalization,
+		dirs:            map[string]map[string][]string{},
+	}
+}
+
+// key returns the name under which equivalent names are grouped.
+func (ni *nameIndex) key(name string) string {
+	// Any normalization form will do, as long as it's the same for all names.
+	name = norm.NFC.String(name)
+	if ni.caseInsensitive {
+		name = foldName(name)
+	}
+	return name
+}
+
+// resolve returns the backend path for name in dir.
+// An exact match wins. Otherwise the lexicographically smallest equivalent name is used.
+// If nothing matches, the name is normalized (if configured) and otherwise used as is, so new files preserve their case.
+func (ni *nameIndex) resolve(underlying billy.Basic, dir, name string) (string, error) {
+	exact := path.Join(dir, name)
+	if _, err := underlying.Stat(exact); err == nil || !os.IsNotExist(err) {
+		return exact, nil
+	}
+	ni.mtx.Lock()
+	idx, ok := ni.dirs[dir]
+	ni.mtx.Unlock()
+	if !ok {
+		entries, err := adapter.ReadDir(underlying, dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return exact, nil
+			}
+			return "", err
+		}
+		idx = map[string][]string{}
+		for _, e := range entries {
+			k := ni.key(e.Name())
+			idx[k] = append(idx[k], e.Name())
+		}
+		for _, names := range idx {
+			sort.Strings(names)
+		}
+		ni.mtx.Lock()
+		ni.dirs[dir] = idx
+		ni.mtx.Unlock()
+	}
+	if names := idx[ni.key(name)]; len(names) > 0 {
+		return path.Join(dir, names[0]), nil
+	}
+	return path.Join(dir, ni.normalization.normalize(name)), nil
+}
+
+// presentEntries normalizes the names of directory entries for the kernel, and drops entries that would end up with the same name.
+// It returns the names to present, in the same order as the returned entries, or nil if the names don't need to be changed.
+func (ni *nameIndex) presentEntries(entries []os.FileInfo) ([]os.FileInfo, []string) {
+	if ni.normalization == NoNormalization {
+		return entries, nil
+	}
+	sorted := make([]os.FileInfo, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name() < sorted[j].Name()
+	})
+	seen := map[string]int{}
+	var retEntries []os.FileInfo
+	var retNames []string
+	for _, e := range sorted {
+		n := ni.normalization.normalize(e.Name())
+		if i, ok := seen[n]; ok {
+			// Prefer the entry that is already in the right form; a lookup of the presented name would resolve to that one.
+			if e.Name() == n {
+				retEntries[i] = e
+			}
+			continue
+		}
+		seen[n] = len(retEntries)
+		retEntries = append(retEntries, e)
+		retNames = append(retNames, n)
+	}
+	return retEntries, retNames
+}
+
+// invalidate drops dir from the index.
+func (ni *nameIndex) invalidate(dir string) {
+	ni.mtx.Lock()
+	defer ni.mtx.Unlock()
+	delete(ni.dirs, dir)
+}
+
+// invalidateTree drops p and all directories below it from the index.
+func (ni *nameIndex) invalidateTree(p string) {
+	ni.mtx.Lock()
+	defer ni.mtx.Unlock()
+	for dir := range ni.dirs {
+		if dir == p || strings.HasPrefix(dir, p+"/") {
+			delete(ni.dirs, dir)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package billybazilfuse
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+const (
+	cafeNFC = "caf\u00e9"
+	cafeNFD = "cafe\u0301"
+)
+
+func TestNameIndexResolve(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		files           []string
+		caseInsensitive bool
+		normalization   Normalization
+		lookup          string
+		want            string
+	}{
+		{name: "exact match", files: []string{"README", "readme"}, caseInsensitive: true, lookup: "readme", want: "dir/readme"},
+		{name: "other case", files: []string{"README"}, caseInsensitive: true, lookup: "readme", want: "dir/README"},
+		{name: "smallest of several cases", files: []string{"readme", "ReadMe"}, caseInsensitive: true, lookup: "README", want: "dir/ReadMe"},
+		{name: "case sensitive", files: []string{"README"}, lookup: "readme", want: "dir/readme"},
+		{name: "new file preserves case", files: []string{"other"}, caseInsensitive: true, lookup: "NewFile", want: "dir/NewFile"},
+		{name: "NFD on the backend", files: []string{cafeNFD}, normalization: NFC, lookup: cafeNFC, want: "dir/" + cafeNFD},
+		{name: "NFC on the backend", files: []string{cafeNFC}, normalization: NFD, lookup: cafeNFD, want: "dir/" + cafeNFC},
+		{name: "new file is normalized", normalization: NFD, lookup: cafeNFC, want: "dir/" + cafeNFD},
+		{name: "other case and form", files: []string{"CAFÉ"}, caseInsensitive: true, normalization: NFC, lookup: cafeNFC, want: "dir/CAFÉ"},
+		{name: "missing directory", caseInsensitive: true, lookup: "x/y", want: "dir/x/y"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := memfs.New()
+			if err := backend.MkdirAll("dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range tc.files {
+				if err := util.WriteFile(backend, "dir/"+f, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ni := newNameIndex(tc.caseInsensitive, tc.normalization)
+			got, err := ni.resolve(backend, "dir", tc.lookup)
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("resolve(%q) = %q; want %q", tc.lookup, got, tc.want)
+			}
+		})
+	}
+}
+
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string { return fi.name }
+
+func TestNameIndexPresentEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		entries       []string
+		normalization Normalization
+		// want are the presented names, and from the backend names they're presented for.
+		want, from []string
+	}{
+		{name: "no normalization", entries: []string{"b", cafeNFD}, want: nil, from: []string{"b", cafeNFD}},
+		{name: "normalized", entries: []string{cafeNFD, "b"}, normalization: NFC, want: []string{"b", cafeNFC}, from: []string{"b", cafeNFD}},
+		{name: "duplicates prefer the right form", entries: []string{cafeNFD, cafeNFC}, normalization: NFC, want: []string{cafeNFC}, from: []string{cafeNFC}},
+		{name: "duplicates in the other form", entries: []string{cafeNFC, cafeNFD}, normalization: NFD, want: []string{cafeNFD}, from: []string{cafeNFD}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var entries []os.FileInfo
+			for _, n := range tc.entries {
+				entries = append(entries, namedFileInfo{name: n})
+			}
+			ni := newNameIndex(false, tc.normalization)
+			gotEntries, gotNames := ni.presentEntries(entries)
+			if !reflect.DeepEqual(gotNames, tc.want) {
+				t.Errorf("presentEntries returned names %q; want %q", gotNames, tc.want)
+			}
+			var from []string
+			for _, e := range gotEntries {
+				from = append(from, e.Name())
+			}
+			if !reflect.DeepEqual(from, tc.from) {
+				t.Errorf("presentEntries returned entries %q; want %q", from, tc.from)
+			}
+		})
+	}
+}
+
+func TestNameIndexIsInvalidatedOnCreate(t *testing.T) {
+	ctx := context.Background()
+	r, backend := testFS(t, Options{CaseInsensitive: true})
+	if err := util.WriteFile(backend, "Other", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := r.node("")
+	// Index the root by looking up a name that isn't there in this case.
+	lookup(t, root, "OTHER")
+	if _, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "New", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if got := lookup(t, root, "NEW").path(); got != "New" {
+		t.Errorf("Lookup(NEW) after creating New resolved to %q; want New", got)
+	}
+}
@@ -0,0 +1,103 @@
+package billybazilfuse
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// openAttrsTTL is how long the attributes fetched when a file is opened are used.
+const openAttrsTTL = time.Second
+
+// openAttrs holds the attributes of recently opened files, fetched in parallel with opening them for Options.OpenAttrs.
+type openAttrs struct {
+	mtx     sync.Mutex
+	pending map[string]*openAttr
+}
+
+type openAttr struct {
+	// done is closed once fi and err are set.
+	done    chan struct{}
+	fi      os.FileInfo
+	err     error
+	expires time.Time
+}
+
+func newOpenAttrs() *openAttrs {
+	return &openAttrs{pending: map[string]*openAttr{}}
+}
+
+// prefetch starts fetching the attributes of p in the background.
+func (oa *openAttrs) prefetch(r *FS, p string) {
+	if oa == nil {
+		return
+	}
+	a := &openAttr{done: make(chan struct{}), expires: time.Now().Add(openAttrsTTL)}
+	oa.mtx.Lock()
+	now := time.Now()
+	for q, b := range oa.pending {
+		if now.After(b.expires) {
+			delete(oa.pending, q)
+		}
+	}
+	oa.pending[p] = a
+	oa.mtx.Unlock()
+	go func() {
+		defer close(a.done)
+		done, err := r.background(context.Background())
+		if err != nil {
+			a.err = err
+			return
+		}
+		defer done()
+		a.fi, a.err = r.underlying.Stat(p)
+	}()
+}
+
+// get returns the attributes fetched for p, waiting for them if they're still being fetched. They're only returned once.
+func (oa *openAttrs) get(p string) (os.FileInfo, bool) {
+	if oa == nil {
+		return nil, false
+	}
+	oa.mtx.Lock()
+	a, ok := oa.pending[p]
+	delete(oa.pending, p)
+	oa.mtx.Unlock()
+	if !ok || time.Now().After(a.expires) {
+		return nil, false
+	}
+	<-a.done
+	if a.err != nil {
+		return nil, false
+	}
+	return a.fi, true
+}
+
+// peek is get, but leaves the attributes for the next get.
+func (oa *openAttrs) peek(p string) (os.FileInfo, bool) {
+	if oa == nil {
+		return nil, false
+	}
+	oa.mtx.Lock()
+	a, ok := oa.pending[p]
+	oa.mtx.Unlock()
+	if !ok || time.Now().After(a.expires) {
+		return nil, false
+	}
+	<-a.done
+	if a.err != nil {
+		return nil, false
+	}
+	return a.fi, true
+}
+
+// forget drops the attributes fetched for p, after it was changed through the mount.
+func (oa *openAttrs) forget(p string) {
+	if oa == nil {
+		return
+	}
+	oa.mtx.Lock()
+	defer oa.mtx.Unlock()
+	delete(oa.pending, p)
+}
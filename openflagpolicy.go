@@ -0,0 +1,30 @@
+package billybazilfuse
+
+import (
+	"os"
+
+	"bazil.org/fuse"
+)
+
+// OpenFlagPolicy picks the caching flags of the response to opening the file at p (a backend path) with flags, like DirectIO for append-only logs and KeepCache for immutable blobs.
+// fi are the attributes of the file, or nil if they couldn't be fetched. Only fuse.OpenDirectIO, fuse.OpenKeepCache and fuse.OpenNonSeekable are used from the result.
+// It's called synchronously for every successful Open and Create of a file, so it shouldn't block.
+type OpenFlagPolicy func(p string, flags fuse.OpenFlags, fi os.FileInfo) fuse.OpenResponseFlags
+
+// openFlagPolicyMask are the flags an OpenFlagPolicy decides.
+const openFlagPolicyMask = fuse.OpenDirectIO | fuse.OpenKeepCache | fuse.OpenNonSeekable
+
+// applyOpenFlagPolicy is deferred by Open and Create to replace the caching flags of resp with the ones from the OpenFlagPolicy if the call succeeds. err points to the result of the call.
+func (r *FS) applyOpenFlagPolicy(p string, flags fuse.OpenFlags, resp *fuse.OpenResponse, err *error) {
+	if *err != nil || r.openFlagPolicy == nil {
+		return
+	}
+	fi, ok := r.openAttrs.peek(p)
+	if !ok {
+		var serr error
+		if fi, serr = r.underlying.Stat(p); serr != nil {
+			fi = nil
+		}
+	}
+	resp.Flags = resp.Flags&^openFlagPolicyMask | r.openFlagPolicy(p, flags, fi)&openFlagPolicyMask
+}
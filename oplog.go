@@ -0,0 +1,235 @@
+package billybazilfuse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// opLogEntry is a line of the OpLog.
+type opLogEntry struct {
+	Time string `json:"time"`
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Uid  uint32 `json:"uid"`
+	Pid  uint32 `json:"pid"`
+	// Size is the number of bytes asked to be read or written.
+	Size      int     `json:"size,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+	Errno     string  `json:"errno,omitempty"`
+	// SampleRate is N if this entry was logged as 1 in N calls, so counts can be scaled up.
+	SampleRate int `json:"sample_rate,omitempty"`
+}
+
+// OpLogSampling makes the OpLog log only some of the calls, for busy mounts.
+// A call is logged if it failed and Errors is set, if it took at least Slow (if not zero), or if it's one of every N calls of its type.
+type OpLogSampling struct {
+	// Rate is N for types of calls not in Rates. Zero and one log every call.
+	Rate int
+	// Rates overrides Rate for types of calls, like {"Read": 1000, "Lookup": 100}. The types are the names used by Stats.
+	Rates map[string]int
+	// Errors logs all failed calls.
+	Errors bool
+	// Slow logs all calls that take at least this long.
+	Slow time.Duration
+}
+
+// opLog writes an opLogEntry for every finished call from the kernel, or for a sample of them.
+type opLog struct {
+	w        io.Writer
+	sampling OpLogSampling
+	// file is the file opened for Options.OpLogFile, which is closed with the filesystem.
+	file *RotatingFile
+
+	mtx sync.Mutex
+	// counts are the numbers of calls by type, for sampling.
+	counts map[string]uint64
+}
+
+func newOpLog(w io.Writer, sampling OpLogSampling) *opLog {
+	return &opLog{w: w, sampling: sampling, counts: map[string]uint64{}}
+}
+
+// sampleRate returns whether a call should be logged, and N if it's logged as 1 in N calls.
+func (l *opLog) sampleRate(op string, latency time.Duration, err error) (int, bool) {
+	s := l.sampling
+	if (err != nil && s.Errors) || (s.Slow > 0 && latency >= s.Slow) {
+		return 0, true
+	}
+	rate, ok := s.Rates[op]
+	if !ok {
+		rate = s.Rate
+	}
+	if rate <= 1 {
+		return 0, true
+	}
+	l.mtx.Lock()
+	n := l.counts[op]
+	l.counts[op] = n + 1
+	l.mtx.Unlock()
+	return rate, n%uint64(rate) == 0
+}
+
+// record writes the entry of a call on the node at p that started at start and failed with err (if not nil). req is nil for calls bazil doesn't pass the request of.
+func (l *opLog) record(op string, p string, req fuse.Request, start time.Time, err error) {
+	if l == nil {
+		return
+	}
+	latency := time.Since(start)
+	rate, ok := l.sampleRate(op, latency, err)
+	if !ok {
+		return
+	}
+	e := opLogEntry{
+		Time:       start.UTC().Format(time.RFC3339Nano),
+		Op:         op,
+		Path:       "/" + p,
+		LatencyMs:  float64(latency.Microseconds()) / 1000,
+		SampleRate: rate,
+	}
+	if req != nil {
+		e.Path = "/" + opLogPath(p, req)
+		e.Size = opLogSize(req)
+		e.Uid = req.Hdr().Uid
+		e.Pid = req.Hdr().Pid
+	}
+	if err != nil {
+		e.Errno = errnoName(err)
+	}
+	b, jerr := json.Marshal(e)
+	if jerr != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	// A failing log must not fail the call it's logging.
+	_, _ = l.w.Write(b)
+}
+
+// opLogPath returns the path a call on the node at p acts on, which is the entry it names for calls like Lookup and Remove.
+func opLogPath(p string, req fuse.Request) string {
+	switch req := req.(type) {
+	case *fuse.LookupRequest:
+		return path.Join(p, req.Name)
+	case *fuse.MkdirRequest:
+		return path.Join(p, req.Name)
+	case *fuse.RemoveRequest:
+		return path.Join(p, req.Name)
+	case *fuse.CreateRequest:
+		return path.Join(p, req.Name)
+	case *fuse.MknodRequest:
+		return path.Join(p, req.Name)
+	case *fuse.SymlinkRequest:
+		return path.Join(p, req.NewName)
+	case *fuse.LinkRequest:
+		return path.Join(p, req.NewName)
+	case *fuse.RenameRequest:
+		return path.Join(p, req.OldName)
+	}
+	return p
+}
+
+// opLogSize returns the number of bytes a call reads or writes.
+func opLogSize(req fuse.Request) int {
+	switch req := req.(type) {
+	case *fuse.ReadRequest:
+		return req.Size
+	case *fuse.WriteRequest:
+		return len(req.Data)
+	}
+	return 0
+}
+
+// RotatingFile is an io.WriteCloser appending to a file, which is rotated when it grows beyond a maximum size.
+// The rotated files get the suffixes .1 (the most recent) up to the number of backups kept, and older ones are removed.
+type RotatingFile struct {
+	fn      string
+	maxSize int64
+	backups int
+
+	mtx  sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens fn for appending, and rotates it when it grows beyond maxSize bytes, keeping backups old files.
+func NewRotatingFile(fn string, maxSize int64, backups int) (*RotatingFile, error) {
+	r := &RotatingFile{fn: fn, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would make it exceed the maximum size.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotateLocked() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	if r.backups <= 0 {
+		if err := os.Remove(r.fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := r.backups - 1; i >= 1; i-- {
+			if err := os.Rename(fmt.Sprintf("%s.%d", r.fn, i), fmt.Sprintf("%s.%d", r.fn, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(r.fn, r.fn+".1"); err != nil {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,313 @@
+package billybazilfuse
+
+import (
+	"io"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Options configures the filesystem created by NewWithOptions. The zero value behaves the same as New(underlying, nil).
+type Options struct {
+	// CallHook is called before every call from FUSE, before it's passed to Billy. Can be nil.
+	CallHook CallHook
+	// ResponseHook is called after every successful call from FUSE, and can modify the response before it's returned to the kernel. Can be nil.
+	ResponseHook ResponseHook
+	// OnError is called when a call from FUSE fails, with the original error and the errno the kernel gets for it. Can be nil.
+	OnError ErrorHook
+	// OnUnknownError is called when a call fails with an error that isn't recognized, and is returned to the kernel as the FallbackErrno for lack of a better one. To keep it cheap, it's only called for the 1st, 10th, 100th and so on error of each type; Stats counts all of them.
+	OnUnknownError func(op string, err error, count int64)
+	// ErrorMapper picks the errno for errors from Billy, overriding the built-in mapping and the FallbackErrno for the errors it recognizes. Can be nil.
+	ErrorMapper ErrorMapper
+	// FallbackErrno is the errno for errors that aren't recognized, like EREMOTEIO or EAGAIN for programs that give up on a file after an EIO. It defaults to EIO.
+	FallbackErrno fuse.Errno
+
+	// StableInodes gives every path the same inode number for as long as it exists, and reports them in Attr and ReadDir.
+	// Without it, bazil hands out dynamic inode numbers that change between lookups and mounts.
+	// This is needed to re-export the mount over NFS (knfsd, Ganesha) without stale file handles.
+	StableInodes bool
+
+	// InodeMapFile is where the inode numbers handed out by StableInodes are persisted, so they survive remounts.
+	// Setting it implies StableInodes. If empty, the mapping is only kept in memory.
+	InodeMapFile string
+
+	// CaseInsensitive makes lookups case-insensitive (but case-preserving) over a case-sensitive backend.
+	// If multiple names on the backend only differ in case, an exact match wins, and otherwise the lexicographically smallest name.
+	// Directory contents are indexed on first use; changes made to the backend outside of the mount might not be noticed.
+	CaseInsensitive bool
+
+	// Normalization is the Unicode normalization form used for names on the backend.
+	// New files are created with normalized names, lookups find names regardless of their normalization, and directory listings present normalized names.
+	// Use NFC to let files created from macOS (which uses NFD) be found from Linux and vice versa.
+	Normalization Normalization
+
+	// NameEncoding translates names between the kernel and a backend that doesn't use UTF-8, like CharmapNameEncoding(charmap.ISO8859_1).
+	// CaseInsensitive and Normalization apply to the names on the backend.
+	NameEncoding NameEncoding
+
+	// IllegalNames configures which names are refused (or escaped) when files are created, because they're problematic on the backend or for other consumers of the data.
+	IllegalNames IllegalNames
+
+	// ResolveSymlinks makes the adapter follow symlinks itself during lookups, so they're presented as whatever they point to.
+	// Absolute targets are relative to the root of the backend. Symlink loops result in ELOOP.
+	// This is useful for consumers that can't follow symlinks, and for backends whose Stat doesn't follow them.
+	ResolveSymlinks bool
+
+	// EmulateSymlinks stores symlinks as small files with a recognizable header if the backend doesn't implement billy.Symlink.
+	// These files are presented to the kernel as real symlinks.
+	EmulateSymlinks bool
+
+	// EmulateSpecialFiles lets Mknod create FIFOs and unix sockets, for software that creates control pipes or sockets in its data directory. They're stored as small files with a recognizable header, and presented to the kernel as FIFOs and sockets.
+	// The kernel implements pipes and sockets itself, so they work between processes on this machine; the backend only keeps the node.
+	EmulateSpecialFiles bool
+
+	// DeviceNodes lets Mknod create character and block devices, and reports the device numbers of existing ones, for serving chroots and container images.
+	// Devices are created directly in the local directory the backend is stored in, so this needs a backend created with osfs.New or implementing LocalDirectory, and a mount allowed to contain devices, which usually means running as root.
+	DeviceNodes bool
+
+	// EmulateHardlinks supports hardlinks, which Billy has no interface for, by storing additional names as small files with a recognizable header pointing to the file with the content.
+	// When the file holding the content is removed, it's renamed over one of its other names, so the content lives on as long as any name refers to it.
+	// Link counts are tracked in memory, and rebuilt by walking the whole backend in NewWithOptions, which can take a while for large remote backends.
+	EmulateHardlinks bool
+
+	// DisableSymlinks refuses to create symlinks with EPERM, even if the backend supports them. Existing symlinks can still be read.
+	DisableSymlinks bool
+
+	// DisableChown refuses to change the owner or group of files with EPERM, even if the backend supports it.
+	DisableChown bool
+
+	// DisableXattrs refuses all extended attribute calls with ENOSYS, even the ones the adapter could serve itself.
+	DisableXattrs bool
+	// DenyXattrWrites refuses to set or remove extended attributes with EPERM. Setting user.billyfuse.fadvise is still allowed, as it's only a hint.
+	DenyXattrWrites bool
+	// SecurityXattrs picks how attributes in the security namespace, like SELinux labels and security.capability, are handled. By default they're stored on the backend like other attributes, which fails with ENOTSUP if it can't store any.
+	SecurityXattrs SecurityXattrPolicy
+	// CapabilityXattr picks how security.capability, holding the file capabilities set by setcap, is handled, overriding SecurityXattrs for it. By default it follows SecurityXattrs.
+	CapabilityXattr CapabilityXattrPolicy
+
+	// StripSetuid clears the setuid and setgid bits from modes set through the mount and from the attributes it reports, so files on the backend can't gain privileges through it.
+	StripSetuid bool
+	// AllowSetuid mounts with allow_suid, so setuid and setgid bits take effect when files are executed. The kernel ignores them by default. It can't be combined with StripSetuid.
+	AllowSetuid bool
+	// SquashRoot refuses calls from root (uid 0) that would modify the backend with EACCES, like root_squash does for NFS exports, so root in a container sharing the mount can't change it.
+	// It's a coarse approximation: root can still read everything it could read before.
+	SquashRoot bool
+	// DefaultPermissions mounts with default_permissions, so the kernel checks the permission bits of files before passing calls on.
+	DefaultPermissions bool
+	// CheckPermissions checks permissions in the library instead, honoring POSIX ACLs, which the kernel ignores for FUSE filesystems. Files are reported with the owner and group the backend reports, or the user running the filesystem.
+	// Use it with fuse.AllowOther, so other users can reach the mount. It can't be combined with DefaultPermissions.
+	CheckPermissions bool
+	// ACLStore keeps the POSIX ACLs set through the system.posix_acl_access and system.posix_acl_default attributes, instead of the backend. It's needed for backends that can't store extended attributes. New entries of a directory inherit its default ACL. Can be nil.
+	ACLStore ACLStore
+
+	// ReadOnly refuses all calls that would modify the backend with EROFS, and adds fuse.ReadOnly to the MountOptions so the kernel refuses most of them itself.
+	// It's implied if the backend implements billy.Capable and lacks billy.WriteCapability, so writes fail up front rather than with ENOSYS or EIO halfway.
+	ReadOnly bool
+
+	// RequireDir makes NewWithOptions refuse backends that don't implement billy.Dir, rather than serving a mount where listing and creating directories fails with ENOSYS.
+	// NewStrict checks this and more.
+	RequireDir bool
+
+	// WriteBufferSize enables a write-behind buffer of this many bytes per open file, which coalesces adjacent small writes from the kernel into larger writes to the backend.
+	// This is a big win for backends that pay a round trip per write. Buffered data is written on flush (close), fsync and release, and when a non-adjacent write comes in.
+	// Errors writing buffered data are returned by a later write, flush or fsync, as with most network filesystems.
+	WriteBufferSize int
+
+	// WriteBufferAge is the longest data stays in the write buffer before it's written to the backend. Defaults to one second.
+	WriteBufferAge time.Duration
+
+	// ReadAhead makes open files prefetch this many bytes in the background when they're read sequentially, so streaming a file from a high-latency backend isn't bound by one round trip per read.
+	// Prefetched data is discarded when the file is written to through the same handle; changes made in other ways might not be seen until the prefetched data has been read.
+	ReadAhead int
+
+	// BlockCache caches file contents read from the backend, like NewMemoryCache(256<<20) or a NewTieredCache. It's shared between all open files.
+	// Cached blocks are dropped when the file is changed through the mount; changes made outside of the mount are noticed when the file is opened, through its size and modification time.
+	BlockCache BlockCache
+
+	// MaxReadahead is the maximum number of bytes the kernel reads ahead, passed to fuse.Mount through FS.MountOptions. Zero leaves the kernel default.
+	// ReadAhead is raised to at least this much, because prefetching less than the kernel already asks for doesn't help.
+	// bazil always negotiates a maximum write size of 128 KiB, which can't be changed.
+	MaxReadahead uint32
+
+	// KeepCachePaths are path.Match patterns (matched against the base name if they have no slash) of backend paths whose page cache the kernel keeps across opens, like "*.tar.gz" for immutable content.
+	KeepCachePaths []string
+
+	// DirectIOPaths are patterns like KeepCachePaths of backend paths that bypass the page cache, for files that change underneath the mount. This takes precedence over KeepCachePaths.
+	// mmap doesn't work on such files.
+	DirectIOPaths []string
+
+	// Coherence picks how the page cache is used for files that don't match KeepCachePaths, DirectIOPaths or NoCachePaths: dropped on every open (the default), not at all, or kept until a change is noticed. See Coherence for which modes support mmap.
+	Coherence Coherence
+
+	// PollInterval makes FS.Serve check recently accessed paths for changes made outside of the mount at this interval, for backends that don't implement Watcher.
+	// Paths whose size or modification time changed are invalidated in the kernel's caches.
+	PollInterval time.Duration
+
+	// PollBudget limits polling to this many Stat calls per second on the backend. Zero means unlimited.
+	PollBudget int
+
+	// PollPaths is how many recently accessed paths are polled. Defaults to 10000.
+	PollPaths int
+
+	// WatchLocal makes FS.Serve watch the local directory the backend stores its files in (using inotify on Linux) and invalidate the kernel's caches for external changes, so editors and file managers on the mount see them promptly.
+	// This works for backends created with osfs.New and ones implementing LocalDirectory. NewWithOptions fails for other backends.
+	WatchLocal bool
+
+	// MaxConcurrentCalls bounds the number of simultaneous calls into the backend, for backends (like SFTP) that degrade badly past a few dozen concurrent requests. Zero means unlimited.
+	// Calls beyond the limit wait; the kernel keeps queueing requests.
+	// Waiting calls are served by priority (metadata operations first, then reads and writes), and take turns between processes.
+	// Background work (like prefetching, Warm and polling) has the same number of slots of its own, as calls may be waiting for it.
+	MaxConcurrentCalls int
+
+	// MaxConcurrentMetadataCalls bounds the number of simultaneous calls other than reads and writes of file contents. Zero means unlimited.
+	MaxConcurrentMetadataCalls int
+
+	// MaxConcurrentDataCalls bounds the number of simultaneous reads and writes of file contents. Zero means unlimited.
+	MaxConcurrentDataCalls int
+
+	// ShareReadHandles makes all read-only opens of the same path share one backend file, for backends that limit the number of open files or connections.
+	// The backend file is closed when the last handle using it is released. Changing the file through the mount makes later opens use a new backend file.
+	ShareReadHandles bool
+
+	// LazyOpen defers opening files on the backend until they're first read or written, saving a round trip for the many opens that are only followed by fstat or close.
+	// Opens that truncate are never deferred. Errors opening the file (like permission problems) are returned by the first read or write instead of by open.
+	LazyOpen bool
+
+	// IdleHandleTimeout closes backend files of open handles that haven't been read or written for this long, so processes holding many rarely used files open don't pin backend resources.
+	// The handles stay valid, and open the file again on their next read or write. Errors closing the file are reported by the next flush or close. This needs FS.Serve.
+	IdleHandleTimeout time.Duration
+
+	// LongOpenHandle reports files that have been open through the mount for longer than this in Stats, to hunt down file descriptor leaks in applications using it. Zero disables it.
+	// FS.Handles and the file handles in ControlDir list all open files regardless.
+	LongOpenHandle time.Duration
+	// OnLongOpenHandle is called once for every file open for longer than LongOpenHandle, within a minute of it crossing the threshold. This needs FS.Serve. Can be nil.
+	OnLongOpenHandle func(h OpenHandle)
+
+	// OrderedWrites makes writes to a file reach the backend one at a time and in the order the kernel sent them, for backends where out-of-order writes are destructive (like append-only stores).
+	// The kernel sends writes concurrently, so a write that would leave a gap after the data written so far waits (up to a second) for the writes before it.
+	OrderedWrites bool
+
+	// SerializeWrites makes writes to the same file through different handles reach the backend one at a time, if the backend file doesn't implement io.WriterAt and writes are emulated with Seek+Write.
+	// Without it, writes through separate handles only exclude each other if the backend serializes them itself, which backends sharing an offset or connection between their files might not.
+	SerializeWrites bool
+
+	// Checksums records the checksums of files written through the mount, and verifies reads of those files against them, for data stored on unreliable backends.
+	// Only files that are written sequentially from the start (like by cp) are recorded. Reads of data that doesn't match its checksum fail with EIO.
+	Checksums ChecksumStore
+
+	// OnChecksumMismatch is called when a block of a file doesn't match its checksum. Block is the offset divided by 128 KiB.
+	OnChecksumMismatch func(path string, block int64)
+
+	// HashXattrs gives files the virtual extended attributes user.billyfuse.md5, user.billyfuse.sha1 and user.billyfuse.sha256, holding the hex encoded hash of their content.
+	// Reading one hashes the file through the backend, unless it was hashed before with the same size and modification time. They aren't listed by listxattr.
+	HashXattrs bool
+
+	// UnknownDirentTypes makes directory listings report the type of every entry as unknown, so the kernel looks up entries only when it needs their type.
+	// This makes listing huge directories on slow backends much faster when their types aren't needed, but makes tools like find and ls --color look up every entry.
+	// With EmulateSymlinks, it avoids reading every small file in the directory to see whether it's a symlink.
+	UnknownDirentTypes bool
+
+	// DirentOrder sorts directory listings, so tools whose output depends on the order of readdir produce the same results on backends that return entries in random order.
+	DirentOrder DirentOrder
+
+	// ReadDirChunkThreshold makes directory listings with more entries than this be converted for the kernel in chunks as it reads them, rather than all at once, to bound the memory used for listing directories with millions of entries. Zero disables it.
+	// Without StableInodes, the inode numbers in such listings don't match the ones reported by stat.
+	ReadDirChunkThreshold int
+
+	// TrackDirMtimes reports the time a directory's entries were last changed through the mount as its modification time, if that's later than what the backend reports.
+	// This is for backends (like some in-memory ones) that don't update the modification time of directories, which breaks make-style freshness checks.
+	TrackDirMtimes bool
+
+	// ControlDir is the name of a virtual directory in the root of the mount, like ".billyfuse", holding the files ctl, stats and health. Empty disables it.
+	// The settings Reload applies can be read and written as extended attributes of ctl, like user.billyfuse.max_concurrent_calls, by root and the user serving the mount. Reading ctl lists them.
+	// Reading stats returns the Stats as JSON. Reading health returns "ok", or "unhealthy" followed by the reasons Healthy returns false.
+	// The directory isn't listed, and shadows an entry with the same name on the backend.
+	ControlDir string
+
+	// MemoryBudget bounds the memory held by write buffers, prefetched data and the memory tier of a NewMemoryCache or NewTieredCache, so a mount on a small machine can't run it out of memory under load. Zero means unlimited.
+	// When it's exceeded, no data is prefetched, and reads first shed cached blocks, then discard prefetched data and write out buffered writes, and then wait (up to five seconds) for memory to be released.
+	MemoryBudget int64
+
+	// WriteBacklogHigh throttles writes when more than this many bytes are in write buffers, until the buffered data is written to the backend and at most WriteBacklogLow bytes remain, so a fast writer can't get far ahead of a slow backend. Zero disables it.
+	// It only has an effect with WriteBufferSize. Throttled writes wait at most ten seconds.
+	WriteBacklogHigh int64
+
+	// WriteBacklogLow is where throttling stops. Defaults to half of WriteBacklogHigh.
+	WriteBacklogLow int64
+
+	// MaxBackendRead splits reads into reads of at most this many bytes from the backend, for backends that limit the size of a read (like protocol message limits). Zero means unlimited.
+	// Backend reads that return less than asked for are continued, rather than presented as the end of the file.
+	MaxBackendRead int
+
+	// MaxBackendWrite splits writes into writes of at most this many bytes to the backend, for backends that limit the size of a write. Zero means unlimited.
+	// If one of them fails, the kernel is told how much was written, like a short write(2).
+	MaxBackendWrite int
+
+	// MaxBackground is the maximum number of background requests (readahead, and asynchronous reads and writes) the kernel sends at once, passed to fuse.Mount through FS.MountOptions. Zero leaves the kernel default (12 on Linux).
+	// Raise it along with MaxConcurrentDataCalls for backends that benefit from many parallel reads; the limiter can't use slots the kernel doesn't send requests for.
+	MaxBackground uint16
+
+	// CongestionThreshold is the number of outstanding background requests beyond which the kernel considers the mount congested and holds back readahead and writeback, passed to fuse.Mount through FS.MountOptions. Zero leaves the kernel default (three quarters of MaxBackground).
+	CongestionThreshold uint16
+
+	// AtomicReplace makes opening an existing file for writing only with O_TRUNC write to a temporary file next to it, which is renamed over the original when the file is closed, so a crash while rewriting a file never leaves it truncated on backends without journaling.
+	// Until then, other opens of the file see its old contents. If closing the temporary file fails, it's removed and the original is left alone.
+	AtomicReplace bool
+
+	// WriteJournal is a local file that writes buffered with WriteBufferSize are recorded in until they reach the backend. Writes that were still buffered when the process died are replayed on the backend by the next NewWithOptions with the same journal, which fails if that isn't possible.
+	// The journal isn't synced, so it survives crashes of the process but not of the machine. Call Close on the filesystem after unmounting to close it.
+	// Each mount needs a journal of its own: it's locked while open, and NewWithOptions fails if another filesystem holds it.
+	WriteJournal string
+
+	// WriteSpillDir is a local directory that write buffers are kept in instead of in memory while MemoryBudget is exceeded, so large uploads to a slow backend are still buffered without using more memory.
+	// Spilled buffers hold up to WriteSpillSize bytes per file, which defaults to 64 MiB. It only has an effect with WriteBufferSize and MemoryBudget.
+	WriteSpillDir  string
+	WriteSpillSize int
+
+	// NoCachePaths are patterns like KeepCachePaths of backend paths that aren't cached at all, for files that change outside of the mount all the time (like "*.lock").
+	// The kernel doesn't cache their attributes and directory entries, they're opened with direct I/O like DirectIOPaths, and reads bypass the BlockCache and ReadAhead.
+	NoCachePaths []string
+
+	// HotPaths keeps leaderboards of this many paths with the most operations and the most bytes read and written, reported by Stats and in the file hot in ControlDir, so operators can see what an I/O spike is touching. Zero disables them.
+	// The counts are halved every minute, so they follow recent activity.
+	HotPaths int
+
+	// OpLog receives a line of JSON for every finished call from the kernel, with the fields time, op, path, uid, pid, size (of reads and writes), latency_ms and errno (if it failed), for log pipelines like ELK or Loki. It must be safe for concurrent use if it's shared by the views of a MultiUserFS.
+	OpLog io.Writer
+	// OpLogFile is a local file to write the OpLog to instead. It's rotated when it grows beyond OpLogMaxSize bytes (100 MiB by default), keeping OpLogBackups old files named like oplog.1. Call Close on the filesystem after unmounting to close it.
+	// Every view of a MultiUserFS would open the file separately, so pass a RotatingFile as OpLog instead there.
+	OpLogFile    string
+	OpLogMaxSize int64
+	OpLogBackups int
+	// OpLogSampling logs only some of the calls, so busy mounts can keep an OpLog cheaply. The zero value logs every call.
+	OpLogSampling OpLogSampling
+
+	// ErrorAlerts are thresholds on the rate of failed calls. While any of them is exceeded, Healthy returns false and Stats lists it, so a monitoring agent can page on a mount that started returning EIO.
+	ErrorAlerts []ErrorAlert
+	// OnErrorAlert is called when one of the ErrorAlerts starts or stops firing, with the number of failures in its window. It's called by the call that crossed the threshold, so it shouldn't block.
+	OnErrorAlert func(a ErrorAlert, failures int, firing bool)
+
+	// HealthCheckInterval makes FS.Serve check whether the backend responds at this interval, by calling Stat on HealthCheckPath (the root by default). A check fails if it takes longer than HealthCheckTimeout, which defaults to 10 seconds.
+	// The result is returned by BackendHealth and included in Stats, and Healthy returns false while the backend is down, so monitoring can tell a backend that's down from a mount process that died.
+	HealthCheckInterval time.Duration
+	HealthCheckPath     string
+	HealthCheckTimeout  time.Duration
+
+	// ReconnectTimeout is how long a backend implementing Reconnector is retried to reconnect after its connection was lost, before the call that noticed fails. It defaults to a minute.
+	ReconnectTimeout time.Duration
+
+	// OpTimeout is a deadline for every call from the kernel. Calls that are still waiting for a concurrency limit, the memory budget or the write backlog when it passes fail with ETIMEDOUT (or EIO with TimeoutEIO, for programs that don't expect ETIMEDOUT), while calls the kernel interrupted fail with EINTR.
+	// The deadline is also passed to the CallHook. Calls that already reached the backend aren't abandoned, as billy can't cancel them.
+	OpTimeout  time.Duration
+	TimeoutEIO bool
+
+	// StatAhead fetches the attributes of the entries of a directory in parallel when a process lists it and then stats the entries one by one, like ls -l does.
+	StatAhead StatAhead
+
+	// OpenAttrs fetches the attributes of files in parallel with opening them, and uses them for the next stat of the file within a second, as processes usually fstat files right after opening them. That saves a round trip when the kernel doesn't have the attributes cached.
+	// The kernel's open reply can't carry attributes, so they're fetched with a separate Stat.
+	OpenAttrs bool
+
+	// OpenFlagPolicy picks the caching flags (DirectIO, KeepCache, NonSeekable) for every file opened or created, replacing the ones from KeepCachePaths, DirectIOPaths and NoCachePaths. The attributes it gets come from OpenAttrs if that's enabled, and cost an extra Stat otherwise. Can be nil.
+	OpenFlagPolicy OpenFlagPolicy
+}
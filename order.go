@@ -0,0 +1,71 @@
+package billybazilfuse
+
+// DirentOrder is the order directory listings are returned in.
+type DirentOrder int
+
+const (
+	// BackendOrder returns entries in the order the backend returned them.
+	BackendOrder DirentOrder = iota
+	// LexicographicOrder sorts entries by their name, byte by byte.
+	LexicographicOrder
+	// NaturalOrder sorts entries by their name, comparing runs of digits by their numeric value, so file2 comes before file10.
+	NaturalOrder
+)
+
+// less returns the function comparing names in this order, or nil to keep the backend's order.
+func (o DirentOrder) less() func(a, b string) bool {
+	switch o {
+	case LexicographicOrder:
+		return func(a, b string) bool {
+			return a < b
+		}
+	case NaturalOrder:
+		return naturalLess
+	}
+	return nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// naturalLess compares a and b, comparing runs of digits by their numeric value. Names that only differ in leading zeros are ordered lexicographically.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return a[i] < b[j]
+			}
+			i++
+			j++
+			continue
+		}
+		si, sj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		// Compare the numbers without their leading zeros: first by length, then digit by digit.
+		na, nb := trimZeros(a[si:i]), trimZeros(b[sj:j])
+		if len(na) != len(nb) {
+			return len(na) < len(nb)
+		}
+		if na != nb {
+			return na < nb
+		}
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func trimZeros(s string) string {
+	for len(s) > 1 && s[0] == '0' {
+		s = s[1:]
+	}
+	return s
+}
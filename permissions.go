@@ -0,0 +1,163 @@
+package billybazilfuse
+
+import (
+	"context"
+	"os"
+	"path"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// fileOwner returns the owner and group of fi, from the backend if it reports them, or the user running the filesystem.
+func fileOwner(fi os.FileInfo) (uid, gid uint32) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return uint32(os.Getuid()), uint32(os.Getgid())
+}
+
+// openAccess returns the permissions needed to open a file with flags.
+func openAccess(flags fuse.OpenFlags) uint16 {
+	var want uint16
+	switch {
+	case flags.IsReadOnly():
+		want = 4
+	case flags.IsWriteOnly():
+		want = 2
+	case flags.IsReadWrite():
+		want = 4 | 2
+	}
+	if flags&fuse.OpenTruncate != 0 {
+		want |= 2
+	}
+	return want
+}
+
+// checkPermissions refuses calls the caller lacks permission for with EACCES (or EPERM for the ones only the owner can make), with Options.CheckPermissions.
+// Calls on entries of a directory are checked against the directory, including the sticky bit; Rename checks the directory the entry is moved into with checkRenameTarget. Calls on open files were checked when they were opened.
+// Only the primary group of the caller is known, so entries for its other groups don't apply.
+func (r *FS) checkPermissions(req fuse.Request, info CallInfo) error {
+	if !r.checkPerms || info.Handle || req.Hdr().Uid == 0 {
+		return nil
+	}
+	// want are the permissions needed on info.Path. Some calls can only be made by the owner, and touching a file is allowed to the owner or anyone who can write it.
+	var want uint16
+	ownerOnly, touch := false, false
+	switch req := req.(type) {
+	case *fuse.LookupRequest:
+		want = 1
+	case *fuse.AccessRequest:
+		want = uint16(req.Mask) & 7
+	case *fuse.OpenRequest:
+		if req.Dir {
+			want = 4
+		} else {
+			want = openAccess(req.Flags)
+		}
+	case *fuse.CreateRequest, *fuse.MkdirRequest, *fuse.MknodRequest, *fuse.SymlinkRequest, *fuse.LinkRequest, *fuse.RemoveRequest, *fuse.RenameRequest:
+		want = 2 | 1
+	case *fuse.SetattrRequest:
+		if req.Valid.Uid() {
+			return fuse.EPERM
+		}
+		if req.Valid.Size() {
+			want = 2
+		}
+		ownerOnly = req.Valid.Mode() || req.Valid.Gid() || (req.Valid.Atime() && !req.Valid.AtimeNow()) || (req.Valid.Mtime() && !req.Valid.MtimeNow())
+		touch = req.Valid.AtimeNow() || req.Valid.MtimeNow()
+	case *fuse.SetxattrRequest:
+		ownerOnly = isACLXattr(req.Name)
+		if !ownerOnly {
+			want = 2
+		}
+	case *fuse.RemovexattrRequest:
+		ownerOnly = isACLXattr(req.Name)
+		if !ownerOnly {
+			want = 2
+		}
+	}
+	if want == 0 && !ownerOnly && !touch {
+		return nil
+	}
+	fi, err := r.statEntry(info.Path)
+	if err != nil {
+		// The call itself will fail.
+		return nil
+	}
+	uid, gid := req.Hdr().Uid, req.Hdr().Gid
+	owner, group := fileOwner(fi)
+	if ownerOnly && uid != owner {
+		return fuse.EPERM
+	}
+	if touch && uid != owner {
+		want |= 2
+	}
+	if want != 0 && !r.accessACL(info.Path, fi).allows(uid, gid, owner, group, want) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	switch req := req.(type) {
+	case *fuse.RemoveRequest:
+		return r.checkSticky(uid, info.Path, fi, req.Name)
+	case *fuse.RenameRequest:
+		return r.checkSticky(uid, info.Path, fi, req.OldName)
+	}
+	return nil
+}
+
+// checkRenameTarget checks that the caller of req may add the entry to the directory dir it's moved into, and replace what's there, with Options.CheckPermissions.
+func (r *FS) checkRenameTarget(req *fuse.RenameRequest, dir string) error {
+	uid, gid := req.Hdr().Uid, req.Hdr().Gid
+	if !r.checkPerms || uid == 0 {
+		return nil
+	}
+	fi, err := r.statEntry(dir)
+	if err != nil {
+		// The call itself will fail.
+		return nil
+	}
+	owner, group := fileOwner(fi)
+	if !r.accessACL(dir, fi).allows(uid, gid, owner, group, 2|1) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return r.checkSticky(uid, dir, fi, req.NewName)
+}
+
+// checkSticky refuses to remove or replace the entry name of the directory dir with EPERM if dir has the sticky bit, unless uid owns the directory or the entry.
+func (r *FS) checkSticky(uid uint32, dir string, dirInfo os.FileInfo, name string) error {
+	if dirInfo.Mode()&os.ModeSticky == 0 {
+		return nil
+	}
+	if owner, _ := fileOwner(dirInfo); owner == uid {
+		return nil
+	}
+	name, err := r.encodeName(name)
+	if err != nil {
+		return nil
+	}
+	fi, err := r.statEntry(path.Join(dir, name))
+	if err != nil {
+		// There's nothing to replace, or the call itself will fail.
+		return nil
+	}
+	if owner, _ := fileOwner(fi); owner == uid {
+		return nil
+	}
+	return fuse.EPERM
+}
+
+var _ fs.NodeAccesser = &node{}
+
+// Access checks permissions for access(2) with Options.CheckPermissions. Otherwise everything is allowed, and the kernel (with Options.DefaultPermissions) or the backend decides when the file is used.
+func (n *node) Access(ctx context.Context, req *fuse.AccessRequest) (err error) {
+	if !n.root.checkPerms {
+		return nil
+	}
+	_, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	done(nil)
+	return nil
+}
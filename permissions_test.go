@@ -0,0 +1,98 @@
+package billybazilfuse
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// ownedFS reports the owners in owners for its files, like a backend on a local filesystem does, and the modes in modes, as memfs can't change them.
+type ownedFS struct {
+	billy.Filesystem
+	owners map[string]uint32
+	modes  map[string]os.FileMode
+}
+
+type ownedFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+	st   *syscall.Stat_t
+}
+
+func (fi ownedFileInfo) Mode() os.FileMode { return fi.mode }
+func (fi ownedFileInfo) Sys() interface{}  { return fi.st }
+
+func (o ownedFS) Stat(p string) (os.FileInfo, error) {
+	fi, err := o.Filesystem.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	mode, ok := o.modes[p]
+	if !ok {
+		mode = fi.Mode()
+	}
+	return ownedFileInfo{fi, mode, &syscall.Stat_t{Uid: o.owners[p], Gid: 10}}, nil
+}
+
+func TestCheckPermissionsRename(t *testing.T) {
+	const owner, caller = 100, 200
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		// srcMode and dstMode are the modes of the directories, which are owned by owner.
+		srcMode, dstMode os.FileMode
+		// fileOwner owns the file moved from src, and targetOwner the file it replaces in dst, if it's set.
+		fileOwner, targetOwner uint32
+		want                   error
+	}{
+		{name: "writable directories", srcMode: 0777, dstMode: 0777, fileOwner: owner},
+		{name: "read-only source", srcMode: 0755, dstMode: 0777, fileOwner: caller, want: fuse.Errno(syscall.EACCES)},
+		{name: "read-only destination", srcMode: 0777, dstMode: 0755, fileOwner: caller, want: fuse.Errno(syscall.EACCES)},
+		{name: "unsearchable destination", srcMode: 0777, dstMode: 0776, fileOwner: caller, want: fuse.Errno(syscall.EACCES)},
+		{name: "sticky source, own file", srcMode: os.ModeSticky | 0777, dstMode: 0777, fileOwner: caller},
+		{name: "sticky source, other's file", srcMode: os.ModeSticky | 0777, dstMode: 0777, fileOwner: owner, want: fuse.EPERM},
+		{name: "sticky destination, nothing replaced", srcMode: 0777, dstMode: os.ModeSticky | 0777, fileOwner: caller},
+		{name: "sticky destination, own file replaced", srcMode: 0777, dstMode: os.ModeSticky | 0777, fileOwner: caller, targetOwner: caller},
+		{name: "sticky destination, other's file replaced", srcMode: 0777, dstMode: os.ModeSticky | 0777, fileOwner: caller, targetOwner: owner, want: fuse.EPERM},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := ownedFS{
+				Filesystem: memfs.New(),
+				owners:     map[string]uint32{"": owner, "src": owner, "dst": owner, "src/f": tc.fileOwner},
+				modes:      map[string]os.FileMode{"src": os.ModeDir | tc.srcMode, "dst": os.ModeDir | tc.dstMode},
+			}
+			for _, dir := range []string{"src", "dst"} {
+				if err := backend.MkdirAll(dir, 0777); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := util.WriteFile(backend, "src/f", []byte("moved"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.targetOwner != 0 {
+				backend.owners["dst/f"] = tc.targetOwner
+				if err := util.WriteFile(backend, "dst/f", []byte("replaced"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r, err := NewWithOptions(backend, Options{CheckPermissions: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &fuse.RenameRequest{Header: fuse.Header{Uid: caller, Gid: 20}, OldName: "f", NewName: "f"}
+			err = r.node("src").Rename(ctx, req, r.node("dst"))
+			if err != tc.want {
+				t.Errorf("Rename = %v; want %v", err, tc.want)
+			}
+			if _, err := backend.Stat("src/f"); (err == nil) == (tc.want == nil) {
+				t.Errorf("src/f exists after Rename: %v; want %v", err == nil, tc.want != nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package billybazilfuse
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPollPaths is how many recently accessed paths are polled if Options.PollPaths isn't set.
+const defaultPollPaths = 10000
+
+// poller remembers the size and modification time of recently accessed paths, and periodically checks whether they changed outside of the mount.
+type poller struct {
+	interval time.Duration
+	budget   atomic.Int64
+	max      int
+
+	mtx     sync.Mutex
+	lru     *list.List // of *pollEntry, most recently accessed first
+	entries map[string]*list.Element
+}
+
+type pollEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func newPoller(interval time.Duration, budget, max int) *poller {
+	if max <= 0 {
+		max = defaultPollPaths
+	}
+	pl := &poller{
+		interval: interval,
+		max:      max,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+	pl.budget.Store(int64(budget))
+	return pl
+}
+
+// seen records that p was accessed, and what it looked like.
+func (pl *poller) seen(p string, fi os.FileInfo) {
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	if e, ok := pl.entries[p]; ok {
+		pe := e.Value.(*pollEntry)
+		pe.size = fi.Size()
+		pe.modTime = fi.ModTime()
+		pl.lru.MoveToFront(e)
+		return
+	}
+	pl.entries[p] = pl.lru.PushFront(&pollEntry{p, fi.Size(), fi.ModTime()})
+	for pl.lru.Len() > pl.max {
+		pe := pl.lru.Remove(pl.lru.Back()).(*pollEntry)
+		delete(pl.entries, pe.path)
+	}
+}
+
+func (pl *poller) forget(p string) {
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	if e, ok := pl.entries[p]; ok {
+		pl.lru.Remove(e)
+		delete(pl.entries, p)
+	}
+}
+
+// snapshot returns the polled entries, most recently accessed first.
+func (pl *poller) snapshot() []pollEntry {
+	pl.mtx.Lock()
+	defer pl.mtx.Unlock()
+	ret := make([]pollEntry, 0, pl.lru.Len())
+	for e := pl.lru.Front(); e != nil; e = e.Next() {
+		ret = append(ret, *e.Value.(*pollEntry))
+	}
+	return ret
+}
+
+// poll checks the recently accessed paths every interval until ctx is cancelled.
+func (r *FS) poll(ctx context.Context) {
+	pl := r.poller
+	t := time.NewTicker(pl.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		var pause time.Duration
+		if budget := pl.budget.Load(); budget > 0 {
+			pause = time.Second / time.Duration(budget)
+		}
+		for _, pe := range pl.snapshot() {
+			if pause > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(pause):
+				}
+			}
+			done, err := r.background(ctx)
+			if err != nil {
+				return
+			}
+			fi, err := r.underlying.Stat(pe.path)
+			done()
+			switch {
+			case err != nil && os.IsNotExist(err):
+				pl.forget(pe.path)
+				r.externalChange(pe.path)
+			case err != nil:
+				// Try again next round.
+			case fi.Size() != pe.size || !fi.ModTime().Equal(pe.modTime):
+				pl.seen(pe.path, fi)
+				r.externalChange(pe.path)
+			}
+		}
+	}
+}
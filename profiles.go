@@ -0,0 +1,68 @@
+package billybazilfuse
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// setuidBits are the mode bits StripSetuid clears.
+const setuidBits = os.ModeSetuid | os.ModeSetgid
+
+// Hardened returns Options for mounts shared with users or containers that aren't fully trusted: setuid and setgid bits are stripped, root is squashed, the kernel checks permissions and extended attributes (including file capabilities) can't be written. Device nodes and emulated FIFOs and sockets stay off.
+// Other fields can be set on the result before passing it to NewWithOptions.
+func Hardened() Options {
+	return Options{
+		StripSetuid:        true,
+		SquashRoot:         true,
+		DefaultPermissions: true,
+		DenyXattrWrites:    true,
+		CapabilityXattr:    CapabilitiesDeny,
+	}
+}
+
+// Permissive returns Options for mounts used by a single trusted user, like a chroot or container image being built: setuid and setgid bits and file capabilities take effect and FIFOs and sockets can be created.
+// Other fields can be set on the result before passing it to NewWithOptions. Add DeviceNodes for backends stored in a local directory.
+func Permissive() Options {
+	return Options{
+		AllowSetuid:         true,
+		EmulateSpecialFiles: true,
+		CapabilityXattr:     CapabilitiesPassthrough,
+	}
+}
+
+// checkSquashedRoot refuses calls from root that would modify the backend with EACCES, if Options.SquashRoot is set.
+func (r *FS) checkSquashedRoot(req fuse.Request) error {
+	if !r.squashRoot || req.Hdr().Uid != 0 || !modifies(req) {
+		return nil
+	}
+	return fuse.Errno(syscall.EACCES)
+}
+
+// ParseProfile returns the Options of the security profile with the given name, "hardened" or "permissive".
+func ParseProfile(name string) (Options, error) {
+	switch name {
+	case "hardened":
+		return Hardened(), nil
+	case "permissive":
+		return Permissive(), nil
+	}
+	return Options{}, fmt.Errorf("unknown security profile %q", name)
+}
+
+// WithProfile returns o with the settings of the security profile p, as returned by Hardened, Permissive or ParseProfile, turned on as well. p's CapabilityXattr is used if o doesn't set one.
+func (o Options) WithProfile(p Options) Options {
+	o.StripSetuid = o.StripSetuid || p.StripSetuid
+	o.AllowSetuid = o.AllowSetuid || p.AllowSetuid
+	o.SquashRoot = o.SquashRoot || p.SquashRoot
+	o.DefaultPermissions = o.DefaultPermissions || p.DefaultPermissions
+	o.DenyXattrWrites = o.DenyXattrWrites || p.DenyXattrWrites
+	o.EmulateSpecialFiles = o.EmulateSpecialFiles || p.EmulateSpecialFiles
+	o.DeviceNodes = o.DeviceNodes || p.DeviceNodes
+	if o.CapabilityXattr == CapabilitiesLikeSecurityXattrs {
+		o.CapabilityXattr = p.CapabilityXattr
+	}
+	return o
+}
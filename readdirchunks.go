@@ -0,0 +1,108 @@
+package billybazilfuse
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// direntHeaderSize is the size of struct fuse_dirent without the name.
+const direntHeaderSize = 24
+
+// chunkedDirHandle is a directory handle that converts entries to dirents as the kernel reads them, rather than all at once like bazil does for ReadDirAll.
+// Directories with up to Options.ReadDirChunkThreshold entries are still converted at once, larger ones only keep the entries from the backend.
+// Offsets are indexes into the listing, so the kernel can continue (or seek to) any point.
+type chunkedDirHandle struct {
+	// dir isn't embedded, as bazil would use its ReadDirAll.
+	dir dirHandle
+
+	mtx     sync.Mutex
+	listing *listing
+	// dirents are the converted entries, if the directory is small enough to convert at once.
+	dirents []fuse.Dirent
+}
+
+var _ fs.HandleReader = &chunkedDirHandle{}
+
+func (h *chunkedDirHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	ctx, done, err := h.dir.root.beginCall(ctx, req, CallInfo{Path: h.dir.path, Handle: true})
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	h.dir.root.hot.add(h.dir.path, 0)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if req.Offset == 0 || h.listing == nil {
+		// Start or rewinddir(3).
+		l, err := h.dir.list()
+		if err != nil {
+			return convertError(err)
+		}
+		h.listing, h.dirents = l, nil
+		if len(l.entries) <= h.dir.root.readDirChunkThreshold {
+			dirents := make([]fuse.Dirent, len(l.entries))
+			for i, e := range l.entries {
+				if dirents[i], err = h.direntAt(e, l.names[i]); err != nil {
+					return convertError(err)
+				}
+			}
+			if hook := h.dir.root.responseHook; hook != nil {
+				if err := hook(ctx, req, &dirents); err != nil {
+					return convertError(err)
+				}
+			}
+			if dirents == nil {
+				// A nil slice means the entries are converted as they're read.
+				dirents = []fuse.Dirent{}
+			}
+			h.dirents = dirents
+		}
+	}
+	count := len(h.listing.entries)
+	if h.dirents != nil {
+		count = len(h.dirents)
+	}
+	data := resp.Data[:0]
+	for i := req.Offset; i < int64(count); i++ {
+		var de fuse.Dirent
+		if h.dirents != nil {
+			de = h.dirents[i]
+		} else if de, err = h.direntAt(h.listing.entries[i], h.listing.names[i]); err != nil {
+			return convertError(err)
+		} else if hook := h.dir.root.responseHook; hook != nil {
+			// Large directories are converted as they're read, so the hook gets their entries one by one, and can remove them by emptying the slice.
+			dirents := []fuse.Dirent{de}
+			if err := hook(ctx, req, &dirents); err != nil {
+				return convertError(err)
+			}
+			if len(dirents) == 0 {
+				continue
+			}
+			de = dirents[0]
+		}
+		if len(data)+direntHeaderSize+(len(de.Name)+7)&^7 > req.Size {
+			break
+		}
+		start := len(data)
+		data = fuse.AppendDirent(data, de)
+		// AppendDirent sets the offset of the next entry to its position in data; we use the index instead.
+		binary.NativeEndian.PutUint64(data[start+8:], uint64(i+1))
+	}
+	resp.Data = data
+	return nil
+}
+
+// direntAt is like dirent, but always fills in an inode number as bazil only does that for ReadDirAll.
+func (h *chunkedDirHandle) direntAt(e os.FileInfo, name string) (fuse.Dirent, error) {
+	de, err := h.dir.dirent(e, name)
+	if err == nil && de.Inode == 0 {
+		de.Inode = fs.GenerateDynamicInode(0, path.Join(h.dir.path, e.Name()))
+	}
+	return de, err
+}
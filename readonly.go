@@ -0,0 +1,41 @@
+package billybazilfuse
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5"
+)
+
+// errReadOnly is returned for calls that would modify a read-only mount.
+var errReadOnly = fuse.Errno(syscall.EROFS)
+
+// lacksWrite returns whether underlying implements billy.Capable and reports it can't write. Backends that don't implement it are assumed to be writable.
+func lacksWrite(underlying billy.Basic) bool {
+	_, ok := underlying.(billy.Capable)
+	return ok && billy.Capabilities(underlying)&billy.WriteCapability == 0
+}
+
+// ReadOnly returns whether the mount is read-only, because Options.ReadOnly was set or the backend can't write.
+func (r *FS) ReadOnly() bool {
+	return r.readOnly
+}
+
+// checkWritable refuses calls that would modify the backend with EROFS if the mount is read-only. The kernel already refuses most of them for mounts with MountOptions, but not if it was mounted without them.
+func (r *FS) checkWritable(req fuse.Request) error {
+	if !r.readOnly || !modifies(req) {
+		return nil
+	}
+	return errReadOnly
+}
+
+// modifies returns whether req would modify the backend, including opens for writing.
+func modifies(req fuse.Request) bool {
+	switch req := req.(type) {
+	case *fuse.CreateRequest, *fuse.MkdirRequest, *fuse.MknodRequest, *fuse.SymlinkRequest, *fuse.LinkRequest, *fuse.RenameRequest, *fuse.RemoveRequest, *fuse.WriteRequest, *fuse.SetattrRequest, *fuse.SetxattrRequest, *fuse.RemovexattrRequest:
+		return true
+	case *fuse.OpenRequest:
+		return !req.Flags.IsReadOnly() || req.Flags&fuse.OpenTruncate != 0
+	}
+	return false
+}
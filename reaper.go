@@ -0,0 +1,55 @@
+package billybazilfuse
+
+import (
+	"context"
+	"time"
+)
+
+// trackHandle registers h, so it can be closed on the backend when it's idle and is counted by Stats.
+func (r *FS) trackHandle(h *handle) {
+	r.handlesMtx.Lock()
+	defer r.handlesMtx.Unlock()
+	r.handles[h] = struct{}{}
+}
+
+func (r *FS) untrackHandle(h *handle) {
+	r.handlesMtx.Lock()
+	defer r.handlesMtx.Unlock()
+	delete(r.handles, h)
+}
+
+// reapIdle closes the backend files of handles that haven't been used for idleTimeout, until ctx is cancelled.
+// The handles stay valid, and open the file again when they're next used.
+func (r *FS) reapIdle(ctx context.Context) {
+	t := time.NewTicker(r.idleTimeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		r.handlesMtx.Lock()
+		handles := make([]*handle, 0, len(r.handles))
+		for h := range r.handles {
+			handles = append(handles, h)
+		}
+		r.handlesMtx.Unlock()
+		for _, h := range handles {
+			h.reapIfIdle(r.idleTimeout)
+		}
+	}
+}
+
+// reapIfIdle closes the backend file if it's open and hasn't been used for timeout.
+func (h *handle) reapIfIdle(timeout time.Duration) {
+	h.openMtx.Lock()
+	defer h.openMtx.Unlock()
+	// Replacements are synced before they're closed, when they're released.
+	if h.fh == nil || h.users > 0 || h.replace != nil || time.Since(h.lastUsed) < timeout {
+		return
+	}
+	if err := h.closeLocked(); err != nil && h.closeErr == nil {
+		h.closeErr = err
+	}
+}
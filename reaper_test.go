@@ -0,0 +1,65 @@
+package billybazilfuse
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func TestReapIfIdle(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		opts  Options
+		flags fuse.OpenFlags
+		// use is called on the handle before it's checked for being idle for timeout.
+		use     func(t *testing.T, h *handle)
+		timeout time.Duration
+		// reaped is whether the backend file should be closed, and want what the handle reads afterwards.
+		reaped bool
+		want   string
+	}{
+		{name: "idle reader", flags: fuse.OpenReadOnly, use: func(t *testing.T, h *handle) { readHandle(t, h) }, reaped: true, want: "content"},
+		{name: "recently used", flags: fuse.OpenReadOnly, use: func(t *testing.T, h *handle) { readHandle(t, h) }, timeout: time.Hour},
+		{name: "in use", flags: fuse.OpenReadOnly, use: func(t *testing.T, h *handle) {
+			// An operation that hasn't finished yet.
+			if _, err := h.file(true); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "buffered writer", opts: Options{WriteBufferSize: 1 << 20, WriteBufferAge: time.Hour}, flags: fuse.OpenReadWrite, use: func(t *testing.T, h *handle) {
+			if err := h.Write(ctx, &fuse.WriteRequest{Data: []byte("changed")}, &fuse.WriteResponse{}); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}, reaped: true, want: "changed"},
+		{name: "replacement", opts: Options{AtomicReplace: true}, flags: fuse.OpenWriteOnly | fuse.OpenTruncate, use: func(t *testing.T, h *handle) {}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, backend := countingTestFS(t, tc.opts)
+			h := openHandle(t, r, "f", tc.flags)
+			tc.use(t, h)
+			_, before := backend.counts()
+			h.reapIfIdle(tc.timeout)
+			_, after := backend.counts()
+			if reaped := after < before; reaped != tc.reaped {
+				t.Fatalf("the backend file was closed: %v; want %v", reaped, tc.reaped)
+			}
+			if !tc.reaped {
+				return
+			}
+			// Writes buffered before the file was closed made it to the backend, and the handle opens the file again when it's used.
+			if got := readHandle(t, h); got != tc.want {
+				t.Errorf("Read after closing the idle file = %q; want %q", got, tc.want)
+			}
+			if _, open := backend.counts(); open != 1 {
+				t.Errorf("%d files are open on the backend after using the handle again; want 1", open)
+			}
+			releaseHandle(t, h)
+			if _, open := backend.counts(); open != 0 {
+				t.Errorf("%d files are still open on the backend after Release", open)
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package billybazilfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Reconnector can be implemented by backends that talk to a server over a connection that can drop, like SFTP.
+//
+// When a call fails with an error IsConnectionError accepts, the filesystem calls Reconnect, retrying with backoff for up to Options.ReconnectTimeout, and uses the returned backend from then on.
+// Calls that are safe to repeat (like Stat, ReadDir and Chmod) are then retried on the new backend. Other calls (like Rename and opening with O_EXCL) fail with the error, as they may have taken effect.
+// Open files are opened again on the new backend at the offset they were at, and reads and writes on them are retried. Appends are only retried if the file shows the first attempt didn't take effect.
+//
+// The filesystem wraps the backend to swap it, so backends implementing Reconnector only get used through billy.Basic, billy.Dir, billy.Symlink and billy.Change, and not through optional interfaces like Watcher and Copier.
+type Reconnector interface {
+	billy.Basic
+	billy.Dir
+	billy.Symlink
+	billy.Change
+	// IsConnectionError returns whether err means the connection was lost.
+	IsConnectionError(err error) bool
+	// Reconnect returns a new connection to the same filesystem, which replaces this one. Closing this one is up to the backend.
+	Reconnect(ctx context.Context) (Reconnector, error)
+}
+
+// reconnectingFS passes calls to the current connection of a Reconnector, and swaps it for a new one when it's lost.
+type reconnectingFS struct {
+	timeout time.Duration
+
+	mtx sync.Mutex
+	cur Reconnector
+	// gen is increased whenever cur is replaced.
+	gen uint64
+
+	// reconnectMtx is held while reconnecting, so only one call does it.
+	reconnectMtx sync.Mutex
+	reconnects   atomic.Int64
+}
+
+var _ billy.Basic = &reconnectingFS{}
+var _ billy.Dir = &reconnectingFS{}
+var _ billy.Symlink = &reconnectingFS{}
+var _ billy.Change = &reconnectingFS{}
+
+func newReconnectingFS(rc Reconnector, timeout time.Duration) *reconnectingFS {
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	return &reconnectingFS{cur: rc, timeout: timeout}
+}
+
+func (r *reconnectingFS) current() (Reconnector, uint64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.cur, r.gen
+}
+
+// reconnect replaces the connection that failed (which was generation gen), unless another call already did. It returns whether there's a new connection.
+func (r *reconnectingFS) reconnect(gen uint64) bool {
+	r.reconnectMtx.Lock()
+	defer r.reconnectMtx.Unlock()
+	cur, g := r.current()
+	if g != gen {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	backoff := 100 * time.Millisecond
+	for {
+		rc, err := cur.Reconnect(ctx)
+		if err == nil {
+			r.mtx.Lock()
+			r.cur = rc
+			r.gen++
+			r.mtx.Unlock()
+			r.reconnects.Add(1)
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// idempotent calls f with the current connection, and if it fails because the connection was lost, calls it again with a new one.
+func (r *reconnectingFS) idempotent(f func(rc Reconnector) error) error {
+	rc, gen := r.current()
+	err := f(rc)
+	if err == nil || !rc.IsConnectionError(err) || !r.reconnect(gen) {
+		return err
+	}
+	rc, _ = r.current()
+	return f(rc)
+}
+
+// once calls f with the current connection, and reconnects if it fails because the connection was lost, without calling f again.
+func (r *reconnectingFS) once(f func(rc Reconnector) error) error {
+	rc, gen := r.current()
+	err := f(rc)
+	if err != nil && rc.IsConnectionError(err) {
+		r.reconnect(gen)
+	}
+	return err
+}
+
+func (r *reconnectingFS) Create(filename string) (billy.File, error) {
+	return r.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (r *reconnectingFS) Open(filename string) (billy.File, error) {
+	return r.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (r *reconnectingFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	rc, gen := r.current()
+	fh, err := rc.OpenFile(filename, flag, perm)
+	// Opening with O_TRUNC or O_EXCL again could lose data or fail, if the first attempt took effect.
+	retry := flag&(os.O_TRUNC|os.O_EXCL) == 0
+	if err != nil && rc.IsConnectionError(err) && r.reconnect(gen) && retry {
+		rc, gen = r.current()
+		fh, err = rc.OpenFile(filename, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &reconnectingFile{fs: r, name: filename, flag: flag, fh: fh, rc: rc, gen: gen, size: -1}
+	if f.appending() {
+		// Remember the size, to tell whether an append took effect if the connection is lost during it.
+		if flag&os.O_TRUNC != 0 {
+			f.size = 0
+		} else if fi, err := r.Stat(filename); err == nil {
+			f.size = fi.Size()
+		}
+	}
+	return f, nil
+}
+
+func (r *reconnectingFS) Stat(filename string) (fi os.FileInfo, err error) {
+	err = r.idempotent(func(rc Reconnector) error {
+		fi, err = rc.Stat(filename)
+		return err
+	})
+	return fi, err
+}
+
+func (r *reconnectingFS) Rename(oldpath, newpath string) error {
+	return r.once(func(rc Reconnector) error {
+		return rc.Rename(oldpath, newpath)
+	})
+}
+
+func (r *reconnectingFS) Remove(filename string) error {
+	return r.once(func(rc Reconnector) error {
+		return rc.Remove(filename)
+	})
+}
+
+func (r *reconnectingFS) Join(elem ...string) string {
+	rc, _ := r.current()
+	return rc.Join(elem...)
+}
+
+func (r *reconnectingFS) ReadDir(path string) (fis []os.FileInfo, err error) {
+	err = r.idempotent(func(rc Reconnector) error {
+		fis, err = rc.ReadDir(path)
+		return err
+	})
+	return fis, err
+}
+
+func (r *reconnectingFS) MkdirAll(filename string, perm os.FileMode) error {
+	return r.idempotent(func(rc Reconnector) error {
+		return rc.MkdirAll(filename, perm)
+	})
+}
+
+func (r *reconnectingFS) Lstat(filename string) (fi os.FileInfo, err error) {
+	err = r.idempotent(func(rc Reconnector) error {
+		fi, err = rc.Lstat(filename)
+		return err
+	})
+	return fi, err
+}
+
+func (r *reconnectingFS) Symlink(target, link string) error {
+	return r.once(func(rc Reconnector) error {
+		return rc.Symlink(target, link)
+	})
+}
+
+func (r *reconnectingFS) Readlink(link string) (target string, err error) {
+	err = r.idempotent(func(rc Reconnector) error {
+		target, err = rc.Readlink(link)
+		return err
+	})
+	return target, err
+}
+
+func (r *reconnectingFS) Chmod(name string, mode os.FileMode) error {
+	return r.idempotent(func(rc Reconnector) error {
+		return rc.Chmod(name, mode)
+	})
+}
+
+func (r *reconnectingFS) Lchown(name string, uid, gid int) error {
+	return r.idempotent(func(rc Reconnector) error {
+		return rc.Lchown(name, uid, gid)
+	})
+}
+
+func (r *reconnectingFS) Chown(name string, uid, gid int) error {
+	return r.idempotent(func(rc Reconnector) error {
+		return rc.Chown(name, uid, gid)
+	})
+}
+
+func (r *reconnectingFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return r.idempotent(func(rc Reconnector) error {
+		return rc.Chtimes(name, atime, mtime)
+	})
+}
+
+// reconnectingFile is a file opened on a reconnectingFS. When a call on it fails because the connection was lost, the file is opened again on the new connection (without O_CREATE, O_TRUNC and O_EXCL), at the same offset, and the call is retried.
+// A retried write skips the ranges other writes on the file wrote since it started, which it would otherwise overwrite. A retried append is skipped if the file shows the first attempt took effect, and fails if the file changed in a way that doesn't tell.
+type reconnectingFile struct {
+	fs   *reconnectingFS
+	name string
+	flag int
+
+	mtx sync.Mutex
+	fh  billy.File
+	// rc and gen are the connection fh was opened on, and its generation.
+	rc  Reconnector
+	gen uint64
+
+	// posMtx serializes the calls that use the offset of the file, which is tracked in pos so it can be restored on a new connection.
+	posMtx sync.Mutex
+	pos    atomic.Int64
+	// size is the size of the file after the last append, or -1 if unknown. Only used with O_APPEND, protected by posMtx.
+	size int64
+
+	journal retryJournal
+}
+
+var _ io.WriterAt = &reconnectingFile{}
+
+func (f *reconnectingFile) file() (billy.File, Reconnector, uint64) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.fh, f.rc, f.gen
+}
+
+// do calls fn with the file. If it fails because the connection was lost, it opens the file again on a new connection and calls retry, or returns the error if retry is nil.
+func (f *reconnectingFile) do(fn, retry func(fh billy.File) error) error {
+	fh, rc, gen := f.file()
+	err := fn(fh)
+	if err == nil || !rc.IsConnectionError(err) || !f.fs.reconnect(gen) {
+		return err
+	}
+	if rerr := f.reopen(gen); rerr != nil || retry == nil {
+		return err
+	}
+	fh, _, _ = f.file()
+	return retry(fh)
+}
+
+// reopen opens the file again on the current connection, unless another call already did since generation gen.
+func (f *reconnectingFile) reopen(gen uint64) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.gen != gen {
+		return nil
+	}
+	rc, g := f.fs.current()
+	fh, err := rc.OpenFile(f.name, f.flag&^(os.O_CREATE|os.O_TRUNC|os.O_EXCL), 0)
+	if err != nil {
+		return err
+	}
+	if pos := f.pos.Load(); pos != 0 && !f.appending() {
+		if _, err := fh.Seek(pos, io.SeekStart); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	// The old connection is gone, so closing its file can only fail.
+	_ = f.fh.Close()
+	f.fh = fh
+	f.rc = rc
+	f.gen = g
+	return nil
+}
+
+// appending returns whether writes go to the end of the file.
+func (f *reconnectingFile) appending() bool {
+	return f.flag&os.O_APPEND != 0
+}
+
+func (f *reconnectingFile) Name() string {
+	return f.name
+}
+
+func (f *reconnectingFile) ReadAt(p []byte, off int64) (n int, err error) {
+	read := func(fh billy.File) error {
+		n, err = fh.ReadAt(p, off)
+		return err
+	}
+	err = f.do(read, read)
+	return n, err
+}
+
+func (f *reconnectingFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.appending() {
+		return f.append(p)
+	}
+	fh, _, _ := f.file()
+	if _, ok := fh.(io.WriterAt); !ok {
+		// Writes are emulated with Seek+Write, which moves the offset.
+		f.posMtx.Lock()
+		defer f.posMtx.Unlock()
+	}
+	start := f.journal.begin()
+	defer func() {
+		f.journal.finish(start, off, off+int64(n))
+	}()
+	err = f.do(func(fh billy.File) error {
+		n, err = f.writeAt(fh, p, off)
+		return err
+	}, func(fh billy.File) error {
+		n, err = f.rewrite(fh, start, p, off)
+		return err
+	})
+	return n, err
+}
+
+// SeeksForWrites returns whether WriteAt is emulated with Seek+Write, because the backend file doesn't implement io.WriterAt.
+func (f *reconnectingFile) SeeksForWrites() bool {
+	fh, _, _ := f.file()
+	_, ok := fh.(io.WriterAt)
+	return !ok
+}
+
+// writeAt writes p at off, with Seek+Write if fh doesn't implement io.WriterAt. The caller must hold posMtx in that case.
+func (f *reconnectingFile) writeAt(fh billy.File, p []byte, off int64) (int, error) {
+	if wa, ok := fh.(io.WriterAt); ok {
+		return wa.WriteAt(p, off)
+	}
+	if _, err := fh.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := fh.Write(p)
+	f.pos.Store(off + int64(n))
+	return n, err
+}
+
+// rewrite retries the write of p at off that started at start, skipping the ranges written since.
+func (f *reconnectingFile) rewrite(fh billy.File, start uint64, p []byte, off int64) (int, error) {
+	for _, g := range f.journal.gaps(start, off, off+int64(len(p))) {
+		if _, err := f.writeAt(fh, p[g.off-off:g.end-off], g.off); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *reconnectingFile) Read(p []byte) (n int, err error) {
+	f.posMtx.Lock()
+	defer f.posMtx.Unlock()
+	read := func(fh billy.File) error {
+		n, err = fh.Read(p)
+		return err
+	}
+	err = f.do(read, read)
+	f.pos.Add(int64(n))
+	return n, err
+}
+
+func (f *reconnectingFile) Write(p []byte) (n int, err error) {
+	if f.appending() {
+		return f.append(p)
+	}
+	f.posMtx.Lock()
+	defer f.posMtx.Unlock()
+	off := f.pos.Load()
+	start := f.journal.begin()
+	defer func() {
+		f.journal.finish(start, off, off+int64(n))
+	}()
+	err = f.do(func(fh billy.File) error {
+		n, err = fh.Write(p)
+		f.pos.Add(int64(n))
+		return err
+	}, func(fh billy.File) error {
+		if n, err = f.rewrite(fh, start, p, off); err != nil {
+			return err
+		}
+		end := off + int64(n)
+		f.pos.Store(end)
+		_, err = fh.Seek(end, io.SeekStart)
+		return err
+	})
+	return n, err
+}
+
+// append writes p to the end of a file opened with O_APPEND. If the connection is lost, it's only retried if the file shows the first attempt didn't take effect.
+func (f *reconnectingFile) append(p []byte) (n int, err error) {
+	f.posMtx.Lock()
+	defer f.posMtx.Unlock()
+	size := f.size
+	f.size = -1
+	err = f.do(func(fh billy.File) error {
+		n, err = fh.Write(p)
+		return err
+	}, func(fh billy.File) error {
+		if size < 0 {
+			return errors.New("billy-bazilfuse: connection lost during append to a file of unknown size")
+		}
+		applied, ok := f.appended(p, size)
+		if !ok {
+			return fmt.Errorf("billy-bazilfuse: connection lost during append, and %q changed", f.name)
+		}
+		if applied {
+			n = len(p)
+			return nil
+		}
+		n, err = fh.Write(p)
+		return err
+	})
+	if err == nil && size >= 0 {
+		f.size = size + int64(n)
+	}
+	return n, err
+}
+
+func (f *reconnectingFile) Seek(offset int64, whence int) (pos int64, err error) {
+	f.posMtx.Lock()
+	defer f.posMtx.Unlock()
+	seek := func(fh billy.File) error {
+		pos, err = fh.Seek(offset, whence)
+		return err
+	}
+	err = f.do(seek, seek)
+	if err == nil {
+		f.pos.Store(pos)
+	}
+	return pos, err
+}
+
+func (f *reconnectingFile) Truncate(size int64) error {
+	if f.appending() {
+		f.posMtx.Lock()
+		defer f.posMtx.Unlock()
+	}
+	truncate := func(fh billy.File) error {
+		return fh.Truncate(size)
+	}
+	err := f.do(truncate, truncate)
+	if f.appending() && err == nil {
+		f.size = size
+	}
+	return err
+}
+
+// Sync flushes the file to stable storage, if the backend's files support it.
+func (f *reconnectingFile) Sync() error {
+	sync := func(fh billy.File) error {
+		if s, ok := fh.(interface{ Sync() error }); ok {
+			return s.Sync()
+		}
+		return nil
+	}
+	return f.do(sync, sync)
+}
+
+func (f *reconnectingFile) Close() error {
+	fh, _, _ := f.file()
+	return fh.Close()
+}
+
+func (f *reconnectingFile) Lock() error {
+	fh, _, _ := f.file()
+	return fh.Lock()
+}
+
+func (f *reconnectingFile) Unlock() error {
+	fh, _, _ := f.file()
+	return fh.Unlock()
+}
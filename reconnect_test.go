@@ -0,0 +1,353 @@
+package billybazilfuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+var errConnectionLost = errors.New("connection lost")
+
+// flakyServer is a memfs that is reached over connections that can be made to drop.
+type flakyServer struct {
+	fs billy.Filesystem
+
+	mtx sync.Mutex
+	// gen is the generation of the working connection. Connections of older generations fail every call.
+	gen int
+	// dropIn is the number of calls after which the connection drops, or -1 if it doesn't. If applied is set, the call that drops it takes effect first.
+	dropIn  int
+	applied bool
+}
+
+func newFlakyServer() *flakyServer {
+	return &flakyServer{fs: memfs.New(), dropIn: -1}
+}
+
+// drop makes the connection drop at the n'th call from now, counting from 0.
+func (s *flakyServer) drop(n int, applied bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.dropIn = n
+	s.applied = applied
+}
+
+func (s *flakyServer) connect() *flakyConn {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return &flakyConn{s: s, gen: s.gen}
+}
+
+// call calls f, unless the connection of generation gen is gone.
+func (s *flakyServer) call(gen int, f func() error) error {
+	s.mtx.Lock()
+	if gen != s.gen {
+		s.mtx.Unlock()
+		return errConnectionLost
+	}
+	drop := s.dropIn == 0
+	if s.dropIn >= 0 {
+		s.dropIn--
+	}
+	if drop {
+		s.gen++
+	}
+	applied := s.applied
+	s.mtx.Unlock()
+	if drop {
+		if applied {
+			f()
+		}
+		return errConnectionLost
+	}
+	return f()
+}
+
+type flakyConn struct {
+	s   *flakyServer
+	gen int
+}
+
+var _ Reconnector = &flakyConn{}
+
+func (c *flakyConn) IsConnectionError(err error) bool {
+	return err == errConnectionLost
+}
+
+func (c *flakyConn) Reconnect(ctx context.Context) (Reconnector, error) {
+	return c.s.connect(), nil
+}
+
+func (c *flakyConn) Create(filename string) (billy.File, error) {
+	return c.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (c *flakyConn) Open(filename string) (billy.File, error) {
+	return c.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (c *flakyConn) OpenFile(filename string, flag int, perm os.FileMode) (f billy.File, err error) {
+	err = c.s.call(c.gen, func() error {
+		f, err = c.s.fs.OpenFile(filename, flag, perm)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &flakyFile{File: f, c: c}, nil
+}
+
+func (c *flakyConn) Stat(filename string) (fi os.FileInfo, err error) {
+	err = c.s.call(c.gen, func() error {
+		fi, err = c.s.fs.Stat(filename)
+		return err
+	})
+	return fi, err
+}
+
+func (c *flakyConn) Rename(oldpath, newpath string) error {
+	return c.s.call(c.gen, func() error { return c.s.fs.Rename(oldpath, newpath) })
+}
+
+func (c *flakyConn) Remove(filename string) error {
+	return c.s.call(c.gen, func() error { return c.s.fs.Remove(filename) })
+}
+
+func (c *flakyConn) Join(elem ...string) string {
+	return c.s.fs.Join(elem...)
+}
+
+func (c *flakyConn) ReadDir(path string) (fis []os.FileInfo, err error) {
+	err = c.s.call(c.gen, func() error {
+		fis, err = c.s.fs.ReadDir(path)
+		return err
+	})
+	return fis, err
+}
+
+func (c *flakyConn) MkdirAll(filename string, perm os.FileMode) error {
+	return c.s.call(c.gen, func() error { return c.s.fs.MkdirAll(filename, perm) })
+}
+
+func (c *flakyConn) Lstat(filename string) (fi os.FileInfo, err error) {
+	err = c.s.call(c.gen, func() error {
+		fi, err = c.s.fs.Lstat(filename)
+		return err
+	})
+	return fi, err
+}
+
+func (c *flakyConn) Symlink(target, link string) error {
+	return c.s.call(c.gen, func() error { return c.s.fs.Symlink(target, link) })
+}
+
+func (c *flakyConn) Readlink(link string) (target string, err error) {
+	err = c.s.call(c.gen, func() error {
+		target, err = c.s.fs.Readlink(link)
+		return err
+	})
+	return target, err
+}
+
+// memfs can't change attributes, so these only fail if the connection is gone.
+func (c *flakyConn) Chmod(name string, mode os.FileMode) error {
+	return c.s.call(c.gen, func() error { return nil })
+}
+
+func (c *flakyConn) Lchown(name string, uid, gid int) error {
+	return c.s.call(c.gen, func() error { return nil })
+}
+
+func (c *flakyConn) Chown(name string, uid, gid int) error {
+	return c.s.call(c.gen, func() error { return nil })
+}
+
+func (c *flakyConn) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return c.s.call(c.gen, func() error { return nil })
+}
+
+// flakyFile is a file opened over a flakyConn.
+type flakyFile struct {
+	billy.File
+	c *flakyConn
+}
+
+func (f *flakyFile) Read(p []byte) (n int, err error) {
+	err = f.c.s.call(f.c.gen, func() error {
+		n, err = f.File.Read(p)
+		return err
+	})
+	return n, err
+}
+
+func (f *flakyFile) ReadAt(p []byte, off int64) (n int, err error) {
+	err = f.c.s.call(f.c.gen, func() error {
+		n, err = f.File.ReadAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (f *flakyFile) Write(p []byte) (n int, err error) {
+	err = f.c.s.call(f.c.gen, func() error {
+		n, err = f.File.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (f *flakyFile) Seek(offset int64, whence int) (pos int64, err error) {
+	err = f.c.s.call(f.c.gen, func() error {
+		pos, err = f.File.Seek(offset, whence)
+		return err
+	})
+	return pos, err
+}
+
+func (f *flakyFile) Truncate(size int64) error {
+	return f.c.s.call(f.c.gen, func() error { return f.File.Truncate(size) })
+}
+
+func TestReconnectingFS(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// The connection drops during op, after it took effect if applied is set.
+		op      func(r *reconnectingFS) error
+		applied bool
+		// wantErr is whether op should fail, and exists the files that should exist afterwards.
+		wantErr bool
+		exists  []string
+	}{
+		{name: "stat is retried", op: func(r *reconnectingFS) error {
+			_, err := r.Stat("f")
+			return err
+		}, exists: []string{"f"}},
+		{name: "listing is retried", applied: true, op: func(r *reconnectingFS) error {
+			_, err := r.ReadDir("")
+			return err
+		}, exists: []string{"f"}},
+		{name: "open is retried", op: func(r *reconnectingFS) error {
+			f, err := r.Open("f")
+			if err == nil {
+				f.Close()
+			}
+			return err
+		}, exists: []string{"f"}},
+		{name: "rename that didn't take effect isn't retried", op: func(r *reconnectingFS) error {
+			return r.Rename("f", "g")
+		}, wantErr: true, exists: []string{"f"}},
+		{name: "rename that took effect isn't retried", applied: true, op: func(r *reconnectingFS) error {
+			return r.Rename("f", "g")
+		}, wantErr: true, exists: []string{"g"}},
+		{name: "exclusive create isn't retried", applied: true, op: func(r *reconnectingFS) error {
+			_, err := r.OpenFile("new", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+			return err
+		}, wantErr: true, exists: []string{"f", "new"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFlakyServer()
+			if err := util.WriteFile(s.fs, "f", []byte("content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			r := newReconnectingFS(s.connect(), time.Second)
+			s.drop(0, tc.applied)
+			err := tc.op(r)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("%s: err = %v; want an error: %v", tc.name, err, tc.wantErr)
+			}
+			if n := r.reconnects.Load(); n != 1 {
+				t.Errorf("reconnected %d times; want once", n)
+			}
+			fis, err := r.ReadDir("")
+			if err != nil {
+				t.Fatalf("ReadDir after reconnecting: %v", err)
+			}
+			var names []string
+			for _, fi := range fis {
+				names = append(names, fi.Name())
+			}
+			if !reflect.DeepEqual(names, tc.exists) {
+				t.Errorf("the backend has %q; want %q", names, tc.exists)
+			}
+		})
+	}
+}
+
+func TestReconnectingFileReopens(t *testing.T) {
+	read := func(f billy.File) (string, error) {
+		b := make([]byte, 3)
+		n, err := f.Read(b)
+		return string(b[:n]), err
+	}
+	for _, tc := range []struct {
+		name string
+		flag int
+		// before is called before the connection drops during op.
+		before func(f billy.File) (string, error)
+		op     func(f billy.File) (string, error)
+		// want is what op should return, and content the content of the file afterwards.
+		want    string
+		content string
+	}{
+		{name: "read continues at the offset", flag: os.O_RDONLY, before: read, op: read, want: "ten", content: "content"},
+		{name: "read at an offset", flag: os.O_RDONLY, op: func(f billy.File) (string, error) {
+			b := make([]byte, 3)
+			n, err := f.ReadAt(b, 4)
+			return string(b[:n]), err
+		}, want: "ent", content: "content"},
+		{name: "read after a seek", flag: os.O_RDONLY, before: func(f billy.File) (string, error) {
+			_, err := f.Seek(4, io.SeekStart)
+			return "", err
+		}, op: read, want: "ent", content: "content"},
+		{name: "write continues at the offset", flag: os.O_RDWR, before: read, op: func(f billy.File) (string, error) {
+			_, err := f.Write([]byte("XYZ"))
+			return "", err
+		}, content: "conXYZt"},
+		{name: "truncate", flag: os.O_RDWR, op: func(f billy.File) (string, error) {
+			return "", f.Truncate(3)
+		}, content: "con"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFlakyServer()
+			if err := util.WriteFile(s.fs, "f", []byte("content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			r := newReconnectingFS(s.connect(), time.Second)
+			f, err := r.OpenFile("f", tc.flag, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if tc.before != nil {
+				if _, err := tc.before(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.drop(0, false)
+			got, err := tc.op(f)
+			if err != nil {
+				t.Fatalf("%s after the connection dropped: %v", tc.name, err)
+			}
+			if got != tc.want {
+				t.Errorf("%s = %q; want %q", tc.name, got, tc.want)
+			}
+			if n := r.reconnects.Load(); n != 1 {
+				t.Errorf("reconnected %d times; want once", n)
+			}
+			if data, err := util.ReadFile(s.fs, "f"); err != nil {
+				t.Fatal(err)
+			} else if string(data) != tc.content {
+				t.Errorf("the file has %q; want %q", data, tc.content)
+			}
+		})
+	}
+}
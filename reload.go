@@ -0,0 +1,34 @@
+package billybazilfuse
+
+// openPolicy holds the patterns that decide how files are cached. It's replaced as a whole by Reload.
+type openPolicy struct {
+	keepCachePaths []string
+	directIOPaths  []string
+	noCachePaths   []string
+}
+
+// Reload applies the settings of opts that can be changed while the filesystem is served, so long-lived mounts can be tuned without remounting.
+// These are MaxConcurrentCalls, MaxConcurrentMetadataCalls, MaxConcurrentDataCalls, KeepCachePaths, DirectIOPaths, NoCachePaths and PollBudget; the other fields of opts are ignored.
+// Lowering a concurrency limit doesn't affect calls in progress; new calls wait until enough of those finished.
+// Use TieredCache.Reload to change the settings of a cache.
+func (r *FS) Reload(opts Options) error {
+	r.settingsMtx.Lock()
+	defer r.settingsMtx.Unlock()
+	return r.reloadLocked(opts)
+}
+
+// reloadLocked applies opts like Reload. r.settingsMtx must be held.
+func (r *FS) reloadLocked(opts Options) error {
+	for _, patterns := range [][]string{opts.KeepCachePaths, opts.DirectIOPaths, opts.NoCachePaths} {
+		if err := validatePatterns(patterns); err != nil {
+			return err
+		}
+	}
+	r.limiter.setLimits(opts.MaxConcurrentCalls, opts.MaxConcurrentMetadataCalls, opts.MaxConcurrentDataCalls)
+	r.openPolicy.Store(&openPolicy{opts.KeepCachePaths, opts.DirectIOPaths, opts.NoCachePaths})
+	if r.poller != nil {
+		r.poller.budget.Store(int64(opts.PollBudget))
+	}
+	r.settings = opts
+	return nil
+}
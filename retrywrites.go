@@ -0,0 +1,118 @@
+package billybazilfuse
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// retryJournal records the byte ranges written through a reconnectingFile, so a write that failed because the connection was lost can be retried without overwriting writes that completed in the meantime.
+type retryJournal struct {
+	mtx sync.Mutex
+	// completed counts the writes that finished.
+	completed uint64
+	// inFlight counts the running writes by the value of completed when they started.
+	inFlight map[uint64]int
+	// ranges are the writes that finished while older writes were running, which a retry of those must not overwrite.
+	ranges []writtenRange
+}
+
+type writtenRange struct {
+	// seq is the value of completed after the write finished.
+	seq      uint64
+	off, end int64
+}
+
+// begin registers a write, and returns a token for finish and gaps.
+func (j *retryJournal) begin() uint64 {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.inFlight == nil {
+		j.inFlight = map[uint64]int{}
+	}
+	j.inFlight[j.completed]++
+	return j.completed
+}
+
+// finish unregisters the write started at start, which wrote [off, end).
+func (j *retryJournal) finish(start uint64, off, end int64) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.completed++
+	if j.inFlight[start]--; j.inFlight[start] == 0 {
+		delete(j.inFlight, start)
+	}
+	if len(j.inFlight) == 0 {
+		j.ranges = nil
+		return
+	}
+	if end > off {
+		j.ranges = append(j.ranges, writtenRange{j.completed, off, end})
+	}
+	// Drop the ranges no running write can be retried over.
+	oldest := j.completed
+	for s := range j.inFlight {
+		if s < oldest {
+			oldest = s
+		}
+	}
+	i := 0
+	for i < len(j.ranges) && j.ranges[i].seq <= oldest {
+		i++
+	}
+	j.ranges = j.ranges[i:]
+}
+
+// gaps returns the parts of [off, end) that weren't written by writes that finished after the write started at start.
+func (j *retryJournal) gaps(start uint64, off, end int64) []writtenRange {
+	j.mtx.Lock()
+	var later []writtenRange
+	for _, r := range j.ranges {
+		if r.seq > start && r.off < end && r.end > off {
+			later = append(later, r)
+		}
+	}
+	j.mtx.Unlock()
+	sort.Slice(later, func(i, k int) bool {
+		return later[i].off < later[k].off
+	})
+	var ret []writtenRange
+	for _, r := range later {
+		if r.off > off {
+			ret = append(ret, writtenRange{off: off, end: r.off})
+		}
+		if r.end > off {
+			off = r.end
+		}
+	}
+	if off < end {
+		ret = append(ret, writtenRange{off: off, end: end})
+	}
+	return ret
+}
+
+// appended returns whether an append of p to a file that was size bytes before it is visible on the current connection. It returns false for ok if that can't be told, because the file changed in another way.
+func (f *reconnectingFile) appended(p []byte, size int64) (applied, ok bool) {
+	fi, err := f.fs.Stat(f.name)
+	if err != nil {
+		return false, false
+	}
+	switch fi.Size() {
+	case size:
+		return false, true
+	case size + int64(len(p)):
+	default:
+		return false, false
+	}
+	rc, _ := f.fs.current()
+	fh, err := rc.Open(f.name)
+	if err != nil {
+		return false, false
+	}
+	defer fh.Close()
+	b := make([]byte, len(p))
+	if n, _ := fh.ReadAt(b, size); n != len(p) || !bytes.Equal(b, p) {
+		return false, false
+	}
+	return true, true
+}
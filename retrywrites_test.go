@@ -0,0 +1,115 @@
+package billybazilfuse
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+)
+
+func TestRetryJournalGaps(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// run does writes on the journal, and returns the token of the write of [0, 10) that is retried.
+		run  func(j *retryJournal) uint64
+		want []writtenRange
+	}{
+		{name: "nothing written since", run: func(j *retryJournal) uint64 {
+			return j.begin()
+		}, want: []writtenRange{{off: 0, end: 10}}},
+		{name: "overlapping write finished since", run: func(j *retryJournal) uint64 {
+			start := j.begin()
+			j.finish(j.begin(), 2, 5)
+			return start
+		}, want: []writtenRange{{off: 0, end: 2}, {off: 5, end: 10}}},
+		{name: "write finished before", run: func(j *retryJournal) uint64 {
+			other := j.begin()
+			start := j.begin()
+			j.finish(other, 2, 5)
+			// other started before, but finished after the retried write started.
+			return start
+		}, want: []writtenRange{{off: 0, end: 2}, {off: 5, end: 10}}},
+		{name: "write finished before the retried write started", run: func(j *retryJournal) uint64 {
+			j.finish(j.begin(), 2, 5)
+			return j.begin()
+		}, want: []writtenRange{{off: 0, end: 10}}},
+		{name: "covering write", run: func(j *retryJournal) uint64 {
+			start := j.begin()
+			j.finish(j.begin(), 0, 20)
+			return start
+		}, want: nil},
+		{name: "two writes", run: func(j *retryJournal) uint64 {
+			start := j.begin()
+			j.finish(j.begin(), 6, 8)
+			j.finish(j.begin(), 2, 4)
+			return start
+		}, want: []writtenRange{{off: 0, end: 2}, {off: 4, end: 6}, {off: 8, end: 10}}},
+		{name: "overlapping writes", run: func(j *retryJournal) uint64 {
+			start := j.begin()
+			j.finish(j.begin(), 2, 6)
+			j.finish(j.begin(), 4, 8)
+			return start
+		}, want: []writtenRange{{off: 0, end: 2}, {off: 8, end: 10}}},
+		{name: "elsewhere in the file", run: func(j *retryJournal) uint64 {
+			start := j.begin()
+			j.finish(j.begin(), 20, 30)
+			return start
+		}, want: []writtenRange{{off: 0, end: 10}}},
+	} {
+		var j retryJournal
+		start := tc.run(&j)
+		if got := j.gaps(start, 0, 10); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: gaps = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReconnectingFileAppend(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// applied is whether the append takes effect before the connection drops. other is appended by someone else after the file was opened.
+		applied bool
+		other   string
+		wantErr bool
+		content string
+	}{
+		{name: "append that didn't take effect is retried", content: "content+more"},
+		{name: "append that took effect isn't repeated", applied: true, content: "content+more"},
+		{name: "file changed by someone else", other: "!", wantErr: true, content: "content!"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFlakyServer()
+			if err := util.WriteFile(s.fs, "f", []byte("content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			r := newReconnectingFS(s.connect(), time.Second)
+			f, err := r.OpenFile("f", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if tc.other != "" {
+				other, err := s.fs.OpenFile("f", os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				other.Write([]byte(tc.other))
+				other.Close()
+			}
+			s.drop(0, tc.applied)
+			n, err := f.Write([]byte("+more"))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Write: %v; want an error: %v", err, tc.wantErr)
+			} else if err == nil && n != 5 {
+				t.Errorf("Write = %d; want 5", n)
+			}
+			if data, err := util.ReadFile(s.fs, "f"); err != nil {
+				t.Fatal(err)
+			} else if string(data) != tc.content {
+				t.Errorf("the file has %q; want %q", data, tc.content)
+			}
+		})
+	}
+}
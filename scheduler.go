@@ -0,0 +1,153 @@
+package billybazilfuse
+
+import (
+	"context"
+	"sync"
+)
+
+// scheduler hands out a limited number of slots for calls into the backend, like a worker pool whose workers are the goroutines serving the requests.
+// Waiting calls are served strictly by priority (their opClass), and within a priority round-robin across callers (processes), so one process doing a giant copy can't starve another's ls.
+type scheduler struct {
+	mtx sync.Mutex
+	// limit is the number of slots, or zero for unlimited. It can be changed while calls hold slots.
+	limit  int
+	inUse  int
+	queues [numOpClasses]fairQueue
+}
+
+type waiter struct {
+	caller  uint32
+	ch      chan struct{}
+	granted bool
+}
+
+// fairQueue is a queue of waiters that takes turns between callers.
+type fairQueue struct {
+	waiting map[uint32][]*waiter
+	// turns are the callers with waiters, in the order they get their turn.
+	turns []uint32
+}
+
+func newScheduler(limit int) *scheduler {
+	s := &scheduler{limit: limit}
+	for i := range s.queues {
+		s.queues[i].waiting = map[uint32][]*waiter{}
+	}
+	return s
+}
+
+func (q *fairQueue) push(w *waiter) {
+	if len(q.waiting[w.caller]) == 0 {
+		q.turns = append(q.turns, w.caller)
+	}
+	q.waiting[w.caller] = append(q.waiting[w.caller], w)
+}
+
+func (q *fairQueue) pop() *waiter {
+	if len(q.turns) == 0 {
+		return nil
+	}
+	caller := q.turns[0]
+	q.turns = q.turns[1:]
+	ws := q.waiting[caller]
+	w := ws[0]
+	if len(ws) == 1 {
+		delete(q.waiting, caller)
+	} else {
+		q.waiting[caller] = ws[1:]
+		q.turns = append(q.turns, caller)
+	}
+	return w
+}
+
+func (q *fairQueue) remove(w *waiter) {
+	ws := q.waiting[w.caller]
+	for i, o := range ws {
+		if o == w {
+			ws = append(ws[:i:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) > 0 {
+		q.waiting[w.caller] = ws
+		return
+	}
+	delete(q.waiting, w.caller)
+	for i, c := range q.turns {
+		if c == w.caller {
+			q.turns = append(q.turns[:i:i], q.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// acquire waits for a slot. It fails with EINTR if ctx is cancelled while waiting, or with the error of Options.OpTimeout if its deadline passes.
+func (s *scheduler) acquire(ctx context.Context, class opClass, caller uint32) error {
+	s.mtx.Lock()
+	if s.hasFreeLocked() {
+		s.inUse++
+		s.mtx.Unlock()
+		return nil
+	}
+	w := &waiter{caller: caller, ch: make(chan struct{})}
+	s.queues[class].push(w)
+	s.mtx.Unlock()
+	select {
+	case <-w.ch:
+		return nil
+	case <-ctx.Done():
+		s.mtx.Lock()
+		granted := w.granted
+		if !granted {
+			s.queues[class].remove(w)
+		}
+		s.mtx.Unlock()
+		if granted {
+			// We got a slot just as we gave up on it.
+			s.release()
+		}
+		return ctxErr(ctx)
+	}
+}
+
+func (s *scheduler) hasFreeLocked() bool {
+	return s.limit <= 0 || s.inUse < s.limit
+}
+
+// release returns a slot, handing it to the next waiter if there is one.
+func (s *scheduler) release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.inUse--
+	s.grantLocked()
+}
+
+// setLimit changes the number of slots. Raising it serves waiting calls right away; lowering it makes new calls wait until enough slots were released.
+func (s *scheduler) setLimit(limit int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.limit = limit
+	s.grantLocked()
+}
+
+// grantLocked hands free slots to waiters, by priority.
+func (s *scheduler) grantLocked() {
+	for s.hasFreeLocked() {
+		w := s.popLocked()
+		if w == nil {
+			return
+		}
+		s.inUse++
+		w.granted = true
+		close(w.ch)
+	}
+}
+
+func (s *scheduler) popLocked() *waiter {
+	for i := range s.queues {
+		if w := s.queues[i].pop(); w != nil {
+			return w
+		}
+	}
+	return nil
+}
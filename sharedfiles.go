@@ -0,0 +1,92 @@
+package billybazilfuse
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+)
+
+// sharedFiles shares one backend file between all read-only opens of the same path, for backends that limit the number of open files or connections.
+// A path is detached from its shared file when it's changed through the mount, so later opens see the new version while existing handles keep reading the file they opened.
+type sharedFiles struct {
+	mtx   sync.Mutex
+	files map[string]*sharedFile
+}
+
+type sharedFile struct {
+	path string
+	fh   *adapter.File
+	refs int
+	// opening is closed when the file has been opened (or failed to). It's nil afterwards.
+	opening chan struct{}
+}
+
+func newSharedFiles() *sharedFiles {
+	return &sharedFiles{files: map[string]*sharedFile{}}
+}
+
+// acquire returns the shared file for p, calling open if there is none yet. Every successful call must be followed by a call to release.
+func (s *sharedFiles) acquire(p string, open func() (*adapter.File, error)) (*sharedFile, error) {
+	s.mtx.Lock()
+	for {
+		sf, ok := s.files[p]
+		if !ok {
+			break
+		}
+		if sf.opening != nil {
+			ch := sf.opening
+			s.mtx.Unlock()
+			<-ch
+			s.mtx.Lock()
+			continue
+		}
+		sf.refs++
+		s.mtx.Unlock()
+		return sf, nil
+	}
+	sf := &sharedFile{path: p, refs: 1, opening: make(chan struct{})}
+	s.files[p] = sf
+	s.mtx.Unlock()
+
+	fh, err := open()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	close(sf.opening)
+	sf.opening = nil
+	if err != nil {
+		if s.files[p] == sf {
+			delete(s.files, p)
+		}
+		return nil, err
+	}
+	sf.fh = fh
+	return sf, nil
+}
+
+// release drops a reference to sf, and closes the backend file when it was the last one.
+func (s *sharedFiles) release(sf *sharedFile) error {
+	s.mtx.Lock()
+	sf.refs--
+	if sf.refs > 0 {
+		s.mtx.Unlock()
+		return nil
+	}
+	if s.files[sf.path] == sf {
+		delete(s.files, sf.path)
+	}
+	s.mtx.Unlock()
+	return sf.fh.Close()
+}
+
+// detach makes later opens of p (and everything below it) open a new backend file.
+func (s *sharedFiles) detach(p string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.files, p)
+	for fp := range s.files {
+		if strings.HasPrefix(fp, p+"/") {
+			delete(s.files, fp)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package billybazilfuse
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// countingFS counts the files opened on it, and how many of them are still open.
+type countingFS struct {
+	billy.Filesystem
+
+	mtx   sync.Mutex
+	opens int
+	open  int
+}
+
+type countedFile struct {
+	billy.File
+	fs   *countingFS
+	once sync.Once
+}
+
+func (c *countingFS) OpenFile(fn string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := c.Filesystem.OpenFile(fn, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.opens++
+	c.open++
+	return &countedFile{File: f, fs: c}, nil
+}
+
+func (f *countedFile) Close() error {
+	f.once.Do(func() {
+		f.fs.mtx.Lock()
+		defer f.fs.mtx.Unlock()
+		f.fs.open--
+	})
+	return f.File.Close()
+}
+
+// counts returns the number of files opened, and the number still open.
+func (c *countingFS) counts() (opens, open int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.opens, c.open
+}
+
+// countingTestFS creates a FS with the given options on a memfs with a file f containing "content".
+func countingTestFS(t *testing.T, opts Options) (*FS, *countingFS) {
+	t.Helper()
+	backend := memfs.New()
+	if err := util.WriteFile(backend, "f", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingFS{Filesystem: backend}
+	r, err := NewWithOptions(counting, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, counting
+}
+
+func openHandle(t *testing.T, r *FS, p string, flags fuse.OpenFlags) *handle {
+	t.Helper()
+	h, err := r.node(p).Open(context.Background(), &fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Open(%q, %v): %v", p, flags, err)
+	}
+	return h.(*handle)
+}
+
+func readHandle(t *testing.T, h *handle) string {
+	t.Helper()
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, 64)}
+	if err := h.Read(context.Background(), &fuse.ReadRequest{Size: 64}, resp); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return string(resp.Data)
+}
+
+func releaseHandle(t *testing.T, h *handle) {
+	t.Helper()
+	if err := h.Release(context.Background(), &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+}
+
+func TestShareReadHandles(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		// flags are the flags of the second open, after a read-only open. If write is set, "changed" is written through another handle before the second open.
+		flags fuse.OpenFlags
+		write bool
+		// opens is the number of backend files that should be opened, and want what the second handle should read.
+		opens int
+		want  string
+	}{
+		{name: "two readers", flags: fuse.OpenReadOnly, opens: 1, want: "content"},
+		{name: "reader and writer", flags: fuse.OpenReadWrite, opens: 2, want: "content"},
+		{name: "reader after a write", flags: fuse.OpenReadOnly, write: true, opens: 3, want: "changed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, backend := countingTestFS(t, Options{ShareReadHandles: true})
+			first := openHandle(t, r, "f", fuse.OpenReadOnly)
+			if tc.write {
+				w := openHandle(t, r, "f", fuse.OpenWriteOnly)
+				if err := w.Write(ctx, &fuse.WriteRequest{Data: []byte("changed")}, &fuse.WriteResponse{}); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				releaseHandle(t, w)
+			}
+			second := openHandle(t, r, "f", tc.flags)
+			if got := readHandle(t, second); got != tc.want {
+				t.Errorf("the second handle read %q; want %q", got, tc.want)
+			}
+			// Files opened on memfs see later writes, so the first handle only reads the old content if nothing was written.
+			if got := readHandle(t, first); !tc.write && got != "content" {
+				t.Errorf("the first handle read %q; want %q", got, "content")
+			}
+			if opens, _ := backend.counts(); opens != tc.opens {
+				t.Errorf("%d files were opened on the backend; want %d", opens, tc.opens)
+			}
+			releaseHandle(t, first)
+			if _, open := backend.counts(); open == 0 {
+				t.Errorf("the backend file of the second handle was closed when the first was released")
+			}
+			releaseHandle(t, second)
+			if _, open := backend.counts(); open != 0 {
+				t.Errorf("%d files are still open on the backend after releasing all handles", open)
+			}
+		})
+	}
+}
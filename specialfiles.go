@@ -0,0 +1,95 @@
+package billybazilfuse
+
+import (
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// specialMarker is the header of the files that stand in for emulated FIFOs and unix sockets. The type follows it.
+const specialMarker = "!<billy-bazilfuse special>\n"
+
+// specialTypes are the types of special files that can be emulated, by the name stored after specialMarker.
+var specialTypes = map[string]os.FileMode{
+	"fifo":   os.ModeNamedPipe,
+	"socket": os.ModeSocket,
+}
+
+// specialInfo presents a marker file as a FIFO or socket.
+type specialInfo struct {
+	os.FileInfo
+	typ os.FileMode
+}
+
+func (s specialInfo) Mode() os.FileMode {
+	return s.typ | s.FileInfo.Mode().Perm()
+}
+
+func (s specialInfo) Size() int64 {
+	return 0
+}
+
+// mightBeEmulatedSpecial returns whether fi has the right type and size to be an emulated FIFO or socket.
+func mightBeEmulatedSpecial(fi os.FileInfo) bool {
+	if !fi.Mode().IsRegular() {
+		return false
+	}
+	for name := range specialTypes {
+		if fi.Size() == int64(len(specialMarker)+len(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readEmulatedSpecial returns the type of the emulated FIFO or socket at p, or ok=false if p isn't one.
+func readEmulatedSpecial(underlying billy.Basic, p string, fi os.FileInfo) (os.FileMode, bool, error) {
+	if !mightBeEmulatedSpecial(fi) {
+		return 0, false, nil
+	}
+	name, ok, err := readMarkerFile(underlying, p, fi, specialMarker)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	typ, ok := specialTypes[name]
+	return typ, ok, nil
+}
+
+// withEmulatedSpecial returns fi, or a FileInfo presenting it as a FIFO or socket if p is an emulated one.
+func (r *FS) withEmulatedSpecial(p string, fi os.FileInfo) (os.FileInfo, error) {
+	if !r.emulateSpecial {
+		return fi, nil
+	}
+	typ, ok, err := readEmulatedSpecial(r.underlying, p, fi)
+	if err != nil || !ok {
+		return fi, err
+	}
+	return specialInfo{fi, typ}, nil
+}
+
+// withEmulatedTypes returns fi, presenting emulated symlinks, FIFOs and sockets as such.
+func (r *FS) withEmulatedTypes(p string, fi os.FileInfo) (os.FileInfo, error) {
+	fi, err := r.withEmulatedSymlink(p, fi)
+	if err != nil {
+		return nil, err
+	}
+	return r.withEmulatedSpecial(p, fi)
+}
+
+// mknodSpecial creates an emulated FIFO or socket at p with the permissions of mode.
+func (r *FS) mknodSpecial(p string, mode os.FileMode) error {
+	name := "fifo"
+	if mode&os.ModeSocket != 0 {
+		name = "socket"
+	}
+	fh, err := r.underlying.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write([]byte(specialMarker + name)); err != nil {
+		fh.Close()
+		r.underlying.Remove(p)
+		return err
+	}
+	return fh.Close()
+}
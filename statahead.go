@@ -0,0 +1,358 @@
+package billybazilfuse
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statAheadListings is the number of recent directory listings remembered for stat-ahead.
+const statAheadListings = 16
+
+// maxSiblingDirs is the number of directories that weren't listed whose stat'ed entries are counted for StatAhead.SiblingTrigger.
+const maxSiblingDirs = 1024
+
+// maxSiblingStats is the most entries stat'ed for StatAhead.SiblingTrigger. Larger directories only use the attributes from the listing, if any.
+const maxSiblingStats = 1000
+
+// StatAhead configures fetching the attributes of the entries of a directory in parallel when a process lists it and then stats the entries one by one, like ls -l does. That turns a round trip per entry into a few parallel batches.
+type StatAhead struct {
+	// Parallelism is the number of concurrent Stat calls. Zero disables stat-ahead.
+	Parallelism int
+	// Trigger is the number of entries of a listed directory that must be stat'ed before the others are fetched. It defaults to 2.
+	Trigger int
+	// MaxFailures stops fetching the entries of a directory after this many Stat calls failed, as the backend is probably struggling. Entries that failed are stat'ed again when asked for. It defaults to 10.
+	MaxFailures int
+	// TTL is how long after the listing fetched attributes are used. Each is used only once, and dropped when the entry is changed through the mount. It defaults to 5 seconds.
+	TTL time.Duration
+	// SiblingTrigger also fetches the attributes of the entries of directories that weren't listed, once this many of their entries were stat'ed within the TTL, like shells expanding wildcards and build tools checking many files do. The directory is listed in the background first.
+	// Zero disables this, as it lists directories nobody asked to list.
+	SiblingTrigger int
+}
+
+// statAhead remembers recent directory listings, and the attributes fetched for their entries.
+type statAhead struct {
+	StatAhead
+
+	mtx      sync.Mutex
+	listings map[string]*statAheadListing
+	attrs    map[string]statAheadAttr
+	// siblings counts the stat'ed entries of directories that weren't listed, for SiblingTrigger.
+	siblings map[string]*siblingCount
+
+	fetched atomic.Int64
+	hits    atomic.Int64
+}
+
+type statAheadListing struct {
+	dir     string
+	entries []os.FileInfo
+	// full is set if the entries have all attributes, rather than only the name and type (from a LightReadDir).
+	full    bool
+	expires time.Time
+	// stats is the number of entries stat'ed since the listing. started is set once the others are being fetched.
+	stats   int
+	started bool
+}
+
+type siblingCount struct {
+	n       int
+	expires time.Time
+}
+
+type statAheadAttr struct {
+	fi      os.FileInfo
+	expires time.Time
+}
+
+func newStatAhead(opts StatAhead) *statAhead {
+	if opts.Trigger <= 0 {
+		opts.Trigger = 2
+	}
+	if opts.MaxFailures <= 0 {
+		opts.MaxFailures = 10
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 5 * time.Second
+	}
+	return &statAhead{StatAhead: opts, listings: map[string]*statAheadListing{}, attrs: map[string]statAheadAttr{}, siblings: map[string]*siblingCount{}}
+}
+
+// listed remembers the listing of dir, as returned by the backend.
+func (sa *statAhead) listed(dir string, entries []os.FileInfo, full bool) {
+	if sa == nil {
+		return
+	}
+	now := time.Now()
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	if len(sa.listings) >= statAheadListings {
+		var oldest *statAheadListing
+		for _, l := range sa.listings {
+			if oldest == nil || l.expires.Before(oldest.expires) {
+				oldest = l
+			}
+		}
+		delete(sa.listings, oldest.dir)
+	}
+	// The caller modifies the entries.
+	sa.listings[dir] = &statAheadListing{dir: dir, entries: append([]os.FileInfo(nil), entries...), full: full, expires: now.Add(sa.TTL)}
+	for p, a := range sa.attrs {
+		if now.After(a.expires) {
+			delete(sa.attrs, p)
+		}
+	}
+}
+
+// get returns the fetched attributes of p, if any. They're only returned once.
+func (sa *statAhead) get(p string) (os.FileInfo, bool) {
+	if sa == nil {
+		return nil, false
+	}
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	a, ok := sa.attrs[p]
+	if !ok {
+		return nil, false
+	}
+	delete(sa.attrs, p)
+	if time.Now().After(a.expires) {
+		return nil, false
+	}
+	sa.hits.Add(1)
+	return a.fi, true
+}
+
+// stated is called when p was stat'ed on the backend. It returns the listing whose other entries should be fetched, if p's directory was listed recently and the Trigger was reached.
+// It returns true for list if the directory wasn't listed, but the SiblingTrigger was reached.
+func (sa *statAhead) stated(p string) (_ *statAheadListing, list bool) {
+	if sa == nil || p == "" {
+		return nil, false
+	}
+	dir := parentDir(p)
+	now := time.Now()
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	l, ok := sa.listings[dir]
+	if ok && now.After(l.expires) {
+		delete(sa.listings, dir)
+		ok = false
+	}
+	if !ok {
+		return nil, sa.countSibling(dir, now)
+	}
+	if l.started {
+		return nil, false
+	}
+	if l.stats++; l.stats < sa.Trigger {
+		return nil, false
+	}
+	l.started = true
+	return l, false
+}
+
+// countSibling counts a stat'ed entry of dir, which wasn't listed, and returns whether the SiblingTrigger was reached.
+func (sa *statAhead) countSibling(dir string, now time.Time) bool {
+	if sa.SiblingTrigger <= 0 {
+		return false
+	}
+	c, ok := sa.siblings[dir]
+	if !ok || now.After(c.expires) {
+		if len(sa.siblings) >= maxSiblingDirs {
+			for d, c := range sa.siblings {
+				if now.After(c.expires) {
+					delete(sa.siblings, d)
+				}
+			}
+			if len(sa.siblings) >= maxSiblingDirs {
+				return false
+			}
+		}
+		c = &siblingCount{expires: now.Add(sa.TTL)}
+		sa.siblings[dir] = c
+	}
+	if c.n++; c.n < sa.SiblingTrigger {
+		return false
+	}
+	delete(sa.siblings, dir)
+	return true
+}
+
+// start returns the listing of dir to fetch the entries of, unless that was already started.
+func (sa *statAhead) start(dir string) *statAheadListing {
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	l, ok := sa.listings[dir]
+	if !ok || l.started {
+		return nil
+	}
+	l.started = true
+	return l
+}
+
+// put stores the attributes of p fetched for listing l, unless l was dropped since.
+func (sa *statAhead) put(l *statAheadListing, p string, fi os.FileInfo) {
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	if sa.listings[l.dir] != l {
+		return
+	}
+	sa.attrs[p] = statAheadAttr{fi, l.expires}
+	sa.fetched.Add(1)
+}
+
+// current returns whether l is still the listing of its directory.
+func (sa *statAhead) current(l *statAheadListing) bool {
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	return sa.listings[l.dir] == l
+}
+
+// forget drops what's known about p, after it was changed through the mount.
+func (sa *statAhead) forget(p string) {
+	if sa == nil {
+		return
+	}
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	delete(sa.attrs, p)
+	delete(sa.listings, parentDir(p))
+}
+
+// forgetDir drops the listing of dir and the attributes of its entries, after entries in it were added, removed or renamed.
+func (sa *statAhead) forgetDir(dir string) {
+	if sa == nil {
+		return
+	}
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	delete(sa.listings, dir)
+	for p := range sa.attrs {
+		if parentDir(p) == dir {
+			delete(sa.attrs, p)
+		}
+	}
+}
+
+// forgetTree drops everything known about p and below it, after it was renamed.
+func (sa *statAhead) forgetTree(p string) {
+	if sa == nil {
+		return
+	}
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+	for dir := range sa.listings {
+		if pathHasPrefix(dir, p) {
+			delete(sa.listings, dir)
+		}
+	}
+	for q := range sa.attrs {
+		if pathHasPrefix(q, p) {
+			delete(sa.attrs, q)
+		}
+	}
+}
+
+// statEntry calls Stat on the backend for the entry at p, and fetches the other entries of its directory if a process seems to be stat'ing them all.
+func (r *FS) statEntry(p string) (os.FileInfo, error) {
+	if fi, ok := r.openAttrs.get(p); ok {
+		return fi, nil
+	}
+	if fi, ok := r.statAhead.get(p); ok {
+		return fi, nil
+	}
+	fi, err := r.underlying.Stat(p)
+	if err == nil {
+		if l, list := r.statAhead.stated(p); l != nil {
+			go r.fetchAttrs(l, p, 0)
+		} else if list {
+			go r.fetchSiblings(parentDir(p))
+		}
+	}
+	return fi, err
+}
+
+// fetchSiblings lists dir, and fetches the attributes of its entries for statEntry.
+func (r *FS) fetchSiblings(dir string) {
+	done, err := r.background(context.Background())
+	if err != nil {
+		return
+	}
+	_, err = r.readDirForListing(dir)
+	done()
+	if err != nil {
+		return
+	}
+	if l := r.statAhead.start(dir); l != nil {
+		r.fetchAttrs(l, "", maxSiblingStats)
+	}
+}
+
+// fetchAttrs fetches the attributes of the entries of l (except skip) for statEntry. Listings with all attributes are used as is, except for symlinks, which Stat follows; other entries are stat'ed with up to Parallelism calls at once, as background work.
+// If there are more than maxStats (unless zero) entries to stat, none are.
+func (r *FS) fetchAttrs(l *statAheadListing, skip string, maxStats int) {
+	sa := r.statAhead
+	var stat []string
+	for _, e := range l.entries {
+		p := path.Join(l.dir, e.Name())
+		if p == skip {
+			continue
+		}
+		if l.full && e.Mode()&os.ModeSymlink == 0 {
+			sa.put(l, p, e)
+		} else {
+			stat = append(stat, p)
+		}
+	}
+	if maxStats > 0 && len(stat) > maxStats {
+		return
+	}
+	todo := make(chan string)
+	var failures atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < sa.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range todo {
+				if failures.Load() >= int64(sa.MaxFailures) || !sa.current(l) {
+					continue
+				}
+				done, err := r.background(context.Background())
+				if err != nil {
+					continue
+				}
+				fi, err := r.underlying.Stat(p)
+				done()
+				if err != nil {
+					failures.Add(1)
+					continue
+				}
+				sa.put(l, p, fi)
+			}
+		}()
+	}
+	for _, p := range stat {
+		todo <- p
+	}
+	close(todo)
+	wg.Wait()
+}
+
+// parentDir returns the directory containing the backend path p.
+func parentDir(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// pathHasPrefix returns whether p is dir or below it.
+func pathHasPrefix(p, dir string) bool {
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
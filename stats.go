@@ -0,0 +1,242 @@
+package billybazilfuse
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// slowCallThreshold is how long a call from the kernel takes before it's reported as slow by Stats.
+const slowCallThreshold = time.Second
+
+// slowCallHistory is how many finished slow calls are remembered.
+const slowCallHistory = 20
+
+// Stats is a snapshot of what the filesystem is doing, for troubleshooting.
+type Stats struct {
+	// InFlight is the number of calls from the kernel in progress, by type (like "Read" or "Lookup").
+	InFlight map[string]int
+	// OpenHandles is the number of open files.
+	OpenHandles int
+	// LongOpenHandles are the files open for longer than Options.LongOpenHandle, oldest first.
+	LongOpenHandles []OpenHandle
+	// Cache are the counters of the BlockCache, if it's a TieredCache.
+	Cache *CacheStats
+	// SlowCalls are the calls in progress for longer than a second, and the most recent finished calls that took longer than that, slowest first.
+	SlowCalls []SlowCall
+	// HotPathsByOps and HotPathsByBytes are the leaderboards of Options.HotPaths, busiest first.
+	HotPathsByOps   []HotPath
+	HotPathsByBytes []HotPath
+	// Ops are the numbers of finished calls by type and the time they took, since the filesystem was created. Comparing two snapshots gives the rate and latency of each type of call.
+	Ops map[string]OpStats
+	// FiringAlerts are the ErrorAlerts whose threshold is exceeded.
+	FiringAlerts []ErrorAlert
+	// Backend is the result of the last health probe, if Options.HealthCheckInterval is set.
+	Backend *BackendHealth
+	// Reconnects is the number of times a backend implementing Reconnector reconnected.
+	Reconnects int64
+	// StatAheadFetched is the number of attributes fetched by Options.StatAhead, and StatAheadHits the number of those that were used.
+	StatAheadFetched int64
+	StatAheadHits    int64
+	// UnknownErrors count the errors that weren't recognized and were returned as the FallbackErrno, by type, most frequent first.
+	UnknownErrors []UnknownError
+}
+
+// OpStats counts the finished calls of one type.
+type OpStats struct {
+	Calls int64
+	Time  time.Duration
+}
+
+// SlowCall is a call from the kernel that took longer than a second.
+type SlowCall struct {
+	Op string
+	// Pid is the process that made the call, or 0 if unknown.
+	Pid      uint32
+	Started  time.Time
+	Duration time.Duration
+	// InFlight is set if the call is still in progress, in which case Duration is how long it has taken so far.
+	InFlight bool
+}
+
+type call struct {
+	op    string
+	pid   uint32
+	start time.Time
+}
+
+// callTracker keeps the calls in progress, the recent slow ones and counters of the finished ones.
+type callTracker struct {
+	mtx      sync.Mutex
+	inFlight map[*call]struct{}
+	slow     []SlowCall // most recent last
+	ops      map[string]OpStats
+}
+
+func newCallTracker() *callTracker {
+	return &callTracker{inFlight: map[*call]struct{}{}, ops: map[string]OpStats{}}
+}
+
+func (t *callTracker) start(op string, pid uint32) *call {
+	c := &call{op, pid, time.Now()}
+	t.mtx.Lock()
+	t.inFlight[c] = struct{}{}
+	t.mtx.Unlock()
+	return c
+}
+
+func (t *callTracker) finish(c *call) {
+	d := time.Since(c.start)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.inFlight, c)
+	os := t.ops[c.op]
+	os.Calls++
+	os.Time += d
+	t.ops[c.op] = os
+	if d < slowCallThreshold {
+		return
+	}
+	if len(t.slow) == slowCallHistory {
+		t.slow = append(t.slow[:0], t.slow[1:]...)
+	}
+	t.slow = append(t.slow, SlowCall{Op: c.op, Pid: c.pid, Started: c.start, Duration: d})
+}
+
+// opName returns the name of the type of a request, like "Read" for a *fuse.ReadRequest.
+func opName(req fuse.Request) string {
+	return strings.TrimSuffix(reflect.TypeOf(req).Elem().Name(), "Request")
+}
+
+// Stats returns a snapshot of the calls in progress, open files, cache counters, slow calls, hot paths and call counters.
+func (r *FS) Stats() Stats {
+	st := Stats{InFlight: map[string]int{}, Ops: map[string]OpStats{}}
+	now := time.Now()
+	r.calls.mtx.Lock()
+	for op, os := range r.calls.ops {
+		st.Ops[op] = os
+	}
+	for c := range r.calls.inFlight {
+		st.InFlight[c.op]++
+		if d := now.Sub(c.start); d >= slowCallThreshold {
+			st.SlowCalls = append(st.SlowCalls, SlowCall{Op: c.op, Pid: c.pid, Started: c.start, Duration: d, InFlight: true})
+		}
+	}
+	st.SlowCalls = append(st.SlowCalls, r.calls.slow...)
+	r.calls.mtx.Unlock()
+	sort.Slice(st.SlowCalls, func(i, j int) bool {
+		return st.SlowCalls[i].Duration > st.SlowCalls[j].Duration
+	})
+
+	r.handlesMtx.Lock()
+	st.OpenHandles = len(r.handles)
+	r.handlesMtx.Unlock()
+	st.LongOpenHandles = r.longOpenHandles()
+
+	if tc, ok := r.cache.(*TieredCache); ok {
+		cs := tc.Stats()
+		st.Cache = &cs
+	}
+	if r.hot != nil {
+		st.HotPathsByOps, st.HotPathsByBytes = r.hot.top()
+	}
+	st.FiringAlerts = r.alerts.firing()
+	if bh, ok := r.BackendHealth(); ok {
+		st.Backend = &bh
+	}
+	if rfs, ok := r.underlying.(*reconnectingFS); ok {
+		st.Reconnects = rfs.reconnects.Load()
+	}
+	st.UnknownErrors = r.unknownErrors.snapshot()
+	if r.statAhead != nil {
+		st.StatAheadFetched = r.statAhead.fetched.Load()
+		st.StatAheadHits = r.statAhead.hits.Load()
+	}
+	return st
+}
+
+// DumpStats writes the Stats to logf (like log.Printf), one line per topic.
+func (r *FS) DumpStats(logf func(format string, args ...interface{})) {
+	st := r.Stats()
+	ops := make([]string, 0, len(st.InFlight))
+	for op, n := range st.InFlight {
+		ops = append(ops, fmt.Sprintf("%s=%d", op, n))
+	}
+	sort.Strings(ops)
+	if len(ops) == 0 {
+		ops = []string{"none"}
+	}
+	logf("Calls in flight: %s", strings.Join(ops, " "))
+	logf("Open handles: %d", st.OpenHandles)
+	for _, oh := range st.LongOpenHandles {
+		logf("Long open handle: /%s opened by pid %d at %s with %v", oh.Path, oh.Pid, oh.Opened.Format(time.RFC3339), oh.Flags)
+	}
+	if cs := st.Cache; cs != nil {
+		hits := cs.MemoryHits + cs.DiskHits
+		rate := 0.0
+		if hits+cs.Misses > 0 {
+			rate = 100 * float64(hits) / float64(hits+cs.Misses)
+		}
+		logf("Cache: %.1f%% hits (memory %d, disk %d), %d misses, %d bypassed, %d bytes in memory, %d bytes on disk", rate, cs.MemoryHits, cs.DiskHits, cs.Misses, cs.Bypassed, cs.MemoryUsage, cs.DiskUsage)
+	}
+	for _, c := range st.SlowCalls {
+		state := "took"
+		if c.InFlight {
+			state = "running for"
+		}
+		logf("Slow call: %s by pid %d started at %s, %s %v", c.Op, c.Pid, c.Started.Format(time.RFC3339), state, c.Duration.Round(time.Millisecond))
+	}
+	for _, hp := range st.HotPathsByOps {
+		logf("Hot path: %d ops on /%s", hp.Count, hp.Path)
+	}
+	for _, hp := range st.HotPathsByBytes {
+		logf("Hot path: %d bytes on /%s", hp.Count, hp.Path)
+	}
+	for _, a := range st.FiringAlerts {
+		logf("Firing alert: %s", a)
+	}
+	if st.Reconnects > 0 {
+		logf("Reconnects: %d", st.Reconnects)
+	}
+	for _, ue := range st.UnknownErrors {
+		logf("Unrecognized error: %d times %s, last from %s: %s", ue.Count, ue.Type, ue.Op, ue.Message)
+	}
+	if st.StatAheadFetched > 0 {
+		logf("Stat-ahead: %d attributes fetched, %d used", st.StatAheadFetched, st.StatAheadHits)
+	}
+	if bh := st.Backend; bh != nil && !bh.Checked.IsZero() {
+		if bh.Up {
+			logf("Backend: up since %s, last check took %v", bh.Since.Format(time.RFC3339), bh.Latency.Round(time.Millisecond))
+		} else {
+			logf("Backend: down since %s: %s", bh.Since.Format(time.RFC3339), bh.Error)
+		}
+	}
+}
+
+// DumpStatsOnSignal calls DumpStats every time the process receives sig (like syscall.SIGUSR1), until the returned function is called.
+func (r *FS) DumpStatsOnSignal(sig os.Signal, logf func(format string, args ...interface{})) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, sig)
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				r.DumpStats(logf)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(quit)
+	}
+}
@@ -0,0 +1,63 @@
+package billybazilfuse
+
+import (
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// MissingFeaturesError is returned by NewStrict (and NewWithOptions with RequireDir) if the backend lacks features the mount would need.
+type MissingFeaturesError struct {
+	// Missing lists the missing features, like "billy.Dir" or "write capability".
+	Missing []string
+}
+
+func (e *MissingFeaturesError) Error() string {
+	return "billy-bazilfuse: backend lacks required features: " + strings.Join(e.Missing, ", ")
+}
+
+var requiredCapabilities = []struct {
+	c    billy.Capability
+	name string
+	// write is set for the capabilities read-only mounts don't need.
+	write bool
+}{
+	{billy.ReadCapability, "read capability", false},
+	{billy.WriteCapability, "write capability", true},
+	{billy.ReadAndWriteCapability, "read and write capability", true},
+	{billy.TruncateCapability, "truncate capability", true},
+}
+
+// CheckBackend returns a *MissingFeaturesError if underlying lacks any of the features needed to serve every call from FUSE with opts, and nil otherwise.
+// Symlinks aren't required if they're emulated or disabled, and writing isn't for read-only mounts (including backends that report they can't write).
+func CheckBackend(underlying billy.Basic, opts Options) error {
+	var missing []string
+	if _, ok := underlying.(billy.Dir); !ok {
+		missing = append(missing, "billy.Dir")
+	}
+	if _, ok := underlying.(billy.Symlink); !ok && !opts.EmulateSymlinks && !opts.DisableSymlinks {
+		missing = append(missing, "billy.Symlink")
+	}
+	if _, ok := underlying.(billy.Change); !ok {
+		missing = append(missing, "billy.Change")
+	}
+	caps := billy.Capabilities(underlying)
+	readOnly := opts.ReadOnly || lacksWrite(underlying)
+	for _, rc := range requiredCapabilities {
+		if caps&rc.c == 0 && !(rc.write && readOnly) {
+			missing = append(missing, rc.name)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingFeaturesError{missing}
+	}
+	return nil
+}
+
+// NewStrict is like NewWithOptions, but refuses backends that CheckBackend finds lacking, rather than failing the affected calls with ENOSYS at runtime.
+func NewStrict(underlying billy.Basic, opts Options) (*FS, error) {
+	if err := CheckBackend(underlying, opts); err != nil {
+		return nil, err
+	}
+	return NewWithOptions(underlying, opts)
+}
@@ -0,0 +1,189 @@
+package billybazilfuse
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+	"github.com/go-git/go-billy/v5"
+)
+
+// maxSymlinks is how many symlinks are followed while resolving a path before giving up with ELOOP, like Linux's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// symlinkMarker is the header of the files that contain emulated symlinks. The target follows it.
+const symlinkMarker = "!<billy-bazilfuse symlink>\n"
+
+// maxSymlinkTarget is the maximum length of a symlink target, like Linux's PATH_MAX.
+const maxSymlinkTarget = 4096
+
+// symlinkInfo presents a file containing an emulated symlink as a symlink.
+type symlinkInfo struct {
+	os.FileInfo
+	target string
+}
+
+func (s symlinkInfo) Mode() os.FileMode {
+	return os.ModeSymlink | 0777
+}
+
+func (s symlinkInfo) Size() int64 {
+	return int64(len(s.target))
+}
+
+// mightBeEmulatedSymlink returns whether fi has the right type and size to be an emulated symlink.
+func mightBeEmulatedSymlink(fi os.FileInfo) bool {
+	return fi.Mode().IsRegular() && fi.Size() > int64(len(symlinkMarker)) && fi.Size() <= int64(len(symlinkMarker)+maxSymlinkTarget)
+}
+
+// readEmulatedSymlink returns the target of the emulated symlink at p, or ok=false if p isn't one.
+func readEmulatedSymlink(underlying billy.Basic, p string, fi os.FileInfo) (target string, ok bool, err error) {
+	if !mightBeEmulatedSymlink(fi) {
+		return "", false, nil
+	}
+	return readMarkerFile(underlying, p, fi, symlinkMarker)
+}
+
+// readMarkerFile returns what follows marker in the file at p, or ok=false if p doesn't start with marker.
+func readMarkerFile(underlying billy.Basic, p string, fi os.FileInfo, marker string) (string, bool, error) {
+	fh, err := underlying.Open(p)
+	if err != nil {
+		return "", false, err
+	}
+	defer fh.Close()
+	buf := make([]byte, fi.Size())
+	n, err := io.ReadFull(fh, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", false, err
+	}
+	buf = buf[:n]
+	if !strings.HasPrefix(string(buf), marker) {
+		return "", false, nil
+	}
+	return string(buf[len(marker):]), true, nil
+}
+
+// withEmulatedSymlink returns fi, or a FileInfo presenting it as a symlink if p is an emulated symlink.
+func (r *FS) withEmulatedSymlink(p string, fi os.FileInfo) (os.FileInfo, error) {
+	if !r.emulateSymlinks {
+		return fi, nil
+	}
+	target, ok, err := readEmulatedSymlink(r.underlying, p, fi)
+	if err != nil || !ok {
+		return fi, err
+	}
+	return symlinkInfo{fi, target}, nil
+}
+
+// supportsSymlinks returns whether the backend supports symlinks, natively or through emulation.
+func (r *FS) supportsSymlinks() bool {
+	if r.emulateSymlinks {
+		return true
+	}
+	_, ok := r.underlying.(billy.Symlink)
+	return ok
+}
+
+// lstat returns information about p without following it if it's a (possibly emulated) symlink.
+func (r *FS) lstat(p string) (os.FileInfo, error) {
+	if sfs, ok := r.underlying.(billy.Symlink); ok {
+		return sfs.Lstat(p)
+	}
+	fi, err := r.underlying.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return r.withEmulatedSymlink(p, fi)
+}
+
+// symlink creates a (possibly emulated) symlink.
+func (r *FS) symlink(target, p string) error {
+	if !r.emulateSymlinks {
+		return adapter.Symlink(r.underlying, target, p)
+	}
+	if len(target) == 0 || len(target) > maxSymlinkTarget {
+		return syscall.ENAMETOOLONG
+	}
+	fh, err := r.underlying.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write([]byte(symlinkMarker + target)); err != nil {
+		fh.Close()
+		r.underlying.Remove(p)
+		return err
+	}
+	return fh.Close()
+}
+
+// readlink returns the target of a (possibly emulated) symlink.
+func (r *FS) readlink(p string) (string, error) {
+	if !r.emulateSymlinks {
+		return adapter.Readlink(r.underlying, p)
+	}
+	fi, err := r.underlying.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	target, ok, err := readEmulatedSymlink(r.underlying, p, fi)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", syscall.EINVAL
+	}
+	return target, nil
+}
+
+// resolvePath resolves all symlinks in rel relative to dir, which must already be resolved.
+// Absolute symlink targets are relative to the root of the backend, and .. never goes above the root.
+// If a path component doesn't exist, the remainder is returned unresolved.
+func (r *FS) resolvePath(dir, rel string) (string, error) {
+	if !r.supportsSymlinks() {
+		return path.Join(dir, rel), nil
+	}
+	hops := 0
+	resolved := dir
+	remaining := strings.Split(rel, "/")
+	for len(remaining) > 0 {
+		c := remaining[0]
+		remaining = remaining[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = path.Dir(resolved); resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+		next := path.Join(resolved, c)
+		fi, err := r.lstat(next)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return path.Join(append([]string{next}, remaining...)...), nil
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinks {
+			return "", syscall.ELOOP
+		}
+		target, err := r.readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,160 @@
+package billybazilfuse
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CacheConfig configures a TieredCache.
+type CacheConfig struct {
+	// MemoryBudget is the number of bytes cached in memory. Zero disables the memory tier.
+	MemoryBudget int64
+	// DiskDir is the directory blocks are cached in on disk. Empty disables the disk tier.
+	DiskDir string
+	// DiskBudget is the number of bytes cached on disk.
+	DiskBudget int64
+	// TTL is how long cached blocks are used. Zero means forever, or until the file is changed.
+	TTL time.Duration
+	// Bypass is a list of path.Match patterns for backend paths that are never cached, like "tmp/*" or "*.log".
+	// Patterns without a slash are matched against the base name.
+	Bypass []string
+}
+
+// CacheStats are counters of a TieredCache.
+type CacheStats struct {
+	MemoryHits int64
+	DiskHits   int64
+	Misses     int64
+	Bypassed   int64
+	Puts       int64
+	// MemoryUsage and DiskUsage are the number of bytes currently cached in each tier.
+	MemoryUsage int64
+	DiskUsage   int64
+}
+
+// TieredCache is a BlockCache that combines a memory tier in front of a disk tier.
+// Blocks found on disk are promoted to memory, and new blocks are stored in both.
+type TieredCache struct {
+	memory *MemoryCache
+	disk   *DiskCache
+	bypass atomic.Pointer[[]string]
+
+	memoryHits atomic.Int64
+	diskHits   atomic.Int64
+	misses     atomic.Int64
+	bypassed   atomic.Int64
+	puts       atomic.Int64
+}
+
+var _ BlockCache = &TieredCache{}
+
+// NewTieredCache creates a TieredCache as configured.
+func NewTieredCache(cfg CacheConfig) (*TieredCache, error) {
+	c := &TieredCache{}
+	if cfg.MemoryBudget > 0 {
+		c.memory = NewMemoryCache(cfg.MemoryBudget)
+	}
+	if cfg.DiskDir != "" {
+		d, err := NewDiskCache(cfg.DiskDir, cfg.DiskBudget)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = d
+	}
+	if err := c.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload applies the TTL and Bypass of cfg to the cache, which can be done while it's in use. The budgets and DiskDir can't be changed.
+func (c *TieredCache) Reload(cfg CacheConfig) error {
+	if err := validatePatterns(cfg.Bypass); err != nil {
+		return err
+	}
+	c.bypass.Store(&cfg.Bypass)
+	if c.memory != nil {
+		c.memory.ttl.Store(int64(cfg.TTL))
+	}
+	if c.disk != nil {
+		c.disk.ttl.Store(int64(cfg.TTL))
+	}
+	return nil
+}
+
+func (c *TieredCache) Get(key BlockKey) ([]byte, bool) {
+	if matchAny(*c.bypass.Load(), key.Path) {
+		c.bypassed.Add(1)
+		return nil, false
+	}
+	if c.memory != nil {
+		if data, ok := c.memory.Get(key); ok {
+			c.memoryHits.Add(1)
+			return data, true
+		}
+	}
+	if c.disk != nil {
+		if data, ok := c.disk.Get(key); ok {
+			c.diskHits.Add(1)
+			if c.memory != nil {
+				c.memory.Put(key, data)
+			}
+			return data, true
+		}
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+func (c *TieredCache) Put(key BlockKey, data []byte) {
+	if matchAny(*c.bypass.Load(), key.Path) {
+		return
+	}
+	c.puts.Add(1)
+	if c.memory != nil {
+		c.memory.Put(key, data)
+	}
+	if c.disk != nil {
+		c.disk.Put(key, data)
+	}
+}
+
+func (c *TieredCache) Invalidate(path string) {
+	if c.memory != nil {
+		c.memory.Invalidate(path)
+	}
+	if c.disk != nil {
+		c.disk.Invalidate(path)
+	}
+}
+
+func (c *TieredCache) usage() int64 {
+	if c.memory == nil {
+		return 0
+	}
+	return c.memory.usage()
+}
+
+func (c *TieredCache) shed(n int64) {
+	if c.memory != nil {
+		c.memory.shed(n)
+	}
+}
+
+// Stats returns the counters of the cache.
+func (c *TieredCache) Stats() CacheStats {
+	s := CacheStats{
+		MemoryHits: c.memoryHits.Load(),
+		DiskHits:   c.diskHits.Load(),
+		Misses:     c.misses.Load(),
+		Bypassed:   c.bypassed.Load(),
+		Puts:       c.puts.Load(),
+	}
+	if c.memory != nil {
+		s.MemoryUsage = c.memory.usage()
+	}
+	if c.disk != nil {
+		s.DiskUsage = c.disk.usage()
+	}
+	return s
+}
@@ -0,0 +1,31 @@
+package billybazilfuse
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// errTimedOut is the error of calls that exceed Options.OpTimeout, unless Options.TimeoutEIO is set.
+var errTimedOut = fuse.Errno(syscall.ETIMEDOUT)
+
+// withTimeout returns ctx with the deadline of Options.OpTimeout. The returned function must be called when the call is done.
+func (r *FS) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.opTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, r.opTimeout, r.timeoutErr)
+}
+
+// ctxErr returns the error for a call whose ctx is done: EINTR if the kernel interrupted it, or the error of Options.OpTimeout if its deadline passed.
+func ctxErr(ctx context.Context) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fuse.EINTR
+	}
+	if en, ok := context.Cause(ctx).(fuse.Errno); ok {
+		return en
+	}
+	return errTimedOut
+}
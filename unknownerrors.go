@@ -0,0 +1,92 @@
+package billybazilfuse
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxUnknownErrorTypes is the number of types of unrecognized errors counted separately. Others are counted together.
+const maxUnknownErrorTypes = 100
+
+// UnknownError counts the errors of one type that weren't recognized, and were returned to the kernel as the FallbackErrno for lack of a better one.
+type UnknownError struct {
+	// Type is the Go type of the error, followed by the types of the errors it wraps, like "*fs.PathError > *errors.errorString".
+	Type  string
+	Count int64
+	// Op and Message are the type of call and the message of the most recent one.
+	Op      string
+	Message string
+}
+
+// unknownErrors counts the unrecognized errors by type, so missing errno mappings can be found.
+type unknownErrors struct {
+	callback func(op string, err error, count int64)
+
+	mtx   sync.Mutex
+	types map[string]*UnknownError
+}
+
+func newUnknownErrors(callback func(op string, err error, count int64)) *unknownErrors {
+	return &unknownErrors{callback: callback, types: map[string]*UnknownError{}}
+}
+
+// record counts err, which a call of type op failed with. The callback is called for the 1st, 10th, 100th and so on error of each type.
+func (u *unknownErrors) record(op string, err error) {
+	t := errorType(err)
+	u.mtx.Lock()
+	ue, ok := u.types[t]
+	if !ok {
+		if len(u.types) >= maxUnknownErrorTypes {
+			t = "other"
+			ue, ok = u.types[t]
+		}
+		if !ok {
+			ue = &UnknownError{Type: t}
+			u.types[t] = ue
+		}
+	}
+	ue.Count++
+	ue.Op = op
+	ue.Message = err.Error()
+	count := ue.Count
+	u.mtx.Unlock()
+	if u.callback != nil && isPowerOfTen(count) {
+		u.callback(op, err, count)
+	}
+}
+
+// snapshot returns the counters, most frequent first.
+func (u *unknownErrors) snapshot() []UnknownError {
+	u.mtx.Lock()
+	ret := make([]UnknownError, 0, len(u.types))
+	for _, ue := range u.types {
+		ret = append(ret, *ue)
+	}
+	u.mtx.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Type < ret[j].Type
+	})
+	return ret
+}
+
+// errorType returns the types of err and the errors it wraps.
+func errorType(err error) string {
+	var types []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		types = append(types, fmt.Sprintf("%T", err))
+	}
+	return strings.Join(types, " > ")
+}
+
+func isPowerOfTen(n int64) bool {
+	for n >= 10 && n%10 == 0 {
+		n /= 10
+	}
+	return n == 1
+}
@@ -0,0 +1,148 @@
+package billybazilfuse
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+)
+
+// Warm walks the backend paths matching any of the path.Match patterns (and everything below matching directories), so the first listing or build on a cold mount of a remote backend isn't slow.
+// This lists the directories and stats the matching paths, which warms the caches of backends that have them; the attributes aren't kept by the mount itself. If content is set, it also reads the contents of the files into the BlockCache, which must be configured.
+// Files that disappear during the walk are skipped. It can be called while the filesystem is being served.
+func (r *FS) Warm(ctx context.Context, patterns []string, content bool) error {
+	if err := validatePatterns(patterns); err != nil {
+		return err
+	}
+	if content && r.cache == nil {
+		return errors.New("billy-bazilfuse: warming content needs a BlockCache")
+	}
+	return r.warmDir(ctx, "", patterns, content)
+}
+
+// warmMatch returns whether p matches any pattern, and otherwise whether something below it might.
+func warmMatch(patterns []string, p string) (match, below bool) {
+	parts := strings.Split(p, "/")
+	for _, pat := range patterns {
+		patParts := strings.Split(pat, "/")
+		if len(patParts) > len(parts) {
+			if ok, _ := path.Match(strings.Join(patParts[:len(parts)], "/"), p); ok {
+				below = true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pat, strings.Join(parts[:len(patParts)], "/")); ok {
+			return true, true
+		}
+	}
+	return false, below
+}
+
+func (r *FS) warmDir(ctx context.Context, dir string, patterns []string, content bool) error {
+	done, err := r.background(ctx)
+	if err != nil {
+		return err
+	}
+	entries, err := adapter.ReadDir(r.underlying, dir)
+	done()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := path.Join(dir, e.Name())
+		match, below := warmMatch(patterns, p)
+		if !match && !below {
+			continue
+		}
+		if match {
+			done, err := r.background(ctx)
+			if err != nil {
+				return err
+			}
+			fi, err := r.underlying.Stat(p)
+			done()
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			if content && fi.Mode().IsRegular() {
+				if err := r.warmContent(ctx, p, fi); err != nil {
+					return err
+				}
+			}
+		}
+		if e.IsDir() {
+			if err := r.warmDir(ctx, p, patterns, content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warmContent reads the blocks of the file at p that aren't cached yet into the cache.
+func (r *FS) warmContent(ctx context.Context, p string, fi os.FileInfo) error {
+	return r.warmRange(ctx, p, fi, 0, 0)
+}
+
+// warmRange reads the blocks of the file at p covering off up to off+length (or up to the end of the file if length is zero) that aren't cached yet into the cache.
+func (r *FS) warmRange(ctx context.Context, p string, fi os.FileInfo, off, length int64) error {
+	key := BlockKey{Path: p, Size: fi.Size(), ModTime: fi.ModTime()}
+	end := fi.Size()
+	if length > 0 && off+length < end {
+		end = off + length
+	}
+	var fh *adapter.File
+	defer func() {
+		if fh != nil {
+			fh.Close()
+		}
+	}()
+	for key.Block = off / cacheBlockSize; key.Block*cacheBlockSize < end; key.Block++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := r.cache.Get(key); ok {
+			continue
+		}
+		if fh == nil {
+			f, err := r.underlying.Open(p)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			fh = adapter.NewFile(f)
+			if r.maxBackendRead > 0 {
+				fh.SetMaxRead(r.maxBackendRead)
+			}
+		}
+		done, err := r.background(ctx)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, cacheBlockSize)
+		n, err := fh.ReadAt(data, key.Block*cacheBlockSize)
+		done()
+		if err != nil {
+			return err
+		}
+		r.cache.Put(key, data[:n])
+		if n < cacheBlockSize {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package billybazilfuse
+
+import (
+	"context"
+	"path"
+)
+
+// Watcher can be implemented by backends that notice changes made to them outside of the mount, like other clients of a shared remote store.
+// When the backend implements it and the filesystem is served with FS.Serve, the kernel's caches are invalidated for every change.
+type Watcher interface {
+	// Watch returns a channel of changes. The channel must be closed after ctx is cancelled.
+	Watch(ctx context.Context) (<-chan ChangeEvent, error)
+}
+
+// ChangeEvent reports that the file or directory at Path was created, modified or removed.
+// A rename is reported as two events, for the old and the new path.
+type ChangeEvent struct {
+	// Path is the path on the backend, like the paths passed to the billy.Filesystem.
+	Path string
+}
+
+func (r *FS) consumeEvents(events <-chan ChangeEvent) {
+	for ev := range events {
+		r.externalChange(path.Clean(ev.Path))
+	}
+}
+
+// externalChange drops everything cached about p, by us and by the kernel.
+func (r *FS) externalChange(p string) {
+	if p == "." || p == "/" {
+		p = ""
+	}
+	r.contentChanged(p)
+	r.invalidateNode(p)
+	if p == "" {
+		return
+	}
+	dir := path.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+	r.dirChanged(dir)
+	r.invalidateNode(dir)
+	r.invalidateEntry(dir, path.Base(p))
+}
+
+// kernelName returns the name the kernel knows the backend name as.
+func (r *FS) kernelName(name string) string {
+	if r.names != nil {
+		name = r.names.normalization.normalize(name)
+	}
+	if r.nameEncoding != nil {
+		name = r.nameEncoding.Decode(name)
+	}
+	return name
+}
+
+// invalidateNode makes the kernel drop the cached attributes and data of the node at p, if it knows about it.
+func (r *FS) invalidateNode(p string) {
+	r.nodesMtx.Lock()
+	srv := r.server
+	r.nodesMtx.Unlock()
+	if srv == nil {
+		return
+	}
+	n, ok := r.lookupNode(p)
+	if !ok {
+		return
+	}
+	// ErrNotCached is expected for nodes the kernel doesn't cache anything for.
+	_ = srv.InvalidateNodeData(n)
+}
+
+// invalidateEntry makes the kernel drop its cached lookup of name in dir.
+func (r *FS) invalidateEntry(dir, name string) {
+	r.nodesMtx.Lock()
+	srv := r.server
+	r.nodesMtx.Unlock()
+	if srv == nil {
+		return
+	}
+	n, ok := r.lookupNode(dir)
+	if !ok {
+		return
+	}
+	_ = srv.InvalidateEntry(n, r.kernelName(name))
+}
@@ -0,0 +1,58 @@
+package billybazilfuse
+
+import (
+	"sync"
+
+	"github.com/Jille/billy-bazilfuse/internal/adapter"
+)
+
+// writeLocks shares a lock between the writable files open at the same path, for Options.SerializeWrites.
+type writeLocks struct {
+	mtx   sync.Mutex
+	paths map[string]*writeLock
+	files map[*adapter.File]*writeLock
+}
+
+type writeLock struct {
+	sync.Mutex
+	path string
+	refs int
+}
+
+func newWriteLocks() *writeLocks {
+	return &writeLocks{paths: map[string]*writeLock{}, files: map[*adapter.File]*writeLock{}}
+}
+
+// attach makes f, which was opened at p, use the lock of p. Every call must be followed by a call to detach once f is closed.
+func (w *writeLocks) attach(p string, f *adapter.File) {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	l, ok := w.paths[p]
+	if !ok {
+		l = &writeLock{path: p}
+		w.paths[p] = l
+	}
+	l.refs++
+	w.files[f] = l
+	w.mtx.Unlock()
+	f.SetPathLock(l)
+}
+
+// detach drops the reference of f to the lock of its path. It does nothing for files that weren't attached.
+func (w *writeLocks) detach(f *adapter.File) {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	l, ok := w.files[f]
+	if !ok {
+		return
+	}
+	delete(w.files, f)
+	if l.refs--; l.refs == 0 {
+		delete(w.paths, l.path)
+	}
+}
@@ -0,0 +1,154 @@
+package billybazilfuse
+
+import (
+	"context"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Billy has no interface for extended attributes, so nodes only have their own if the backend implements Xattrer (or is stored in a local directory).
+// Attributes in the security namespace follow Options.SecurityXattrs (and security.capability Options.CapabilityXattr), and POSIX ACLs are kept in Options.ACLStore if it's set.
+// With Options.HashXattrs, files have virtual attributes holding hashes of their content. They aren't listed, so tools copying extended attributes don't hash every file.
+// Setting user.billyfuse.fadvise passes a hint to FS.Advise.
+
+var _ fs.NodeGetxattrer = &node{}
+var _ fs.NodeListxattrer = &node{}
+var _ fs.NodeSetxattrer = &node{}
+var _ fs.NodeRemovexattrer = &node{}
+
+func (n *node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, req, resp, &err)
+	n.root.hot.add(n.path(), 0)
+	if n.root.disableXattrs {
+		return fuse.ENOSYS
+	}
+	if n.root.hashes != nil {
+		sum, ok, err := n.root.contentHash(n.path(), req.Name)
+		if err != nil {
+			return convertError(err)
+		}
+		if ok {
+			resp.Xattr = []byte(sum)
+			return nil
+		}
+	}
+	if n.root.aclStore != nil && isACLXattr(req.Name) {
+		v, err := n.root.storedACL(n.path(), req.Name)
+		if err != nil {
+			return convertError(err)
+		}
+		resp.Xattr = v
+		return nil
+	}
+	if n.root.xattrs == nil || n.root.hidesXattr(req.Name) {
+		return fuse.ErrNoXattr
+	}
+	v, err := n.root.xattrs.GetXattr(n.path(), req.Name)
+	if err != nil {
+		return convertError(err)
+	}
+	resp.Xattr = v
+	return nil
+}
+
+func (n *node) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	defer n.root.respondAfter(ctx, req, resp, &err)
+	if n.root.disableXattrs {
+		return fuse.ENOSYS
+	}
+	if n.root.aclStore != nil {
+		resp.Append(n.root.storedACLNames(n.path())...)
+	}
+	if n.root.xattrs == nil {
+		return nil
+	}
+	names, err := n.root.xattrs.ListXattrs(n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	for _, name := range names {
+		if !n.root.hidesXattr(name) && (n.root.aclStore == nil || !isACLXattr(name)) {
+			resp.Append(name)
+		}
+	}
+	return nil
+}
+
+func (n *node) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	if n.root.disableXattrs {
+		return fuse.ENOSYS
+	}
+	if n.root.denyXattrWrites && req.Name != adviseXattr {
+		return fuse.EPERM
+	}
+	if req.Name == adviseXattr {
+		advice, off, length, err := parseAdvice(req.Xattr)
+		if err != nil {
+			return err
+		}
+		return convertError(n.root.Advise(n.path(), off, length, advice))
+	}
+	if n.root.aclStore != nil && isACLXattr(req.Name) {
+		return convertError(n.root.setStoredACL(n.path(), req.Name, req.Xattr))
+	}
+	if p, ok := n.root.securityPolicy(req.Name); ok {
+		switch p {
+		case SecurityXattrsStub:
+			return nil
+		case SecurityXattrsDeny:
+			return fuse.EPERM
+		}
+	}
+	if n.root.xattrs == nil {
+		return fuse.ENOTSUP
+	}
+	return convertError(n.root.xattrs.SetXattr(n.path(), req.Name, req.Xattr, req.Flags))
+}
+
+func (n *node) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	ctx, done, err := n.root.begin(ctx, req, n.path())
+	if err != nil {
+		return convertError(err)
+	}
+	defer func() { done(err) }()
+	if n.root.disableXattrs {
+		return fuse.ENOSYS
+	}
+	if n.root.denyXattrWrites {
+		return fuse.EPERM
+	}
+	if n.root.aclStore != nil && isACLXattr(req.Name) {
+		if _, err := n.root.storedACL(n.path(), req.Name); err != nil {
+			return convertError(err)
+		}
+		return convertError(n.root.setStoredACL(n.path(), req.Name, nil))
+	}
+	if p, ok := n.root.securityPolicy(req.Name); ok {
+		switch p {
+		case SecurityXattrsStub:
+			return nil
+		case SecurityXattrsDeny:
+			return fuse.EPERM
+		}
+	}
+	if n.root.xattrs == nil {
+		return fuse.ErrNoXattr
+	}
+	return convertError(n.root.xattrs.RemoveXattr(n.path(), req.Name))
+}
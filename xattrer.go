@@ -0,0 +1,133 @@
+package billybazilfuse
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Xattrer can be implemented by backends that store extended attributes. Names include their namespace, like "user.comment".
+// Missing attributes are reported with fuse.ErrNoXattr, and attributes the backend can't store with ENOTSUP.
+// On Linux, backends created with osfs.New or implementing LocalDirectory store them on the local files without implementing Xattrer.
+type Xattrer interface {
+	GetXattr(path, name string) ([]byte, error)
+	ListXattrs(path string) ([]string, error)
+	// SetXattr sets an attribute. flags holds XATTR_CREATE or XATTR_REPLACE, as passed to setxattr(2).
+	SetXattr(path, name string, value []byte, flags uint32) error
+	RemoveXattr(path, name string) error
+}
+
+// xattrerFor returns the Xattrer storing the extended attributes of underlying, or nil if it can't store them.
+func xattrerFor(underlying billy.Basic) Xattrer {
+	if x, ok := underlying.(Xattrer); ok {
+		return x
+	}
+	if dir := localDirectory(underlying); dir != "" {
+		return newLocalXattrs(dir)
+	}
+	return nil
+}
+
+// SecurityXattrPolicy picks how extended attributes in the security namespace, like SELinux labels and file capabilities, are handled.
+type SecurityXattrPolicy int
+
+const (
+	// SecurityXattrsPassthrough stores them on the backend like other attributes, if it implements Xattrer. Otherwise setting them fails with ENOTSUP.
+	SecurityXattrsPassthrough SecurityXattrPolicy = iota
+	// SecurityXattrsStub pretends setting and removing them succeeds without storing them, and reports that files have none, so extracting archives with tar or rpm doesn't abort.
+	SecurityXattrsStub
+	// SecurityXattrsDeny refuses to set or remove them with EPERM, and reports that files have none.
+	SecurityXattrsDeny
+)
+
+// String returns the name of p, like "passthrough".
+func (p SecurityXattrPolicy) String() string {
+	switch p {
+	case SecurityXattrsPassthrough:
+		return "passthrough"
+	case SecurityXattrsStub:
+		return "stub"
+	case SecurityXattrsDeny:
+		return "deny"
+	}
+	return fmt.Sprintf("SecurityXattrPolicy(%d)", int(p))
+}
+
+// UnmarshalText parses the name of a SecurityXattrPolicy, as returned by String.
+func (p *SecurityXattrPolicy) UnmarshalText(b []byte) error {
+	for _, v := range []SecurityXattrPolicy{SecurityXattrsPassthrough, SecurityXattrsStub, SecurityXattrsDeny} {
+		if string(b) == v.String() {
+			*p = v
+			return nil
+		}
+	}
+	return fmt.Errorf("billy-bazilfuse: unknown security xattr policy %q", b)
+}
+
+// capabilityXattr holds the file capabilities set by setcap(8).
+const capabilityXattr = "security.capability"
+
+// CapabilityXattrPolicy picks how security.capability, which holds the file capabilities set by setcap(8), is handled. Package installs set it on some binaries, and fail if that fails.
+type CapabilityXattrPolicy int
+
+const (
+	// CapabilitiesLikeSecurityXattrs handles it like the other attributes in the security namespace, following Options.SecurityXattrs.
+	CapabilitiesLikeSecurityXattrs CapabilityXattrPolicy = iota
+	// CapabilitiesPassthrough stores it on the backend, if it implements Xattrer. Otherwise setting it fails with ENOTSUP. The kernel only honors file capabilities on mounts with Options.AllowSetuid.
+	CapabilitiesPassthrough
+	// CapabilitiesStub pretends setting and removing it succeeds without storing it, and reports that files have none. The binaries are installed without their capabilities.
+	CapabilitiesStub
+	// CapabilitiesDeny refuses to set or remove it with EPERM, and reports that files have none.
+	CapabilitiesDeny
+)
+
+// String returns the name of p, like "stub".
+func (p CapabilityXattrPolicy) String() string {
+	switch p {
+	case CapabilitiesLikeSecurityXattrs:
+		return "security_xattrs"
+	case CapabilitiesPassthrough:
+		return "passthrough"
+	case CapabilitiesStub:
+		return "stub"
+	case CapabilitiesDeny:
+		return "deny"
+	}
+	return fmt.Sprintf("CapabilityXattrPolicy(%d)", int(p))
+}
+
+// UnmarshalText parses the name of a CapabilityXattrPolicy, as returned by String.
+func (p *CapabilityXattrPolicy) UnmarshalText(b []byte) error {
+	for _, v := range []CapabilityXattrPolicy{CapabilitiesLikeSecurityXattrs, CapabilitiesPassthrough, CapabilitiesStub, CapabilitiesDeny} {
+		if string(b) == v.String() {
+			*p = v
+			return nil
+		}
+	}
+	return fmt.Errorf("billy-bazilfuse: unknown capability xattr policy %q", b)
+}
+
+// securityPolicy returns how the attribute name is handled, or ok=false if it isn't in the security namespace.
+func (r *FS) securityPolicy(name string) (_ SecurityXattrPolicy, ok bool) {
+	if !strings.HasPrefix(name, "security.") {
+		return 0, false
+	}
+	if name == capabilityXattr {
+		switch r.capabilityXattr {
+		case CapabilitiesPassthrough:
+			return SecurityXattrsPassthrough, true
+		case CapabilitiesStub:
+			return SecurityXattrsStub, true
+		case CapabilitiesDeny:
+			return SecurityXattrsDeny, true
+		}
+	}
+	return r.securityXattrs, true
+}
+
+// hidesXattr returns whether the attribute name isn't passed to the backend.
+func (r *FS) hidesXattr(name string) bool {
+	p, ok := r.securityPolicy(name)
+	return ok && p != SecurityXattrsPassthrough
+}